@@ -0,0 +1,653 @@
+package conf
+
+// The syntax tree of a configuration file, which unlike the map returned
+// by Parse keeps comments, ordering, include directives and the source
+// text of values. It can be edited and written back, see write.go.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NodeKind is the kind of a syntax tree node.
+type NodeKind int
+
+const (
+	MapNode NodeKind = iota
+	ArrayNode
+	StringNode
+	IntegerNode
+	FloatNode
+	BoolNode
+	DatetimeNode
+	VariableNode
+	IncludeNode
+)
+
+var nodeKindNames = [...]string{
+	MapNode:      "map",
+	ArrayNode:    "array",
+	StringNode:   "string",
+	IntegerNode:  "integer",
+	FloatNode:    "float",
+	BoolNode:     "bool",
+	DatetimeNode: "datetime",
+	VariableNode: "variable",
+	IncludeNode:  "include",
+}
+
+func (k NodeKind) String() string {
+	if k < 0 || int(k) >= len(nodeKindNames) {
+		return fmt.Sprintf("NodeKind(%d)", int(k))
+	}
+	return nodeKindNames[k]
+}
+
+// Node is an element of the syntax tree. The entries of a map are nodes
+// with a Key, or include directives. The elements of an array are nodes
+// without a Key.
+type Node struct {
+	Kind NodeKind
+	// Key of a map entry.
+	Key string
+	// Source text of a scalar value, including quotes and the '$' of
+	// variables, or of the file of an include directive.
+	Raw string
+	// Entries of a map or elements of an array.
+	Children []*Node
+	// Lines before the node, either comments including their '#' or
+	// '//' marker, or empty strings for blank lines.
+	Comments []string
+	// Comment on the same line as the node.
+	Comment string
+	// Lines after the last child of a map or an array.
+	EndComments []string
+	// Where the node was parsed, zero for nodes created by edits.
+	Pos Position
+
+	// Source of a parsed node, to write it back as is while unchanged.
+	src *nodeSource
+}
+
+// nodeSource is the source text of a parsed node, along with its fields
+// as parsed to tell whether it has been changed since.
+type nodeSource struct {
+	// Offsets of the node in the input, from its key to the end of its
+	// value, while it is being parsed.
+	start, end int
+	// Text of the node, and offsets in it of its value and of the end of
+	// the opening delimiter of a map or an array.
+	text      string
+	val, open int
+	// Text before the node from the end of the previous line, and after
+	// it up to the end of its line.
+	lead, trail string
+	// Text of a map or an array after its opening delimiter up to the end
+	// of its line, after its last child, and its closing delimiter.
+	head, tail, close string
+	// Indentation of the line of the node, and of its children.
+	indent, childIndent string
+	// Whether a map or an array spans multiple lines.
+	multiline bool
+
+	kind                  NodeKind
+	key, raw, comment     string
+	comments, endComments []string
+	children              []*Node
+}
+
+// Document is the syntax tree of a configuration file. Included files
+// are not parsed, only their include directive is part of the tree.
+type Document struct {
+	Root *Node
+}
+
+// ParseDocument returns the syntax tree of the configuration data.
+func ParseDocument(data string) (*Document, error) {
+	return parseDocument(data, "")
+}
+
+// ParseDocumentFile returns the syntax tree of a configuration file.
+func ParseDocumentFile(fp string) (*Document, error) {
+	data, err := ioutil.ReadFile(fp)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config file: %v", err)
+	}
+	return parseDocument(string(data), fp)
+}
+
+func parseDocument(data, file string) (*Document, error) {
+	b := &docBuilder{lx: lex(data), file: file}
+	root := &Node{Kind: MapNode, src: &nodeSource{}}
+	if err := b.entries(root, itemEOF); err != nil {
+		return nil, err
+	}
+	root.src.text, root.src.multiline = data, true
+	root.snapshot()
+	return &Document{Root: root}, nil
+}
+
+// docBuilder builds the syntax tree from the lexer's tokens.
+type docBuilder struct {
+	lx   *lexer
+	file string
+	// Comments and blank lines not yet attached to a node.
+	pending []string
+	// Line of the last token, and the node it belongs to if any.
+	line int
+	last *Node
+}
+
+func (b *docBuilder) position(tok token) Position {
+	return Position{File: b.file, Line: tok.line, Column: tok.col}
+}
+
+func (b *docBuilder) errorf(tok token, format string, args ...interface{}) error {
+	return &ParseError{Pos: b.position(tok), Reason: fmt.Sprintf(format, args...)}
+}
+
+// next returns the next token that is not a comment. Comments on the
+// same line as the last node are attached to it, others are pending
+// until the next node.
+func (b *docBuilder) next() (token, error) {
+	for {
+		tok := b.lx.nextToken()
+		if b.line > 0 && tok.line > b.line+1 && tok.typ != itemText {
+			if n := len(b.pending); n == 0 || b.pending[n-1] != "" {
+				b.pending = append(b.pending, "")
+			}
+		}
+		switch tok.typ {
+		case itemError:
+			return tok, b.errorf(tok, "Parse error on line %d: '%s'", tok.line, tok.val)
+		case itemText:
+			comment := "#" + tok.val
+			if tok.off > 0 && b.lx.input[tok.off-1] == commentSlashStart {
+				comment = "//" + tok.val
+			}
+			if b.last != nil && tok.line == b.line {
+				if b.last.Comment != "" {
+					b.last.Comment += " "
+				}
+				b.last.Comment += comment
+			} else {
+				b.pending = append(b.pending, comment)
+			}
+			b.line = tok.line
+			continue
+		case itemCommentStart:
+			continue
+		}
+		b.line = tok.line
+		b.last = nil
+		return tok, nil
+	}
+}
+
+// takeComments returns the pending comments.
+func (b *docBuilder) takeComments() []string {
+	c := b.pending
+	b.pending = nil
+	return c
+}
+
+// entries adds the entries of a map to n, up to the end token.
+func (b *docBuilder) entries(n *Node, end itemType) error {
+	for {
+		tok, err := b.next()
+		if err != nil {
+			return err
+		}
+		switch tok.typ {
+		case end:
+			n.EndComments = b.takeComments()
+			b.last = n
+			if end == itemEOF {
+				b.children(n, 0, len(b.lx.input))
+			} else {
+				b.children(n, n.src.open, tok.end-1)
+			}
+			return nil
+		case itemKey:
+			entry := &Node{Key: tok.val, Comments: b.takeComments(), Pos: b.position(tok)}
+			start := b.keyStart(tok)
+			vt, err := b.next()
+			if err != nil {
+				return err
+			}
+			if err := b.value(entry, vt); err != nil {
+				return err
+			}
+			entry.src.start = start
+			n.Children = append(n.Children, entry)
+		case itemInclude:
+			entry := &Node{Kind: IncludeNode, Raw: b.raw(tok), Comments: b.takeComments(), Pos: b.position(tok)}
+			start, end := b.span(tok)
+			// Back to the include keyword.
+			for start > 0 && (b.lx.input[start-1] == ' ' || b.lx.input[start-1] == '\t') {
+				start--
+			}
+			entry.src = &nodeSource{start: start - len("include"), val: start, end: end}
+			n.Children = append(n.Children, entry)
+			b.last = entry
+		default:
+			return b.errorf(tok, "Unexpected %s on line %d", tok.typ, tok.line)
+		}
+	}
+}
+
+// value sets the value of n from the tokens starting with tok.
+func (b *docBuilder) value(n *Node, tok token) error {
+	switch tok.typ {
+	case itemMapStart:
+		n.Kind = MapNode
+		n.src = &nodeSource{start: tok.off, val: tok.off, open: tok.off + 1}
+		b.last = n
+		return b.entries(n, itemMapEnd)
+	case itemArrayStart:
+		n.Kind = ArrayNode
+		n.src = &nodeSource{start: tok.off, val: tok.off, open: tok.off + 1}
+		b.last = n
+		for {
+			et, err := b.next()
+			if err != nil {
+				return err
+			}
+			if et.typ == itemArrayEnd {
+				n.EndComments = b.takeComments()
+				b.last = n
+				b.children(n, n.src.open, et.end-1)
+				return nil
+			}
+			elem := &Node{Comments: b.takeComments(), Pos: b.position(et)}
+			if err := b.value(elem, et); err != nil {
+				return err
+			}
+			n.Children = append(n.Children, elem)
+		}
+	case itemString:
+		n.Kind = StringNode
+	case itemInteger:
+		n.Kind = IntegerNode
+	case itemFloat:
+		n.Kind = FloatNode
+	case itemBool:
+		n.Kind = BoolNode
+	case itemDatetime:
+		n.Kind = DatetimeNode
+	case itemVariable:
+		n.Kind = VariableNode
+	default:
+		return b.errorf(tok, "Unexpected %s on line %d", tok.typ, tok.line)
+	}
+	n.Raw = b.raw(tok)
+	start, end := b.span(tok)
+	n.src = &nodeSource{start: start, val: start, end: end}
+	b.last = n
+	return nil
+}
+
+// raw returns the source text of a scalar token.
+func (b *docBuilder) raw(tok token) string {
+	start, end := b.span(tok)
+	return b.lx.input[start:end]
+}
+
+// span returns the offsets of the source text of a scalar token.
+func (b *docBuilder) span(tok token) (int, int) {
+	input := b.lx.input
+	switch tok.typ {
+	case itemVariable:
+		return tok.off - 1, tok.end
+	case itemString, itemInclude:
+		if tok.off > 0 && tok.end < len(input) {
+			switch input[tok.off-1] {
+			case dqStringStart, sqStringStart, blockStart:
+				return tok.off - 1, tok.end + 1
+			}
+		}
+	}
+	return tok.off, tok.end
+}
+
+// keyStart returns the offset of a key, including its opening quote.
+func (b *docBuilder) keyStart(tok token) int {
+	input := b.lx.input
+	if tok.off > 0 && tok.end < len(input) {
+		if q := input[tok.off-1]; (q == dqStringStart || q == sqStringStart) && input[tok.end] == q {
+			return tok.off - 1
+		}
+	}
+	return tok.off
+}
+
+// children sets the source text of the children of n, which are between
+// the from and to offsets, and of what surrounds them. The text between
+// two children is split at the end of the line of the first one.
+func (b *docBuilder) children(n *Node, from, to int) {
+	input := b.lx.input
+	s := n.src
+	if from > 0 {
+		// Not the root, which has no delimiters.
+		s.end = to + 1
+		s.close = input[to:s.end]
+		s.multiline = strings.ContainsRune(input[from:to], '\n')
+		s.childIndent = lineIndent(input, s.start) + strings.Repeat(" ", indentWidth)
+	}
+	indented := false
+	var prev *nodeSource
+	for _, c := range n.Children {
+		cs := c.src
+		gap := input[from:cs.start]
+		switch {
+		case prev != nil:
+			prev.trail, gap = splitLine(gap)
+		case from > 0:
+			s.head, gap = splitLine(gap)
+		}
+		if ls := strings.LastIndexByte(input[:cs.start], '\n') + 1; !indented &&
+			strings.TrimLeft(input[ls:cs.start], " \t") == "" {
+			s.childIndent, indented = input[ls:cs.start], true
+		}
+		cs.lead = gap
+		cs.indent = lineIndent(input, cs.start)
+		cs.text = input[cs.start:cs.end]
+		cs.val -= cs.start
+		if cs.open > 0 {
+			cs.open -= cs.start
+		}
+		from, prev = cs.end, cs
+	}
+	gap := input[from:to]
+	switch {
+	case prev != nil:
+		prev.trail, gap = splitLine(gap)
+	case from > 0:
+		s.head, gap = splitLine(gap)
+	}
+	s.tail = gap
+}
+
+// splitLine splits text after its first end of line, if any.
+func splitLine(text string) (string, string) {
+	if i := strings.IndexByte(text, '\n'); i >= 0 {
+		return text[:i+1], text[i+1:]
+	}
+	return "", text
+}
+
+// lineIndent returns the indentation of the line at offset off.
+func lineIndent(input string, off int) string {
+	line := input[strings.LastIndexByte(input[:off], '\n')+1:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// snapshot records the fields of n and its children as parsed, once
+// comments have been attached.
+func (n *Node) snapshot() {
+	s := n.src
+	s.kind, s.key, s.raw, s.comment = n.Kind, n.Key, n.Raw, n.Comment
+	s.comments, s.endComments = n.Comments, n.EndComments
+	s.children = append([]*Node(nil), n.Children...)
+	for _, c := range n.Children {
+		c.snapshot()
+	}
+}
+
+// pathElem is a map key or an array index of a path.
+type pathElem struct {
+	key   string
+	index int
+}
+
+// parsePath splits a path like "authorization.users[0].user".
+func parsePath(path string) ([]pathElem, error) {
+	var elems []pathElem
+	for _, part := range strings.Split(path, ".") {
+		key := part
+		var indexes []string
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			key = part[:i]
+			for _, idx := range strings.Split(part[i+1:], "[") {
+				if !strings.HasSuffix(idx, "]") {
+					return nil, fmt.Errorf("invalid path %q", path)
+				}
+				indexes = append(indexes, idx[:len(idx)-1])
+			}
+		}
+		if key != "" {
+			elems = append(elems, pathElem{key: key})
+		} else if len(indexes) == 0 || len(elems) == 0 {
+			return nil, fmt.Errorf("invalid path %q", path)
+		}
+		for _, idx := range indexes {
+			i, err := strconv.Atoi(idx)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid index in path %q", path)
+			}
+			elems = append(elems, pathElem{index: i})
+		}
+	}
+	return elems, nil
+}
+
+// child returns the entry or element of n for e, along with its index.
+// For duplicate keys, the last entry is returned as it is the one that
+// takes effect.
+func (n *Node) child(e pathElem) (*Node, int) {
+	switch n.Kind {
+	case MapNode:
+		if e.key == "" {
+			return nil, -1
+		}
+		for i := len(n.Children) - 1; i >= 0; i-- {
+			if c := n.Children[i]; c.Kind != IncludeNode && c.Key == e.key {
+				return c, i
+			}
+		}
+	case ArrayNode:
+		if e.key == "" && e.index < len(n.Children) {
+			return n.Children[e.index], e.index
+		}
+	}
+	return nil, -1
+}
+
+// Lookup returns the node at path, or nil if there is none.
+func (d *Document) Lookup(path string) *Node {
+	elems, err := parsePath(path)
+	if err != nil {
+		return nil
+	}
+	n := d.Root
+	for _, e := range elems {
+		if n, _ = n.child(e); n == nil {
+			return nil
+		}
+	}
+	return n
+}
+
+// Set sets the value at path, keeping the comments of an existing entry.
+// Missing maps along the path are created, and new entries are added at
+// the end of their map. Values can be strings, booleans, numbers,
+// time.Time, slices, maps with string keys or a *Node.
+func (d *Document) Set(path string, v interface{}) error {
+	value, err := NewNode(v)
+	if err != nil {
+		return err
+	}
+	elems, err := parsePath(path)
+	if err != nil {
+		return err
+	}
+	n := d.Root
+	for i, e := range elems {
+		c, _ := n.child(e)
+		last := i == len(elems)-1
+		if c == nil {
+			switch {
+			case n.Kind == MapNode && e.key != "":
+				c = &Node{Kind: MapNode, Key: e.key}
+				n.Children = append(n.Children, c)
+			case n.Kind == ArrayNode && e.key == "" && e.index == len(n.Children) && last:
+				c = &Node{}
+				n.Children = append(n.Children, c)
+			default:
+				return fmt.Errorf("can not set %q, no %s in %s", path, e, n.Kind)
+			}
+		}
+		if last {
+			c.Kind, c.Raw, c.Children, c.EndComments = value.Kind, value.Raw, value.Children, value.EndComments
+			return nil
+		}
+		n = c
+	}
+	return nil
+}
+
+// Delete removes the entry or element at path. It returns false if
+// there is none.
+func (d *Document) Delete(path string) bool {
+	elems, err := parsePath(path)
+	if err != nil {
+		return false
+	}
+	n := d.Root
+	for i, e := range elems {
+		c, idx := n.child(e)
+		if c == nil {
+			return false
+		}
+		if i == len(elems)-1 {
+			n.Children = append(n.Children[:idx], n.Children[idx+1:]...)
+			return true
+		}
+		n = c
+	}
+	return false
+}
+
+// Append adds a value at the end of the array at path, which is
+// created if missing.
+func (d *Document) Append(path string, v interface{}) error {
+	value, err := NewNode(v)
+	if err != nil {
+		return err
+	}
+	n := d.Lookup(path)
+	if n == nil {
+		if err := d.Set(path, []interface{}{}); err != nil {
+			return err
+		}
+		n = d.Lookup(path)
+	}
+	if n.Kind != ArrayNode {
+		return fmt.Errorf("can not append to %q, it is a %s", path, n.Kind)
+	}
+	n.Children = append(n.Children, value)
+	return nil
+}
+
+func (e pathElem) String() string {
+	if e.key != "" {
+		return fmt.Sprintf("key %q", e.key)
+	}
+	return fmt.Sprintf("index %d", e.index)
+}
+
+// NewNode returns the node for a value, see Document.Set for the
+// supported types.
+func NewNode(v interface{}) (*Node, error) {
+	switch v := v.(type) {
+	case *Node:
+		return v, nil
+	case string:
+		return &Node{Kind: StringNode, Raw: quoteString(v)}, nil
+	case bool:
+		return &Node{Kind: BoolNode, Raw: strconv.FormatBool(v)}, nil
+	case time.Time:
+		return &Node{Kind: DatetimeNode, Raw: v.UTC().Format("2006-01-02T15:04:05Z")}, nil
+	case float32, float64:
+		f := reflect.ValueOf(v).Float()
+		raw := strconv.FormatFloat(f, 'f', -1, 64)
+		if !strings.Contains(raw, ".") {
+			raw += ".0"
+		}
+		return &Node{Kind: FloatNode, Raw: raw}, nil
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Node{Kind: IntegerNode, Raw: strconv.FormatInt(rv.Int(), 10)}, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Node{Kind: IntegerNode, Raw: strconv.FormatUint(rv.Uint(), 10)}, nil
+	case reflect.Slice, reflect.Array:
+		n := &Node{Kind: ArrayNode}
+		for i := 0; i < rv.Len(); i++ {
+			c, err := NewNode(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			n.Children = append(n.Children, c)
+		}
+		return n, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			return nil, fmt.Errorf("unsupported map key type %s", rv.Type().Key())
+		}
+		keys := make([]string, 0, rv.Len())
+		for _, k := range rv.MapKeys() {
+			keys = append(keys, k.String())
+		}
+		sort.Strings(keys)
+		n := &Node{Kind: MapNode}
+		for _, k := range keys {
+			c, err := NewNode(rv.MapIndex(reflect.ValueOf(k).Convert(rv.Type().Key())).Interface())
+			if err != nil {
+				return nil, err
+			}
+			c.Key = k
+			n.Children = append(n.Children, c)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+// quoteString returns the source text of a string value, in double quotes
+// with '$' escaped so that variable references are not interpolated.
+func quoteString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '$':
+			sb.WriteString(`\$`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			if r < ' ' {
+				fmt.Fprintf(&sb, `\x%02x`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
@@ -0,0 +1,335 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var astConf = `
+# Server config
+
+listen = 127.0.0.1:4222 // client port
+max_payload = 1MB
+
+authorization {
+  # Superuser can do anything.
+  super_user = {
+    publish = "*"
+    subscribe = ">"
+  }
+
+  users = [
+    {user: alice, password: foo, permissions: $super_user}
+    # Bob has default permissions.
+    {user: bob,   password: 'b@r'}
+  ]
+  "quoted key": "with \"quotes\" and ${HOME:-/root}"
+}
+
+
+cluster {
+  include './routes.conf' ; # routes
+  timeout: 0.5
+  text: (
+multi line
+)
+}
+`
+
+var astConfFormatted = `# Server config
+
+listen: 127.0.0.1:4222 // client port
+max_payload: 1MB
+
+authorization {
+  # Superuser can do anything.
+  super_user {
+    publish: "*"
+    subscribe: ">"
+  }
+
+  users: [
+    {user: alice, password: foo, permissions: $super_user}
+    # Bob has default permissions.
+    {user: bob, password: 'b@r'}
+  ]
+  "quoted key": "with \"quotes\" and ${HOME:-/root}"
+}
+
+cluster {
+  include './routes.conf' # routes
+  timeout: 0.5
+  text: (
+multi line
+)
+}
+`
+
+func TestFormat(t *testing.T) {
+	s, err := Format(astConf)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if s != astConfFormatted {
+		t.Fatalf("Not Equal:\nReceived:\n%s\nExpected:\n%s\n", s, astConfFormatted)
+	}
+	// Formatting is idempotent.
+	if s2, err := Format(s); err != nil || s2 != s {
+		t.Fatalf("Formatting again changed the result, err=%v:\n%s", err, s2)
+	}
+}
+
+func TestFormatRoundTrip(t *testing.T) {
+	for _, data := range []string{easynum, sample1, cluster, sample3, sample4, sample5} {
+		s, err := Format(data)
+		if err != nil {
+			t.Fatalf("Received err: %v\n", err)
+		}
+		m1, err := Parse(data)
+		if err != nil {
+			t.Fatalf("Received err: %v\n", err)
+		}
+		m2, err := Parse(s)
+		if err != nil {
+			t.Fatalf("Received err parsing formatted config: %v\n%s", err, s)
+		}
+		if !reflect.DeepEqual(m1, m2) {
+			t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m2, m1)
+		}
+	}
+}
+
+func TestParseDocument(t *testing.T) {
+	d, err := ParseDocument(astConf)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	n := d.Lookup("authorization.users[1].password")
+	if n == nil || n.Kind != StringNode || n.Raw != "'b@r'" {
+		t.Fatalf("Unexpected node: %+v", n)
+	}
+	if n.Pos.Line != 17 || n.Pos.Column != 19 {
+		t.Fatalf("Unexpected position: %v", n.Pos)
+	}
+	if n := d.Lookup("authorization.users[1]"); n == nil || len(n.Comments) != 1 ||
+		n.Comments[0] != "# Bob has default permissions." {
+		t.Fatalf("Unexpected node: %+v", n)
+	}
+	if n := d.Lookup("listen"); n == nil || n.Comment != "// client port" || len(n.Comments) != 2 {
+		t.Fatalf("Unexpected node: %+v", n)
+	}
+	if n := d.Lookup("cluster"); n == nil || n.Children[0].Kind != IncludeNode || n.Children[0].Raw != "'./routes.conf'" {
+		t.Fatalf("Unexpected node: %+v", n)
+	}
+	for _, path := range []string{"missing", "authorization.users[2]", "listen.foo", "authorization.users.user"} {
+		if n := d.Lookup(path); n != nil {
+			t.Fatalf("Expected no node for %q, got %+v", path, n)
+		}
+	}
+
+	_, err = ParseDocument("foo = 1\nbar {\n  baz = [1, 2\n")
+	if _, ok := err.(*ParseError); !ok {
+		t.Fatalf("Expected a *ParseError, got %v", err)
+	}
+}
+
+func TestDocumentEdit(t *testing.T) {
+	d, err := ParseDocument(astConf)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if err := d.Set("listen", "0.0.0.0:4222"); err != nil {
+		t.Fatalf("Error setting value: %v", err)
+	}
+	if err := d.Set("cluster.timeout", 2); err != nil {
+		t.Fatalf("Error setting value: %v", err)
+	}
+	if err := d.Set("tls.cert_file", "./certs/server.pem"); err != nil {
+		t.Fatalf("Error setting value: %v", err)
+	}
+	if err := d.Set("authorization.users[1].password", "baz"); err != nil {
+		t.Fatalf("Error setting value: %v", err)
+	}
+	if err := d.Append("authorization.users", map[string]interface{}{"user": "carol", "password": "qux"}); err != nil {
+		t.Fatalf("Error appending value: %v", err)
+	}
+	if err := d.Append("cluster.routes", "nats-route://127.0.0.1:6223"); err != nil {
+		t.Fatalf("Error appending value: %v", err)
+	}
+	if !d.Delete("authorization.super_user") || !d.Delete("cluster.text") || d.Delete("cluster.missing") {
+		t.Fatal("Unexpected delete result")
+	}
+	if err := d.Set("listen.foo", 1); err == nil {
+		t.Fatal("Expected an error setting a key in a string")
+	}
+	if err := d.Append("listen", 1); err == nil {
+		t.Fatal("Expected an error appending to a string")
+	}
+
+	// Unchanged nodes are written as parsed, and changed maps and arrays
+	// keep the text around their unchanged entries.
+	expected := `
+# Server config
+
+listen = "0.0.0.0:4222" // client port
+max_payload = 1MB
+
+authorization {
+  users = [
+    {user: alice, password: foo, permissions: $super_user}
+    # Bob has default permissions.
+    {user: bob, password: "baz"}
+    {password: "qux", user: "carol"}
+  ]
+  "quoted key": "with \"quotes\" and ${HOME:-/root}"
+}
+
+
+cluster {
+  include './routes.conf' ; # routes
+  timeout: 2
+  routes: ["nats-route://127.0.0.1:6223"]
+}
+tls {
+  cert_file: "./certs/server.pem"
+}
+`
+	if s := d.String(); s != expected {
+		t.Fatalf("Not Equal:\nReceived:\n%s\nExpected:\n%s\n", s, expected)
+	}
+
+	// The whole document can still be formatted.
+	if s, err := Format(expected); err != nil || d.Format() != s {
+		t.Fatalf("Unexpected format, err=%v:\n%s", err, d.Format())
+	}
+}
+
+func TestDocumentWriteAsParsed(t *testing.T) {
+	for _, data := range []string{astConf, easynum, sample1, cluster, sample3, sample4, sample5} {
+		d, err := ParseDocument(data)
+		if err != nil {
+			t.Fatalf("Received err: %v\n", err)
+		}
+		if s := d.String(); s != data {
+			t.Fatalf("Not Equal:\nReceived:\n%s\nExpected:\n%s\n", s, data)
+		}
+	}
+}
+
+func TestDocumentEditLayout(t *testing.T) {
+	data := "a = 1; b = 2 # b\n" +
+		"m {\n\tx = 1\n\ty = 2\n}\n" +
+		"arr [\n    1,\n    2,\n]\n" +
+		"tail { z: 1 }\n"
+	d, err := ParseDocument(data)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if !d.Delete("a") || !d.Delete("m.x") || !d.Delete("arr[0]") {
+		t.Fatal("Unexpected delete result")
+	}
+	if err := d.Set("b", 3); err != nil {
+		t.Fatalf("Error setting value: %v", err)
+	}
+	if err := d.Set("m.w", "new"); err != nil {
+		t.Fatalf("Error setting value: %v", err)
+	}
+	if err := d.Append("arr", 3); err != nil {
+		t.Fatalf("Error appending value: %v", err)
+	}
+	if err := d.Set("tail.z", 2); err != nil {
+		t.Fatalf("Error setting value: %v", err)
+	}
+	d.Lookup("m.y").Comment = "# y"
+
+	expected := "b = 3 # b\n" +
+		"m {\n\ty = 2 # y\n\tw: \"new\"\n}\n" +
+		"arr [\n    2,\n    3\n]\n" +
+		"tail {\n  z: 2\n}\n"
+	if s := d.String(); s != expected {
+		t.Fatalf("Not Equal:\nReceived:\n%q\nExpected:\n%q\n", s, expected)
+	}
+	if _, err := Parse(d.String()); err != nil {
+		t.Fatalf("Received err parsing edited config: %v", err)
+	}
+}
+
+func TestNewNode(t *testing.T) {
+	dt := time.Date(2016, 5, 4, 18, 53, 41, 0, time.UTC)
+	tests := []struct {
+		v    interface{}
+		kind NodeKind
+		raw  string
+	}{
+		{"foo", StringNode, `"foo"`},
+		{"a \"b\"\n\\", StringNode, `"a \"b\"\n\\"`},
+		{"${HOME}", StringNode, `"\${HOME}"`},
+		{"it's $5", StringNode, `"it's \$5"`},
+		{true, BoolNode, "true"},
+		{int64(-22), IntegerNode, "-22"},
+		{uint16(22), IntegerNode, "22"},
+		{2.0, FloatNode, "2.0"},
+		{2.5, FloatNode, "2.5"},
+		{dt, DatetimeNode, "2016-05-04T18:53:41Z"},
+	}
+	for _, test := range tests {
+		n, err := NewNode(test.v)
+		if err != nil || n.Kind != test.kind || n.Raw != test.raw {
+			t.Fatalf("Unexpected node for %v: %+v, err=%v", test.v, n, err)
+		}
+		// Make sure the value is parsed back the same way.
+		m, err := Parse("k = " + n.Raw)
+		if err != nil {
+			t.Fatalf("Received err: %v\n", err)
+		}
+		v := reflect.ValueOf(test.v)
+		switch v.Kind() {
+		case reflect.Int64, reflect.Uint16:
+			if m["k"] != int64(v.Convert(reflect.TypeOf(int64(0))).Int()) {
+				t.Fatalf("Unexpected value parsed for %v: %v", test.v, m["k"])
+			}
+		default:
+			if !reflect.DeepEqual(m["k"], test.v) {
+				t.Fatalf("Unexpected value parsed for %v: %v", test.v, m["k"])
+			}
+		}
+	}
+	if _, err := NewNode(struct{}{}); err == nil || !strings.Contains(err.Error(), "unsupported") {
+		t.Fatalf("Expected an error for an unsupported type, got %v", err)
+	}
+}
+
+func TestDocumentSetRoundTrip(t *testing.T) {
+	os.Setenv("__UNIQ_RT__", "interpolated")
+	defer os.Unsetenv("__UNIQ_RT__")
+
+	values := []string{
+		"${__UNIQ_RT__}",
+		"it's ${__UNIQ_RT__}",
+		"a\n${__UNIQ_RT__}",
+		`say "${__UNIQ_RT__}"`,
+		`back\slash $ and \${__UNIQ_RT__}`,
+	}
+	d, err := ParseDocument("")
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	for i, v := range values {
+		if err := d.Set(fmt.Sprintf("v%d", i), v); err != nil {
+			t.Fatalf("Error setting value: %v", err)
+		}
+	}
+	m, err := Parse(d.String())
+	if err != nil {
+		t.Fatalf("Received err: %v\n%s", err, d.String())
+	}
+	for i, v := range values {
+		if got := m[fmt.Sprintf("v%d", i)]; got != v {
+			t.Fatalf("Expected %q to be parsed back, got %q from:\n%s", v, got, d.String())
+		}
+	}
+}
@@ -67,6 +67,10 @@ const (
 	blockEnd          = ')'
 )
 
+// fileVariable starts a reference to the content of a file,
+// e.g. $file("/run/secrets/pass").
+const fileVariable = "file("
+
 type stateFn func(lx *lexer) stateFn
 
 type lexer struct {
@@ -76,7 +80,7 @@ type lexer struct {
 	width int
 	line  int
 	state stateFn
-	items chan item
+	items chan token
 
 	// A stack of state functions used to maintain context.
 	// The idea is to reuse parts of the state machine in various places.
@@ -88,6 +92,11 @@ type lexer struct {
 	// Used for processing escapable substrings in double-quoted and raw strings
 	stringParts   []string
 	stringStateFn stateFn
+	// Start of the first string part.
+	partsStart int
+	// Variable references embedded in a double quoted string, by index
+	// in stringParts, along with their column.
+	stringRefs map[int]int
 }
 
 type item struct {
@@ -96,23 +105,60 @@ type item struct {
 	line int
 }
 
+// token is an item along with where it is in the input. The offsets
+// exclude the delimiters of quoted strings and variables.
+type token struct {
+	item
+	col int
+	off int
+	end int
+	// Parts of a string with embedded variable references.
+	parts []stringPart
+}
+
+// stringPart is either literal text or a variable reference, in which
+// case col is the column of the reference.
+type stringPart struct {
+	val string
+	ref bool
+	col int
+}
+
 func (lx *lexer) nextItem() item {
+	return lx.nextToken().item
+}
+
+func (lx *lexer) nextToken() token {
 	for {
 		select {
-		case item := <-lx.items:
-			return item
+		case tok := <-lx.items:
+			return tok
 		default:
 			lx.state = lx.state(lx)
 		}
 	}
 }
 
+// column returns the 1-based column of the given input offset.
+func (lx *lexer) column(offset int) int {
+	ls := strings.LastIndexByte(lx.input[:offset], '\n') + 1
+	return utf8.RuneCountInString(lx.input[ls:offset]) + 1
+}
+
+// itemStart returns the input offset of the item being lexed.
+func (lx *lexer) itemStart() int {
+	if len(lx.stringParts) > 0 {
+		return lx.partsStart
+	}
+	return lx.start
+}
+
 func lex(input string) *lexer {
 	lx := &lexer{
 		input:       input,
 		state:       lexTop,
 		line:        1,
-		items:       make(chan item, 10),
+		items:       make(chan token, 10),
 		stack:       make([]stateFn, 0, 10),
 		stringParts: []string{},
 	}
@@ -134,28 +180,60 @@ func (lx *lexer) pop() stateFn {
 }
 
 func (lx *lexer) emit(typ itemType) {
-	lx.items <- item{typ, strings.Join(lx.stringParts, "") + lx.input[lx.start:lx.pos], lx.line}
+	off := lx.itemStart()
+	if typ == itemArrayStart || typ == itemMapStart {
+		// Point at the delimiter, which has been ignored.
+		off--
+	}
+	lx.items <- token{
+		item: item{typ, strings.Join(lx.stringParts, "") + lx.input[lx.start:lx.pos], lx.line},
+		col:  lx.column(off),
+		off:  off,
+		end:  lx.pos,
+	}
 	lx.start = lx.pos
 }
 
 func (lx *lexer) emitString() {
 	var finalString string
+	var parts []stringPart
+	off := lx.itemStart()
+	if len(lx.stringRefs) > 0 {
+		for i, s := range lx.stringParts {
+			rcol, ref := lx.stringRefs[i]
+			parts = append(parts, stringPart{val: s, ref: ref, col: rcol})
+		}
+		parts = append(parts, stringPart{val: lx.input[lx.start:lx.pos]})
+		lx.stringRefs = nil
+	}
 	if len(lx.stringParts) > 0 {
 		finalString = strings.Join(lx.stringParts, "") + lx.input[lx.start:lx.pos]
 		lx.stringParts = []string{}
 	} else {
 		finalString = lx.input[lx.start:lx.pos]
 	}
-	lx.items <- item{itemString, finalString, lx.line}
+	lx.items <- token{
+		item:  item{itemString, finalString, lx.line},
+		col:   lx.column(off),
+		off:   off,
+		end:   lx.pos,
+		parts: parts,
+	}
 	lx.start = lx.pos
 }
 
 func (lx *lexer) addCurrentStringPart(offset int) {
+	if len(lx.stringParts) == 0 {
+		lx.partsStart = lx.start
+	}
 	lx.stringParts = append(lx.stringParts, lx.input[lx.start:lx.pos-offset])
 	lx.start = lx.pos
 }
 
 func (lx *lexer) addStringPart(s string) stateFn {
+	if len(lx.stringParts) == 0 {
+		lx.partsStart = lx.start
+	}
 	lx.stringParts = append(lx.stringParts, s)
 	lx.start = lx.pos
 	return lx.stringStateFn
@@ -208,11 +286,11 @@ func (lx *lexer) errorf(format string, values ...interface{}) stateFn {
 			values[i] = escapeSpecial(v)
 		}
 	}
-	lx.items <- item{
+	lx.items <- token{item: item{
 		itemError,
 		fmt.Sprintf(format, values...),
 		lx.line,
-	}
+	}, col: lx.column(lx.pos), off: lx.pos, end: lx.pos}
 	return nil
 }
 
@@ -496,6 +574,10 @@ func lexValue(lx *lexer) stateFn {
 	case r == blockStart:
 		lx.ignore()
 		return lexBlock
+	case r == '$' && lx.peek() == mapStart:
+		return lexBracedVariable
+	case r == '$' && strings.HasPrefix(lx.input[lx.pos:], fileVariable):
+		return lexFileVariable
 	case unicode.IsDigit(r):
 		lx.backup() // avoid an extra state and use the same as above
 		return lexNumberOrDateOrIPStart
@@ -730,7 +812,7 @@ func (lx *lexer) isBool() bool {
 
 // Check if the unquoted string is a variable reference, starting with $.
 func (lx *lexer) isVariable() bool {
-	if lx.input[lx.start] == '$' {
+	if lx.start < len(lx.input) && lx.input[lx.start] == '$' {
 		lx.start += 1
 		return true
 	}
@@ -755,13 +837,17 @@ func lexQuotedString(lx *lexer) stateFn {
 
 // lexDubQuotedString consumes the inner contents of a string. It assumes that the
 // beginning '"' has already been consumed and ignored. It will not interpret any
-// internal contents.
+// internal contents, except for escapes and ${...} variable references, which
+// can be escaped as \${...}.
 func lexDubQuotedString(lx *lexer) stateFn {
 	r := lx.next()
 	switch {
 	case r == '\\':
 		lx.addCurrentStringPart(1)
 		return lexStringEscape
+	case r == '$' && lx.peek() == mapStart:
+		lx.addCurrentStringPart(1)
+		return lexStringVariable
 	case r == dqStringEnd:
 		lx.backup()
 		lx.emitString()
@@ -839,6 +925,59 @@ func lexBlock(lx *lexer) stateFn {
 	return lexBlock
 }
 
+// lexBracedVariable consumes a ${...} variable reference. It assumes that
+// the '$' has already been consumed.
+func lexBracedVariable(lx *lexer) stateFn {
+	return lx.lexVariableUntil(mapEnd, lexBracedVariable)
+}
+
+// lexFileVariable consumes a $file(...) reference. It assumes that
+// the '$' has already been consumed.
+func lexFileVariable(lx *lexer) stateFn {
+	return lx.lexVariableUntil(blockEnd, lexFileVariable)
+}
+
+// lexVariableUntil emits the variable reference, without the '$', once
+// end has been consumed.
+func (lx *lexer) lexVariableUntil(end rune, self stateFn) stateFn {
+	r := lx.next()
+	switch {
+	case r == end:
+		lx.start++ // skip the '$'
+		lx.emit(itemVariable)
+		return lx.pop()
+	case isNL(r) || r == eof:
+		lx.backup()
+		return lx.errorf("Unterminated variable reference '%s'.", lx.input[lx.start:lx.pos])
+	}
+	return self
+}
+
+// lexStringVariable consumes a ${...} variable reference embedded in a
+// double quoted string. It assumes that the '$' has already been consumed.
+// Unterminated references are kept as is, like before interpolation.
+func lexStringVariable(lx *lexer) stateFn {
+	r := lx.next()
+	switch {
+	case r == mapEnd:
+		if lx.stringRefs == nil {
+			lx.stringRefs = make(map[int]int)
+		}
+		lx.stringRefs[len(lx.stringParts)] = lx.column(lx.start)
+		lx.addCurrentStringPart(0)
+		return lexDubQuotedString
+	case r == dqStringEnd:
+		lx.backup()
+		// Put back the '$', the rest is still to be emitted.
+		lx.stringParts = append(lx.stringParts, "$")
+		return lexDubQuotedString
+	case isNL(r) || r == eof:
+		lx.backup()
+		return lx.errorf("Unterminated variable reference in string.")
+	}
+	return lexStringVariable
+}
+
 // lexStringEscape consumes an escaped character. It assumes that the preceding
 // '\\' has already been consumed.
 func lexStringEscape(lx *lexer) stateFn {
@@ -856,9 +995,11 @@ func lexStringEscape(lx *lexer) stateFn {
 		return lx.addStringPart("\"")
 	case '\\':
 		return lx.addStringPart("\\")
+	case '$':
+		return lx.addStringPart("$")
 	}
 	return lx.errorf("Invalid escape character '%v'. Only the following "+
-		"escape characters are allowed: \\xXX, \\t, \\n, \\r, \\\", \\\\.", r)
+		"escape characters are allowed: \\xXX, \\t, \\n, \\r, \\\", \\\\, \\$.", r)
 }
 
 // lexStringBinary consumes two hexadecimal digits following '\x'. It assumes
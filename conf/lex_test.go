@@ -349,6 +349,87 @@ func TestVariableValues(t *testing.T) {
 	expect(t, lx, expectedItems)
 }
 
+func TestBracedVariableValues(t *testing.T) {
+	expectedItems := []item{
+		{itemKey, "foo", 1},
+		{itemVariable, "{bar:-a default}", 1},
+		{itemKey, "pass", 2},
+		{itemVariable, `file("/run/secrets/pass")`, 2},
+		{itemEOF, "", 2},
+	}
+	lx := lex("foo = ${bar:-a default}\npass = $file(\"/run/secrets/pass\")")
+	expect(t, lx, expectedItems)
+
+	expectedItems = []item{
+		{itemKey, "foo", 1},
+		{itemError, "Unterminated variable reference '${bar'.", 1},
+	}
+	lx = lex("foo = ${bar\n")
+	expect(t, lx, expectedItems)
+}
+
+func TestStringVariables(t *testing.T) {
+	expectedItems := []item{
+		{itemKey, "foo", 1},
+		{itemString, "nats://{HOST}:{PORT:-4222}", 1},
+		{itemEOF, "", 1},
+	}
+	lx := lex(`foo = "nats://${HOST}:${PORT:-4222}"`)
+	expect(t, lx, expectedItems)
+
+	lx = lex(`foo = "nats://${HOST}:${PORT:-4222}"`)
+	lx.nextToken()
+	tok := lx.nextToken()
+	expectedParts := []stringPart{
+		{val: "nats://"},
+		{val: "{HOST}", ref: true, col: 16},
+		{val: ":"},
+		{val: "{PORT:-4222}", ref: true, col: 24},
+		{val: ""},
+	}
+	if len(tok.parts) != len(expectedParts) {
+		t.Fatalf("Expected parts %+v, got %+v", expectedParts, tok.parts)
+	}
+	for i, part := range tok.parts {
+		if part != expectedParts[i] {
+			t.Fatalf("Expected parts %+v, got %+v", expectedParts, tok.parts)
+		}
+	}
+
+	// Single quoted strings are not interpreted.
+	expectedItems = []item{
+		{itemKey, "foo", 1},
+		{itemString, "${HOST}", 1},
+		{itemEOF, "", 1},
+	}
+	lx = lex(`foo = '${HOST}'`)
+	expect(t, lx, expectedItems)
+
+	// Escaped and unterminated references are kept as is.
+	expectedItems = []item{
+		{itemKey, "foo", 1},
+		{itemString, "${HOST}", 1},
+		{itemEOF, "", 1},
+	}
+	lx = lex(`foo = "\${HOST}"`)
+	expect(t, lx, expectedItems)
+
+	expectedItems = []item{
+		{itemKey, "foo", 1},
+		{itemString, "${HOST", 1},
+		{itemEOF, "", 1},
+	}
+	lx = lex(`foo = "${HOST"`)
+	expect(t, lx, expectedItems)
+
+	expectedItems = []item{
+		{itemKey, "foo", 1},
+		{itemError, "Unterminated variable reference in string.", 1},
+	}
+	lx = lex("foo = \"${HOST\n\"")
+	expect(t, lx, expectedItems)
+}
+
 func TestArrays(t *testing.T) {
 	expectedItems := []item{
 		{itemKey, "foo", 1},
@@ -662,7 +743,7 @@ func TestCompoundStringESE(t *testing.T) {
 func TestBadStringEscape(t *testing.T) {
 	expectedItems := []item{
 		{itemKey, "foo", 1},
-		{itemError, "Invalid escape character 'y'. Only the following escape characters are allowed: \\xXX, \\t, \\n, \\r, \\\", \\\\.", 1},
+		{itemError, "Invalid escape character 'y'. Only the following escape characters are allowed: \\xXX, \\t, \\n, \\r, \\\", \\\\, \\$.", 1},
 		{itemEOF, "", 2},
 	}
 	lx := lex(`foo = \y`)
@@ -30,6 +30,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -51,13 +52,84 @@ type parser struct {
 
 	// The config file path, empty by default.
 	fp string
+
+	// The config file name, used for positions.
+	file string
+
+	// Where the keys were defined, and what was referenced.
+	src *Source
+
+	// The files being parsed, from the top one down to this one,
+	// used to detect include cycles.
+	chain []string
+}
+
+// sizeSuffixes are the multipliers of the suffixes integers can have.
+var sizeSuffixes = map[string]int64{
+	"":   1,
+	"k":  1000,
+	"kb": 1024,
+	"m":  1000 * 1000,
+	"mb": 1024 * 1024,
+	"g":  1000 * 1000 * 1000,
+	"gb": 1024 * 1024 * 1024,
+}
+
+// Position is the location of an element in a configuration file.
+type Position struct {
+	File   string `json:"file,omitempty"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+}
+
+func (p Position) String() string {
+	if p.File == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Column)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// Reference is an include file or environment variable used by a
+// configuration file.
+type Reference struct {
+	Name string   `json:"name"`
+	Pos  Position `json:"position"`
+}
+
+// Source describes where the content of a parsed configuration came from.
+type Source struct {
+	// File parsed, empty if parsed from a string.
+	File string
+	// Position of each key, and of each array element, by path. Nested
+	// keys are separated by dots and array elements use their index,
+	// e.g. "authorization.users[0].user".
+	Positions map[string]Position
+	// Files included, with the position of the include directive.
+	Includes []Reference
+	// Variables resolved from the environment.
+	Env []Reference
+	// Files read with $file().
+	Files []Reference
+	// Paths of the keys referenced as variables.
+	Variables map[string]bool
+}
+
+// ParseError is returned when a configuration can not be parsed.
+// The error message does not include the position.
+type ParseError struct {
+	Pos    Position
+	Reason string
+}
+
+func (e *ParseError) Error() string {
+	return e.Reason
 }
 
 // Parse will return a map of keys to interface{}, although concrete types
 // underly them. The values supported are string, bool, int64, float64, DateTime.
 // Arrays and nested Maps are also supported.
 func Parse(data string) (map[string]interface{}, error) {
-	p, err := parse(data, "")
+	p, err := parse(data, "", "")
 	if err != nil {
 		return nil, err
 	}
@@ -66,34 +138,53 @@ func Parse(data string) (map[string]interface{}, error) {
 
 // ParseFile is a helper to open file, etc. and parse the contents.
 func ParseFile(fp string) (map[string]interface{}, error) {
+	m, _, err := ParseFileWithSource(fp)
+	return m, err
+}
+
+// ParseFileWithSource is like ParseFile, but also returns where each key
+// was defined along with the files and environment variables referenced.
+// Errors that relate to a location in a file are of type *ParseError.
+func ParseFileWithSource(fp string) (map[string]interface{}, *Source, error) {
+	p, err := parseFile(fp, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return p.mapping, p.src, nil
+}
+
+// parseFile parses a file included by the files in chain.
+func parseFile(fp string, chain []string) (*parser, error) {
 	data, err := ioutil.ReadFile(fp)
 	if err != nil {
 		return nil, fmt.Errorf("error opening config file: %v", err)
 	}
-
-	p, err := parse(string(data), filepath.Dir(fp))
+	abs, err := filepath.Abs(fp)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error opening config file: %v", err)
 	}
-	return p.mapping, nil
+	return parse(string(data), filepath.Dir(fp), fp, append(chain[:len(chain):len(chain)], abs)...)
 }
 
-func parse(data, fp string) (p *parser, err error) {
+func parse(data, fp, file string, chain ...string) (p *parser, err error) {
 	p = &parser{
 		mapping: make(map[string]interface{}),
 		lx:      lex(data),
 		ctxs:    make([]interface{}, 0, 4),
 		keys:    make([]string, 0, 4),
 		fp:      fp,
+		file:    file,
+		src:     &Source{File: file, Positions: make(map[string]Position), Variables: make(map[string]bool)},
+		chain:   chain,
 	}
 	p.pushContext(p.mapping)
 
 	for {
-		it := p.next()
-		if it.typ == itemEOF {
+		tok := p.next()
+		if tok.typ == itemEOF {
 			break
 		}
-		if err := p.processItem(it); err != nil {
+		if err := p.processItem(tok); err != nil {
 			return nil, err
 		}
 	}
@@ -101,8 +192,50 @@ func parse(data, fp string) (p *parser, err error) {
 	return p, nil
 }
 
-func (p *parser) next() item {
-	return p.lx.nextItem()
+func (p *parser) next() token {
+	return p.lx.nextToken()
+}
+
+func (p *parser) position(tok token) Position {
+	return Position{File: p.file, Line: tok.line, Column: tok.col}
+}
+
+func (p *parser) errorf(tok token, format string, args ...interface{}) error {
+	return &ParseError{Pos: p.position(tok), Reason: fmt.Sprintf(format, args...)}
+}
+
+// path returns the path of the value being parsed, which is the last
+// key pushed in a map context or the next element in an array context.
+func (p *parser) path() string {
+	return p.pathTo(len(p.ctxs))
+}
+
+// contextPath returns the path of the current context.
+func (p *parser) contextPath() string {
+	return p.pathTo(len(p.ctxs) - 1)
+}
+
+// pathTo returns the path made of the keys and array indexes
+// of the first n contexts.
+func (p *parser) pathTo(n int) string {
+	var sb strings.Builder
+	k := 0
+	for i := 0; i < n; i++ {
+		switch ctx := p.ctxs[i].(type) {
+		case map[string]interface{}:
+			if k >= len(p.keys) {
+				return sb.String()
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(p.keys[k])
+			k++
+		case []interface{}:
+			fmt.Fprintf(&sb, "[%d]", len(ctx))
+		}
+	}
+	return sb.String()
 }
 
 func (p *parser) pushContext(ctx interface{}) {
@@ -135,19 +268,37 @@ func (p *parser) popKey() string {
 	return last
 }
 
-func (p *parser) processItem(it item) error {
+func (p *parser) processItem(it token) error {
+	// Record where array elements are, keys are recorded below.
+	if _, ok := p.ctx.([]interface{}); ok {
+		switch it.typ {
+		case itemString, itemInteger, itemFloat, itemBool, itemDatetime,
+			itemMapStart, itemArrayStart, itemVariable:
+			p.src.Positions[p.path()] = p.position(it)
+		}
+	}
+
 	switch it.typ {
 	case itemError:
-		return fmt.Errorf("Parse error on line %d: '%s'", it.line, it.val)
+		return p.errorf(it, "Parse error on line %d: '%s'", it.line, it.val)
 	case itemKey:
 		p.pushKey(it.val)
+		p.src.Positions[p.path()] = p.position(it)
 	case itemMapStart:
 		newCtx := make(map[string]interface{})
 		p.pushContext(newCtx)
 	case itemMapEnd:
 		p.setValue(p.popContext())
 	case itemString:
-		p.setValue(it.val) // FIXME(dlc) sanitize string?
+		if len(it.parts) == 0 {
+			p.setValue(it.val) // FIXME(dlc) sanitize string?
+			break
+		}
+		s, err := p.interpolate(it)
+		if err != nil {
+			return err
+		}
+		p.setValue(s)
 	case itemInteger:
 		lastDigit := 0
 		for _, r := range it.val {
@@ -161,36 +312,23 @@ func (p *parser) processItem(it item) error {
 		if err != nil {
 			if e, ok := err.(*strconv.NumError); ok &&
 				e.Err == strconv.ErrRange {
-				return fmt.Errorf("Integer '%s' is out of the range.", it.val)
+				return p.errorf(it, "Integer '%s' is out of the range.", it.val)
 			}
-			return fmt.Errorf("Expected integer, but got '%s'.", it.val)
+			return p.errorf(it, "Expected integer, but got '%s'.", it.val)
 		}
 		// Process a suffix
 		suffix := strings.ToLower(strings.TrimSpace(it.val[lastDigit:]))
-		switch suffix {
-		case "":
-			p.setValue(num)
-		case "k":
-			p.setValue(num * 1000)
-		case "kb":
-			p.setValue(num * 1024)
-		case "m":
-			p.setValue(num * 1000 * 1000)
-		case "mb":
-			p.setValue(num * 1024 * 1024)
-		case "g":
-			p.setValue(num * 1000 * 1000 * 1000)
-		case "gb":
-			p.setValue(num * 1024 * 1024 * 1024)
+		if mult, ok := sizeSuffixes[suffix]; ok {
+			p.setValue(num * mult)
 		}
 	case itemFloat:
 		num, err := strconv.ParseFloat(it.val, 64)
 		if err != nil {
 			if e, ok := err.(*strconv.NumError); ok &&
 				e.Err == strconv.ErrRange {
-				return fmt.Errorf("Float '%s' is out of the range.", it.val)
+				return p.errorf(it, "Float '%s' is out of the range.", it.val)
 			}
-			return fmt.Errorf("Expected float, but got '%s'.", it.val)
+			return p.errorf(it, "Expected float, but got '%s'.", it.val)
 		}
 		p.setValue(num)
 	case itemBool:
@@ -200,12 +338,12 @@ func (p *parser) processItem(it item) error {
 		case "false", "no", "off":
 			p.setValue(false)
 		default:
-			return fmt.Errorf("Expected boolean value, but got '%s'.", it.val)
+			return p.errorf(it, "Expected boolean value, but got '%s'.", it.val)
 		}
 	case itemDatetime:
 		dt, err := time.Parse("2006-01-02T15:04:05Z", it.val)
 		if err != nil {
-			return fmt.Errorf(
+			return p.errorf(it,
 				"Expected Zulu formatted DateTime, but got '%s'.", it.val)
 		}
 		p.setValue(dt)
@@ -217,26 +355,153 @@ func (p *parser) processItem(it item) error {
 		p.popContext()
 		p.setValue(array)
 	case itemVariable:
-		if value, ok := p.lookupVariable(it.val); ok {
-			p.setValue(value)
-		} else {
-			return fmt.Errorf("Variable reference for '%s' on line %d can not be found.",
-				it.val, it.line)
+		value, err := p.resolveVariable(it, it.val, false)
+		if err != nil {
+			return err
 		}
+		p.setValue(value)
 	case itemInclude:
-		m, err := ParseFile(filepath.Join(p.fp, it.val))
+		files, err := p.includeFiles(it)
 		if err != nil {
-			return fmt.Errorf("Error parsing include file '%s', %v.", it.val, err)
+			return err
 		}
-		for k, v := range m {
-			p.pushKey(k)
-			p.setValue(v)
+		for _, file := range files {
+			if err := p.include(it, file); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
+// includeFiles returns the files an include refers to, relative to the
+// including file. A directory stands for the ".conf" files in it, and a
+// glob pattern for the files it matches, in the order of their names.
+func (p *parser) includeFiles(it token) ([]string, error) {
+	path := it.val
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(p.fp, path)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		path = filepath.Join(path, "*.conf")
+	} else if !strings.ContainsAny(it.val, "*?[") {
+		return []string{path}, nil
+	}
+	matches, err := filepath.Glob(path)
+	if err != nil {
+		return nil, p.errorf(it, "Error parsing include pattern '%s', %v.", it.val, err)
+	}
+	files := matches[:0]
+	for _, m := range matches {
+		if fi, err := os.Stat(m); err == nil && !fi.IsDir() {
+			files = append(files, m)
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// include parses an included file and sets its keys in the current map.
+func (p *parser) include(it token, file string) error {
+	if abs, err := filepath.Abs(file); err == nil {
+		for i, f := range p.chain {
+			if f == abs {
+				cycle := append(p.chain[i:len(p.chain):len(p.chain)], abs)
+				return p.errorf(it, "Include cycle detected: %s.", strings.Join(cycle, " -> "))
+			}
+		}
+	}
+	ctx, ok := p.ctx.(map[string]interface{})
+	if !ok {
+		return p.errorf(it, "Unexpected include in an array.")
+	}
+
+	p.src.Includes = append(p.src.Includes, Reference{Name: file, Pos: p.position(it)})
+	ip, err := parseFile(file, p.chain)
+	if err != nil {
+		reason := fmt.Sprintf("Error parsing include file '%s', %v.", it.val, err)
+		// Report the position in the included file when known.
+		if pe, ok := err.(*ParseError); ok {
+			return &ParseError{Pos: pe.Pos, Reason: reason}
+		}
+		return p.errorf(it, "%s", reason)
+	}
+	p.src.Includes = append(p.src.Includes, ip.src.Includes...)
+	p.src.Env = append(p.src.Env, ip.src.Env...)
+	p.src.Files = append(p.src.Files, ip.src.Files...)
+
+	prefix := p.contextPath()
+	if prefix != "" {
+		prefix += "."
+	}
+	for k, v := range ip.mapping {
+		ctx[k] = p.merge(ctx[k], v, prefix+k, k, ip.src)
+	}
+	return nil
+}
+
+// merge returns the value of an included file at path ipath set over the
+// existing value at path. Maps are merged into existing maps and arrays
+// appended to existing arrays, so that configurations can be put together
+// from fragments. Other values replace the existing ones.
+func (p *parser) merge(old, val interface{}, path, ipath string, src *Source) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		if om, ok := old.(map[string]interface{}); ok {
+			// Copy maps as they may be shared through variables.
+			m := make(map[string]interface{}, len(om)+len(v))
+			for k, ov := range om {
+				m[k] = ov
+			}
+			for k, kv := range v {
+				m[k] = p.merge(m[k], kv, path+"."+k, ipath+"."+k, src)
+			}
+			return m
+		}
+	case []interface{}:
+		if oa, ok := old.([]interface{}); ok {
+			a := make([]interface{}, len(oa), len(oa)+len(v))
+			copy(a, oa)
+			for i, e := range v {
+				a = append(a, p.merge(nil, e, fmt.Sprintf("%s[%d]", path, len(a)), fmt.Sprintf("%s[%d]", ipath, i), src))
+			}
+			return a
+		}
+	}
+	p.moveSource(path, ipath, src)
+	return val
+}
+
+// moveSource replaces the positions and variables at path and below with
+// those of an included file at ipath.
+func (p *parser) moveSource(path, ipath string, src *Source) {
+	under := func(k, path string) (string, bool) {
+		if k == path {
+			return "", true
+		}
+		if strings.HasPrefix(k, path) && (k[len(path)] == '.' || k[len(path)] == '[') {
+			return k[len(path):], true
+		}
+		return "", false
+	}
+	for k := range p.src.Positions {
+		if _, ok := under(k, path); ok {
+			delete(p.src.Positions, k)
+		}
+	}
+	for k, pos := range src.Positions {
+		if rest, ok := under(k, ipath); ok {
+			p.src.Positions[path+rest] = pos
+		}
+	}
+	for k := range src.Variables {
+		if rest, ok := under(k, ipath); ok {
+			p.src.Variables[path+rest] = true
+		}
+	}
+}
+
 // Used to map an environment value into a temporary map to pass to secondary Parse call.
 const pkey = "pk"
 
@@ -247,11 +512,12 @@ const bcryptPrefix = "2a$"
 // it has seen before, with the top level scoping being the environment variables. We
 // ignore array contexts and only process the map contexts..
 //
-// Returns true for ok if it finds something, similar to map.
-func (p *parser) lookupVariable(varReference string) (interface{}, bool) {
+// Returns true for ok if it finds something, similar to map, and true
+// for env if the value comes from the environment.
+func (p *parser) lookupVariable(varReference string) (value interface{}, ok bool, env bool) {
 	// Do special check to see if it is a raw bcrypt string.
 	if strings.HasPrefix(varReference, bcryptPrefix) {
-		return "$" + varReference, true
+		return "$" + varReference, true, false
 	}
 
 	// Loop through contexts currently on the stack.
@@ -260,7 +526,12 @@ func (p *parser) lookupVariable(varReference string) (interface{}, bool) {
 		// Process if it is a map context
 		if m, ok := ctx.(map[string]interface{}); ok {
 			if v, ok := m[varReference]; ok {
-				return v, ok
+				path := p.pathTo(i)
+				if path != "" {
+					path += "."
+				}
+				p.src.Variables[path+varReference] = true
+				return v, ok, false
 			}
 		}
 	}
@@ -271,10 +542,115 @@ func (p *parser) lookupVariable(varReference string) (interface{}, bool) {
 		// Everything we get here will be a string value, so we need to process as a parser would.
 		if vmap, err := Parse(fmt.Sprintf("%s=%s", pkey, vStr)); err == nil {
 			v, ok := vmap[pkey]
-			return v, ok
+			return v, ok, ok
+		}
+	}
+	return nil, false, false
+}
+
+// resolveVariable resolves a variable reference, which is one of NAME,
+// {NAME}, {NAME:-default}, {NAME:?error} or file(path). When embedded in
+// a string, the raw value of environment variables is returned, and the
+// reference itself for undefined variables.
+func (p *parser) resolveVariable(tok token, ref string, embedded bool) (interface{}, error) {
+	if strings.HasPrefix(ref, fileVariable) && strings.HasSuffix(ref, ")") {
+		return p.readFileVariable(tok, ref[len(fileVariable):len(ref)-1])
+	}
+
+	name, op, arg := ref, "", ""
+	if strings.HasPrefix(ref, "{") && strings.HasSuffix(ref, "}") {
+		name = ref[1 : len(ref)-1]
+		if i := strings.IndexByte(name, ':'); i >= 0 {
+			if len(name) < i+2 || (name[i+1] != '-' && name[i+1] != '?') {
+				return nil, p.errorf(tok, "Invalid variable reference '$%s' on line %d.", ref, tok.line)
+			}
+			name, op, arg = name[:i], name[i:i+2], name[i+2:]
+		}
+	}
+
+	value, ok, env := p.lookupVariable(name)
+	if ok && env {
+		p.src.Env = append(p.src.Env, Reference{Name: name, Pos: p.position(tok)})
+		if embedded {
+			value = os.Getenv(name)
+		}
+	}
+	// With a default or an error, empty values are treated as unset.
+	if ok && (op == "" || value != "") {
+		return value, nil
+	}
+	switch op {
+	case ":-":
+		if embedded {
+			return arg, nil
+		}
+		// Defaults are typed like values from the environment.
+		if vmap, err := Parse(fmt.Sprintf("%s=%s", pkey, arg)); err == nil {
+			if v, ok := vmap[pkey]; ok {
+				return v, nil
+			}
+		}
+		return arg, nil
+	case ":?":
+		if arg == "" {
+			return nil, p.errorf(tok, "Variable '%s' on line %d is not set.", name, tok.line)
+		}
+		return nil, p.errorf(tok, "Variable '%s' on line %d is not set: %s", name, tok.line, arg)
+	}
+	// Strings referencing undefined variables are kept as is, like before
+	// interpolation.
+	if embedded {
+		return "$" + ref, nil
+	}
+	return nil, p.errorf(tok, "Variable reference for '%s' on line %d can not be found.",
+		name, tok.line)
+}
+
+// readFileVariable returns the content of the file referenced by
+// $file(path), with surrounding white space trimmed. Relative paths
+// are relative to the config file, like includes.
+func (p *parser) readFileVariable(tok token, arg string) (interface{}, error) {
+	file := strings.TrimSpace(arg)
+	if len(file) >= 2 && (file[0] == '"' || file[0] == '\'') && file[len(file)-1] == file[0] {
+		file = file[1 : len(file)-1]
+	}
+	if file == "" {
+		return nil, p.errorf(tok, "Missing file name in '$%s' on line %d.", tok.val, tok.line)
+	}
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(p.fp, file)
+	}
+	p.src.Files = append(p.src.Files, Reference{Name: file, Pos: p.position(tok)})
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, p.errorf(tok, "Error reading file '%s' on line %d: %v", file, tok.line, err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// interpolate returns the string with its embedded variable references
+// replaced by their value.
+func (p *parser) interpolate(tok token) (string, error) {
+	var sb strings.Builder
+	for _, part := range tok.parts {
+		if !part.ref {
+			sb.WriteString(part.val)
+			continue
+		}
+		rt := tok
+		rt.col = part.col
+		value, err := p.resolveVariable(rt, part.val, true)
+		if err != nil {
+			return "", err
+		}
+		switch value.(type) {
+		case map[string]interface{}, []interface{}:
+			return "", p.errorf(rt, "Variable '%s' on line %d can not be embedded in a string.",
+				part.val, tok.line)
 		}
+		fmt.Fprint(&sb, value)
 	}
-	return nil, false
+	return sb.String(), nil
 }
 
 func (p *parser) setValue(val interface{}) {
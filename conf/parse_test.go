@@ -2,7 +2,9 @@ package conf
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -107,6 +109,110 @@ func TestBcryptVariable(t *testing.T) {
 	test(t, "password: $2a$11$ooo", ex)
 }
 
+func TestEnvVariableDefault(t *testing.T) {
+	evar := "__UNIQ44__"
+	os.Setenv(evar, "44")
+	defer os.Unsetenv(evar)
+
+	ex := map[string]interface{}{
+		"foo": int64(44),
+		"bar": int64(4222),
+		"baz": "a default",
+		"bat": int64(2000),
+	}
+	test(t, fmt.Sprintf("foo = ${%s:-1}\nbar = ${__UNSET__:-4222}\nbaz = ${__UNSET__:-a default}\n"+
+		"bat = ${__UNSET__:-2k}", evar), ex)
+
+	// Empty values are replaced by the default too.
+	os.Setenv(evar, "")
+	test(t, fmt.Sprintf("foo = ${%s:-bar}", evar), map[string]interface{}{"foo": "bar"})
+}
+
+func TestEnvVariableRequired(t *testing.T) {
+	_, err := parse("foo = 1\nbar = ${__UNSET__:?bar must be set}", "", "test.conf")
+	if err == nil {
+		t.Fatal("Expected an error for a required variable, got none")
+	}
+	pe, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected a *ParseError, got %T", err)
+	}
+	if pe.Pos.String() != "test.conf:2:8" || pe.Reason != "Variable '__UNSET__' on line 2 is not set: bar must be set" {
+		t.Fatalf("Unexpected error: %s: %v", pe.Pos, pe)
+	}
+}
+
+func TestEnvVariableInString(t *testing.T) {
+	evar := "__UNIQ55__"
+	os.Setenv(evar, "1MB")
+	defer os.Unsetenv(evar)
+
+	ex := map[string]interface{}{
+		"host": "localhost",
+		"foo":  fmt.Sprintf("max ${%s} is 1MB, local port ${__UNSET__} is 4222", evar),
+		"bar":  "nats://localhost:4222",
+	}
+	test(t, fmt.Sprintf(`host = localhost
+foo = 'max ${%s} is 1MB, local port ${__UNSET__} is 4222'
+bar = "nats://${host}:${__UNSET__:-4222}"`, evar), ex)
+
+	ex["foo"] = "max 1MB"
+	test(t, fmt.Sprintf(`host = localhost
+foo = "max ${%s}"
+bar = "nats://${host}:${__UNSET__:-4222}"`, evar), ex)
+
+	// Undefined and escaped references are kept as is, and required ones
+	// are still checked.
+	test(t, fmt.Sprintf(`ss = secret
+password = "p${__UNSET__}word"
+literal = "p\${ss}word"
+port = "port ${%s} ${__UNSET__"`, evar), map[string]interface{}{
+		"ss":       "secret",
+		"password": "p${__UNSET__}word",
+		"literal":  "p${ss}word",
+		"port":     "port 1MB ${__UNSET__",
+	})
+
+	_, err := parse("foo = \"port ${__UNSET__:?port must be set}\"", "", "test.conf")
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Pos.String() != "test.conf:1:14" || !strings.HasPrefix(pe.Reason, "Variable '__UNSET__'") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestFileVariable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "conf")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	secret := filepath.Join(dir, "pass")
+	if err := ioutil.WriteFile(secret, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatalf("Error writing secret: %v", err)
+	}
+
+	ex := map[string]interface{}{
+		"abs": "s3cr3t",
+		"rel": "s3cr3t",
+	}
+	p, err := parse(fmt.Sprintf("abs = $file(\"%s\")\nrel = $file(pass)", secret), dir, "test.conf")
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if !reflect.DeepEqual(p.mapping, ex) {
+		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", p.mapping, ex)
+	}
+	if len(p.src.Files) != 2 || p.src.Files[1].Name != secret || p.src.Files[1].Pos.String() != "test.conf:2:8" {
+		t.Fatalf("Unexpected file references: %+v", p.src.Files)
+	}
+
+	_, err = parse("foo = 1\nbar = $file('missing')", dir, "test.conf")
+	pe, ok := err.(*ParseError)
+	if !ok || pe.Pos.String() != "test.conf:2:8" || !strings.HasPrefix(pe.Reason, "Error reading file") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
 var easynum = `
 k = 8k
 kb = 4kb
@@ -273,3 +379,135 @@ func TestIncludes(t *testing.T) {
 		t.Fatalf("Not Equal:\nReceived: '%+v'\nExpected: '%+v'\n", m, ex)
 	}
 }
+
+func TestParseFileWithSource(t *testing.T) {
+	m, src, err := ParseFileWithSource("simple.conf")
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if m == nil || src == nil {
+		t.Fatal("Received nil map or source")
+	}
+
+	expected := map[string]string{
+		"listen":                      "simple.conf:1:1",
+		"authorization":               "simple.conf:3:1",
+		"authorization.timeout":       "simple.conf:5:3",
+		"authorization.users":         "includes/users.conf:5:1",
+		"authorization.users[1].user": "includes/users.conf:7:4",
+		"authorization.ALICE_PASS":    "includes/passwords.conf:2:1",
+	}
+	for path, pos := range expected {
+		if p, ok := src.Positions[path]; !ok || p.String() != pos {
+			t.Fatalf("Expected %q to be at %s, got %v", path, pos, p)
+		}
+	}
+
+	if len(src.Includes) != 2 {
+		t.Fatalf("Expected 2 includes, got %+v", src.Includes)
+	}
+	if inc := src.Includes[0]; inc.Name != "includes/users.conf" || inc.Pos.String() != "simple.conf:4:12" {
+		t.Fatalf("Unexpected include: %+v", inc)
+	}
+	if inc := src.Includes[1]; inc.Name != "includes/passwords.conf" || inc.Pos.String() != "includes/users.conf:3:9" {
+		t.Fatalf("Unexpected include: %+v", inc)
+	}
+	if !src.Variables["authorization.ALICE_PASS"] || !src.Variables["authorization.BOB_PASS"] {
+		t.Fatalf("Expected the passwords to be referenced as variables, got %+v", src.Variables)
+	}
+}
+
+func TestIncludeGlob(t *testing.T) {
+	m, src, err := ParseFileWithSource("includes/teams.conf")
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	auth := m["authorization"].(map[string]interface{})
+	if auth["timeout"] != int64(2) {
+		t.Fatalf("Expected the timeout to be replaced, got %v", auth["timeout"])
+	}
+	var users []string
+	for _, u := range auth["users"].([]interface{}) {
+		users = append(users, u.(map[string]interface{})["user"].(string))
+	}
+	if !reflect.DeepEqual(users, []string{"admin", "alice", "bob"}) {
+		t.Fatalf("Expected the users to be appended in order, got %v", users)
+	}
+
+	expected := map[string]string{
+		"authorization":                              "includes/teams.conf:3:1",
+		"authorization.timeout":                      "includes/teams.d/20-beta.conf:3:3",
+		"authorization.users[0].user":                "includes/teams.conf:6:6",
+		"authorization.users[1]":                     "includes/teams.d/10-alpha.conf:4:5",
+		"authorization.users[2].permissions.publish": "includes/teams.d/20-beta.conf:5:46",
+	}
+	for path, pos := range expected {
+		if p, ok := src.Positions[path]; !ok || p.String() != pos {
+			t.Fatalf("Expected %q to be at %s, got %v", path, pos, p)
+		}
+	}
+	if len(src.Includes) != 2 || src.Includes[0].Name != "includes/teams.d/10-alpha.conf" ||
+		src.Includes[1].Name != "includes/teams.d/20-beta.conf" {
+		t.Fatalf("Unexpected includes: %+v", src.Includes)
+	}
+
+	// A directory includes the .conf files in it.
+	m, err = Parse("authorization { include 'includes/teams.d' }")
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	auth = m["authorization"].(map[string]interface{})["authorization"].(map[string]interface{})
+	if len(auth["users"].([]interface{})) != 2 {
+		t.Fatalf("Unexpected users: %+v", auth["users"])
+	}
+
+	// Patterns matching nothing include nothing.
+	m, err = Parse("include 'includes/none.d/*.conf'")
+	if err != nil || len(m) != 0 {
+		t.Fatalf("Expected an empty config, got %+v, err=%v", m, err)
+	}
+}
+
+func TestIncludeCycle(t *testing.T) {
+	_, err := ParseFile("includes/cycle_a.conf")
+	pe, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected a *ParseError, got %v", err)
+	}
+	if !strings.Contains(pe.Reason, "Include cycle detected") ||
+		!strings.Contains(pe.Reason, filepath.Join("includes", "cycle_b.conf")+" -> ") {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if pe.Pos.String() != "includes/cycle_b.conf:2:10" {
+		t.Fatalf("Unexpected position: %v", pe.Pos)
+	}
+}
+
+func TestParseErrorPosition(t *testing.T) {
+	evar := "__UNIQ33__"
+	os.Setenv(evar, "33")
+	defer os.Unsetenv(evar)
+
+	p, err := parse(fmt.Sprintf("foo = $%s\nbar {\n  baz = $missing\n}", evar), "", "test.conf")
+	if err == nil {
+		t.Fatal("Expected an error for a missing variable, got none")
+	}
+	pe, ok := err.(*ParseError)
+	if !ok {
+		t.Fatalf("Expected a *ParseError, got %T", err)
+	}
+	if pos := pe.Pos.String(); pos != "test.conf:3:10" {
+		t.Fatalf("Expected error at test.conf:3:10, got %s", pos)
+	}
+	if !strings.HasPrefix(err.Error(), "Variable reference") {
+		t.Fatalf("Wanted a variable reference err, got %q\n", err)
+	}
+
+	p, err = parse(fmt.Sprintf("foo = $%s", evar), "", "test.conf")
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if len(p.src.Env) != 1 || p.src.Env[0].Name != evar || p.src.Env[0].Pos.String() != "test.conf:1:8" {
+		t.Fatalf("Unexpected environment references: %+v", p.src.Env)
+	}
+}
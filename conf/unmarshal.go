@@ -0,0 +1,314 @@
+package conf
+
+// Decoding of configurations into Go values. Struct fields are matched
+// with keys by the name in their "conf" tag, or their own name, ignoring
+// case, and can accept other keys with "alias=" options in the tag:
+//
+//   type Options struct {
+//       Listen     string        `conf:"listen"`
+//       MaxPayload int64         `conf:"max_payload,alias=max_pay"`
+//       Timeout    time.Duration `conf:"timeout"`
+//   }
+//
+// Besides the conversions done by util/decode, durations can be given
+// as strings such as "2s" or as a number of seconds, integers as sizes
+// such as "1MB", IP addresses and URLs as strings, and a single string
+// is accepted where a list of strings, such as subjects, is expected.
+// Subject fields only accept valid subjects.
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/elitecodegroovy/gmessage/util/decode"
+)
+
+const tagName = "conf"
+
+var (
+	durationType = reflect.TypeOf(time.Duration(0))
+	ipType       = reflect.TypeOf(net.IP(nil))
+	urlType      = reflect.TypeOf(url.URL{})
+	subjectType  = reflect.TypeOf(Subject(""))
+)
+
+// Subject is a subject, which may contain wildcards. Decoding fails for
+// invalid subjects, and a list of subjects can be given as a single one.
+type Subject string
+
+// UnmarshalError is returned when a parsed configuration can not be
+// decoded. It holds an error for each unknown key and each value that
+// could not be decoded, sorted by position.
+type UnmarshalError struct {
+	Errors []*ParseError
+}
+
+func (e *UnmarshalError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, pe := range e.Errors {
+		switch {
+		case pe.Pos.Line > 0:
+			msgs[i] = fmt.Sprintf("%s: %s", pe.Pos, pe.Reason)
+		case pe.Pos.File != "":
+			msgs[i] = fmt.Sprintf("%s: %s", pe.Pos.File, pe.Reason)
+		default:
+			msgs[i] = pe.Reason
+		}
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Unmarshal parses the configuration data and decodes it into v, which
+// must be a pointer to a struct or a map.
+func Unmarshal(data string, v interface{}) error {
+	p, err := parse(data, "", "")
+	if err != nil {
+		return err
+	}
+	return Decode(p.mapping, p.src, "", v)
+}
+
+// UnmarshalFile parses the configuration file and decodes it into v.
+func UnmarshalFile(fp string, v interface{}) error {
+	m, src, err := ParseFileWithSource(fp)
+	if err != nil {
+		return err
+	}
+	return Decode(m, src, "", v)
+}
+
+// Decode decodes the value at path in a parsed configuration into v, or
+// the whole configuration if path is empty. Applications embedding the
+// server can use it to read their own section of its configuration file,
+// keys being only checked within that section. Nothing is decoded if
+// there is no value at path. The source, which may be nil, is used for
+// the positions of the errors.
+func Decode(m map[string]interface{}, src *Source, path string, v interface{}) error {
+	var data interface{} = m
+	if path != "" {
+		for _, k := range strings.Split(path, ".") {
+			sm, ok := data.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("'%s' is not a map", path)
+			}
+			if data, ok = sm[k]; !ok {
+				return nil
+			}
+		}
+	}
+
+	md := &decode.Metadata{}
+	d, err := decode.NewDecoder(&decode.DecoderConfig{
+		DecodeHook: decodeHook,
+		Metadata:   md,
+		Result:     v,
+		TagName:    tagName,
+	})
+	if err != nil {
+		return err
+	}
+	err = d.Decode(data)
+
+	u := &unmarshaler{src: src, path: path}
+	switch e := err.(type) {
+	case nil:
+	case *decode.FieldError:
+		u.errorf(e.Name, "%s", e.Error())
+	case *decode.Error:
+		u.decodeErrors(e)
+	default:
+		return err
+	}
+	for _, k := range md.Unused {
+		if src != nil && src.Variables[u.fullPath(k)] {
+			continue
+		}
+		u.errorf(k, "Unknown field '%s'", u.fullPath(k))
+	}
+	if len(u.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(u.errs, func(i, j int) bool {
+		pi, pj := u.errs[i].Pos, u.errs[j].Pos
+		if pi.File != pj.File {
+			return pi.File < pj.File
+		}
+		if pi.Line != pj.Line {
+			return pi.Line < pj.Line
+		}
+		return pi.Column < pj.Column
+	})
+	return &UnmarshalError{Errors: u.errs}
+}
+
+type unmarshaler struct {
+	src  *Source
+	path string
+	errs []*ParseError
+}
+
+// decodeErrors records the errors of a decode, at the position of the
+// field they are about when it is known.
+func (u *unmarshaler) decodeErrors(e *decode.Error) {
+	fields := make(map[string]int)
+	for _, fe := range e.Fields {
+		u.errorf(fe.Name, "%s", fe.Error())
+		fields[fe.Error()]++
+	}
+	for _, msg := range e.Errors {
+		if fields[msg] > 0 {
+			fields[msg]--
+			continue
+		}
+		u.errs = append(u.errs, &ParseError{Pos: u.position(""), Reason: msg})
+	}
+}
+
+func (u *unmarshaler) errorf(name, format string, args ...interface{}) {
+	u.errs = append(u.errs, &ParseError{Pos: u.position(name), Reason: fmt.Sprintf(format, args...)})
+}
+
+// fullPath returns the path in the configuration of a field named
+// by the decoder.
+func (u *unmarshaler) fullPath(name string) string {
+	// Map keys are named "map[key]" by the decoder, and "map.key" here.
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(name, '[')
+		if i < 0 {
+			break
+		}
+		j := strings.IndexByte(name[i:], ']')
+		if j < 0 {
+			break
+		}
+		key := name[i+1 : i+j]
+		sb.WriteString(name[:i])
+		if _, err := strconv.Atoi(key); err == nil {
+			sb.WriteString(name[i : i+j+1])
+		} else {
+			sb.WriteByte('.')
+			sb.WriteString(key)
+		}
+		name = name[i+j+1:]
+	}
+	sb.WriteString(name)
+	name = sb.String()
+
+	switch {
+	case u.path == "":
+		return name
+	case name == "", name[0] == '[':
+		return u.path + name
+	default:
+		return u.path + "." + name
+	}
+}
+
+// position returns the position of a field named by the decoder, or of
+// its closest parent with a known position, or only the file if none is
+// known.
+func (u *unmarshaler) position(name string) Position {
+	if u.src == nil {
+		return Position{}
+	}
+	for path := u.fullPath(name); path != ""; {
+		if pos, ok := u.src.Positions[path]; ok {
+			return pos
+		}
+		i := strings.LastIndexAny(path, ".[")
+		if i < 0 {
+			break
+		}
+		path = path[:i]
+	}
+	return Position{File: u.src.File}
+}
+
+// decodeHook converts the values of a parsed configuration to the types
+// the decoder can not convert them to by itself.
+func decodeHook(from, to reflect.Type, data interface{}) (interface{}, error) {
+	switch {
+	case to == durationType:
+		switch v := data.(type) {
+		case string:
+			return time.ParseDuration(v)
+		case int64:
+			return time.Duration(v) * time.Second, nil
+		case float64:
+			return time.Duration(v * float64(time.Second)), nil
+		}
+	case to == ipType:
+		if s, ok := data.(string); ok {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address '%s'", s)
+			}
+			return ip, nil
+		}
+	case to == urlType:
+		if s, ok := data.(string); ok {
+			u, err := url.Parse(s)
+			if err != nil {
+				return nil, err
+			}
+			return *u, nil
+		}
+	case to == subjectType:
+		if s, ok := data.(string); ok && !isValidSubject(s) {
+			return nil, fmt.Errorf("invalid subject '%s'", s)
+		}
+	case from.Kind() != reflect.String:
+	case to.Kind() >= reflect.Int && to.Kind() <= reflect.Uint64:
+		if n, ok := parseSize(data.(string)); ok {
+			return n, nil
+		}
+	case to.Kind() == reflect.Slice && to.Elem().Kind() == reflect.String:
+		return []string{data.(string)}, nil
+	}
+	return data, nil
+}
+
+// isValidSubject returns true if a subject is valid, with the rules of
+// server.IsValidSubject, which can not be imported here.
+func isValidSubject(subject string) bool {
+	if subject == "" {
+		return false
+	}
+	fwc := false
+	for _, t := range strings.Split(subject, ".") {
+		if len(t) == 0 || fwc {
+			return false
+		}
+		fwc = t == ">"
+	}
+	return true
+}
+
+// parseSize parses a quoted size such as "1MB", with the suffixes
+// unquoted integers can have.
+func parseSize(s string) (int64, bool) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) && r != '-' })
+	if i == 0 {
+		return 0, false
+	} else if i < 0 {
+		i = len(s)
+	}
+	mult, ok := sizeSuffixes[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return n * mult, true
+}
@@ -0,0 +1,183 @@
+package conf
+
+import (
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testPermissions struct {
+	Publish   []Subject `conf:"publish"`
+	Subscribe []Subject `conf:"subscribe"`
+}
+
+type testUser struct {
+	Username    string           `conf:"user,alias=username"`
+	Password    string           `conf:"password,alias=pass"`
+	Permissions *testPermissions `conf:"permissions"`
+}
+
+type testOptions struct {
+	Host        net.IP               `conf:"host,alias=net"`
+	Port        int                  `conf:"port"`
+	MaxPayload  int32                `conf:"max_payload"`
+	MaxPending  int64                `conf:"max_pending"`
+	PingEvery   time.Duration        `conf:"ping_interval"`
+	AuthTimeout time.Duration        `conf:"auth_timeout"`
+	Debug       bool                 `conf:"debug"`
+	Users       []testUser           `conf:"users"`
+	Accounts    map[string]*testUser `conf:"accounts"`
+	Advertise   *url.URL             `conf:"advertise"`
+}
+
+func TestUnmarshal(t *testing.T) {
+	var opts struct {
+		testOptions `conf:",squash"`
+		Cluster     struct {
+			Routes []string `conf:"routes"`
+		} `conf:"cluster"`
+	}
+	err := Unmarshal(`
+		perms = {publish: "foo.>", subscribe: [">"]}
+		net: 127.0.0.1
+		PORT: 4222
+		max_payload: 1MB
+		max_pending: "64kb"
+		ping_interval: "2m"
+		auth_timeout: 0.5
+		debug: true
+		advertise: "nats://demo.example.com:4222"
+		users = [
+		  {user: alice, password: foo, permissions: $perms}
+		  {username: bob, pass: bar}
+		]
+		accounts {
+		  carol {user: carol}
+		}
+		cluster {
+		  routes: "nats-route://127.0.0.1:6222"
+		}
+	`, &opts)
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	if !opts.Host.Equal(net.IPv4(127, 0, 0, 1)) || opts.Port != 4222 {
+		t.Fatalf("Unexpected host or port: %v:%d", opts.Host, opts.Port)
+	}
+	if opts.MaxPayload != 1024*1024 || opts.MaxPending != 64*1024 {
+		t.Fatalf("Unexpected sizes: %d, %d", opts.MaxPayload, opts.MaxPending)
+	}
+	if opts.PingEvery != 2*time.Minute || opts.AuthTimeout != 500*time.Millisecond {
+		t.Fatalf("Unexpected durations: %v, %v", opts.PingEvery, opts.AuthTimeout)
+	}
+	if !opts.Debug {
+		t.Fatal("Expected debug to be set")
+	}
+	if opts.Advertise == nil || opts.Advertise.Host != "demo.example.com:4222" {
+		t.Fatalf("Unexpected advertise URL: %v", opts.Advertise)
+	}
+	expected := []testUser{
+		{"alice", "foo", &testPermissions{Publish: []Subject{"foo.>"}, Subscribe: []Subject{">"}}},
+		{"bob", "bar", nil},
+	}
+	if !reflect.DeepEqual(opts.Users, expected) {
+		t.Fatalf("Unexpected users: %+v", opts.Users)
+	}
+	if u := opts.Accounts["carol"]; u == nil || u.Username != "carol" {
+		t.Fatalf("Unexpected accounts: %+v", opts.Accounts)
+	}
+	if !reflect.DeepEqual(opts.Cluster.Routes, []string{"nats-route://127.0.0.1:6222"}) {
+		t.Fatalf("Unexpected routes: %v", opts.Cluster.Routes)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var opts testOptions
+	err := Unmarshal(`
+port: "4222x"
+users = [
+  {user: alice, passwd: foo}
+  {user: bob, permissions: {publish: [1, "bar"], subscribe: ["foo..bar", "baz"]}}
+  {user: carol, permissions: {publish: ">.foo"}}
+]
+ping_interval: "2 minutes"
+host: 127.0.0
+accounts {
+  carol {nick: carol}
+}
+`, &opts)
+	ue, ok := err.(*UnmarshalError)
+	if !ok {
+		t.Fatalf("Expected an *UnmarshalError, got %v", err)
+	}
+	expected := []struct {
+		line, col int
+		reason    string
+	}{
+		{2, 1, "'port' expected type 'int'"},
+		{4, 17, "Unknown field 'users[0].passwd'"},
+		{5, 39, "'users[1].permissions.publish[0]' expected type 'conf.Subject'"},
+		{5, 63, "error decoding 'users[1].permissions.subscribe[0]': invalid subject 'foo..bar'"},
+		{6, 31, "error decoding 'users[2].permissions.publish[0]': invalid subject '>.foo'"},
+		{8, 1, "error decoding 'ping_interval'"},
+		{9, 1, "error decoding 'host': invalid IP address '127.0.0'"},
+		{11, 10, "Unknown field 'accounts.carol.nick'"},
+	}
+	if len(ue.Errors) != len(expected) {
+		t.Fatalf("Unexpected errors: %v", err)
+	}
+	for i, e := range expected {
+		pe := ue.Errors[i]
+		if pe.Pos.Line != e.line || pe.Pos.Column != e.col || !strings.HasPrefix(pe.Reason, e.reason) {
+			t.Fatalf("Unexpected error %d, expected %d:%d: %s, got %s: %s", i, e.line, e.col, e.reason, pe.Pos, pe.Reason)
+		}
+	}
+	if !strings.HasPrefix(err.Error(), "2:1: 'port' expected type 'int'") {
+		t.Fatalf("Unexpected error message: %v", err)
+	}
+
+	// Errors without a known position have no prefix.
+	err = Decode(map[string]interface{}{"port": "x"}, nil, "", &opts)
+	if err == nil || err.Error() != "'port' expected type 'int', got unconvertible type 'string'" {
+		t.Fatalf("Unexpected error message: %v", err)
+	}
+
+	// Parse errors are returned as is.
+	if _, ok := Unmarshal("port: [1, 2", &opts).(*ParseError); !ok {
+		t.Fatal("Expected a *ParseError")
+	}
+}
+
+func TestDecodeSection(t *testing.T) {
+	m, src, err := ParseFileWithSource("simple.conf")
+	if err != nil {
+		t.Fatalf("Received err: %v\n", err)
+	}
+	var app struct {
+		Users []testUser `conf:"users"`
+	}
+	err = Decode(m, src, "authorization", &app)
+	ue, ok := err.(*UnmarshalError)
+	if !ok || len(ue.Errors) != 1 || ue.Errors[0].Pos.File != "simple.conf" ||
+		!strings.Contains(ue.Errors[0].Reason, "authorization.timeout") {
+		t.Fatalf("Expected an unknown field error for the timeout, got %v", err)
+	}
+	if len(app.Users) != 2 || app.Users[1].Username != "bob" || !strings.HasPrefix(app.Users[1].Password, "$2a$11$") {
+		t.Fatalf("Unexpected values: %+v", app)
+	}
+	// Keys without a position are reported in the file.
+	m["extra"] = int64(1)
+	err = Decode(m, src, "", &app)
+	if err == nil || !strings.Contains(err.Error(), "simple.conf: Unknown field 'extra'") {
+		t.Fatalf("Expected an unknown field error in the file, got %v", err)
+	}
+	if err := Decode(m, src, "missing.section", &app); err != nil {
+		t.Fatalf("Expected no error for a missing section, got %v", err)
+	}
+	if err := Decode(m, src, "listen.foo", &app); err == nil {
+		t.Fatal("Expected an error for a section that is not a map")
+	}
+}
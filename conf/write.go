@@ -0,0 +1,344 @@
+package conf
+
+// Writing of syntax trees. Documents are written back as they were parsed,
+// except for the nodes changed since, which are written in the canonical
+// format: entries one per line as "key: value", or "key {" for maps,
+// indented by two spaces, with comments and single blank lines kept where
+// they were. Arrays and maps in arrays are written on a single line when
+// they only hold a few scalar values without comments. Changed maps and
+// arrays spanning multiple lines keep the text around their unchanged
+// entries, and their new entries are indented like the others. Format
+// writes whole documents in the canonical format.
+
+import (
+	"io"
+	"strings"
+	"unicode"
+)
+
+const (
+	indentWidth     = 2
+	maxInlineLength = 72
+)
+
+// Bytes returns the document, as parsed except for the changes made since.
+func (d *Document) Bytes() []byte {
+	return []byte(d.String())
+}
+
+func (d *Document) String() string {
+	w := &docWriter{}
+	switch root := d.Root; {
+	case root.src == nil:
+		w.entries(root, 0)
+	case !root.changed():
+		w.sb.WriteString(root.src.text)
+	default:
+		w.children(root)
+	}
+	return w.sb.String()
+}
+
+// WriteTo writes the document, as parsed except for the changes made
+// since.
+func (d *Document) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.WriteString(w, d.String())
+	return int64(n), err
+}
+
+// Format returns the document in the canonical format.
+func (d *Document) Format() string {
+	w := &docWriter{}
+	w.entries(d.Root, 0)
+	return w.sb.String()
+}
+
+// Format returns the configuration data in the canonical format.
+func Format(data string) (string, error) {
+	d, err := ParseDocument(data)
+	if err != nil {
+		return "", err
+	}
+	return d.Format(), nil
+}
+
+type docWriter struct {
+	sb strings.Builder
+	// Indentation of the lines written in the canonical format, before
+	// that of their depth.
+	base string
+}
+
+func (w *docWriter) indent(depth int) {
+	w.sb.WriteString(w.base)
+	w.sb.WriteString(strings.Repeat(" ", depth*indentWidth))
+}
+
+// lineStart tells whether the text written so far ends a line.
+func (w *docWriter) lineStart() bool {
+	s := w.sb.String()
+	return len(s) == 0 || s[len(s)-1] == '\n'
+}
+
+// children writes the children of a parsed map or array, the text around
+// them as parsed if unchanged, and its end.
+func (w *docWriter) children(n *Node) {
+	s := n.src
+	w.sb.WriteString(s.head)
+	for i, c := range n.Children {
+		w.child(n, c, i == 0)
+	}
+	if equalLines(n.EndComments, s.endComments) && (strings.ContainsRune(s.tail, '\n') || !w.lineStart()) {
+		w.sb.WriteString(s.tail)
+	} else {
+		if !w.lineStart() {
+			w.sb.WriteByte('\n')
+		}
+		w.base = s.childIndent
+		w.comments(n.EndComments, 0, len(n.Children) == 0, true)
+		w.sb.WriteString(s.indent)
+	}
+	w.sb.WriteString(s.close)
+}
+
+// child writes an entry or an element of a parsed map or array p, as
+// parsed if unchanged, along with the rest of its last line.
+func (w *docWriter) child(p, c *Node, first bool) {
+	s := c.src
+	if s != nil && equalLines(c.Comments, s.comments) && (strings.ContainsRune(s.lead, '\n') || !w.lineStart()) {
+		lead := s.lead
+		if first && len(p.src.children) > 0 && p.src.children[0] != c {
+			// Blank lines are not kept at the start of a block.
+			for line, rest := splitLine(lead); line != "" && strings.TrimSpace(line) == ""; line, rest = splitLine(rest) {
+				lead = rest
+			}
+		}
+		w.sb.WriteString(lead)
+	} else {
+		if !w.lineStart() {
+			w.sb.WriteByte('\n')
+		}
+		w.base = p.src.childIndent
+		w.comments(c.Comments, 0, first, false)
+		w.indent(0)
+	}
+
+	switch {
+	case s == nil:
+	case !c.changed():
+		w.sb.WriteString(s.text)
+		w.trail(c)
+		return
+	case c.Kind == IncludeNode && s.kind == IncludeNode:
+		w.sb.WriteString(s.text[:s.val])
+		w.sb.WriteString(c.Raw)
+		w.trail(c)
+		return
+	case c.Kind == IncludeNode || s.kind == IncludeNode || c.Key != s.key ||
+		(c.Kind == MapNode) != (s.kind == MapNode):
+		// The key part can not be kept.
+		s = nil
+	case c.Kind == s.kind && (c.Kind == MapNode || c.Kind == ArrayNode) && s.multiline && c.Comment == s.comment:
+		w.sb.WriteString(s.text[:s.open])
+		w.children(c)
+		w.trail(c)
+		return
+	case c.Kind != MapNode && c.Kind != ArrayNode:
+		w.sb.WriteString(s.text[:s.val])
+		w.sb.WriteString(c.Raw)
+		w.trail(c)
+		return
+	}
+
+	w.base = p.src.childIndent
+	switch {
+	case s != nil:
+		w.sb.WriteString(s.text[:s.val])
+	case c.Kind == IncludeNode:
+		w.sb.WriteString("include ")
+		w.sb.WriteString(c.Raw)
+		w.lineEnd(c.Comment)
+		return
+	case p.Kind == MapNode:
+		w.sb.WriteString(quoteKey(c.Key))
+		if c.Kind == MapNode {
+			w.sb.WriteByte(' ')
+		} else {
+			w.sb.WriteString(": ")
+		}
+	}
+	w.value(c, 0, p.Kind == ArrayNode)
+}
+
+// trail writes the rest of the line of a parsed node, as parsed if its
+// comment is unchanged.
+func (w *docWriter) trail(n *Node) {
+	if n.Comment == n.src.comment {
+		w.sb.WriteString(n.src.trail)
+	} else {
+		w.lineEnd(n.Comment)
+	}
+}
+
+// lineEnd ends the current line with the comment, if any.
+func (w *docWriter) lineEnd(comment string) {
+	if comment != "" {
+		w.sb.WriteByte(' ')
+		w.sb.WriteString(comment)
+	}
+	w.sb.WriteByte('\n')
+}
+
+// comments writes comment lines. Blank lines are skipped at the start
+// of a block, and at its end when last is true.
+func (w *docWriter) comments(lines []string, depth int, first, last bool) {
+	for first && len(lines) > 0 && lines[0] == "" {
+		lines = lines[1:]
+	}
+	for last && len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for _, l := range lines {
+		if l != "" {
+			w.indent(depth)
+			w.sb.WriteString(l)
+		}
+		w.sb.WriteByte('\n')
+	}
+}
+
+// entries writes the entries of a map, one per line.
+func (w *docWriter) entries(n *Node, depth int) {
+	for i, c := range n.Children {
+		w.comments(c.Comments, depth, i == 0, false)
+		w.indent(depth)
+		if c.Kind == IncludeNode {
+			w.sb.WriteString("include ")
+			w.sb.WriteString(c.Raw)
+			w.lineEnd(c.Comment)
+			continue
+		}
+		w.sb.WriteString(quoteKey(c.Key))
+		if c.Kind == MapNode {
+			w.sb.WriteByte(' ')
+		} else {
+			w.sb.WriteString(": ")
+		}
+		w.value(c, depth, false)
+	}
+	w.comments(n.EndComments, depth, len(n.Children) == 0, true)
+}
+
+// value writes a value, starting on the current line, along with the
+// rest of its last line.
+func (w *docWriter) value(n *Node, depth int, elem bool) {
+	if n.Kind != MapNode && n.Kind != ArrayNode {
+		w.sb.WriteString(n.Raw)
+		w.lineEnd(n.Comment)
+		return
+	}
+	if s, ok := inline(n, elem); ok {
+		w.sb.WriteString(s)
+		w.lineEnd(n.Comment)
+		return
+	}
+	if n.Kind == MapNode {
+		w.sb.WriteByte(mapStart)
+		w.lineEnd(n.Comment)
+		w.entries(n, depth+1)
+		w.indent(depth)
+		w.sb.WriteByte(mapEnd)
+		w.sb.WriteByte('\n')
+		return
+	}
+	w.sb.WriteByte(arrayStart)
+	w.lineEnd(n.Comment)
+	for i, c := range n.Children {
+		w.comments(c.Comments, depth+1, i == 0, false)
+		w.indent(depth + 1)
+		w.value(c, depth+1, true)
+	}
+	w.comments(n.EndComments, depth+1, len(n.Children) == 0, true)
+	w.indent(depth)
+	w.sb.WriteByte(arrayEnd)
+	w.sb.WriteByte('\n')
+}
+
+// inline returns the single line form of a map or an array, if it can
+// be written that way. Maps are only written inline as array elements,
+// or when empty.
+func inline(n *Node, elem bool) (string, bool) {
+	if len(n.EndComments) > 0 || (n.Kind == MapNode && !elem && len(n.Children) > 0) {
+		return "", false
+	}
+	parts := make([]string, 0, len(n.Children))
+	for _, c := range n.Children {
+		switch {
+		case c.Kind == MapNode, c.Kind == ArrayNode, c.Kind == IncludeNode,
+			len(c.Comments) > 0, c.Comment != "", strings.ContainsAny(c.Raw, "\r\n"):
+			return "", false
+		case n.Kind == MapNode:
+			parts = append(parts, quoteKey(c.Key)+": "+c.Raw)
+		default:
+			parts = append(parts, c.Raw)
+		}
+	}
+	var s string
+	if n.Kind == MapNode {
+		s = string(mapStart) + strings.Join(parts, ", ") + string(mapEnd)
+	} else {
+		s = string(arrayStart) + strings.Join(parts, ", ") + string(arrayEnd)
+	}
+	if len(s) > maxInlineLength {
+		return "", false
+	}
+	return s, true
+}
+
+// changed tells whether n or its children have been changed since they
+// were parsed.
+func (n *Node) changed() bool {
+	s := n.src
+	if s == nil || n.Kind != s.kind || n.Key != s.key || n.Raw != s.raw || n.Comment != s.comment ||
+		!equalLines(n.Comments, s.comments) || !equalLines(n.EndComments, s.endComments) ||
+		len(n.Children) != len(s.children) {
+		return true
+	}
+	for i, c := range n.Children {
+		if c != s.children[i] || c.changed() {
+			return true
+		}
+	}
+	return false
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteKey returns the key, quoted if it would not be parsed back
+// as the same key otherwise.
+func quoteKey(key string) string {
+	bare := key != "" && !strings.EqualFold(key, "include")
+	for _, r := range key {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			bare = false
+			break
+		}
+	}
+	if bare {
+		return key
+	}
+	if strings.ContainsRune(key, dqStringStart) {
+		return string(sqStringStart) + key + string(sqStringEnd)
+	}
+	return string(dqStringStart) + key + string(dqStringEnd)
+}
@@ -49,6 +49,10 @@ const PERMISSIONS_ERR = "permissions violation"
 // AUTHORIZATION_ERR is for when gmessage server user authorization has failed.
 const AUTHORIZATION_ERR = "authorization violation"
 
+// SLOW_CONSUMER_ERR is for when the gmessage server dropped messages to this
+// connection as per its slow consumer policy.
+const SLOW_CONSUMER_ERR = "slow consumer"
+
 // Errors
 var (
 	ErrConnectionClosed     = errors.New("gmessage: connection closed")
@@ -74,6 +78,7 @@ var (
 	ErrInvalidMsg           = errors.New("gmessage: invalid message or message nil")
 	ErrInvalidArg           = errors.New("gmessage: invalid argument")
 	ErrInvalidContext       = errors.New("gmessage: invalid context")
+	ErrRebalance            = errors.New("gmessage: server asked to reconnect to another server")
 	ErrStaleConnection      = errors.New("gmessage: " + STALE_CONNECTION)
 )
 
@@ -278,6 +283,20 @@ type Options struct {
 	// a new Inbox and a new Subscription for each request.
 	// 28
 	UseOldRequestStyle bool
+
+	// QueueWeight is the weight of the queue subscriptions of this
+	// connection relative to the other members of their groups. The
+	// server delivers proportionally more messages to heavier members.
+	// 29
+	QueueWeight int
+
+	// SlowConsumerPolicy asks the server to drop messages instead of
+	// closing the connection when this client can not keep up with them:
+	// "drop_newest", "drop_oldest" or "pause". The server default, or the
+	// one of the user, is used if empty. When set, dropped messages are
+	// reported to the AsyncErrorCB with ErrSlowConsumer.
+	// 30
+	SlowConsumerPolicy string
 }
 
 const (
@@ -422,6 +441,7 @@ type serverInfo struct {
 	TLSRequired  bool     `json:"tls_required"`
 	MaxPayload   int64    `json:"max_payload"`
 	ConnectURLs  []string `json:"connect_urls,omitempty"`
+	Rebalance    bool     `json:"rebalance,omitempty"`
 }
 
 const (
@@ -444,6 +464,8 @@ type connectInfo struct {
 	Lang     string `json:"lang"`
 	Version  string `json:"version"`
 	Protocol int    `json:"protocol"`
+	Weight   int    `json:"queue_weight,omitempty"`
+	SCPolicy string `json:"slow_consumer_policy,omitempty"`
 }
 
 // MsgHandler is a callback function that processes messages delivered to
@@ -681,6 +703,24 @@ func UseOldRequestStyle() Option {
 	}
 }
 
+// QueueWeight is an Option to set the weight of the queue subscriptions
+// of the connection.
+func QueueWeight(weight int) Option {
+	return func(o *Options) error {
+		o.QueueWeight = weight
+		return nil
+	}
+}
+
+// SlowConsumerPolicy is an Option to set the policy the server applies when
+// the connection can not keep up with the messages delivered to it.
+func SlowConsumerPolicy(policy string) Option {
+	return func(o *Options) error {
+		o.SlowConsumerPolicy = policy
+		return nil
+	}
+}
+
 // Handler processing
 
 // SetDisconnectHandler will set the disconnect event handler.
@@ -866,6 +906,16 @@ func (nc *Conn) pickServer() error {
 
 const tlsScheme = "tls"
 
+// unixScheme is the scheme of the URLs of servers listening on a unix
+// domain socket, like unix:///var/run/gmessage.sock.
+const unixScheme = "unix"
+
+// unixSocketPath returns the path of the socket of a unix URL. It can be
+// relative when the URL is written unix://gmessage.sock.
+func unixSocketPath(u *url.URL) string {
+	return u.Host + u.Path
+}
+
 // Create the server pool using the options given.
 // We will place a Url option first, followed by any
 // Server Options. We will randomize the server pool unless
@@ -928,7 +978,10 @@ func (nc *Conn) addURLToPool(sURL string, implicit bool) error {
 	}
 	s := &srv{url: u, isImplicit: implicit}
 	nc.srvPool = append(nc.srvPool, s)
-	nc.urls[u.Host] = struct{}{}
+	// Servers discovered through INFO are never unix domain sockets.
+	if u.Scheme != unixScheme {
+		nc.urls[u.Host] = struct{}{}
+	}
 	return nil
 }
 
@@ -965,7 +1018,11 @@ func (nc *Conn) createConn() (err error) {
 	if dialer == nil {
 		dialer = nc.Opts.Dialer
 	}
-	nc.conn, err = dialer.Dial("tcp", nc.url.Host)
+	network, addr := "tcp", nc.url.Host
+	if nc.url.Scheme == unixScheme {
+		network, addr = "unix", unixSocketPath(nc.url)
+	}
+	nc.conn, err = dialer.Dial(network, addr)
 	if err != nil {
 		return err
 	}
@@ -1225,7 +1282,7 @@ func (nc *Conn) connectProto() (string, error) {
 	}
 	cinfo := connectInfo{o.Verbose, o.Pedantic,
 		user, pass, token,
-		o.Secure, o.Name, LangString, Version, clientProtoInfo}
+		o.Secure, o.Name, LangString, Version, clientProtoInfo, o.QueueWeight, o.SlowConsumerPolicy}
 	b, err := json.Marshal(cinfo)
 	if err != nil {
 		return _EMPTY_, ErrJsonParse
@@ -1857,6 +1914,16 @@ func (nc *Conn) processPermissionsViolation(err string) {
 	nc.mu.Unlock()
 }
 
+// processSlowConsumerDrops is called when the server signals that it dropped
+// messages to this connection. The connection remains usable.
+func (nc *Conn) processSlowConsumerDrops() {
+	nc.mu.Lock()
+	if nc.Opts.AsyncErrorCB != nil {
+		nc.ach.push(func() { nc.Opts.AsyncErrorCB(nc, nil, ErrSlowConsumer) })
+	}
+	nc.mu.Unlock()
+}
+
 // processAuthorizationViolation is called when the server signals a user
 // authorization violation.
 func (nc *Conn) processAuthorizationViolation(err string) {
@@ -2023,7 +2090,13 @@ func (nc *Conn) processAsyncInfo(info []byte) {
 	nc.mu.Lock()
 	// Ignore errors, we will simply not update the server pool...
 	nc.processInfo(string(info))
+	// The server asks us to move to another server of the cluster, which
+	// we do if we are allowed to reconnect and know of another one.
+	rebalance := nc.info.Rebalance && nc.Opts.AllowReconnect && len(nc.srvPool) > 1
 	nc.mu.Unlock()
+	if rebalance {
+		nc.processOpErr(ErrRebalance)
+	}
 }
 
 // LastError reports the last error encountered via the connection.
@@ -2045,9 +2118,10 @@ func (nc *Conn) processErr(e string) {
 	// Trim, remove quotes, convert to lower case.
 	e = normalizeErr(e)
 
-	// FIXME(dlc) - process Slow Consumer signals special.
 	if e == STALE_CONNECTION {
 		nc.processOpErr(ErrStaleConnection)
+	} else if strings.HasPrefix(e, SLOW_CONSUMER_ERR) {
+		nc.processSlowConsumerDrops()
 	} else if strings.HasPrefix(e, PERMISSIONS_ERR) {
 		nc.processPermissionsViolation(e)
 	} else if strings.HasPrefix(e, AUTHORIZATION_ERR) {
@@ -3090,6 +3164,10 @@ func (nc *Conn) getServers(implicitOnly bool) []string {
 			continue
 		}
 		url := nc.srvPool[i].url
+		if url.Scheme == unixScheme {
+			servers = append(servers, fmt.Sprintf("%s://%s", url.Scheme, unixSocketPath(url)))
+			continue
+		}
 		servers = append(servers, fmt.Sprintf("%s://%s", url.Scheme, url.Host))
 	}
 	return servers
@@ -10,6 +10,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
@@ -1120,6 +1123,72 @@ func TestConnAsyncCBDeadlock(t *testing.T) {
 	}
 }
 
+func TestSlowConsumerDropsErr(t *testing.T) {
+	s := RunServerOnPort(TEST_PORT)
+	defer s.Shutdown()
+
+	ch := make(chan error, 1)
+	o := GetDefaultOptions()
+	o.Url = fmt.Sprintf("gmessage://127.0.0.1:%d", TEST_PORT)
+	o.AsyncErrorCB = func(_ *Conn, _ *Subscription, err error) {
+		ch <- err
+	}
+	nc, err := o.Connect()
+	if err != nil {
+		t.Fatalf("Should have connected ok: %v", err)
+	}
+	defer nc.Close()
+
+	// Drops are reported without closing the connection.
+	nc.processErr("'Slow Consumer, Messages Dropped'")
+	select {
+	case err := <-ch:
+		if err != ErrSlowConsumer {
+			t.Fatalf("Expected %v, got %v", ErrSlowConsumer, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected an async error")
+	}
+	if nc.IsClosed() || nc.LastError() != nil {
+		t.Fatalf("Expected the connection to remain usable: %v", nc.LastError())
+	}
+}
+
+func TestUnixSocketURL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gio")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gm.sock")
+
+	opts := giotest.DefaultTestOptions
+	opts.Port = TEST_PORT
+	opts.UnixSocket = path
+	s := RunServerWithOptions(opts)
+	defer s.Shutdown()
+
+	nc, err := Connect("unix://" + path)
+	if err != nil {
+		t.Fatalf("Should have connected ok: %v", err)
+	}
+	defer nc.Close()
+	if servers := nc.Servers(); len(servers) != 1 || servers[0] != "unix://"+path {
+		t.Fatalf("Unexpected servers: %v", servers)
+	}
+	if url := nc.ConnectedUrl(); url != "unix://"+path {
+		t.Fatalf("Unexpected connected url: %q", url)
+	}
+	sub, err := nc.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	nc.Publish("foo", []byte("hello"))
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error receiving message: %v", err)
+	}
+}
+
 func TestPingTimerLeakedOnClose(t *testing.T) {
 	s := RunServerOnPort(TEST_PORT)
 	defer s.Shutdown()
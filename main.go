@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"os"
 
+	"github.com/elitecodegroovy/gmessage/conf"
 	"github.com/elitecodegroovy/gmessage/server"
 )
 
@@ -22,8 +25,10 @@ var usageStr = `
     -m, --http_port <port>           http监控端口
     -ms,--https_port <port>          https监控端口
     -c, --config <file>              配置文件
-    -sl,--signal <signal>[=<pid>]    发送信号给系统进程 (停止、退出、重新打开，重新加载)
+    -t, --test-config                测试配置文件并退出
+    -sl,--signal <signal>[=<pid>]    发送信号给系统进程 (停止、退出、优雅退出、升级、重新打开，重新加载)
         --client_advertise <string>  客户端的URL告知给其他服务器
+        --unix_socket <path>         本地客户端的Unix域套接字
 
 日志可选项:
     -l, --log <file>                 文件重定向到日志输出
@@ -58,6 +63,19 @@ TLS可选项:
     -h, --help                       显示这个消息
     -v, --version                    显示版本
         --help_tls                   TLS 帮助
+
+命令:
+    conf fmt [-w] [-l] <file> ...    以规范格式重新格式化配置文件
+`
+
+var confUsageStr = `
+使用: gmessage conf fmt [可选项] <file> ...
+
+以规范格式重新格式化配置文件, 保留注释和顺序。默认输出到标准输出。
+
+可选项:
+    -w                               将结果写回源文件
+    -l                               列出格式与规范格式不同的文件
 `
 
 // usage will print out the flag options for the server.
@@ -78,7 +96,95 @@ func PrintAndExit(msg string) {
 	os.Exit(1)
 }
 
+// checkConfigAndExit reports all problems found in the configuration file
+// and exits with a non-zero status if there is any.
+func checkConfigAndExit(configFile string) {
+	cc := server.CheckConfigFile(configFile)
+	for _, inc := range cc.Includes {
+		fmt.Printf("%s: include %q\n", inc.Pos, inc.Name)
+	}
+	for _, env := range cc.Env {
+		fmt.Printf("%s: environment variable %q\n", env.Pos, env.Name)
+	}
+	for _, file := range cc.Files {
+		fmt.Printf("%s: file %q\n", file.Pos, file.Name)
+	}
+	for _, p := range cc.Problems {
+		fmt.Fprintf(os.Stderr, "%s\n", p)
+	}
+	if len(cc.Problems) > 0 {
+		PrintAndExit(fmt.Sprintf("configuration file %s test failed: %d problem(s)", configFile, len(cc.Problems)))
+	}
+	fmt.Printf("configuration file %s test is successful\n", configFile)
+	os.Exit(0)
+}
+
+// runConfCommand runs the conf subcommand and returns the exit status.
+func runConfCommand(args []string) int {
+	if len(args) == 0 || args[0] != "fmt" {
+		fmt.Fprintf(os.Stderr, "%s\n", confUsageStr)
+		return 2
+	}
+	fs := flag.NewFlagSet("gmessage conf fmt", flag.ExitOnError)
+	fs.Usage = func() { fmt.Fprintf(os.Stderr, "%s\n", confUsageStr) }
+	write := fs.Bool("w", false, "Write result to the source file.")
+	list := fs.Bool("l", false, "List files whose formatting differs.")
+	fs.Parse(args[1:])
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	status := 0
+	for _, file := range fs.Args() {
+		if err := formatConfFile(file, *write, *list); err != nil {
+			if pe, ok := err.(*conf.ParseError); ok {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", pe.Pos, pe.Reason)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", file, err)
+			}
+			status = 1
+		}
+	}
+	return status
+}
+
+// formatConfFile formats a configuration file, printing the result
+// unless the file is rewritten or only listed.
+func formatConfFile(file string, write, list bool) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	d, err := conf.ParseDocumentFile(file)
+	if err != nil {
+		return err
+	}
+	out := []byte(d.Format())
+	changed := !bytes.Equal(data, out)
+	if list && changed {
+		fmt.Println(file)
+	}
+	if write {
+		if !changed {
+			return nil
+		}
+		fi, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(file, out, fi.Mode().Perm())
+	}
+	if !list {
+		os.Stdout.Write(out)
+	}
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "conf" {
+		os.Exit(runConfCommand(os.Args[2:]))
+	}
+
 	// Create a FlagSet and sets the usage
 	fs := flag.NewFlagSet("gmesssage-server", flag.ExitOnError)
 
@@ -91,6 +197,11 @@ func main() {
 		PrintAndExit(err.Error() + "\n" + usageStr)
 	}
 
+	// Test the configuration file and exit.
+	if opts.CheckConfig {
+		checkConfigAndExit(opts.ConfigFile)
+	}
+
 	// Create the server with appropriate options.
 	s := server.New(opts)
 
@@ -20,6 +20,9 @@ type ClientAuthentication interface {
 	GetOpts() *clientOpts
 	// If TLS is enabled, TLS ConnectionState, nil otherwise
 	GetTLSConnectionState() *tls.ConnectionState
+	// If connected through a unix domain socket, the credentials of the
+	// peer process where supported, nil otherwise
+	GetPeerCredentials() *PeerCredentials
 	// Optionally map a user after auth.
 	RegisterUser(*User)
 }
@@ -29,6 +32,17 @@ type User struct {
 	Username    string       `json:"user"`
 	Password    string       `json:"password"`
 	Permissions *Permissions `json:"permissions"`
+
+	// SlowConsumerPolicy overrides the server's for the user's connections.
+	SlowConsumerPolicy SlowConsumerPolicy `json:"slow_consumer_policy,omitempty"`
+
+	// MaxConnections and MaxSubscriptions override the server's limits
+	// for the user, if set.
+	MaxConnections   int `json:"max_connections,omitempty"`
+	MaxSubscriptions int `json:"max_subscriptions,omitempty"`
+
+	// AllowedCIDRs restricts the networks the user can connect from.
+	AllowedCIDRs []string `json:"allowed_cidrs,omitempty"`
 }
 
 // clone performs a deep copy of the User struct, returning a new clone with
@@ -40,6 +54,10 @@ func (u *User) clone() *User {
 	clone := &User{}
 	*clone = *u
 	clone.Permissions = u.Permissions.clone()
+	if u.AllowedCIDRs != nil {
+		clone.AllowedCIDRs = make([]string, len(u.AllowedCIDRs))
+		copy(clone.AllowedCIDRs, u.AllowedCIDRs)
+	}
 	return clone
 }
 
@@ -142,7 +160,7 @@ func (s *Server) isClientAuthorized(c *client) bool {
 		if !ok {
 			return false
 		}
-		ok = comparePasswords(user.Password, c.opts.Password)
+		ok = comparePasswords(user.Password, c.opts.Password) && isUserIPAllowed(user, c)
 		// If we are authorized, register the user which will properly setup any permissions
 		// for pub/sub authorizations.
 		if ok {
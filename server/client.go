@@ -19,6 +19,8 @@ const (
 	CLIENT = iota
 	// ROUTER is another router in the cluster.
 	ROUTER
+	// SYSTEM is an internal client used by the server to publish its own messages.
+	SYSTEM
 )
 
 const (
@@ -59,6 +61,8 @@ const (
 	handshakeComplete                        // For TLS clients, indicate that the handshake is complete
 	clearConnection                          // Marks that clearConnection has already been called.
 	flushOutbound                            // Marks client as having a flushOutbound call in progress.
+	slowConsumer                             // Marks client as having been detected as a slow consumer.
+	rebalanceSent                            // Marks client as asked to reconnect to another server.
 )
 
 // set the flag (would be equivalent to set the boolean to true)
@@ -112,6 +116,9 @@ const (
 	DuplicateRoute
 	RouteRemoved
 	ServerShutdown
+	MaxSubscriptionsExceeded
+	MaxUserConnectionsExceeded
+	MaxIPConnectionsExceeded
 )
 
 type client struct {
@@ -147,6 +154,25 @@ type client struct {
 	trace bool
 	echo  bool
 
+	// Slow consumer policies of the user and asked for by the connection,
+	// and number of messages dropped as per the policy in effect.
+	uscp       SlowConsumerPolicy
+	cscp       SlowConsumerPolicy
+	outDropped int64
+
+	// Maximum subscriptions of the user, overriding the server's, and what
+	// the connection is counted under for the connection limits.
+	umsubs int
+	climit *connLimitKey
+
+	// Credentials of the peer process of unix domain socket connections.
+	pcred *PeerCredentials
+
+	// Client description for the message hook, and message being processed
+	// as seen by it, only when a hook is set.
+	hc *HookClient
+	hm *HookMsg
+
 	flags clientFlag // Compact booleans into a single field. Size will be increased when needed.
 }
 
@@ -170,6 +196,10 @@ type outbound struct {
 	mp  int64         // snapshot of max pending.
 	wdl time.Duration // Snapshot fo write deadline.
 	lft time.Duration // Last flush time.
+
+	scp SlowConsumerPolicy // Snapshot of the slow consumer policy.
+	dq  [][]byte           // Messages that can still be dropped, for the drop oldest policy.
+	stc chan struct{}      // Closed when caught up, for the producers paused by the pause policy.
 }
 
 type permissions struct {
@@ -194,6 +224,11 @@ type readCache struct {
 	subs    int
 	rsz     int // Read buffer size
 	srs     int // Short reads, used for dynamic buffer resizing.
+
+	stc chan struct{} // Set when a slow consumer asks to pause reading.
+
+	zstart bool   // Set when the remote of a route starts compressing.
+	zrest  []byte // The compressed data after the INFO that started it.
 }
 
 func (c *client) String() (id string) {
@@ -222,6 +257,27 @@ type subscription struct {
 	sid     []byte
 	nm      int64
 	max     int64
+	weight  int                // Weight of a queue subscription, set from CONNECT or the route sid.
+	phash   uint64             // Member hash of a queue subscription, for partitioned groups.
+	icb     internalMsgHandler // Only for internal subscriptions.
+	hook    *HookSubscription  // Only for client subscriptions, when a message hook is set.
+}
+
+// isRemote returns true if the subscription is from a route.
+func (s *subscription) isRemote() bool {
+	return s.client != nil && s.client.typ == ROUTER
+}
+
+// queueWeight returns the weight of a queue subscription, relative to
+// the other members of its group.
+func (s *subscription) queueWeight() int {
+	switch {
+	case s.weight < 1:
+		return 1
+	case s.weight > MAX_QUEUE_WEIGHT:
+		return MAX_QUEUE_WEIGHT
+	}
+	return s.weight
 }
 
 type clientOpts struct {
@@ -236,6 +292,9 @@ type clientOpts struct {
 	Lang          string `json:"lang"`
 	Version       string `json:"version"`
 	Protocol      int    `json:"protocol"`
+	QueueWeight   int    `json:"queue_weight,omitempty"`
+
+	SlowConsumerPolicy string `json:"slow_consumer_policy,omitempty"`
 }
 
 var defaultOpts = clientOpts{Verbose: true, Pedantic: true, Echo: true}
@@ -256,6 +315,7 @@ func (c *client) initClient() {
 	// Snapshots to avoid mutex access in fast paths.
 	c.out.wdl = opts.WriteDeadline
 	c.out.mp = opts.MaxPending
+	c.applySlowConsumerPolicy(opts.SlowConsumerPolicy)
 
 	c.subs = make(map[string]*subscription)
 	c.echo = true
@@ -274,9 +334,16 @@ func (c *client) initClient() {
 
 	// snapshot the string version of the connection
 	conn := "-"
-	if ip, ok := c.nc.(*net.TCPConn); ok {
-		addr := ip.RemoteAddr().(*net.TCPAddr)
+	switch nc := c.nc.(type) {
+	case *net.TCPConn, *proxyConn:
+		addr := nc.RemoteAddr().(*net.TCPAddr)
 		conn = fmt.Sprintf("%s:%d", addr.IP, addr.Port)
+	case *net.UnixConn:
+		conn = "unix"
+		if pcred, err := peerCredentials(nc); err == nil {
+			c.pcred = pcred
+			conn = fmt.Sprintf("unix:%d", pcred.PID)
+		}
 	}
 
 	switch c.typ {
@@ -291,6 +358,19 @@ func (c *client) initClient() {
 // with the authenticated user. This is used to map any permissions
 // into the client.
 func (c *client) RegisterUser(user *User) {
+	c.mu.Lock()
+	c.uscp = user.SlowConsumerPolicy
+	c.umsubs = user.MaxSubscriptions
+	if c.srv != nil {
+		opts := c.srv.getOpts()
+		c.applySlowConsumerPolicy(opts.SlowConsumerPolicy)
+		c.msubs = opts.MaxSubs
+	}
+	if c.umsubs > 0 {
+		c.msubs = c.umsubs
+	}
+	c.mu.Unlock()
+
 	if user.Permissions == nil {
 		// Reset perms to nil in case client previously had them.
 		c.mu.Lock()
@@ -376,8 +456,11 @@ func (c *client) readLoop() {
 	// Start read buffer.
 	b := make([]byte, c.in.rsz)
 
+	// Replaced by a decompressing reader if a route starts compressing.
+	var r io.Reader = nc
+
 	for {
-		n, err := nc.Read(b)
+		n, err := r.Read(b)
 		if err != nil {
 			if err == io.EOF {
 				c.closeConnection(ClientClosed)
@@ -406,6 +489,13 @@ func (c *client) readLoop() {
 			return
 		}
 
+		// The remote of the route started compressing, what is left of
+		// the buffer and all that follows is compressed.
+		if c.in.zstart {
+			r = c.newDecompressReader(nc, c.in.zrest)
+			c.in.zstart, c.in.zrest = false, nil
+		}
+
 		// Updates stats for client and server that were collected
 		// from parsing through the buffer.
 		if c.in.msgs > 0 {
@@ -430,7 +520,9 @@ func (c *client) readLoop() {
 			// Update last activity for message delivery
 			cp.last = last
 			cp.out.fsp--
-			if budget > 0 && cp.flushOutbound() {
+			// Clients that are not closed as slow consumers are left to their
+			// write loop, so that we do not block on them.
+			if budget > 0 && cp.out.scp <= SlowConsumerClose && cp.flushOutbound() {
 				budget -= cp.out.lft
 			} else {
 				cp.flushSignal()
@@ -439,6 +531,12 @@ func (c *client) readLoop() {
 			delete(c.pcd, cp)
 		}
 
+		// Pause while a slow consumer we published to catches up.
+		if c.in.stc != nil {
+			c.waitStalled(c.in.stc)
+			c.in.stc = nil
+		}
+
 		// Update activity, check read buffer size.
 		c.mu.Lock()
 		nc := c.nc
@@ -511,6 +609,9 @@ func (c *client) flushOutbound() bool {
 	// Snapshot opts
 	srv := c.srv
 
+	// Messages being written can no longer be dropped.
+	c.releaseDropQueue()
+
 	// Place primary on nb, assign primary to secondary, nil out nb and secondary.
 	nb := c.collapsePtoNB()
 	c.out.p, c.out.nb, c.out.s = c.out.s, nil, nil
@@ -522,6 +623,10 @@ func (c *client) flushOutbound() bool {
 	nc := c.nc
 	attempted := c.out.pb
 	apm := c.out.pm
+	var cw *compressWriter
+	if c.route != nil && c.route.comp != nil {
+		cw = c.route.comp.out
+	}
 
 	// Do NOT hold lock during actual IO
 	c.mu.Unlock()
@@ -532,7 +637,13 @@ func (c *client) flushOutbound() bool {
 	// most platforms, need to account for that with deadline?
 	nc.SetWriteDeadline(now.Add(c.out.wdl))
 	// Actual write to the socket.
-	n, err := nb.WriteTo(nc)
+	var n int64
+	var err error
+	if cw != nil {
+		n, err = cw.write(nb)
+	} else {
+		n, err = nb.WriteTo(nc)
+	}
 	nc.SetWriteDeadline(time.Time{})
 	lft := time.Since(now)
 
@@ -554,11 +665,23 @@ func (c *client) flushOutbound() bool {
 	}
 
 	if err != nil {
+		ne, ok := err.(net.Error)
+		timeout := ok && ne.Timeout()
+		// Clients that are not closed as slow consumers keep what could
+		// not be written, their policy applies to further messages.
+		if timeout && c.out.scp > SlowConsumerClose {
+			if n == 0 {
+				c.handlePartialWrite(nb)
+			}
+			c.Debugf("WriteDeadline of %v Exceeded, %d bytes pending", c.out.wdl, c.out.pb)
+			return true
+		}
 		if n == 0 {
 			c.out.pb -= attempted
 		}
-		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		if timeout {
 			atomic.AddInt64(&srv.slowConsumers, 1)
+			c.flags.set(slowConsumer)
 			c.clearConnection(SlowConsumerWriteDeadline)
 			c.Noticef("Slow Consumer Detected: WriteDeadline of %v Exceeded", c.out.wdl)
 		} else {
@@ -568,6 +691,11 @@ func (c *client) flushOutbound() bool {
 		return true
 	}
 
+	// Resume paused producers if we caught up.
+	if c.flags.isSet(slowConsumer) {
+		c.caughtUp()
+	}
+
 	// Adjust based on what we wrote plus any pending.
 	pt := int(n + c.out.pb)
 
@@ -696,6 +824,16 @@ func (c *client) processConnect(arg []byte) error {
 	proto := c.opts.Protocol
 	verbose := c.opts.Verbose
 	lang := c.opts.Lang
+	if c.opts.SlowConsumerPolicy != "" {
+		scp, err := parseSlowConsumerPolicy(c.opts.SlowConsumerPolicy)
+		if err != nil {
+			c.mu.Unlock()
+			c.sendErr(err.Error())
+			c.closeConnection(ProtocolViolation)
+			return err
+		}
+		c.cscp = scp
+	}
 	c.mu.Unlock()
 
 	if srv != nil {
@@ -714,6 +852,18 @@ func (c *client) processConnect(arg []byte) error {
 			c.authViolation()
 			return ErrAuthorization
 		}
+
+		c.mu.Lock()
+		c.applySlowConsumerPolicy(srv.getOpts().SlowConsumerPolicy)
+		c.mu.Unlock()
+
+		// Check the connection limits now that the user is known.
+		if typ == CLIENT {
+			if state, err := srv.registerConnLimits(c); err != nil {
+				c.connLimitExceeded(err, state)
+				return err
+			}
+		}
 	}
 
 	// Check client protocol request if it exists.
@@ -766,6 +916,12 @@ func (c *client) maxConnExceeded() {
 	c.closeConnection(MaxConnectionsExceeded)
 }
 
+func (c *client) connLimitExceeded(err error, state ClosedState) {
+	c.Errorf(err.Error())
+	c.sendErr(err.Error())
+	c.closeConnection(state)
+}
+
 func (c *client) maxSubsExceeded() {
 	c.Errorf(ErrTooManySubs.Error())
 	c.sendErr(ErrTooManySubs.Error())
@@ -781,12 +937,18 @@ func (c *client) maxPayloadViolation(sz int, max int64) {
 // Return pending length.
 // Lock should be held.
 func (c *client) queueOutbound(data []byte) {
+	// Keep in order with the messages that could still be dropped.
+	if len(c.out.dq) > 0 {
+		c.releaseDropQueue()
+	}
+
 	// Add to pending bytes total.
 	c.out.pb += int64(len(data))
 
 	// Check for slow consumer via pending bytes limit.
 	// ok to return here, client is going away.
-	if c.out.pb > c.out.mp {
+	if c.overMaxPending() {
+		c.flags.set(slowConsumer)
 		c.clearConnection(SlowConsumerPendingBytes)
 		atomic.AddInt64(&c.srv.slowConsumers, 1)
 		c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", c.out.mp)
@@ -961,6 +1123,9 @@ func (c *client) processPong() {
 	c.mu.Lock()
 	c.ping.out = 0
 	c.rtt = time.Since(c.rttStart)
+	if c.route != nil {
+		c.checkAutoCompression()
+	}
 	c.mu.Unlock()
 }
 
@@ -1122,6 +1287,14 @@ func (c *client) processSub(argo []byte) (err error) {
 		c.mu.Unlock()
 		return nil
 	}
+	if sub.queue != nil {
+		if c.typ == ROUTER {
+			sub.weight = routeSidWeight(sub.sid)
+		} else {
+			sub.weight = c.opts.QueueWeight
+		}
+		sub.phash = c.partitionMemberHash(sub)
+	}
 
 	// Check permissions if applicable.
 	if c.typ == ROUTER {
@@ -1147,6 +1320,30 @@ func (c *client) processSub(argo []byte) (err error) {
 	// We can have two SUB protocols coming from a route due to some
 	// race conditions. We should make sure that we process only one.
 	sid := string(sub.sid)
+
+	// The message hook is called without the lock.
+	if c.typ == CLIENT && c.srv != nil && c.srv.hook != nil && c.subs[sid] == nil {
+		sub.hook = &HookSubscription{
+			Client:  c.hookClient(),
+			Subject: string(sub.subject),
+			Queue:   string(sub.queue),
+			Sid:     sid,
+		}
+		c.mu.Unlock()
+		if !c.srv.hook.OnSubscribe(sub.hook) {
+			// Reported like permissions, which clients do not treat as fatal.
+			c.sendErr(fmt.Sprintf("Permissions Violation for Subscription to %q", sub.subject))
+			c.Debugf("Subscription refused by the message hook - Subject %q, SID %s", sub.subject, sub.sid)
+			return nil
+		}
+		c.mu.Lock()
+		if c.nc == nil {
+			c.mu.Unlock()
+			c.srv.hook.OnUnsubscribe(sub.hook)
+			return nil
+		}
+	}
+
 	if c.subs[sid] == nil {
 		c.subs[sid] = sub
 		if c.srv != nil {
@@ -1160,6 +1357,9 @@ func (c *client) processSub(argo []byte) (err error) {
 	}
 	c.mu.Unlock()
 	if err != nil {
+		if sub.hook != nil {
+			c.srv.hook.OnUnsubscribe(sub.hook)
+		}
 		c.sendErr("Invalid Subject")
 		return nil
 	} else if c.opts.Verbose {
@@ -1173,10 +1373,11 @@ func (c *client) processSub(argo []byte) (err error) {
 }
 
 // canSubscribe determines if the client is authorized to subscribe to the
-// given subject. Assumes caller is holding lock.
+// given subject. System requests require an explicit subscribe permission.
+// Assumes caller is holding lock.
 func (c *client) canSubscribe(sub []byte) bool {
 	if c.perms == nil {
-		return true
+		return !isSysRequestSubject(sub)
 	}
 	return len(c.perms.sub.Match(string(sub)).psubs) > 0
 }
@@ -1184,15 +1385,18 @@ func (c *client) canSubscribe(sub []byte) bool {
 // Low level unsubscribe for a given client.
 func (c *client) unsubscribe(sub *subscription) {
 	c.mu.Lock()
-	defer c.mu.Unlock()
 	if sub.max > 0 && sub.nm < sub.max {
 		c.Debugf(
 			"Deferring actual UNSUB(%s): %d max, %d received\n",
 			string(sub.subject), sub.max, sub.nm)
+		c.mu.Unlock()
 		return
 	}
 	c.traceOp("<-> %s", "DELSUB", sub.sid)
 
+	// The hook is told when the connection is closed otherwise, and only
+	// once per subscription.
+	hooked := sub.hook != nil && c.nc != nil && c.subs[string(sub.sid)] == sub
 	delete(c.subs, string(sub.sid))
 	if c.srv != nil {
 		c.srv.sl.Remove(sub)
@@ -1206,6 +1410,11 @@ func (c *client) unsubscribe(sub *subscription) {
 	if c.typ == CLIENT && c.srv != nil && len(sub.queue) > 0 {
 		c.srv.holdRemoteQSub(sub)
 	}
+	c.mu.Unlock()
+
+	if hooked {
+		c.srv.hook.OnUnsubscribe(sub.hook)
+	}
 }
 
 func (c *client) processUnsub(arg []byte) error {
@@ -1288,24 +1497,36 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) bool {
 		return false
 	}
 
+	// System requests are only delivered to the clients explicitly
+	// subscribed to them, see isSysRequestSubject.
+	if client.typ == CLIENT && isSysRequestSubject(c.pa.subject) && !isSysRequestSubject(sub.subject) {
+		client.mu.Unlock()
+		return false
+	}
+
+	// Internal subscriptions are handled by the server directly.
+	if client.typ == SYSTEM {
+		client.mu.Unlock()
+		if sub.icb == nil {
+			return false
+		}
+		sub.icb(sub, string(c.pa.subject), string(c.pa.reply), msg[:len(msg)-LEN_CR_LF])
+		return true
+	}
+
 	srv := client.srv
 
 	sub.nm++
 	// Check if we should auto-unsubscribe.
+	// For routing..
+	shouldForward := client.typ != ROUTER && client.srv != nil
+	lastMsg := false
 	if sub.max > 0 {
-		// For routing..
-		shouldForward := client.typ != ROUTER && client.srv != nil
 		// If we are at the exact number, unsubscribe but
 		// still process the message in hand, otherwise
 		// unsubscribe and drop message on the floor.
 		if sub.nm == sub.max {
-			c.Debugf("Auto-unsubscribe limit of %d reached for sid '%s'\n", sub.max, string(sub.sid))
-			// Due to defer, reverse the code order so that execution
-			// is consistent with other cases where we unsubscribe.
-			if shouldForward {
-				defer srv.broadcastUnSubscribe(sub)
-			}
-			defer client.unsubscribe(sub)
+			lastMsg = true
 		} else if sub.nm > sub.max {
 			c.Debugf("Auto-unsubscribe limit [%d] exceeded\n", sub.max)
 			client.mu.Unlock()
@@ -1317,12 +1538,53 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) bool {
 		}
 	}
 
+	// Messages to a route with a pool are sent on the connection of their
+	// subject.
+	if client.typ == ROUTER && client.route.pool != nil {
+		if pc := client.route.pool.connFor(c.pa.subject); pc != nil && pc != client {
+			client.mu.Unlock()
+			client = pc
+			client.mu.Lock()
+		}
+	}
+
 	// Check for closed connection
 	if client.nc == nil {
 		client.mu.Unlock()
 		return false
 	}
 
+	// Apply the slow consumer policy, unless it is to close the connection.
+	if client.out.scp > SlowConsumerClose && client.out.pb+int64(len(mh)+len(msg)) > client.out.mp {
+		if !client.handleSlowConsumer(c, int64(len(mh)+len(msg))) {
+			client.mu.Unlock()
+			return false
+		}
+	}
+
+	// The message hook is called without the lock, once nothing else
+	// can skip the delivery.
+	if sub.hook != nil && c.hm != nil {
+		client.mu.Unlock()
+		ok := srv.hook.OnDeliver(sub.hook, c.hm)
+		client.mu.Lock()
+		if !ok || client.nc == nil {
+			sub.nm--
+			client.mu.Unlock()
+			return false
+		}
+	}
+
+	if lastMsg {
+		c.Debugf("Auto-unsubscribe limit of %d reached for sid '%s'\n", sub.max, string(sub.sid))
+		// Due to defer, reverse the code order so that execution
+		// is consistent with other cases where we unsubscribe.
+		if shouldForward {
+			defer srv.broadcastUnSubscribe(sub)
+		}
+		defer sub.client.unsubscribe(sub)
+	}
+
 	// Update statistics
 
 	// The msg includes the CR_LF, so pull back out for accounting.
@@ -1337,8 +1599,12 @@ func (c *client) deliverMsg(sub *subscription, mh, msg []byte) bool {
 	atomic.AddInt64(&srv.outBytes, msgSize)
 
 	// Queue to outbound buffer
-	client.queueOutbound(mh)
-	client.queueOutbound(msg)
+	if client.out.scp == SlowConsumerDropOldest {
+		client.queueDroppable(mh, msg)
+	} else {
+		client.queueOutbound(mh)
+		client.queueOutbound(msg)
+	}
 
 	client.out.pm++
 
@@ -1375,11 +1641,28 @@ func (c *client) prunePubPermsCache() {
 	}
 }
 
+// isReservedSubject returns true for subjects under _SYS.>, which
+// only the server itself is allowed to publish to.
+func isReservedSubject(subject []byte) bool {
+	return len(subject) > 4 && string(subject[:5]) == "_SYS."
+}
+
+// isSysRequestSubject returns true for subjects under _SYS.REQ.>, which
+// clients may publish and subscribe to when explicitly permitted. Only the
+// subscriptions on those subjects receive the requests, which may carry
+// credentials, not wildcard ones like >.
+func isSysRequestSubject(subject []byte) bool {
+	return len(subject) > 8 && string(subject[:9]) == "_SYS.REQ."
+}
+
 // pubAllowed checks on publish permissioning.
 func (c *client) pubAllowed(subject []byte) bool {
 	// Disallow publish to _SYS.>, these are reserved for internals.
-	if len(subject) > 4 && string(subject[:5]) == "_SYS." {
-		return false
+	// System requests require an explicit publish permission.
+	if isReservedSubject(subject) {
+		if !isSysRequestSubject(subject) || c.perms == nil {
+			return false
+		}
 	}
 	if c.perms == nil {
 		return true
@@ -1426,10 +1709,23 @@ func (c *client) processMsg(msg []byte) {
 		c.traceMsg(msg)
 	}
 
+	// Check if the message has been marked for tracing.
+	mt := c.newMsgTrace()
+	if mt != nil {
+		defer srv.sendMsgTrace(mt)
+		mt.ingress(c)
+	}
+
 	// Check pub permissions (don't do this for routes)
-	if c.typ == CLIENT && !c.pubAllowed(c.pa.subject) {
-		c.pubPermissionViolation(c.pa.subject)
-		return
+	if c.typ == CLIENT {
+		allowed := c.pubAllowed(c.pa.subject)
+		if mt != nil {
+			mt.permission(allowed)
+		}
+		if !allowed {
+			c.pubPermissionViolation(c.pa.subject)
+			return
+		}
 	}
 
 	if c.opts.Verbose {
@@ -1441,6 +1737,20 @@ func (c *client) processMsg(msg []byte) {
 		return
 	}
 
+	// The message hook may drop or rewrite the message.
+	if srv.hook != nil {
+		if msg = c.publishHook(msg); msg == nil {
+			if mt != nil {
+				mt.drop("message hook")
+			}
+			return
+		}
+	}
+
+	if srv.latency != nil {
+		srv.trackLatency(c)
+	}
+
 	// Match the subscriptions. We will use our own L1 map if
 	// it's still valid, avoiding contention on the shared sublist.
 	var r *SublistResult
@@ -1472,16 +1782,23 @@ func (c *client) processMsg(msg []byte) {
 		}
 	}
 
+	if mt != nil {
+		mt.match(r)
+	}
+
 	// This is the fanout scale.
 	fanout := len(r.psubs) + len(r.qsubs)
 
 	// Check for no interest, short circuit if so.
 	if fanout == 0 {
+		if mt != nil {
+			mt.drop("no interest")
+		}
 		return
 	}
 
 	if c.typ == ROUTER {
-		c.processRoutedMsg(r, msg)
+		c.processRoutedMsg(r, msg, mt)
 		return
 	}
 
@@ -1520,7 +1837,10 @@ func (c *client) processMsg(msg []byte) {
 		}
 		// Normal delivery
 		mh := c.msgHeader(msgh[:si], sub)
-		c.deliverMsg(sub, mh, msg)
+		ok := c.deliverMsg(sub, mh, msg)
+		if mt != nil {
+			mt.delivered(sub, ok)
+		}
 	}
 
 	// Check to see if we have our own rand yet. Global rand
@@ -1531,22 +1851,76 @@ func (c *client) processMsg(msg []byte) {
 	// Process queue subs
 	for i := 0; i < len(r.qsubs); i++ {
 		qsubs := r.qsubs[i]
-		// Find a subscription that is able to deliver this message
-		// starting at a random index.
-		startIndex := c.in.prand.Intn(len(qsubs))
-		for i := 0; i < len(qsubs); i++ {
-			index := (startIndex + i) % len(qsubs)
-			sub := qsubs[index]
-			if sub != nil {
-				mh := c.msgHeader(msgh[:si], sub)
-				if c.deliverMsg(sub, mh, msg) {
-					break
-				}
+		if sub := c.deliverToQueueGroup(qsubs, msgh[:si], msg); sub != nil {
+			if mt != nil {
+				mt.delivered(sub, true)
 			}
+		} else if mt != nil && len(qsubs) > 0 && qsubs[0] != nil {
+			mt.drop("no queue member available").Queue = string(qsubs[0].queue)
 		}
 	}
 }
 
+// deliverToQueueGroup delivers the message to the member of a partitioned
+// queue group owning its partition key, or to any member of other groups.
+func (c *client) deliverToQueueGroup(qsubs []*subscription, msgh, msg []byte) *subscription {
+	if c.srv != nil && c.srv.partitions != nil && len(qsubs) > 0 && qsubs[0] != nil {
+		if key := c.srv.partitions.key(qsubs[0].queue, c.pa.subject); key != nil {
+			return c.deliverToPartition(qsubs, key, msgh, msg)
+		}
+	}
+	return c.deliverToQueue(qsubs, msgh, msg)
+}
+
+// deliverToQueue delivers the message to one member of a queue group and
+// returns it, or nil if no member could take the message. Members of local
+// clients are preferred, and members on routes only used when no local
+// member could take the message. Either are picked at random in proportion
+// to their weight. Assumes c.in.prand is set.
+func (c *client) deliverToQueue(qsubs []*subscription, msgh, msg []byte) *subscription {
+	if sub := c.deliverToQueueMembers(qsubs, false, msgh, msg); sub != nil {
+		return sub
+	}
+	return c.deliverToQueueMembers(qsubs, true, msgh, msg)
+}
+
+// deliverToQueueMembers delivers the message to one of the local or remote
+// members of a queue group, picked in proportion to its weight, or to the
+// following ones if it can not take the message. Returns the member, or
+// nil if none could take the message.
+func (c *client) deliverToQueueMembers(qsubs []*subscription, remote bool, msgh, msg []byte) *subscription {
+	// Sum the weights of the members.
+	total := 0
+	for _, sub := range qsubs {
+		if sub != nil && sub.isRemote() == remote {
+			total += sub.queueWeight()
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+	startIndex, n := 0, c.in.prand.Intn(total)
+	for i, sub := range qsubs {
+		if sub == nil || sub.isRemote() != remote {
+			continue
+		}
+		if n -= sub.queueWeight(); n < 0 {
+			startIndex = i
+			break
+		}
+	}
+	for i := 0; i < len(qsubs); i++ {
+		sub := qsubs[(startIndex+i)%len(qsubs)]
+		if sub == nil || sub.isRemote() != remote {
+			continue
+		}
+		if c.deliverMsg(sub, c.msgHeader(msgh, sub), msg) {
+			return sub
+		}
+	}
+	return nil
+}
+
 func (c *client) pubPermissionViolation(subject []byte) {
 	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q", subject))
 	c.Errorf("Publish Violation - User %q, Subject %q", c.opts.Username, subject)
@@ -1641,6 +2015,12 @@ func (c *client) clearConnection(reason ClosedState) {
 	// Clear outbound here.
 	c.out.sg.Broadcast()
 
+	// Resume producers paused by us.
+	if c.out.stc != nil {
+		close(c.out.stc)
+		c.out.stc = nil
+	}
+
 	// With TLS, Close() is sending an alert (that is doing a write).
 	// Need to set a deadline otherwise the server could block there
 	// if the peer is not reading from socket.
@@ -1663,6 +2043,8 @@ func (c *client) typeString() string {
 		return "Client"
 	case ROUTER:
 		return "Router"
+	case SYSTEM:
+		return "System"
 	}
 	return "Unknown Type"
 }
@@ -1694,6 +2076,8 @@ func (c *client) closeConnection(reason ClosedState) {
 		routeClosed   bool
 		retryImplicit bool
 		connectURLs   []string
+		primary       *client
+		pooled        []*client
 	)
 	if c.route != nil {
 		routeClosed = c.route.closed
@@ -1701,6 +2085,11 @@ func (c *client) closeConnection(reason ClosedState) {
 			retryImplicit = c.route.retry
 		}
 		connectURLs = c.route.connectURLs
+		primary = c.route.primary
+		if c.route.pool != nil {
+			pooled = c.route.pool.members()
+			c.route.pool = nil
+		}
 	}
 
 	c.mu.Unlock()
@@ -1725,8 +2114,21 @@ func (c *client) closeConnection(reason ClosedState) {
 				// Forward on unsubscribes if we are not
 				// a router ourselves.
 				srv.broadcastUnSubscribe(sub)
+				if sub.hook != nil {
+					srv.hook.OnUnsubscribe(sub.hook)
+				}
 			}
 		}
+
+		// The pooled connections of a route go away with it, and are
+		// opened again by the route if needed.
+		for _, pc := range pooled {
+			pc.closeConnection(reason)
+		}
+		if primary != nil {
+			srv.removeRoutePoolConn(c, primary, routeClosed)
+			return
+		}
 	}
 
 	// Don't reconnect routes that are being closed.
@@ -1025,6 +1025,74 @@ func TestDynamicBuffers(t *testing.T) {
 
 // Similar to the routed version. Make sure we receive all of the
 // messages with auto-unsubscribe enabled.
+func TestQueueWeightedDelivery(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("gio://%s:%d", opts.Host, opts.Port)
+	var counts [2]int32
+	for i, weight := range []int{3, 0} {
+		nc, err := gio.Connect(url, gio.QueueWeight(weight))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+		count := &counts[i]
+		if _, err := nc.QueueSubscribe("foo", "bar", func(*gio.Msg) {
+			atomic.AddInt32(count, 1)
+		}); err != nil {
+			t.Fatalf("Error on subscribe: %v", err)
+		}
+		nc.Flush()
+	}
+
+	nc, err := gio.Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	total := int32(4000)
+	for i := int32(0); i < total; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	nc.Flush()
+
+	checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&counts[0]) + atomic.LoadInt32(&counts[1]); n != total {
+			return fmt.Errorf("Received %d messages, expected %d", n, total)
+		}
+		return nil
+	})
+	// The heavier member should have received about 3 times as many.
+	if n := atomic.LoadInt32(&counts[0]); n < 2700 || n > 3300 {
+		t.Fatalf("Expected about 3000 messages for the heavier member, got %d", n)
+	}
+
+	// The weights and the number of messages of each member are in Subsz.
+	sz, err := s.Subsz(&SubszOptions{Subscriptions: true})
+	if err != nil {
+		t.Fatalf("Error getting subsz: %v", err)
+	}
+	if len(sz.Subs) != 2 {
+		t.Fatalf("Expected 2 subscriptions, got %+v", sz.Subs)
+	}
+	for _, sd := range sz.Subs {
+		var i int
+		switch sd.Weight {
+		case 3:
+			i = 0
+		case 1:
+			i = 1
+		default:
+			t.Fatalf("Unexpected weight: %+v", sd)
+		}
+		if sd.Queue != "bar" || sd.Msgs != int64(atomic.LoadInt32(&counts[i])) {
+			t.Fatalf("Unexpected subscription details: %+v, received %d", sd, counts[i])
+		}
+	}
+}
+
 func TestQueueAutoUnsubscribe(t *testing.T) {
 	opts := DefaultOptions()
 	s := RunServer(opts)
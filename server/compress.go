@@ -0,0 +1,219 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// Route compression.
+//
+// Route connections can be compressed with DEFLATE, trading CPU for
+// bandwidth on links between zones or regions. Each server advertises in
+// its route INFO whether it decompresses, and compresses what it sends on
+// a route only if the remote does. With `compression: deflate` a server
+// compresses as soon as the route is registered, with `auto` only once the
+// RTT measured on the route reaches compression_rtt_threshold, so that
+// routes within a zone are left uncompressed. Each direction is negotiated
+// on its own.
+//
+// A server switches to compression by sending an INFO with compressed set,
+// followed by a DEFLATE stream flushed after each write, for the rest of
+// the connection. The remote decompresses everything after that INFO.
+
+// Route compression modes.
+const (
+	// CompressionOff does not compress routes.
+	CompressionOff = "off"
+	// CompressionDeflate compresses routes with DEFLATE.
+	CompressionDeflate = "deflate"
+	// CompressionAuto compresses routes with DEFLATE when their RTT is
+	// high enough.
+	CompressionAuto = "auto"
+)
+
+// parseCompression parses a route compression mode. A boolean enables or
+// disables DEFLATE.
+func parseCompression(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return CompressionDeflate, nil
+		}
+		return CompressionOff, nil
+	case string:
+		switch mode := strings.ToLower(strings.TrimSpace(v)); mode {
+		case CompressionOff, "none", "disabled", "":
+			return CompressionOff, nil
+		case CompressionDeflate, CompressionAuto:
+			return mode, nil
+		case "s2":
+			return "", fmt.Errorf("Compression mode %q is not supported, use %q or %q",
+				v, CompressionDeflate, CompressionAuto)
+		}
+	}
+	return "", fmt.Errorf("Unknown compression mode %v, expected %q, %q or %q",
+		v, CompressionOff, CompressionDeflate, CompressionAuto)
+}
+
+// compressionAdvert returns the compression advertised in the route INFO
+// for a mode, empty if the server does not decompress.
+func compressionAdvert(mode string) string {
+	switch mode {
+	case CompressionDeflate, CompressionAuto:
+		return CompressionDeflate
+	}
+	return ""
+}
+
+// routeCompression is the compression state of a route. The counters come
+// first, to be 64bits aligned for atomic use.
+type routeCompression struct {
+	rawOut  int64
+	compOut int64
+	rawIn   int64
+	compIn  int64
+
+	mode string          // The configured mode.
+	auto bool            // Waiting for the RTT to start compressing.
+	out  *compressWriter // Set once compressing what is sent.
+	in   bool            // Whether the remote compresses what it sends.
+}
+
+// compressionRatio returns how many times smaller the compressed bytes
+// are, or 0 if nothing was compressed.
+func compressionRatio(raw, comp int64) float64 {
+	if comp == 0 {
+		return 0
+	}
+	return float64(raw) / float64(comp)
+}
+
+// countWriter counts the bytes written to a connection.
+type countWriter struct {
+	nc net.Conn
+	n  *int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.nc.Write(b)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
+}
+
+// countReader counts the bytes read from a reader.
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
+
+// compressWriter compresses what is sent on a route. It is only used by
+// the flusher of the route.
+type compressWriter struct {
+	rc     *routeCompression
+	nc     net.Conn
+	fw     *flate.Writer
+	marker []byte // The INFO to send before the first compressed data.
+}
+
+// write compresses the buffers to the connection. Since a partial write
+// leaves the stream unusable, nothing is reported written on error.
+func (w *compressWriter) write(nb net.Buffers) (int64, error) {
+	if w.marker != nil {
+		if _, err := w.nc.Write(w.marker); err != nil {
+			return 0, err
+		}
+		w.marker = nil
+	}
+	var n int64
+	for _, b := range nb {
+		if _, err := w.fw.Write(b); err != nil {
+			return 0, err
+		}
+		n += int64(len(b))
+	}
+	if err := w.fw.Flush(); err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&w.rc.rawOut, n)
+	return n, nil
+}
+
+// decompressReader decompresses what is read from a route.
+type decompressReader struct {
+	rc *routeCompression
+	fr io.ReadCloser
+}
+
+func (r *decompressReader) Read(b []byte) (int, error) {
+	n, err := r.fr.Read(b)
+	atomic.AddInt64(&r.rc.rawIn, int64(n))
+	return n, err
+}
+
+// initRouteCompression is called with the first INFO of the remote, to
+// start compressing if the remote decompresses. Lock should be held.
+func (c *client) initRouteCompression(info *Info) {
+	rc := c.route.comp
+	if rc == nil || info.Compression != CompressionDeflate {
+		return
+	}
+	switch rc.mode {
+	case CompressionDeflate:
+		c.startCompression()
+	case CompressionAuto:
+		// Measure the RTT now rather than waiting for the ping timer.
+		rc.auto = true
+		c.sendPing()
+	}
+}
+
+// checkAutoCompression starts compressing a route in auto mode once its
+// RTT reaches the threshold. Lock should be held.
+func (c *client) checkAutoCompression() {
+	rc := c.route.comp
+	if rc == nil || !rc.auto || rc.out != nil {
+		return
+	}
+	if threshold := c.srv.getOpts().Cluster.CompressionRTT; c.rtt >= threshold {
+		c.Debugf("Route RTT of %v reached %v", c.rtt, threshold)
+		c.startCompression()
+	}
+}
+
+// startCompression compresses what is sent on the route from the next
+// flush on. Lock should be held.
+func (c *client) startCompression() {
+	rc := c.route.comp
+	if rc.out != nil || c.nc == nil {
+		return
+	}
+	b, _ := json.Marshal(&Info{ID: c.srv.info.ID, Compression: CompressionDeflate, Compressed: true})
+	// The level is fixed, so there is no error.
+	fw, _ := flate.NewWriter(&countWriter{nc: c.nc, n: &rc.compOut}, flate.BestSpeed)
+	rc.auto = false
+	rc.out = &compressWriter{rc: rc, nc: c.nc, fw: fw, marker: []byte(fmt.Sprintf(InfoProto, b))}
+	c.Debugf("Route compression enabled")
+}
+
+// newDecompressReader returns the reader of a route whose remote started
+// compressing, with rest the compressed data already read. It is called by
+// the read loop.
+func (c *client) newDecompressReader(nc net.Conn, rest []byte) io.Reader {
+	rc := c.route.comp
+	rest = append([]byte(nil), rest...)
+	atomic.AddInt64(&rc.compIn, int64(len(rest)))
+	src := io.MultiReader(bytes.NewReader(rest), &countReader{r: nc, n: &rc.compIn})
+	return &decompressReader{rc: rc, fr: flate.NewReader(src)}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestRouteCompressionConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/route_compression.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.Cluster.Compression != CompressionAuto {
+		t.Fatalf("Expected compression %q, got %q", CompressionAuto, opts.Cluster.Compression)
+	}
+	if opts.Cluster.CompressionRTT != 50*time.Millisecond {
+		t.Fatalf("Expected compression RTT threshold of 50ms, got %v", opts.Cluster.CompressionRTT)
+	}
+	if cc := CheckConfigFile("./configs/route_compression.conf"); len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+
+	for _, test := range []struct {
+		value    interface{}
+		expected string
+	}{
+		{"deflate", CompressionDeflate},
+		{"Auto", CompressionAuto},
+		{"off", CompressionOff},
+		{"none", CompressionOff},
+		{true, CompressionDeflate},
+		{false, CompressionOff},
+	} {
+		mode, err := parseCompression(test.value)
+		if err != nil {
+			t.Fatalf("Error parsing %v: %v", test.value, err)
+		}
+		if mode != test.expected {
+			t.Fatalf("Expected %v to be %q, got %q", test.value, test.expected, mode)
+		}
+	}
+	for _, v := range []interface{}{"s2", "gzip", int64(1)} {
+		if _, err := parseCompression(v); err == nil {
+			t.Fatalf("Expected error parsing %v", v)
+		}
+	}
+}
+
+// runCompressedRoutes runs two servers routed to each other with the
+// given compression modes and RTT thresholds.
+func runCompressedRoutes(t *testing.T, modeA, modeB string, rttA, rttB time.Duration) (*Server, *Server) {
+	t.Helper()
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	optsA.Cluster.Compression = modeA
+	optsA.Cluster.CompressionRTT = rttA
+	sa := RunServer(optsA)
+
+	optsB := nextServerOpts(optsA)
+	optsB.Cluster.Compression = modeB
+	optsB.Cluster.CompressionRTT = rttB
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sa.ClusterAddr().Port))
+	sb := RunServer(optsB)
+
+	checkClusterFormed(t, sa, sb)
+	return sa, sb
+}
+
+// checkRoutedMsgs sends messages from a client of sa to a client of sb.
+func checkRoutedMsgs(t *testing.T, sa, sb *Server) {
+	t.Helper()
+	ncb, err := gio.Connect(fmt.Sprintf("nats://127.0.0.1:%d", sb.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncb.Close()
+	sub, err := ncb.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	ncb.Flush()
+	checkExpectedSubs(t, 1, sa)
+
+	nca, err := gio.Connect(fmt.Sprintf("nats://127.0.0.1:%d", sa.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nca.Close()
+	payload := bytes.Repeat([]byte("compressible "), 100)
+	for i := 0; i < 100; i++ {
+		nca.Publish("foo", payload)
+	}
+	nca.Flush()
+	for i := 0; i < 100; i++ {
+		msg, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Error receiving message %d: %v", i, err)
+		}
+		if !bytes.Equal(msg.Data, payload) {
+			t.Fatalf("Unexpected payload for message %d: %q", i, msg.Data)
+		}
+	}
+}
+
+// getRouteInfo returns the Routez entry of the only route of s.
+func getRouteInfo(t *testing.T, s *Server) *RouteInfo {
+	t.Helper()
+	rz, err := s.Routez(nil)
+	if err != nil {
+		t.Fatalf("Error getting routez: %v", err)
+	}
+	if len(rz.Routes) != 1 {
+		t.Fatalf("Expected 1 route, got %d", len(rz.Routes))
+	}
+	return rz.Routes[0]
+}
+
+func TestRouteCompression(t *testing.T) {
+	sa, sb := runCompressedRoutes(t, CompressionDeflate, CompressionDeflate, 0, 0)
+	defer sa.Shutdown()
+	defer sb.Shutdown()
+
+	checkRoutedMsgs(t, sa, sb)
+
+	ra, rb := getRouteInfo(t, sa), getRouteInfo(t, sb)
+	for _, ri := range []*RouteInfo{ra, rb} {
+		if ri.Compression != CompressionDeflate || !ri.OutCompressed || !ri.InCompressed {
+			t.Fatalf("Expected route compressed both ways, got %+v", ri)
+		}
+	}
+	// The messages went from A to B, and are very compressible.
+	if ra.OutCompressionRatio < 5 {
+		t.Fatalf("Expected a high compression ratio, got %v", ra.OutCompressionRatio)
+	}
+	if rb.InCompressionRatio < 5 {
+		t.Fatalf("Expected a high decompression ratio, got %v", rb.InCompressionRatio)
+	}
+}
+
+func TestRouteCompressionNegotiation(t *testing.T) {
+	// B does not decompress, so A does not compress, but B can still send
+	// to A compressed.
+	sa, sb := runCompressedRoutes(t, CompressionDeflate, CompressionOff, 0, 0)
+	defer sa.Shutdown()
+	defer sb.Shutdown()
+
+	checkRoutedMsgs(t, sa, sb)
+	checkRoutedMsgs(t, sb, sa)
+
+	if ra := getRouteInfo(t, sa); ra.OutCompressed || ra.InCompressed || ra.OutCompressionRatio != 0 {
+		t.Fatalf("Expected route not compressed, got %+v", ra)
+	}
+	if rb := getRouteInfo(t, sb); rb.Compression != "" || rb.OutCompressed || rb.InCompressed {
+		t.Fatalf("Expected route compression off, got %+v", rb)
+	}
+}
+
+func TestRouteCompressionAuto(t *testing.T) {
+	// Any RTT is high enough for A, none for B.
+	sa, sb := runCompressedRoutes(t, CompressionAuto, CompressionAuto, time.Nanosecond, time.Hour)
+	defer sa.Shutdown()
+	defer sb.Shutdown()
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if ri := getRouteInfo(t, sa); !ri.OutCompressed {
+			return fmt.Errorf("Expected route to be compressed")
+		}
+		return nil
+	})
+	checkRoutedMsgs(t, sa, sb)
+	checkRoutedMsgs(t, sb, sa)
+
+	if rb := getRouteInfo(t, sb); rb.Compression != CompressionAuto || rb.OutCompressed || !rb.InCompressed {
+		t.Fatalf("Expected route compressed from A only, got %+v", rb)
+	}
+}
+
+func TestRouteCompressionRoutesToEachOther(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	optsA.Cluster.Compression = CompressionDeflate
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sa.ClusterAddr().Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	// Make A solicit B too, so that one of the connections is dropped, and
+	// the route may be upgraded to solicited with the other.
+	rURL := RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sb.ClusterAddr().Port))[0]
+	sa.startGoRoutine(func() { sa.connectToRoute(rURL, false) })
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if ri := getRouteInfo(t, sa); !ri.DidSolicit {
+			return fmt.Errorf("Expected route to be upgraded to solicited")
+		}
+		return nil
+	})
+
+	checkClusterFormed(t, sa, sb)
+	checkRoutedMsgs(t, sa, sb)
+	checkRoutedMsgs(t, sb, sa)
+
+	for _, s := range []*Server{sa, sb} {
+		if ri := getRouteInfo(t, s); !ri.OutCompressed || !ri.InCompressed {
+			t.Fatalf("Expected route compressed both ways, got %+v", ri)
+		}
+	}
+}
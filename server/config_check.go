@@ -0,0 +1,672 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/conf"
+)
+
+// ConfigProblem is an issue found when checking a configuration file.
+type ConfigProblem struct {
+	Pos    conf.Position `json:"position"`
+	Key    string        `json:"key,omitempty"`
+	Reason string        `json:"reason"`
+}
+
+func (p *ConfigProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Pos, p.Reason)
+}
+
+// ConfigCheck is the result of checking a configuration file.
+type ConfigCheck struct {
+	File     string           `json:"file"`
+	Includes []conf.Reference `json:"includes,omitempty"`
+	Env      []conf.Reference `json:"env,omitempty"`
+	Files    []conf.Reference `json:"files,omitempty"`
+	Problems []*ConfigProblem `json:"problems,omitempty"`
+}
+
+// CheckConfigFile loads the configuration file and validates every value.
+// Unlike ProcessConfigFile, it does not stop at the first error, so that
+// all problems are reported along with where they are in the file.
+func CheckConfigFile(configFile string) *ConfigCheck {
+	cc := &configChecker{ConfigCheck: &ConfigCheck{File: configFile}}
+
+	m, src, err := conf.ParseFileWithSource(configFile)
+	if err != nil {
+		if pe, ok := err.(*conf.ParseError); ok {
+			cc.Problems = append(cc.Problems, &ConfigProblem{Pos: pe.Pos, Reason: pe.Reason})
+		} else {
+			cc.Problems = append(cc.Problems, &ConfigProblem{Pos: conf.Position{File: configFile}, Reason: err.Error()})
+		}
+		return cc.ConfigCheck
+	}
+	cc.src = src
+	cc.Includes = src.Includes
+	cc.Env = src.Env
+	cc.Files = src.Files
+
+	cc.checkTop(m)
+
+	// Report anything the checks above would have missed.
+	if len(cc.Problems) == 0 {
+		if err := cc.processConfigFile(configFile); err != nil {
+			cc.Problems = append(cc.Problems, &ConfigProblem{Pos: conf.Position{File: configFile}, Reason: err.Error()})
+		}
+	}
+
+	sort.SliceStable(cc.Problems, func(i, j int) bool {
+		pi, pj := cc.Problems[i].Pos, cc.Problems[j].Pos
+		if pi.File != pj.File {
+			return pi.File < pj.File
+		}
+		if pi.Line != pj.Line {
+			return pi.Line < pj.Line
+		}
+		return pi.Column < pj.Column
+	})
+	return cc.ConfigCheck
+}
+
+type configChecker struct {
+	*ConfigCheck
+	src *conf.Source
+}
+
+// processConfigFile runs ProcessConfigFile, which may panic on values
+// of an unexpected type.
+func (cc *configChecker) processConfigFile(configFile string) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("error processing configuration: %v", r)
+		}
+	}()
+	_, err = ProcessConfigFile(configFile)
+	return err
+}
+
+// errorf records a problem for the key at path. If the key has no known
+// position, the closest parent's position is used.
+func (cc *configChecker) errorf(path string, format string, args ...interface{}) {
+	pos, ok := cc.src.Positions[path]
+	for p := path; !ok && p != ""; {
+		if i := strings.LastIndexAny(p, ".["); i >= 0 {
+			p = p[:i]
+		} else {
+			p = ""
+		}
+		pos, ok = cc.src.Positions[p]
+	}
+	if !ok {
+		pos = conf.Position{File: cc.File}
+	}
+	cc.Problems = append(cc.Problems, &ConfigProblem{Pos: pos, Key: path, Reason: fmt.Sprintf(format, args...)})
+}
+
+// unknown records a problem for an unknown key, unless it is only
+// there to be referenced as a variable.
+func (cc *configChecker) unknown(path, block string) {
+	if cc.src.Variables[path] {
+		return
+	}
+	if block == "" {
+		cc.errorf(path, "unknown field %q", path)
+	} else {
+		cc.errorf(path, "unknown field %q in %s", path[strings.LastIndex(path, ".")+1:], block)
+	}
+}
+
+func (cc *configChecker) checkTop(m map[string]interface{}) {
+	for k, v := range m {
+		switch strings.ToLower(k) {
+		case "listen":
+			cc.checkClientListen(k, v)
+		case "http", "https":
+			cc.checkListen(k, v)
+		case "port", "http_port", "monitor_port", "https_port", "prof_port":
+			cc.checkPort(k, v)
+		case "host", "net", "client_advertise", "logfile", "log_file", "remote_syslog",
+			"pidfile", "pid_file", "ports_file_dir", "reload_token", "unix_socket":
+			cc.checkString(k, v)
+		case "debug", "trace", "logtime", "syslog":
+			cc.checkBool(k, v)
+		case "proxy_protocol":
+			if _, err := parseProxyProtocol(v); err != nil {
+				cc.errorf(k, "%v", err)
+			}
+		case "max_control_line", "max_payload", "max_pending", "max_connections", "max_conn",
+			"max_subscriptions", "max_subs", "ping_interval", "ping_max",
+			"max_connections_per_user", "max_connections_per_ip":
+			cc.checkInt(k, v)
+		case "msg_trace_subject", "trace_subject":
+			cc.checkLiteralSubject(k, v)
+		case "write_deadline":
+			switch wd := v.(type) {
+			case string:
+				if _, err := time.ParseDuration(wd); err != nil {
+					cc.errorf(k, "invalid duration: %v", err)
+				}
+			case int64:
+			default:
+				cc.errorf(k, "expected a duration, got %v", v)
+			}
+		case "drain_timeout":
+			if s, ok := cc.checkString(k, v); ok {
+				if _, err := time.ParseDuration(s); err != nil {
+					cc.errorf(k, "invalid duration: %v", err)
+				}
+			}
+		case "authorization":
+			cc.checkAuthorization(k, v, false)
+		case "cluster":
+			cc.checkCluster(k, v)
+		case "tls":
+			cc.checkTLS(k, v)
+		case "latency":
+			cc.checkLatency(k, v)
+		case "slow_consumer_policy":
+			cc.checkSlowConsumerPolicy(k, v)
+		case "partitioned_queues":
+			cc.checkPartitionedQueues(k, v)
+		case "connection_limits":
+			cc.checkConnLimits(k, v)
+		case "unix_socket_mode":
+			if _, err := parseFileMode(v); err != nil {
+				cc.errorf(k, "%v", err)
+			}
+		case "unix_socket_owner", "unix_socket_group":
+			if _, err := parseOwner(v); err != nil {
+				cc.errorf(k, "%v", err)
+			}
+		case "allowed_cidrs", "denied_cidrs", "http_allowed_cidrs", "http_denied_cidrs",
+			"monitor_allowed_cidrs", "monitor_denied_cidrs":
+			cc.checkCIDRs(k, v)
+		default:
+			cc.unknown(k, "")
+		}
+	}
+}
+
+func (cc *configChecker) checkString(path string, v interface{}) (string, bool) {
+	s, ok := v.(string)
+	if !ok {
+		cc.errorf(path, "expected a string, got %v", v)
+	}
+	return s, ok
+}
+
+func (cc *configChecker) checkBool(path string, v interface{}) {
+	if _, ok := v.(bool); !ok {
+		cc.errorf(path, "expected a boolean, got %v", v)
+	}
+}
+
+func (cc *configChecker) checkInt(path string, v interface{}) {
+	n, ok := v.(int64)
+	if !ok {
+		cc.errorf(path, "expected an integer, got %v", v)
+	} else if n < 0 {
+		cc.errorf(path, "expected a positive value, got %d", n)
+	}
+}
+
+func (cc *configChecker) checkNumber(path string, v interface{}) {
+	switch v.(type) {
+	case int64, float64:
+	default:
+		cc.errorf(path, "expected a number, got %v", v)
+	}
+}
+
+func (cc *configChecker) checkMap(path string, v interface{}) (map[string]interface{}, bool) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		cc.errorf(path, "expected a map, got %v", v)
+	}
+	return m, ok
+}
+
+func (cc *configChecker) checkArray(path string, v interface{}) ([]interface{}, bool) {
+	a, ok := v.([]interface{})
+	if !ok {
+		cc.errorf(path, "expected an array, got %v", v)
+	}
+	return a, ok
+}
+
+func (cc *configChecker) checkPort(path string, v interface{}) {
+	port, ok := v.(int64)
+	if !ok {
+		cc.errorf(path, "expected a port number, got %v", v)
+		return
+	}
+	cc.checkPortRange(path, int(port))
+}
+
+func (cc *configChecker) checkPortRange(path string, port int) {
+	if port < RANDOM_PORT || port > 65535 {
+		cc.errorf(path, "invalid port %d", port)
+	}
+}
+
+func (cc *configChecker) checkClientListen(path string, v interface{}) {
+	addrs, ok := v.([]interface{})
+	if !ok {
+		addrs = []interface{}{v}
+	}
+	for _, addr := range addrs {
+		if s, ok := addr.(string); ok {
+			if p, ok := parseUnixSocket(s); ok {
+				if p == "" {
+					cc.errorf(path, "unix socket requires a path")
+				}
+				continue
+			}
+		}
+		cc.checkListen(path, addr)
+	}
+}
+
+func (cc *configChecker) checkListen(path string, v interface{}) {
+	switch hp := v.(type) {
+	case int64:
+		cc.checkPortRange(path, int(hp))
+	case string:
+		_, port, err := net.SplitHostPort(hp)
+		if err != nil {
+			cc.errorf(path, "could not parse address %q", hp)
+			return
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			cc.errorf(path, "could not parse port %q", port)
+			return
+		}
+		cc.checkPortRange(path, p)
+	default:
+		cc.errorf(path, "expected an address or a port, got %v", v)
+	}
+}
+
+func (cc *configChecker) checkLiteralSubject(path string, v interface{}) {
+	if s, ok := cc.checkString(path, v); ok && !IsValidLiteralSubject(s) {
+		cc.errorf(path, "subject %q is not a valid literal subject", s)
+	}
+}
+
+func (cc *configChecker) checkSubjects(path string, v interface{}) {
+	switch sv := v.(type) {
+	case string:
+		if !IsValidSubject(sv) {
+			cc.errorf(path, "subject %q is not a valid subject", sv)
+		}
+	case []interface{}:
+		for i, s := range sv {
+			cc.checkSubjects(fmt.Sprintf("%s[%d]", path, i), s)
+		}
+	default:
+		cc.errorf(path, "expected a subject or an array of subjects, got %v", v)
+	}
+}
+
+func (cc *configChecker) checkPermissions(path string, v interface{}) {
+	m, ok := cc.checkMap(path, v)
+	if !ok {
+		return
+	}
+	for k, v := range m {
+		kp := path + "." + k
+		switch strings.ToLower(k) {
+		case "pub", "publish", "import", "sub", "subscribe", "export":
+			cc.checkSubjects(kp, v)
+		default:
+			cc.unknown(kp, "permissions")
+		}
+	}
+}
+
+func (cc *configChecker) checkAuthorization(path string, v interface{}, cluster bool) {
+	m, ok := cc.checkMap(path, v)
+	if !ok {
+		return
+	}
+	for k, v := range m {
+		kp := path + "." + k
+		switch strings.ToLower(k) {
+		case "user", "username", "pass", "password", "token":
+			cc.checkString(kp, v)
+		case "timeout":
+			cc.checkNumber(kp, v)
+		case "users":
+			if cluster {
+				cc.errorf(kp, "cluster authorization does not allow multiple users")
+				continue
+			}
+			cc.checkUsers(kp, v)
+		case "default_permission", "default_permissions", "permissions":
+			cc.checkPermissions(kp, v)
+		default:
+			cc.unknown(kp, "authorization")
+		}
+	}
+}
+
+func (cc *configChecker) checkUsers(path string, v interface{}) {
+	users, ok := cc.checkArray(path, v)
+	if !ok {
+		return
+	}
+	seen := make(map[string]bool)
+	for i, u := range users {
+		up := fmt.Sprintf("%s[%d]", path, i)
+		um, ok := cc.checkMap(up, u)
+		if !ok {
+			continue
+		}
+		var name, pass string
+		for k, v := range um {
+			kp := up + "." + k
+			switch strings.ToLower(k) {
+			case "user", "username":
+				name, _ = cc.checkString(kp, v)
+			case "pass", "password":
+				pass, _ = cc.checkString(kp, v)
+			case "permission", "permissions", "authorization":
+				cc.checkPermissions(kp, v)
+			case "slow_consumer_policy":
+				cc.checkSlowConsumerPolicy(kp, v)
+			case "max_connections", "max_conn", "max_subscriptions", "max_subs":
+				cc.checkInt(kp, v)
+			case "allowed_cidrs":
+				cc.checkCIDRs(kp, v)
+			default:
+				cc.unknown(kp, "user")
+			}
+		}
+		if name == "" || pass == "" {
+			cc.errorf(up, "user entry requires a user and a password")
+		}
+		if name != "" {
+			if seen[name] {
+				cc.errorf(up, "duplicate user %q", name)
+			}
+			seen[name] = true
+		}
+	}
+}
+
+func (cc *configChecker) checkCluster(path string, v interface{}) {
+	m, ok := cc.checkMap(path, v)
+	if !ok {
+		return
+	}
+	for k, v := range m {
+		kp := path + "." + k
+		switch strings.ToLower(k) {
+		case "listen":
+			cc.checkListen(kp, v)
+		case "port":
+			cc.checkPort(kp, v)
+		case "host", "net":
+			cc.checkString(kp, v)
+		case "cluster_advertise", "advertise":
+			if s, ok := cc.checkString(kp, v); ok {
+				if _, _, err := parseHostPort(s, 0); err != nil {
+					cc.errorf(kp, "invalid advertise address %q: %v", s, err)
+				}
+			}
+		case "no_advertise":
+			cc.checkBool(kp, v)
+		case "connect_retries":
+			cc.checkInt(kp, v)
+		case "authorization":
+			cc.checkAuthorization(kp, v, true)
+		case "routes":
+			routes, ok := cc.checkArray(kp, v)
+			if !ok {
+				continue
+			}
+			for i, r := range routes {
+				rp := fmt.Sprintf("%s[%d]", kp, i)
+				if s, ok := cc.checkString(rp, r); ok {
+					if u, err := url.Parse(s); err != nil || u.Host == "" {
+						cc.errorf(rp, "invalid route url %q", s)
+					}
+				}
+			}
+		case "tls":
+			cc.checkTLS(kp, v)
+		case "allowed_cidrs", "denied_cidrs":
+			cc.checkCIDRs(kp, v)
+		case "proxy_protocol":
+			if _, err := parseProxyProtocol(v); err != nil {
+				cc.errorf(kp, "%v", err)
+			}
+		case "compression":
+			if _, err := parseCompression(v); err != nil {
+				cc.errorf(kp, "%v", err)
+			}
+		case "pool_size":
+			cc.checkInt(kp, v)
+		case "dedicated_subjects":
+			cc.checkSubjects(kp, v)
+		case "compression_rtt_threshold", "rebalance_interval":
+			if s, ok := cc.checkString(kp, v); ok {
+				if _, err := time.ParseDuration(s); err != nil {
+					cc.errorf(kp, "invalid duration: %v", err)
+				}
+			}
+		default:
+			cc.unknown(kp, "cluster")
+		}
+	}
+}
+
+func (cc *configChecker) checkTLS(path string, v interface{}) {
+	m, ok := cc.checkMap(path, v)
+	if !ok {
+		return
+	}
+	valid := true
+	for k, v := range m {
+		kp := path + "." + k
+		switch strings.ToLower(k) {
+		case "cert_file", "key_file", "ca_file":
+			file, ok := cc.checkString(kp, v)
+			if !ok {
+				valid = false
+				continue
+			}
+			if _, err := os.Stat(file); err != nil {
+				cc.errorf(kp, "%v", err)
+				valid = false
+			}
+		case "verify":
+			cc.checkBool(kp, v)
+		case "certs":
+			if _, err := parseTLSCerts(v); err != nil {
+				cc.errorf(kp, "%v", err)
+				valid = false
+			}
+		case "watch":
+			if _, err := parseTLSWatch(v); err != nil {
+				cc.errorf(kp, "%v", err)
+				valid = false
+			}
+		case "timeout":
+			cc.checkNumber(kp, v)
+		case "cipher_suites", "curve_preferences":
+			names, ok := cc.checkArray(kp, v)
+			if !ok {
+				valid = false
+				continue
+			}
+			if len(names) == 0 {
+				cc.errorf(kp, "%s cannot be empty", k)
+			}
+			for i, n := range names {
+				np := fmt.Sprintf("%s[%d]", kp, i)
+				name, ok := cc.checkString(np, n)
+				if !ok {
+					valid = false
+					continue
+				}
+				var err error
+				if strings.ToLower(k) == "cipher_suites" {
+					_, err = parseCipher(name)
+				} else {
+					_, err = parseCurvePreferences(name)
+				}
+				if err != nil {
+					cc.errorf(np, "%v", err)
+				}
+			}
+		default:
+			cc.unknown(kp, "tls")
+			valid = false
+		}
+	}
+	if !valid {
+		return
+	}
+	// Make sure that the certificates can be loaded.
+	tc, err := parseTLS(m)
+	if err == nil {
+		_, err = GenTLSConfig(tc)
+	}
+	if err != nil {
+		cc.errorf(path, "%v", err)
+	}
+}
+
+func (cc *configChecker) checkLatency(path string, v interface{}) {
+	m, ok := cc.checkMap(path, v)
+	if !ok {
+		return
+	}
+	for k, v := range m {
+		kp := path + "." + k
+		switch strings.ToLower(k) {
+		case "subject":
+			cc.checkLiteralSubject(kp, v)
+		case "services":
+			services, ok := cc.checkArray(kp, v)
+			if !ok {
+				continue
+			}
+			for i, sv := range services {
+				sp := fmt.Sprintf("%s[%d]", kp, i)
+				sm, ok := cc.checkMap(sp, sv)
+				if !ok {
+					continue
+				}
+				if _, ok := sm["subject"]; !ok {
+					cc.errorf(sp, "latency service entry requires a subject")
+				}
+				for k, v := range sm {
+					skp := sp + "." + k
+					switch strings.ToLower(k) {
+					case "subject":
+						cc.checkSubjects(skp, v)
+					case "sampling":
+						if _, err := parseSampling(v); err != nil {
+							cc.errorf(skp, "%v", err)
+						}
+					default:
+						cc.unknown(skp, "latency service")
+					}
+				}
+			}
+		default:
+			cc.unknown(kp, "latency")
+		}
+	}
+}
+
+func (cc *configChecker) checkSlowConsumerPolicy(path string, v interface{}) {
+	if _, err := parseSlowConsumerPolicy(v); err != nil {
+		cc.errorf(path, "%v", err)
+	}
+}
+
+func (cc *configChecker) checkPartitionedQueues(path string, v interface{}) {
+	entries, ok := cc.checkArray(path, v)
+	if !ok {
+		return
+	}
+	for i, ev := range entries {
+		ep := fmt.Sprintf("%s[%d]", path, i)
+		em, ok := cc.checkMap(ep, ev)
+		if !ok {
+			continue
+		}
+		if _, ok := em["queue"]; !ok {
+			cc.errorf(ep, "partitioned queue entry requires a queue")
+		}
+		for k, v := range em {
+			kp := ep + "." + k
+			switch strings.ToLower(k) {
+			case "queue":
+				cc.checkString(kp, v)
+			case "subject":
+				if s, ok := cc.checkString(kp, v); ok && !IsValidSubject(s) {
+					cc.errorf(kp, "subject %q is not a valid subject", s)
+				}
+			case "token":
+				cc.checkInt(kp, v)
+			default:
+				cc.unknown(kp, "partitioned queue")
+			}
+		}
+	}
+}
+
+func (cc *configChecker) checkConnLimits(path string, v interface{}) {
+	entries, ok := cc.checkArray(path, v)
+	if !ok {
+		return
+	}
+	for i, ev := range entries {
+		ep := fmt.Sprintf("%s[%d]", path, i)
+		em, ok := cc.checkMap(ep, ev)
+		if !ok {
+			continue
+		}
+		var hasCIDR, hasMax bool
+		for k, v := range em {
+			kp := ep + "." + k
+			switch strings.ToLower(k) {
+			case "cidr", "network":
+				hasCIDR = true
+				if s, ok := cc.checkString(kp, v); ok {
+					if _, _, err := net.ParseCIDR(s); err != nil {
+						cc.errorf(kp, "invalid cidr: %v", err)
+					}
+				}
+			case "max_connections", "max_conn":
+				hasMax = true
+				if n, ok := v.(int64); !ok || n <= 0 {
+					cc.errorf(kp, "expected a positive integer, got %v", v)
+				}
+			default:
+				cc.unknown(kp, "connection limit")
+			}
+		}
+		if !hasCIDR || !hasMax {
+			cc.errorf(ep, "connection limit entry requires a cidr and max_connections")
+		}
+	}
+}
+
+func (cc *configChecker) checkCIDRs(path string, v interface{}) {
+	if _, err := parseCIDRs(v); err != nil {
+		cc.errorf(path, "%v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"flag"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigFileValid(t *testing.T) {
+	cc := CheckConfigFile("./configs/check/valid.conf")
+	if len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+	if len(cc.Includes) != 1 {
+		t.Fatalf("Expected 1 include, got %+v", cc.Includes)
+	}
+	inc := cc.Includes[0]
+	if inc.Name != "configs/check/users.conf" || inc.Pos.String() != "./configs/check/valid.conf:8:10" {
+		t.Fatalf("Unexpected include: %+v", inc)
+	}
+}
+
+func TestCheckConfigFileProblems(t *testing.T) {
+	os.Setenv("CHECK_TRACE_SUBJECT", "trace.*")
+	defer os.Unsetenv("CHECK_TRACE_SUBJECT")
+
+	file := "./configs/check/invalid.conf"
+	cc := CheckConfigFile(file)
+
+	if len(cc.Env) != 1 || cc.Env[0].Name != "CHECK_TRACE_SUBJECT" {
+		t.Fatalf("Unexpected environment variables: %+v", cc.Env)
+	}
+
+	expected := []struct {
+		pos    string
+		reason string
+	}{
+		{"3:1", "invalid port 70000"},
+		{"4:1", "expected an integer"},
+		{"5:1", `unknown field "unknown_key"`},
+		{"6:1", `"trace.*" is not a valid literal subject`},
+		{"10:48", `"foo..bar" is not a valid subject`},
+		{"11:5", `duplicate user "alice"`},
+		{"12:5", "requires a user and a password"},
+		{"17:3", "no such file or directory"},
+		{"19:20", "Unrecognized cipher TLS_BAD_CIPHER"},
+		{"23:3", "invalid port -2"},
+		{"25:6", `invalid route url ":bad"`},
+	}
+	if len(cc.Problems) != len(expected) {
+		t.Fatalf("Expected %d problems, got %d: %v", len(expected), len(cc.Problems), cc.Problems)
+	}
+	for i, e := range expected {
+		p := cc.Problems[i]
+		if p.Pos.String() != file+":"+e.pos || !strings.Contains(p.Reason, e.reason) {
+			t.Fatalf("Expected problem %q at %s, got %q at %s", e.reason, e.pos, p.Reason, p.Pos)
+		}
+	}
+}
+
+func TestCheckConfigFileParseError(t *testing.T) {
+	cc := CheckConfigFile("./configs/check/missing.conf")
+	if len(cc.Problems) != 1 || !strings.Contains(cc.Problems[0].Reason, "error opening config file") {
+		t.Fatalf("Unexpected problems: %v", cc.Problems)
+	}
+
+	// Missing variables are reported with their position.
+	cc = CheckConfigFile("./configs/check/invalid.conf")
+	if len(cc.Problems) != 1 || cc.Problems[0].Pos.String() != "./configs/check/invalid.conf:6:21" {
+		t.Fatalf("Unexpected problems: %v", cc.Problems)
+	}
+}
+
+func TestConfigureOptionsCheckConfig(t *testing.T) {
+	// ConfigureOptions sets the flags snapshot used by reload.
+	defer func(fs *Options) { FlagSnapshot = fs }(FlagSnapshot)
+
+	opts, err := ConfigureOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-t", "-c", "./configs/check/invalid.conf"}, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !opts.CheckConfig || opts.ConfigFile != "./configs/check/invalid.conf" {
+		t.Fatalf("Unexpected options: %+v", opts)
+	}
+	if _, err := ConfigureOptions(flag.NewFlagSet("test", flag.ContinueOnError), []string{"--test-config"}, nil, nil, nil); err == nil {
+		t.Fatal("Expected an error without a configuration file")
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Connection limits.
+//
+// Besides the global max_connections, connections can be limited per user,
+// with max_connections_per_user or the max_connections of a user entry,
+// and per source IP address with max_connections_per_ip. Networks given as
+// CIDR blocks in connection_limits are limited as a whole, counting the
+// connections from all their addresses together. The limits are checked
+// when the CONNECT is processed, once the client is authorized, and the
+// connection is closed with an error if it would exceed one of them. On
+// reload, the newest connections exceeding the new limits are closed.
+//
+// A user entry can also have its own max_subscriptions, overriding the
+// server's for the connections of the user.
+
+// ConnLimit limits the number of connections from a network.
+type ConnLimit struct {
+	CIDR    string `json:"cidr"`
+	MaxConn int    `json:"max_connections"`
+
+	ipnet *net.IPNet
+}
+
+// contains returns true if ip is in the network of the limit.
+func (cl *ConnLimit) contains(ip net.IP) bool {
+	ipnet := cl.ipnet
+	if ipnet == nil {
+		// Limits set programmatically are not parsed yet.
+		_, n, err := net.ParseCIDR(cl.CIDR)
+		if err != nil {
+			return false
+		}
+		ipnet = n
+	}
+	return ipnet.Contains(ip)
+}
+
+// connLimitKey is what a client is counted under for the connection limits.
+// It is protected by the server's lock.
+type connLimitKey struct {
+	user string
+	ip   string
+	nets []*ConnLimit
+}
+
+// remoteIP returns the source IP address of a connection, or an empty
+// string if it does not have one.
+func remoteIP(nc net.Conn) string {
+	if nc == nil {
+		return ""
+	}
+	if addr, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
+
+// matchConnLimits returns the network limits that apply to ip.
+func matchConnLimits(ip string, limits []*ConnLimit) []*ConnLimit {
+	if ip == "" || len(limits) == 0 {
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	var nets []*ConnLimit
+	for _, cl := range limits {
+		if cl.contains(addr) {
+			nets = append(nets, cl)
+		}
+	}
+	return nets
+}
+
+// registerConnLimits counts a client that sent its CONNECT against the
+// connection limits. If it would exceed one of them, it is not counted and
+// the state to close the connection with and the error are returned.
+func (s *Server) registerConnLimits(c *client) (ClosedState, error) {
+	opts := s.getOpts()
+	withUsers := s.hasUsers() || opts.Username != ""
+
+	c.mu.Lock()
+	key := &connLimitKey{ip: remoteIP(c.nc)}
+	if withUsers {
+		key.user = c.opts.Username
+	}
+	cid := c.cid
+	c.mu.Unlock()
+	key.nets = matchConnLimits(key.ip, opts.ConnLimits)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// The client may have been removed already.
+	if s.clients[cid] != c {
+		return 0, nil
+	}
+	if state, err := s.checkConnLimits(key, opts); err != nil {
+		return state, err
+	}
+	s.addConnLimitKey(key)
+	c.climit = key
+	return 0, nil
+}
+
+// unregisterConnLimits stops counting a client against the connection
+// limits. Server lock should be held.
+func (s *Server) unregisterConnLimits(c *client) {
+	key := c.climit
+	if key == nil {
+		return
+	}
+	c.climit = nil
+	if key.user != "" {
+		if s.userConns[key.user]--; s.userConns[key.user] <= 0 {
+			delete(s.userConns, key.user)
+		}
+	}
+	if key.ip != "" {
+		if s.ipConns[key.ip]--; s.ipConns[key.ip] <= 0 {
+			delete(s.ipConns, key.ip)
+		}
+	}
+	for _, cl := range key.nets {
+		if s.netConns[cl.CIDR]--; s.netConns[cl.CIDR] <= 0 {
+			delete(s.netConns, cl.CIDR)
+		}
+	}
+}
+
+// addConnLimitKey counts a connection. Server lock should be held.
+func (s *Server) addConnLimitKey(key *connLimitKey) {
+	if key.user != "" {
+		s.userConns[key.user]++
+	}
+	if key.ip != "" {
+		s.ipConns[key.ip]++
+	}
+	for _, cl := range key.nets {
+		s.netConns[cl.CIDR]++
+	}
+}
+
+// checkConnLimits returns an error if one more connection counted under
+// key would exceed a limit. Server lock should be held.
+func (s *Server) checkConnLimits(key *connLimitKey, opts *Options) (ClosedState, error) {
+	if key.user != "" {
+		max := opts.MaxConnPerUser
+		if u := s.users[key.user]; u != nil && u.MaxConnections > 0 {
+			max = u.MaxConnections
+		}
+		if max > 0 && s.userConns[key.user] >= max {
+			return MaxUserConnectionsExceeded, ErrTooManyUserConnections
+		}
+	}
+	if key.ip != "" && opts.MaxConnPerIP > 0 && s.ipConns[key.ip] >= opts.MaxConnPerIP {
+		return MaxIPConnectionsExceeded, ErrTooManyIPConnections
+	}
+	for _, cl := range key.nets {
+		if s.netConns[cl.CIDR] >= cl.MaxConn {
+			return MaxIPConnectionsExceeded, ErrTooManyNetworkConnections
+		}
+	}
+	return 0, nil
+}
+
+// enforceConnLimits counts the clients again after the limits have been
+// reloaded, and closes the newest connections exceeding them.
+func (s *Server) enforceConnLimits() {
+	opts := s.getOpts()
+
+	s.mu.Lock()
+	clients := make([]*client, 0, len(s.clients))
+	for _, c := range s.clients {
+		if c.climit != nil {
+			clients = append(clients, c)
+		}
+	}
+	// Oldest connections first, so that they are kept.
+	sort.Slice(clients, func(i, j int) bool { return clients[i].cid < clients[j].cid })
+
+	s.userConns = make(map[string]int)
+	s.ipConns = make(map[string]int)
+	s.netConns = make(map[string]int)
+	type exceeded struct {
+		c     *client
+		state ClosedState
+		err   error
+	}
+	var toClose []exceeded
+	for _, c := range clients {
+		key := c.climit
+		key.nets = matchConnLimits(key.ip, opts.ConnLimits)
+		if state, err := s.checkConnLimits(key, opts); err != nil {
+			c.climit = nil
+			toClose = append(toClose, exceeded{c, state, err})
+			continue
+		}
+		s.addConnLimitKey(key)
+	}
+	s.mu.Unlock()
+
+	for _, e := range toClose {
+		e.c.connLimitExceeded(e.err, e.state)
+	}
+	if len(toClose) > 0 {
+		s.Noticef("Closed %d connections to fall within the connection limits", len(toClose))
+	}
+}
+
+// parseConnLimits parses the connection_limits array, of entries with a
+// cidr and max_connections.
+func parseConnLimits(v interface{}, opts *Options) error {
+	la, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("Expected connection limits to be an array, got %v", v)
+	}
+	for _, lv := range la {
+		lm, ok := lv.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Expected connection limit entry to be a map/struct, got %v", lv)
+		}
+		cl := &ConnLimit{}
+		for k, v := range lm {
+			switch strings.ToLower(k) {
+			case "cidr", "network":
+				cl.CIDR = v.(string)
+			case "max_connections", "max_conn":
+				cl.MaxConn = int(v.(int64))
+			default:
+				return fmt.Errorf("Unknown field %s parsing connection limit", k)
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(cl.CIDR)
+		if err != nil {
+			return fmt.Errorf("Connection limit requires a valid cidr: %v", err)
+		}
+		if cl.MaxConn <= 0 {
+			return fmt.Errorf("Connection limit for %s requires a positive max_connections", cl.CIDR)
+		}
+		cl.ipnet = ipnet
+		opts.ConnLimits = append(opts.ConnLimits, cl)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestConnLimitsConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/conn_limits.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.MaxConnPerUser != 2 || opts.MaxConnPerIP != 10 {
+		t.Fatalf("Unexpected limits: %d per user, %d per IP", opts.MaxConnPerUser, opts.MaxConnPerIP)
+	}
+	if len(opts.ConnLimits) != 1 || opts.ConnLimits[0].CIDR != "127.0.0.0/8" || opts.ConnLimits[0].MaxConn != 4 {
+		t.Fatalf("Unexpected connection limits: %+v", opts.ConnLimits)
+	}
+	if u := opts.Users[0]; u.MaxConnections != 1 || u.MaxSubscriptions != 2 {
+		t.Fatalf("Unexpected user limits: %+v", u)
+	}
+
+	for _, cl := range []map[string]interface{}{
+		{"max_connections": int64(1)},
+		{"cidr": "10.0.0.1", "max_connections": int64(1)},
+		{"cidr": "10.0.0.0/8"},
+		{"cidr": "10.0.0.0/8", "max_connections": int64(1), "max": int64(2)},
+	} {
+		if err := parseConnLimits([]interface{}{cl}, &Options{}); err == nil {
+			t.Fatalf("Expected error for %v", cl)
+		}
+	}
+}
+
+// expectConnLimitErr connects with the given options, and checks that the
+// connection is refused with err.
+func expectConnLimitErr(t *testing.T, url string, expected error, o ...gio.Option) {
+	t.Helper()
+	nc, err := gio.Connect(url, o...)
+	if err == nil {
+		nc.Close()
+		t.Fatalf("Expected connection to fail with %q", expected)
+	}
+	if !strings.Contains(err.Error(), strings.ToLower(expected.Error())) {
+		t.Fatalf("Expected error %q, got %q", expected, err)
+	}
+}
+
+func TestConnLimitsPerUser(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/conn_limits.conf")
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, s.Addr().(*net.TCPAddr).Port)
+	connect := func(o ...gio.Option) *gio.Conn {
+		t.Helper()
+		nc, err := gio.Connect(url, o...)
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		return nc
+	}
+
+	alice := connect(gio.UserInfo("alice", "foo"))
+	defer alice.Close()
+	expectConnLimitErr(t, url, ErrTooManyUserConnections, gio.UserInfo("alice", "foo"))
+
+	bob := connect(gio.UserInfo("bob", "bar"))
+	defer bob.Close()
+	bob2 := connect(gio.UserInfo("bob", "bar"))
+	expectConnLimitErr(t, url, ErrTooManyUserConnections, gio.UserInfo("bob", "bar"))
+
+	// A connection that goes away makes room for another one.
+	bob2.Close()
+	checkClientsCount(t, s, 2)
+	bob2 = connect(gio.UserInfo("bob", "bar"))
+	defer bob2.Close()
+
+	// The network allows 4 connections at most, whatever the user.
+	carol := connect(gio.UserInfo("carol", "baz"))
+	defer carol.Close()
+	expectConnLimitErr(t, url, ErrTooManyNetworkConnections, gio.UserInfo("carol", "baz"))
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		cz, err := s.Connz(&ConnzOptions{State: ConnClosed})
+		if err != nil {
+			return err
+		}
+		reasons := make(map[string]int)
+		for _, ci := range cz.Conns {
+			reasons[ci.Reason]++
+		}
+		if reasons["Maximum User Connections Exceeded"] != 2 || reasons["Maximum IP Connections Exceeded"] != 1 {
+			return fmt.Errorf("Unexpected closed connections: %v", reasons)
+		}
+		return nil
+	})
+}
+
+func TestConnLimitsMaxSubsPerUser(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/conn_limits.conf")
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, s.Addr().(*net.TCPAddr).Port)
+	alice, err := gio.Connect(url, gio.UserInfo("alice", "foo"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer alice.Close()
+	bob, err := gio.Connect(url, gio.UserInfo("bob", "bar"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer bob.Close()
+
+	for i := 0; i < 3; i++ {
+		bob.Subscribe(fmt.Sprintf("foo.%d", i), func(*gio.Msg) {})
+	}
+	bob.Flush()
+	if err := bob.LastError(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	if len(cz.Conns) != 2 || cz.Conns[0].MaxSubs != 2 || cz.Conns[1].MaxSubs != 0 {
+		t.Fatalf("Unexpected connections: %+v", cz.Conns)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := alice.Subscribe(fmt.Sprintf("foo.%d", i), func(*gio.Msg) {}); err != nil {
+			t.Fatalf("Error on subscribe: %v", err)
+		}
+	}
+	// This should cause the error.
+	alice.Subscribe("foo.2", func(*gio.Msg) {})
+	alice.Flush()
+	if err := alice.LastError(); err == nil {
+		t.Fatal("Expected an error but got none")
+	}
+}
+
+func TestConnLimitsPerIP(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MaxConnPerIP = 2
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	for i := 0; i < 2; i++ {
+		nc, err := gio.Connect(url)
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+	}
+	expectConnLimitErr(t, url, ErrTooManyIPConnections)
+
+	s.mu.Lock()
+	n := s.ipConns["127.0.0.1"]
+	s.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("Expected 2 connections counted for the IP, got %d", n)
+	}
+}
@@ -9,10 +9,12 @@ type Command string
 
 // Valid Command values.
 const (
-	CommandStop   = Command("stop")
-	CommandQuit   = Command("quit")
-	CommandReopen = Command("reopen")
-	CommandReload = Command("reload")
+	CommandStop    = Command("stop")
+	CommandQuit    = Command("quit")
+	CommandTerm    = Command("term")
+	CommandUpgrade = Command("upgrade")
+	CommandReopen  = Command("reopen")
+	CommandReload  = Command("reload")
 )
 
 var (
@@ -52,6 +54,9 @@ const (
 	// MAX_PENDING_SIZE is the maximum outbound pending bytes per client.
 	MAX_PENDING_SIZE = (256 * 1024 * 1024)
 
+	// MAX_QUEUE_WEIGHT is the maximum weight of a queue subscription.
+	MAX_QUEUE_WEIGHT = 1000
+
 	// DEFAULT_MAX_CONNECTIONS is the default maximum connections allowed.
 	DEFAULT_MAX_CONNECTIONS = (64 * 1024)
 
@@ -61,6 +66,13 @@ const (
 	// AUTH_TIMEOUT is the authorization wait time.
 	AUTH_TIMEOUT = 2 * TLS_TIMEOUT
 
+	// PROXY_PROTOCOL_TIMEOUT is the wait time for a PROXY protocol header.
+	PROXY_PROTOCOL_TIMEOUT = 2 * time.Second
+
+	// PROXY_PROTOCOL_PEEK_TIMEOUT is the wait time for the start of an
+	// optional PROXY protocol header.
+	PROXY_PROTOCOL_PEEK_TIMEOUT = 200 * time.Millisecond
+
 	// DEFAULT_PING_INTERVAL is how often pings are sent to clients and routes.
 	DEFAULT_PING_INTERVAL = 2 * time.Minute
 
@@ -94,6 +106,46 @@ const (
 	// DEFAULT_ROUTE_DIAL Route dial timeout.
 	DEFAULT_ROUTE_DIAL = 1 * time.Second
 
+	// DEFAULT_ROUTE_COMPRESSION_RTT is the RTT from which routes are
+	// compressed in auto mode.
+	DEFAULT_ROUTE_COMPRESSION_RTT = 10 * time.Millisecond
+
+	// ROUTE_LOAD_UPDATE_DELAY is how long after a change the number of
+	// clients is sent to the routes.
+	ROUTE_LOAD_UPDATE_DELAY = 250 * time.Millisecond
+
+	// REBALANCE_SETTLE_TIME is how long a rebalance waits at most for the
+	// routes to send their number of clients after the previous one.
+	REBALANCE_SETTLE_TIME = 5 * time.Second
+
+	// DEFAULT_TLS_WATCH_INTERVAL is how often the files of a tls block
+	// with watch enabled are checked.
+	DEFAULT_TLS_WATCH_INTERVAL = 10 * time.Second
+
+	// TLS_CERT_CHECK_INTERVAL is how often the certificates in use are
+	// checked for reloads and expiry.
+	TLS_CERT_CHECK_INTERVAL = time.Minute
+
+	// TLS_CERT_EXPIRY_WARNING is how long before their expiry certificates
+	// are reported as expiring.
+	TLS_CERT_EXPIRY_WARNING = 30 * 24 * time.Hour
+
+	// DEFAULT_DRAIN_TIMEOUT is how long a graceful shutdown waits at most
+	// for the pending data of the connections to be sent.
+	DEFAULT_DRAIN_TIMEOUT = 10 * time.Second
+
+	// DRAIN_CHECK_INTERVAL is how often a graceful shutdown checks whether
+	// the pending data of the connections was sent.
+	DRAIN_CHECK_INTERVAL = 10 * time.Millisecond
+
+	// UPGRADE_TIMEOUT is how long an upgrade waits at most for the new
+	// process to be ready.
+	UPGRADE_TIMEOUT = 10 * time.Second
+
+	// SYSTEMD_READY_TIMEOUT is how long the server waits at most to be
+	// ready before telling systemd.
+	SYSTEMD_READY_TIMEOUT = 10 * time.Second
+
 	// PROTO_SNIPPET_SIZE is the default size of proto to print on parse errors.
 	PROTO_SNIPPET_SIZE = 32
 
@@ -108,4 +160,10 @@ const (
 
 	// DEFAULT_MAX_CLOSED_CLIENTS
 	DEFAULT_MAX_CLOSED_CLIENTS = 10000
+
+	// DEFAULT_MSG_TRACE_SUBJECT is the subject trace events are published to.
+	DEFAULT_MSG_TRACE_SUBJECT = "_SYS.TRACE.EVENTS"
+
+	// DEFAULT_LATENCY_SUBJECT is the subject latency metrics are published to.
+	DEFAULT_LATENCY_SUBJECT = "_SYS.LATENCY.METRICS"
 )
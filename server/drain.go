@@ -0,0 +1,139 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Graceful shutdown.
+//
+// Shutdown closes the connections right away, losing the messages still
+// pending in their outbound buffers. ShutdownWithContext first stops
+// accepting connections and tells the routes that this server is leaving,
+// so that they stop advertising it to their clients and do not retry an
+// implicit route to it. It then waits for the pending data of the clients
+// and routes to be sent, until the context is done, before shutting down.
+// SIGTERM and the stop of the Windows service shut down this way, waiting
+// at most drain_timeout.
+
+// ShutdownWithContext stops accepting connections, tells the routes that
+// this server is leaving, and waits for the pending data of the connections
+// to be sent before shutting down. If ctx is done first, the server is shut
+// down anyway and the error of ctx is returned.
+func (s *Server) ShutdownWithContext(ctx context.Context) error {
+	started := s.startDrain()
+	err := s.waitDrained(ctx)
+	s.Shutdown()
+	if started {
+		close(s.drained)
+	}
+	return err
+}
+
+// shutdownGracefully shuts down the server, waiting at most drain_timeout
+// for the pending data of the connections to be sent.
+func (s *Server) shutdownGracefully() {
+	timeout := s.getOpts().DrainTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := s.ShutdownWithContext(ctx); err != nil {
+		s.Errorf("Shut down with pending data after a drain timeout of %v", timeout)
+	}
+}
+
+// startDrain stops accepting connections and tells the routes that this
+// server is leaving, unless it is already draining or shut down. It returns
+// true if it did.
+func (s *Server) startDrain() bool {
+	s.mu.Lock()
+	if !s.running || s.draining {
+		s.mu.Unlock()
+		return false
+	}
+	s.draining = true
+	s.drained = make(chan struct{})
+	// The accept loops wait for the shutdown, which closes the listeners
+	// again and waits for the loops as usual.
+	for _, l := range []net.Listener{s.listener, s.unixListener, s.routeListener} {
+		if l != nil {
+			l.Close()
+		}
+	}
+	routes := make([]*client, 0, len(s.routes))
+	for _, r := range s.routes {
+		routes = append(routes, r)
+	}
+	b, _ := json.Marshal(&Info{ID: s.info.ID, Draining: true})
+	s.mu.Unlock()
+
+	sdNotify("STOPPING=1")
+	s.Noticef("Draining connections before shutdown")
+	proto := []byte(fmt.Sprintf(InfoProto, b))
+	for _, r := range routes {
+		r.mu.Lock()
+		// Do not reconnect to routes closed while draining.
+		r.route.closed = true
+		r.sendInfo(proto)
+		r.mu.Unlock()
+	}
+	return true
+}
+
+// isDraining returns true once the server stopped accepting connections
+// before a graceful shutdown.
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// waitDrained waits until no connection has pending data, or until ctx is
+// done.
+func (s *Server) waitDrained(ctx context.Context) error {
+	t := time.NewTicker(DRAIN_CHECK_INTERVAL)
+	defer t.Stop()
+	for {
+		pending := s.flushPending()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			s.Debugf("%d connections still have pending data", pending)
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// flushPending signals the flusher of the clients and routes with pending
+// data, and returns how many of them there are.
+func (s *Server) flushPending() int {
+	s.mu.Lock()
+	conns := make([]*client, 0, len(s.clients)+len(s.routes))
+	for _, c := range s.clients {
+		conns = append(conns, c)
+	}
+	for _, r := range s.routes {
+		conns = append(conns, r)
+	}
+	s.mu.Unlock()
+
+	pending := 0
+	for i := 0; i < len(conns); i++ {
+		c := conns[i]
+		c.mu.Lock()
+		if c.route != nil && c.route.pool != nil {
+			conns = append(conns, c.route.pool.members()...)
+		}
+		if c.nc != nil && c.out.pb > 0 {
+			pending++
+			c.flushSignal()
+		}
+		c.mu.Unlock()
+	}
+	return pending
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestDrainConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/drain.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.DrainTimeout != 30*time.Second {
+		t.Fatalf("Expected drain timeout of 30s, got %v", opts.DrainTimeout)
+	}
+	if cc := CheckConfigFile("./configs/drain.conf"); len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+}
+
+const drainMsgSize = 10 * 1024
+
+// subscribeAndPublishPending subscribes on a raw connection that is not
+// read from, and publishes n messages to it, returning the subscriber once
+// some of them are pending in the server. The server should not close slow
+// consumers, which would drop the pending data.
+func subscribeAndPublishPending(t *testing.T, s *Server, n int) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+	sub, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	br := bufio.NewReaderSize(sub, 64*1024)
+	if _, err := sub.Write([]byte("CONNECT {\"verbose\":false}\r\nSUB foo 1\r\nPING\r\n")); err != nil {
+		t.Fatalf("Error on write: %v", err)
+	}
+	for _, expected := range []string{"INFO ", "PONG"} {
+		line, err := br.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, expected) {
+			t.Fatalf("Expected %q, got %q (%v)", expected, line, err)
+		}
+	}
+
+	nc, err := gio.Connect(fmt.Sprintf("nats://%s", addr))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	payload := make([]byte, drainMsgSize)
+	for i := 0; i < n; i++ {
+		if err := nc.Publish("foo", payload); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+	if s.flushPending() == 0 {
+		t.Fatal("Expected pending data")
+	}
+	return sub, br
+}
+
+// readDrainMsgs reads messages until the connection is closed, returning
+// how many were received.
+func readDrainMsgs(t *testing.T, br *bufio.Reader) int {
+	t.Helper()
+	count := 0
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return count
+		}
+		if !strings.HasPrefix(line, "MSG ") {
+			continue
+		}
+		if _, err := io.CopyN(ioutil.Discard, br, drainMsgSize+2); err != nil {
+			return count
+		}
+		count++
+	}
+}
+
+func TestShutdownWithContext(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SlowConsumerPolicy = SlowConsumerDropNewest
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	sub, br := subscribeAndPublishPending(t, s, 2000)
+	defer sub.Close()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ShutdownWithContext(context.Background())
+	}()
+
+	// New connections are refused while draining.
+	addr := fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if c, err := net.Dial("tcp", addr); err == nil {
+			c.Close()
+			return fmt.Errorf("Expected connection to be refused")
+		}
+		return nil
+	})
+	select {
+	case err := <-errCh:
+		t.Fatalf("Expected shutdown to wait for pending data, got %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if n := readDrainMsgs(t, br); n != 2000 {
+		t.Fatalf("Expected 2000 messages, got %d", n)
+	}
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shutdown did not complete")
+	}
+	if s.isRunning() {
+		t.Fatal("Expected server to be shut down")
+	}
+}
+
+func TestShutdownWithContextTimeout(t *testing.T) {
+	opts := DefaultOptions()
+	opts.SlowConsumerPolicy = SlowConsumerDropNewest
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	sub, _ := subscribeAndPublishPending(t, s, 2000)
+	defer sub.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := s.ShutdownWithContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected deadline exceeded, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Fatalf("Shutdown took too long: %v", d)
+	}
+	if s.isRunning() {
+		t.Fatal("Expected server to be shut down")
+	}
+}
+
+func TestShutdownWithContextRoutes(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.SlowConsumerPolicy = SlowConsumerDropNewest
+	optsA.Cluster.Host = "127.0.0.1"
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sa.ClusterAddr().Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+	checkClusterFormed(t, sa, sb)
+
+	nc, err := gio.Connect(fmt.Sprintf("nats://127.0.0.1:%d", sb.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if len(nc.DiscoveredServers()) != 1 {
+			return fmt.Errorf("Client did not discover server A")
+		}
+		return nil
+	})
+
+	sub, br := subscribeAndPublishPending(t, sa, 2000)
+	defer sub.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- sa.ShutdownWithContext(context.Background())
+	}()
+
+	// While A drains, B stops advertising it but keeps the route.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if servers := nc.DiscoveredServers(); len(servers) != 0 {
+			return fmt.Errorf("Expected server A to be removed, got %v", servers)
+		}
+		return nil
+	})
+	if n := sb.NumRoutes(); n != 1 {
+		t.Fatalf("Expected route to be kept while draining, got %d", n)
+	}
+
+	if n := readDrainMsgs(t, br); n != 2000 {
+		t.Fatalf("Expected 2000 messages, got %d", n)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	checkNumRoutes(t, sb, 0)
+}
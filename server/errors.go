@@ -32,7 +32,23 @@ var (
 	// has been reached.
 	ErrTooManySubs = errors.New("Maximum Subscriptions Exceeded")
 
+	// ErrTooManyUserConnections signals a client that the maximum number of connections
+	// of its user has been reached.
+	ErrTooManyUserConnections = errors.New("Maximum Connections Per User Exceeded")
+
+	// ErrTooManyIPConnections signals a client that the maximum number of connections
+	// from its IP address has been reached.
+	ErrTooManyIPConnections = errors.New("Maximum Connections Per IP Exceeded")
+
+	// ErrTooManyNetworkConnections signals a client that the maximum number of connections
+	// from its network has been reached.
+	ErrTooManyNetworkConnections = errors.New("Maximum Connections Per Network Exceeded")
+
 	// ErrClientConnectedToRoutePort represents an error condition when a client
 	// attempted to connect to the route listen port.
 	ErrClientConnectedToRoutePort = errors.New("Attempted To Connect To Route Port")
+
+	// ErrSlowConsumerDropped signals a slow consumer client that messages to it
+	// have been dropped, as per its slow consumer policy.
+	ErrSlowConsumerDropped = errors.New("Slow Consumer, Messages Dropped")
 )
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"strconv"
+)
+
+// Message hooks.
+//
+// An application embedding the server can intercept the messages and the
+// subscriptions of the client connections by setting Options.MessageHook.
+// The hook sees the messages published by the clients, and can drop or
+// rewrite them before they are matched against the subscriptions. It sees
+// each delivery to a client subscription, including the messages coming
+// from routes and those published by the server itself, and can skip it.
+// It also sees the subscriptions being added and removed.
+//
+// The hook is called concurrently from the goroutines of the connections,
+// and must be safe for concurrent use:
+//
+//   - OnPublish and OnSubscribe are called from the goroutine reading the
+//     connection, so in the order of its protocol.
+//   - OnDeliver is called from the goroutine of the connection the message
+//     came from, a client or a route, in the order of its messages. Calls for
+//     the same subscription can be concurrent for messages from different
+//     connections.
+//   - OnUnsubscribe is called once per subscription OnSubscribe allowed,
+//     from the goroutine removing it, that is the one reading the
+//     connection, delivering the last message to an auto-unsubscribing
+//     subscription, or closing the connection.
+//
+// No lock of the server or of the connections is held while the hook is
+// called. It holds up the connection it is called from, so it should not
+// block. The hook is trusted: rewritten messages are not checked against
+// the permissions and limits again.
+//
+// Without a hook, the cost is a nil check per message, delivery and
+// subscription.
+
+// MessageHook intercepts the messages and subscriptions of the client
+// connections, see Options.MessageHook.
+type MessageHook interface {
+	// OnPublish is called for each message published by a client that its
+	// permissions allow. The message can be modified; returning false
+	// drops it.
+	OnPublish(c *HookClient, msg *HookMsg) bool
+	// OnDeliver is called before delivering a message to a client
+	// subscription, once nothing else can skip the delivery. The message
+	// must not be modified; returning false skips the subscription, a
+	// queue group then picking another member.
+	OnDeliver(sub *HookSubscription, msg *HookMsg) bool
+	// OnSubscribe is called for each subscription of a client that its
+	// permissions and limits allow. Returning false refuses it, which the
+	// client is told as a permissions violation.
+	OnSubscribe(sub *HookSubscription) bool
+	// OnUnsubscribe is called once a subscription is removed, on UNSUB,
+	// once the auto-unsubscribe limit is reached, or when the connection
+	// is closed.
+	OnUnsubscribe(sub *HookSubscription)
+}
+
+// HookClient describes a client connection. It must not be modified.
+type HookClient struct {
+	Cid  uint64
+	Name string
+	User string
+}
+
+// HookSubscription describes a client subscription. It must not be
+// modified.
+type HookSubscription struct {
+	Client  *HookClient
+	Subject string
+	Queue   string
+	Sid     string
+}
+
+// HookMsg is a message seen by a MessageHook. Data does not include the
+// trailing CR_LF and must be copied if retained after the call.
+type HookMsg struct {
+	Subject string
+	Reply   string
+	Data    []byte
+}
+
+// hookClient returns the description of the client for the hook, created
+// once the connection has sent its CONNECT. Lock should be held.
+func (c *client) hookClient() *HookClient {
+	if c.hc == nil {
+		c.hc = &HookClient{Cid: c.cid, Name: c.opts.Name, User: c.opts.Username}
+	}
+	return c.hc
+}
+
+// publishHook makes the message of c.pa available to the delivery hooks,
+// and calls OnPublish for the messages of the clients. It returns the
+// message to process, rewritten if needed, or nil if dropped.
+func (c *client) publishHook(msg []byte) []byte {
+	data := msg[:len(msg)-LEN_CR_LF]
+	hm := &HookMsg{Subject: string(c.pa.subject), Reply: string(c.pa.reply), Data: data}
+	c.hm = hm
+	if c.typ != CLIENT {
+		return msg
+	}
+
+	c.mu.Lock()
+	hc := c.hookClient()
+	c.mu.Unlock()
+	if !c.srv.hook.OnPublish(hc, hm) {
+		return nil
+	}
+
+	if hm.Subject != string(c.pa.subject) {
+		if !IsValidLiteralSubject(hm.Subject) {
+			c.Errorf("Message hook rewrote subject %q to invalid %q, dropping message", c.pa.subject, hm.Subject)
+			return nil
+		}
+		c.pa.subject = []byte(hm.Subject)
+	}
+	if hm.Reply != string(c.pa.reply) {
+		if hm.Reply == _EMPTY_ {
+			c.pa.reply = nil
+		} else {
+			c.pa.reply = []byte(hm.Reply)
+		}
+	}
+	// Data modified in place is already in msg.
+	if len(hm.Data) != len(data) || (len(data) > 0 && &hm.Data[0] != &data[0]) {
+		msg = make([]byte, 0, len(hm.Data)+LEN_CR_LF)
+		msg = append(append(msg, hm.Data...), CR_LF...)
+		hm.Data = msg[:len(hm.Data)]
+		c.pa.size = len(hm.Data)
+		c.pa.szb = []byte(strconv.Itoa(c.pa.size))
+	}
+	return msg
+}
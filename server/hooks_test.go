@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+// testMessageHook drops messages published to "drop", rewrites those
+// published to "rewrite", skips the deliveries to the clients named
+// "skip", refuses the subscriptions to "refused", and records the
+// subscriptions and the deliveries it sees.
+type testMessageHook struct {
+	sync.Mutex
+	subs     map[string]int
+	unsubs   map[string]int
+	delivers map[string]int
+}
+
+func newTestMessageHook() *testMessageHook {
+	return &testMessageHook{subs: make(map[string]int), unsubs: make(map[string]int), delivers: make(map[string]int)}
+}
+
+func (h *testMessageHook) OnPublish(c *HookClient, msg *HookMsg) bool {
+	switch msg.Subject {
+	case "drop":
+		return false
+	case "rewrite":
+		msg.Subject = "rewritten"
+		msg.Data = append(bytes.ToUpper(msg.Data), fmt.Sprintf(" from %s", c.Name)...)
+	case "inplace":
+		copy(msg.Data, bytes.ToUpper(msg.Data))
+	case "invalid":
+		msg.Subject = "foo.*"
+	}
+	return true
+}
+
+func (h *testMessageHook) OnDeliver(sub *HookSubscription, msg *HookMsg) bool {
+	h.Lock()
+	h.delivers[msg.Subject]++
+	h.Unlock()
+	return sub.Client.Name != "skip"
+}
+
+func (h *testMessageHook) OnSubscribe(sub *HookSubscription) bool {
+	if sub.Subject == "refused" {
+		return false
+	}
+	h.Lock()
+	h.subs[sub.Subject]++
+	h.Unlock()
+	return true
+}
+
+func (h *testMessageHook) OnUnsubscribe(sub *HookSubscription) {
+	h.Lock()
+	h.unsubs[sub.Subject]++
+	h.Unlock()
+}
+
+// counts returns the number of subscriptions and unsubscriptions seen on
+// subject.
+func (h *testMessageHook) counts(subject string) (int, int) {
+	h.Lock()
+	defer h.Unlock()
+	return h.subs[subject], h.unsubs[subject]
+}
+
+func runMessageHookServer(hook MessageHook) *Server {
+	opts := DefaultOptions()
+	opts.MessageHook = hook
+	return RunServer(opts)
+}
+
+func TestMessageHookPublish(t *testing.T) {
+	s := runMessageHookServer(newTestMessageHook())
+	defer s.Shutdown()
+
+	nc, err := gio.Connect(fmt.Sprintf("nats://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port), gio.Name("pub"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	sub, err := nc.SubscribeSync(">")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	for _, subject := range []string{"drop", "rewrite", "inplace", "invalid", "foo"} {
+		nc.PublishRequest(subject, "reply", []byte("hello"))
+	}
+	nc.Flush()
+
+	for _, expected := range []struct{ subject, data string }{
+		{"rewritten", "HELLO from pub"},
+		{"inplace", "HELLO"},
+		{"foo", "hello"},
+	} {
+		msg, err := sub.NextMsg(time.Second)
+		if err != nil {
+			t.Fatalf("Expected message on %q, got %v", expected.subject, err)
+		}
+		if msg.Subject != expected.subject || string(msg.Data) != expected.data || msg.Reply != "reply" {
+			t.Fatalf("Expected %q on %q, got %q on %q with reply %q",
+				expected.data, expected.subject, msg.Data, msg.Subject, msg.Reply)
+		}
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no more messages, got %q on %q", msg.Data, msg.Subject)
+	}
+}
+
+func TestMessageHookDeliver(t *testing.T) {
+	s := runMessageHookServer(newTestMessageHook())
+	defer s.Shutdown()
+	url := fmt.Sprintf("nats://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+
+	connect := func(name string) *gio.Conn {
+		nc, err := gio.Connect(url, gio.Name(name))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		return nc
+	}
+	skip, keep := connect("skip"), connect("keep")
+	defer skip.Close()
+	defer keep.Close()
+
+	subs := make([]*gio.Subscription, 0, 4)
+	for _, nc := range []*gio.Conn{skip, keep} {
+		sub, _ := nc.SubscribeSync("foo")
+		qsub, _ := nc.QueueSubscribeSync("foo", "bar")
+		subs = append(subs, sub, qsub)
+		nc.Flush()
+	}
+
+	for i := 0; i < 10; i++ {
+		skip.Publish("foo", []byte("hello"))
+	}
+	skip.Flush()
+
+	// The queue group members of the skipped client are passed over.
+	expected := []int{0, 0, 10, 10}
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		for i, sub := range subs {
+			if n, _, _ := sub.Pending(); n != expected[i] {
+				return fmt.Errorf("Expected %d messages on subscription %d, got %d", expected[i], i, n)
+			}
+		}
+		return nil
+	})
+}
+
+// deliveries returns the number of deliveries seen on subject.
+func (h *testMessageHook) deliveries(subject string) int {
+	h.Lock()
+	defer h.Unlock()
+	return h.delivers[subject]
+}
+
+func TestMessageHookDeliverSkipped(t *testing.T) {
+	hook := newTestMessageHook()
+	s := runMessageHookServer(hook)
+	defer s.Shutdown()
+
+	nc, err := gio.Connect(fmt.Sprintf("nats://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+	sub, _ := nc.SubscribeSync(">")
+	sub.AutoUnsubscribe(2)
+	nc.Flush()
+
+	// System requests are not delivered to wildcard subscriptions, and
+	// deliveries past the auto-unsubscribe limit are skipped, so the hook
+	// does not see them.
+	nc.Publish(fmt.Sprintf("_SYS.REQ.SERVER.%s.RELOAD", s.ID()), []byte("token"))
+	for i := 0; i < 5; i++ {
+		nc.Publish("foo", []byte("hello"))
+	}
+	nc.Flush()
+	for i := 0; i < 2; i++ {
+		if msg, err := sub.NextMsg(time.Second); err != nil || msg.Subject != "foo" {
+			t.Fatalf("Expected message on foo, got %v, %v", msg, err)
+		}
+	}
+	if n := hook.deliveries("foo"); n != 2 {
+		t.Fatalf("Expected 2 deliveries on foo, got %d", n)
+	}
+	hook.Lock()
+	defer hook.Unlock()
+	for subject := range hook.delivers {
+		if strings.HasPrefix(subject, "_SYS.") {
+			t.Fatalf("Expected no delivery of system requests, got %q", subject)
+		}
+	}
+}
+
+func TestMessageHookSubscribe(t *testing.T) {
+	hook := newTestMessageHook()
+	s := runMessageHookServer(hook)
+	defer s.Shutdown()
+
+	errCh := make(chan error, 1)
+	nc, err := gio.Connect(fmt.Sprintf("nats://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port),
+		gio.ErrorHandler(func(_ *gio.Conn, _ *gio.Subscription, err error) {
+			errCh <- err
+		}))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	nc.SubscribeSync("refused")
+	select {
+	case err := <-errCh:
+		if !strings.Contains(err.Error(), "permissions violation") {
+			t.Fatalf("Expected subscription to be refused, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected subscription to be refused")
+	}
+	if n := s.NumSubscriptions(); n != 0 {
+		t.Fatalf("Expected no subscription, got %d", n)
+	}
+
+	unsub, _ := nc.SubscribeSync("unsub")
+	auto, _ := nc.SubscribeSync("auto")
+	auto.AutoUnsubscribe(1)
+	nc.SubscribeSync("closed")
+	nc.Flush()
+	unsub.Unsubscribe()
+	nc.Publish("auto", []byte("hello"))
+	nc.Flush()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		for _, subject := range []string{"unsub", "auto"} {
+			if subs, unsubs := hook.counts(subject); subs != 1 || unsubs != 1 {
+				return fmt.Errorf("Expected 1 subscription and unsubscription on %q, got %d and %d", subject, subs, unsubs)
+			}
+		}
+		return nil
+	})
+	if subs, unsubs := hook.counts("closed"); subs != 1 || unsubs != 0 {
+		t.Fatalf("Expected 1 subscription and no unsubscription, got %d and %d", subs, unsubs)
+	}
+
+	nc.Close()
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if _, unsubs := hook.counts("closed"); unsubs != 1 {
+			return fmt.Errorf("Expected unsubscription on close, got %d", unsubs)
+		}
+		return nil
+	})
+}
+
+func TestMessageHookReload(t *testing.T) {
+	opts, config := newOptionsWithSymlinkConfig(t, "tmp_hooks.conf", "./configs/reload/basic.conf")
+	defer os.Remove(config)
+	hook := newTestMessageHook()
+	opts.MessageHook = hook
+	opts.NoLog = true
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error reloading config: %v", err)
+	}
+	if s.getOpts().MessageHook != hook {
+		t.Fatal("Expected message hook to be kept on reload")
+	}
+}
+
+// benchmarkMessageHook publishes to a subscription of the same client,
+// with hook set.
+func benchmarkMessageHook(b *testing.B, hook MessageHook) {
+	opts := defaultServerOptions
+	opts.MessageHook = hook
+	_, c, cr, _ := rawSetup(opts)
+	go io.Copy(ioutil.Discard, cr)
+	c.parse([]byte("SUB foo 1\r\n"))
+
+	pub := []byte("PUB foo 5\r\nhello\r\n")
+	b.SetBytes(int64(len(pub)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.parse(pub)
+		for cp := range c.pcd {
+			cp.mu.Lock()
+			cp.flushOutbound()
+			cp.mu.Unlock()
+			delete(c.pcd, cp)
+		}
+	}
+	b.StopTimer()
+	c.nc.Close()
+}
+
+// noopMessageHook allows everything.
+type noopMessageHook struct{}
+
+func (noopMessageHook) OnPublish(*HookClient, *HookMsg) bool       { return true }
+func (noopMessageHook) OnDeliver(*HookSubscription, *HookMsg) bool { return true }
+func (noopMessageHook) OnSubscribe(*HookSubscription) bool         { return true }
+func (noopMessageHook) OnUnsubscribe(*HookSubscription)            {}
+
+func Benchmark_PubSubNoMessageHook(b *testing.B) {
+	benchmarkMessageHook(b, nil)
+}
+
+func Benchmark_PubSubMessageHook(b *testing.B) {
+	benchmarkMessageHook(b, noopMessageHook{})
+}
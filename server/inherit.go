@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net"
+	"strconv"
+)
+
+// Inherited listeners.
+//
+// A server can start with listeners opened by another process, which it
+// uses instead of listening itself when they listen on the address of the
+// options, so that no connection is refused while a process replaces
+// another. The listeners in use are tracked by name, so that they can be
+// handed off in turn. Inherited listeners that are not used once the
+// server is ready are closed.
+
+// Names of the listeners that can be inherited.
+const (
+	clientListenerName = "client"
+	routeListenerName  = "route"
+	httpListenerName   = "http"
+	httpsListenerName  = "https"
+	unixListenerName   = "unix"
+)
+
+// listen returns the listener inherited for name if it listens on addr,
+// or listens on addr, and tracks it as the listener in use for name.
+func (s *Server) listen(name, network, addr string) (net.Listener, error) {
+	l := s.inheritedListener(name, network, addr)
+	if l == nil {
+		var err error
+		if l, err = net.Listen(network, addr); err != nil {
+			return nil, err
+		}
+	}
+	s.trackListener(name, l)
+	return l, nil
+}
+
+// inheritedListener returns the listener inherited for name if it listens
+// on addr, nil otherwise. It is returned only once.
+func (s *Server) inheritedListener(name, network, addr string) net.Listener {
+	s.mu.Lock()
+	l := s.inherited[name]
+	delete(s.inherited, name)
+	s.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	if !listenerMatches(l, network, addr) {
+		s.Noticef("Not using the inherited %s listener on %s, listening on %s", name, l.Addr(), addr)
+		l.Close()
+		return nil
+	}
+	s.Noticef("Using the inherited %s listener on %s", name, l.Addr())
+	return l
+}
+
+// listenerMatches returns true if l listens on addr. Any port matches a
+// random one, and the unspecified addresses match each other.
+func listenerMatches(l net.Listener, network, addr string) bool {
+	if network == "unix" {
+		return l.Addr().Network() == "unix" && l.Addr().String() == addr
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	tcp, ok := l.Addr().(*net.TCPAddr)
+	if !ok || (port != "0" && port != strconv.Itoa(tcp.Port)) {
+		return false
+	}
+	if isUnspecifiedHost(host) {
+		return len(tcp.IP) == 0 || tcp.IP.IsUnspecified()
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return false
+		}
+	}
+	for _, ip := range ips {
+		if ip.Equal(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnspecifiedHost returns true if host listens on all the addresses.
+func isUnspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// trackListener records l as the listener in use for name.
+func (s *Server) trackListener(name string, l net.Listener) {
+	s.mu.Lock()
+	if s.listeners == nil {
+		s.listeners = make(map[string]net.Listener)
+	}
+	s.listeners[name] = l
+	s.mu.Unlock()
+}
+
+// closeInherited closes the inherited listeners that were not used.
+func (s *Server) closeInherited() {
+	s.mu.Lock()
+	inherited := s.inherited
+	s.inherited = nil
+	s.mu.Unlock()
+	for name, l := range inherited {
+		s.Noticef("Closing the unused inherited %s listener on %s", name, l.Addr())
+		l.Close()
+	}
+}
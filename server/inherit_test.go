@@ -0,0 +1,118 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readServerID returns the ID in the INFO of the server listening on addr.
+func readServerID(t *testing.T, network, addr string) string {
+	t.Helper()
+	c, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		t.Fatalf("Expected INFO, got %q (%v)", line, err)
+	}
+	var info Info
+	if err := json.Unmarshal([]byte(line[len("INFO "):]), &info); err != nil {
+		t.Fatalf("Error unmarshaling INFO: %v", err)
+	}
+	return info.ID
+}
+
+func TestInheritedListeners(t *testing.T) {
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Error on listen: %v", err)
+		}
+		return l
+	}
+	client, monitor, unused := listen(), listen(), listen()
+	port := client.Addr().(*net.TCPAddr).Port
+
+	opts := DefaultOptions()
+	opts.Port = port
+	opts.Cluster.Port = 0
+	s := New(opts)
+	s.inherited = map[string]net.Listener{
+		clientListenerName: client,
+		httpListenerName:   monitor,
+		routeListenerName:  unused,
+	}
+	go s.Start()
+	defer s.Shutdown()
+	if !s.ReadyForConnections(2 * time.Second) {
+		t.Fatal("Unable to start server")
+	}
+
+	s.mu.Lock()
+	l, tracked := s.listener, s.listeners[clientListenerName]
+	s.mu.Unlock()
+	if l != client || tracked != client {
+		t.Fatal("Expected the inherited client listener to be used")
+	}
+	if id := readServerID(t, "tcp", fmt.Sprintf("127.0.0.1:%d", port)); id != s.ID() {
+		t.Fatalf("Expected INFO of %q, got %q", s.ID(), id)
+	}
+	// Any port matches a random one.
+	if s.MonitorAddr().Port != monitor.Addr().(*net.TCPAddr).Port {
+		t.Fatal("Expected the inherited monitoring listener to be used")
+	}
+
+	// Routing is disabled, so the route listener is closed once ready.
+	s.closeInherited()
+	if _, err := unused.Accept(); err == nil {
+		t.Fatal("Expected the unused listener to be closed")
+	}
+
+	if listenerMatches(client, "tcp", "127.0.0.1:1") {
+		t.Fatal("Expected listener not to match another port")
+	}
+}
+
+func TestInheritedListenerMatches(t *testing.T) {
+	local, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	defer local.Close()
+	all, err := net.Listen("tcp", "0.0.0.0:0")
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	defer all.Close()
+	lport := local.Addr().(*net.TCPAddr).Port
+	allport := all.Addr().(*net.TCPAddr).Port
+
+	for _, test := range []struct {
+		l     net.Listener
+		addr  string
+		match bool
+	}{
+		{local, fmt.Sprintf("127.0.0.1:%d", lport), true},
+		{local, "127.0.0.1:0", true},
+		{local, fmt.Sprintf("localhost:%d", lport), true},
+		{local, fmt.Sprintf("127.0.0.2:%d", lport), false},
+		{local, fmt.Sprintf("0.0.0.0:%d", lport), false},
+		{local, fmt.Sprintf(":%d", lport), false},
+		{all, fmt.Sprintf("0.0.0.0:%d", allport), true},
+		{all, fmt.Sprintf(":%d", allport), true},
+		{all, fmt.Sprintf("[::]:%d", allport), true},
+		{all, fmt.Sprintf("127.0.0.1:%d", allport), false},
+	} {
+		if m := listenerMatches(test.l, "tcp", test.addr); m != test.match {
+			t.Fatalf("Expected listener on %s to match %s: %v, got %v", test.l.Addr(), test.addr, test.match, m)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+// Support for messages published and received by the server itself.
+// They go through the SYSTEM client, which has no connection and is
+// never registered with the server's clients.
+
+// internalMsgHandler is invoked for messages delivered to an internal
+// subscription. The msg does not include the trailing CR_LF and must
+// be copied if retained after the call.
+type internalMsgHandler func(sub *subscription, subject, reply string, msg []byte)
+
+// sysClient returns the internal client, creating it if needed.
+// Lock (sysMu) should be held.
+func (s *Server) sysClient() *client {
+	if s.sys == nil {
+		c := &client{srv: s, typ: SYSTEM, pcd: make(map[*client]struct{})}
+		c.cid = atomic.AddUint64(&s.gcid, 1)
+		c.subs = make(map[string]*subscription)
+		// The msg header starts with "MSG ",
+		// in bytes that is [77 83 71 32].
+		c.msgb = [msgScratchSize]byte{77, 83, 71, 32}
+		s.sys = c
+	}
+	return s.sys
+}
+
+// sendInternalMsg publishes a message generated by the server itself.
+// The message is delivered to local subscribers and forwarded to routes
+// with matching interest like any other message. It is never delivered
+// back to this server's own internal subscriptions.
+func (s *Server) sendInternalMsg(subject string, msg []byte) {
+	s.sysMu.Lock()
+	defer s.sysMu.Unlock()
+
+	c := s.sysClient()
+	c.pa.subject = []byte(subject)
+	c.pa.reply = nil
+	c.pa.size = len(msg)
+	c.pa.szb = []byte(strconv.Itoa(len(msg)))
+	c.processMsg(append(msg, CR_LF...))
+
+	// Signal the flushers of the connections we delivered to.
+	for cp := range c.pcd {
+		cp.mu.Lock()
+		cp.out.fsp--
+		cp.flushSignal()
+		cp.mu.Unlock()
+		delete(c.pcd, cp)
+	}
+}
+
+// sysSubscribe registers an internal subscription on subject. Interest
+// is propagated to the routes like for client subscriptions.
+func (s *Server) sysSubscribe(subject string, cb internalMsgHandler) (*subscription, error) {
+	s.sysMu.Lock()
+	c := s.sysClient()
+	s.sysSid++
+	sid := strconv.FormatUint(s.sysSid, 10)
+	s.sysMu.Unlock()
+
+	sub := &subscription{client: c, subject: []byte(subject), sid: []byte(sid), icb: cb}
+	c.mu.Lock()
+	c.subs[sid] = sub
+	err := s.sl.Insert(sub)
+	if err != nil {
+		delete(c.subs, sid)
+	}
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	s.broadcastSubscribe(sub)
+	return sub, nil
+}
+
+// sysUnsubscribe removes an internal subscription.
+func (s *Server) sysUnsubscribe(sub *subscription) {
+	sub.client.unsubscribe(sub)
+	s.broadcastUnSubscribe(sub)
+}
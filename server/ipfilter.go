@@ -0,0 +1,233 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+// IP allow and deny lists.
+//
+// The client, route and monitoring listeners can each be given lists of
+// allowed and denied networks, as CIDR blocks or single IP addresses.
+// Connections are checked as soon as they are accepted, before anything is
+// sent to them: a connection from a denied network is closed, and so is a
+// connection from outside of the allowed networks if there are any. Denied
+// networks take precedence. The number of connections rejected is reported
+// in Varz. Lists changed on reload apply to new connections.
+//
+// Users can also be restricted to networks, which is checked when they
+// authenticate.
+
+// ipFilter allows or denies IP addresses.
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// rejectedStats counts the connections rejected by the IP filters. Make
+// sure all are 64bits for atomic use.
+type rejectedStats struct {
+	clients int64
+	routes  int64
+	http    int64
+}
+
+// newIPFilter returns the filter for the allowed and denied networks, or
+// nil if there are none.
+func newIPFilter(allowed, denied []string) (*ipFilter, error) {
+	if len(allowed) == 0 && len(denied) == 0 {
+		return nil, nil
+	}
+	f := &ipFilter{}
+	var err error
+	if f.allow, err = parseIPNets(allowed); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseIPNets(denied); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// parseIPNets parses CIDR blocks. Single IP addresses are accepted as the
+// network of that address only.
+func parseIPNets(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid IP address or CIDR %q", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid IP address or CIDR %q: %v", cidr, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// allowed returns true if ip is not denied, and allowed if there are
+// allowed networks. A nil filter allows everything.
+func (f *ipFilter) allowed(ip net.IP) bool {
+	if f == nil {
+		return true
+	}
+	if ip == nil {
+		return len(f.allow) == 0
+	}
+	for _, n := range f.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(f.allow) == 0 {
+		return true
+	}
+	for _, n := range f.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// connIP returns the remote IP address of a connection, or nil if it does
+// not have one.
+func connIP(nc net.Conn) net.IP {
+	if addr, ok := nc.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// configureIPFilters sets up the IP filters of the listeners from the
+// current options.
+func (s *Server) configureIPFilters() error {
+	opts := s.getOpts()
+	clientFilter, err := newIPFilter(opts.AllowedCIDRs, opts.DeniedCIDRs)
+	if err != nil {
+		return err
+	}
+	routeFilter, err := newIPFilter(opts.Cluster.AllowedCIDRs, opts.Cluster.DeniedCIDRs)
+	if err != nil {
+		return fmt.Errorf("cluster: %v", err)
+	}
+	httpFilter, err := newIPFilter(opts.HTTPAllowedCIDRs, opts.HTTPDeniedCIDRs)
+	if err != nil {
+		return fmt.Errorf("monitoring: %v", err)
+	}
+	s.mu.Lock()
+	s.clientFilter = clientFilter
+	s.routeFilter = routeFilter
+	s.httpFilter = httpFilter
+	s.mu.Unlock()
+	return nil
+}
+
+// isClientIPAllowed checks a client connection against the client
+// listener's IP filter, and counts it if it is rejected.
+func (s *Server) isClientIPAllowed(nc net.Conn) bool {
+	s.mu.Lock()
+	f := s.clientFilter
+	s.mu.Unlock()
+	if f.allowed(connIP(nc)) {
+		return true
+	}
+	atomic.AddInt64(&s.rejected.clients, 1)
+	s.Debugf("Client connection from %s rejected by IP filter", nc.RemoteAddr())
+	return false
+}
+
+// isRouteIPAllowed checks a route connection against the route listener's
+// IP filter, and counts it if it is rejected.
+func (s *Server) isRouteIPAllowed(nc net.Conn) bool {
+	s.mu.Lock()
+	f := s.routeFilter
+	s.mu.Unlock()
+	if f.allowed(connIP(nc)) {
+		return true
+	}
+	atomic.AddInt64(&s.rejected.routes, 1)
+	s.Debugf("Route connection from %s rejected by IP filter", nc.RemoteAddr())
+	return false
+}
+
+// ipFilterListener is the monitoring listener, closing the connections
+// rejected by its IP filter.
+type ipFilterListener struct {
+	net.Listener
+	s *Server
+}
+
+// Accept waits for and returns the next connection allowed.
+func (l *ipFilterListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		l.s.mu.Lock()
+		f := l.s.httpFilter
+		l.s.mu.Unlock()
+		if f.allowed(connIP(conn)) {
+			return conn, nil
+		}
+		atomic.AddInt64(&l.s.rejected.http, 1)
+		l.s.Debugf("Monitoring connection from %s rejected by IP filter", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// isUserIPAllowed returns true if the user can connect from the address of
+// the client.
+func isUserIPAllowed(user *User, c *client) bool {
+	if len(user.AllowedCIDRs) == 0 {
+		return true
+	}
+	f, err := newIPFilter(user.AllowedCIDRs, nil)
+	if err != nil {
+		return false
+	}
+	c.mu.Lock()
+	nc := c.nc
+	c.mu.Unlock()
+	if nc == nil {
+		return false
+	}
+	return f.allowed(connIP(nc))
+}
+
+// parseCIDRs parses a list of networks, given as a single string or as an
+// array of strings.
+func parseCIDRs(v interface{}) ([]string, error) {
+	var cidrs []string
+	switch v := v.(type) {
+	case string:
+		cidrs = []string{v}
+	case []interface{}:
+		for _, e := range v {
+			cidr, ok := e.(string)
+			if !ok {
+				return nil, fmt.Errorf("Expected CIDR to be a string, got %v", e)
+			}
+			cidrs = append(cidrs, cidr)
+		}
+	default:
+		return nil, fmt.Errorf("Expected CIDRs to be a string or an array, got %v", v)
+	}
+	if _, err := parseIPNets(cidrs); err != nil {
+		return nil, err
+	}
+	return cidrs, nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestIPFilter(t *testing.T) {
+	f, err := newIPFilter([]string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}, []string{"10.1.0.0/16", "10.2.3.4"})
+	if err != nil {
+		t.Fatalf("Error creating filter: %v", err)
+	}
+	for _, test := range []struct {
+		ip      string
+		allowed bool
+	}{
+		{"10.0.0.1", true},
+		{"10.1.2.3", false},
+		{"10.2.3.4", false},
+		{"10.2.3.5", true},
+		{"192.168.1.1", true},
+		{"192.168.1.2", false},
+		{"::ffff:10.0.0.1", true},
+		{"fd00::1", true},
+		{"fe80::1", false},
+	} {
+		if allowed := f.allowed(net.ParseIP(test.ip)); allowed != test.allowed {
+			t.Fatalf("Expected %s allowed to be %v, got %v", test.ip, test.allowed, allowed)
+		}
+	}
+
+	// Without allowed networks, all but the denied ones are allowed.
+	f, _ = newIPFilter(nil, []string{"10.0.0.0/8"})
+	if f.allowed(net.ParseIP("10.0.0.1")) || !f.allowed(net.ParseIP("127.0.0.1")) {
+		t.Fatal("Expected only denied networks to be rejected")
+	}
+	if f, _ := newIPFilter(nil, nil); f != nil || !f.allowed(net.ParseIP("10.0.0.1")) {
+		t.Fatal("Expected no filter to allow everything")
+	}
+	for _, cidr := range []string{"10.0.0.0/33", "10.0.0", "localhost"} {
+		if _, err := newIPFilter([]string{cidr}, nil); err == nil {
+			t.Fatalf("Expected error for %q", cidr)
+		}
+	}
+}
+
+func TestIPFilterConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/ip_filter.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	for _, test := range []struct {
+		name     string
+		got      []string
+		expected []string
+	}{
+		{"allowed_cidrs", opts.AllowedCIDRs, []string{"127.0.0.0/8", "10.0.0.0/8"}},
+		{"denied_cidrs", opts.DeniedCIDRs, []string{"10.1.2.3"}},
+		{"http_allowed_cidrs", opts.HTTPAllowedCIDRs, []string{"127.0.0.1"}},
+		{"cluster denied_cidrs", opts.Cluster.DeniedCIDRs, []string{"192.168.0.0/16", "fd00::/8"}},
+		{"alice allowed_cidrs", opts.Users[0].AllowedCIDRs, []string{"10.0.0.0/8"}},
+		{"bob allowed_cidrs", opts.Users[1].AllowedCIDRs, []string{"127.0.0.1"}},
+	} {
+		if !reflect.DeepEqual(test.got, test.expected) {
+			t.Fatalf("Expected %s to be %v, got %v", test.name, test.expected, test.got)
+		}
+	}
+	if cc := CheckConfigFile("./configs/ip_filter.conf"); len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+	if _, err := parseCIDRs([]interface{}{"10.0.0.0/8", int64(1)}); err == nil {
+		t.Fatal("Expected error for a CIDR that is not a string")
+	}
+	if _, err := parseCIDRs("10.0.0.0/64"); err == nil {
+		t.Fatal("Expected error for an invalid CIDR")
+	}
+}
+
+func TestIPFilterClients(t *testing.T) {
+	opts := DefaultOptions()
+	opts.DeniedCIDRs = []string{"127.0.0.1"}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	addr := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	if nc, err := gio.Connect(addr, gio.Timeout(time.Second)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to be rejected")
+	}
+	// The connection did not reach the server.
+	if n := s.NumClients(); n != 0 {
+		t.Fatalf("Expected no client, got %d", n)
+	}
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error getting varz: %v", err)
+	}
+	if v.RejectedConns != 1 {
+		t.Fatalf("Expected 1 rejected connection, got %d", v.RejectedConns)
+	}
+
+	// Allowed after a reload.
+	newOpts := *s.getOpts()
+	newOpts.DeniedCIDRs = nil
+	newOpts.AllowedCIDRs = []string{"127.0.0.0/8"}
+	if err := s.reloadOptions(&newOpts); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	nc, err := gio.Connect(addr)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+}
+
+func TestIPFilterUsers(t *testing.T) {
+	s, opts := RunServerWithConfig("./configs/ip_filter.conf")
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, s.Addr().(*net.TCPAddr).Port)
+	if nc, err := gio.Connect(url, gio.UserInfo("alice", "foo")); err == nil {
+		nc.Close()
+		t.Fatal("Expected alice to not be allowed to connect from 127.0.0.1")
+	}
+	nc, err := gio.Connect(url, gio.UserInfo("bob", "bar"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+}
+
+func TestIPFilterRoutes(t *testing.T) {
+	optsA, _ := ProcessConfigFile("./configs/seed.conf")
+	optsA.NoSigs, optsA.NoLog = true, true
+	optsA.Cluster.DeniedCIDRs = []string{"127.0.0.0/8"}
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := nextServerOpts(optsA)
+	optsB.Cluster.DeniedCIDRs = nil
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://%s:%d", optsA.Cluster.Host, srvA.ClusterAddr().Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt64(&srvA.rejected.routes); n == 0 {
+			return fmt.Errorf("Expected route connections to be rejected")
+		}
+		return nil
+	})
+	if n := srvA.NumRoutes(); n != 0 {
+		t.Fatalf("Expected no route, got %d", n)
+	}
+}
+
+func TestIPFilterMonitoring(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HTTPDeniedCIDRs = []string{"127.0.0.1"}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, VarzPath)
+	c := &http.Client{Timeout: time.Second}
+	if resp, err := c.Get(url); err == nil {
+		resp.Body.Close()
+		t.Fatal("Expected monitoring connection to be rejected")
+	}
+	v, err := s.Varz(nil)
+	if err != nil {
+		t.Fatalf("Error getting varz: %v", err)
+	}
+	if v.RejectedHTTP == 0 {
+		t.Fatal("Expected rejected monitoring connections")
+	}
+
+	newOpts := *s.getOpts()
+	newOpts.HTTPDeniedCIDRs = nil
+	if err := s.reloadOptions(&newOpts); err != nil {
+		t.Fatalf("Error on reload: %v", err)
+	}
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("Error getting varz: %v", err)
+	}
+	resp.Body.Close()
+}
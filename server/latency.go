@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Request/reply latency sampling.
+//
+// Requests published to a configured service subject are sampled based on
+// a hash of their reply subject, so that all servers of a cluster take the
+// same decision for a given request without any coordination. The server
+// the requester is connected to measures the total latency, while the server
+// the responder is connected to measures the service latency. When those are
+// different servers, the latter sends its measurement to the former through
+// an internal subject. The complete metric is then published as a
+// ServiceLatency to the latency subject (see Options.LatencySubject).
+
+// latencyRespPrefix is the prefix of the internal subject a server receives
+// service measurements on, the suffix being the server's ID.
+const latencyRespPrefix = "_SYS.LATENCY.RESP."
+
+const (
+	// Maximum number of requests being tracked at any given time.
+	maxLatencyTracked = 10000
+
+	// Tracked requests that got no response after this are discarded.
+	latencyTrackedMaxAge = 2 * time.Minute
+
+	// How often tracked requests are checked for expiry.
+	latencyExpireInterval = time.Second
+)
+
+// ServiceLatencyConfig selects the requests that are sampled.
+type ServiceLatencyConfig struct {
+	Subject  string `json:"subject"`
+	Sampling int    `json:"sampling"` // Percentage of requests sampled, 1-100.
+}
+
+// LatencyClient describes the requester or the responder of a sampled request.
+type LatencyClient struct {
+	Server string        `json:"server_id"`
+	Cid    uint64        `json:"cid"`
+	User   string        `json:"user,omitempty"`
+	RTT    time.Duration `json:"rtt"`
+}
+
+// ServiceLatency is the metric published for each sampled request.
+// ServiceLatency is the time the responder took to process the request,
+// from the time it was delivered to it, minus the responder's RTT.
+// TotalLatency is the time between the request and the response as seen
+// by the requester's server, plus the requester's RTT.
+type ServiceLatency struct {
+	Subject        string        `json:"subject"`
+	Requester      LatencyClient `json:"requester"`
+	Responder      LatencyClient `json:"responder"`
+	RequestStart   time.Time     `json:"start"`
+	ServiceLatency time.Duration `json:"service"`
+	TotalLatency   time.Duration `json:"total"`
+}
+
+// latencyResponse is the measurement made by the responder's server.
+type latencyResponse struct {
+	Reply     string        `json:"reply"`
+	Responder LatencyClient `json:"responder"`
+	Service   time.Duration `json:"service"`
+}
+
+// latencyRequest is a sampled request tracked by the requester's server.
+type latencyRequest struct {
+	start     time.Time
+	subject   string
+	requester LatencyClient
+	respAt    time.Time
+	resp      *latencyResponse
+}
+
+// latencyServed is a sampled request tracked by every server it went
+// through, in case the responder is connected to it.
+type latencyServed struct {
+	start  time.Time
+	origin string // ID of the requester's server.
+}
+
+type latencyTracker struct {
+	// Number of requests and responses being tracked, so that the other
+	// messages are skipped without locking. Here first for alignment.
+	tracked int64
+
+	mu       sync.Mutex
+	id       string
+	subject  string
+	services []*ServiceLatencyConfig
+	requests map[string]*latencyRequest
+	served   map[string]*latencyServed
+	expired  time.Time // When tracked requests were last checked for expiry.
+}
+
+func newLatencyTracker(id string, opts *Options) *latencyTracker {
+	if len(opts.ServiceLatency) == 0 {
+		return nil
+	}
+	return &latencyTracker{
+		id:       id,
+		subject:  opts.LatencySubject,
+		services: opts.ServiceLatency,
+		requests: make(map[string]*latencyRequest),
+		served:   make(map[string]*latencyServed),
+	}
+}
+
+// sampled returns true if the request on subject with the given reply
+// subject should be sampled. The services are not changed after creation,
+// so no lock is needed.
+func (lt *latencyTracker) sampled(subject, reply []byte) bool {
+	for _, sl := range lt.services {
+		if !matchLiteral(string(subject), sl.Subject) {
+			continue
+		}
+		if sl.Sampling >= 100 {
+			return true
+		}
+		h := fnv.New32a()
+		h.Write(reply)
+		return int(h.Sum32()%100) < sl.Sampling
+	}
+	return false
+}
+
+// prune discards requests that are too old if there are too many tracked.
+// Returns false if there is no room to track a new request.
+// Lock should be held.
+func (lt *latencyTracker) prune(now time.Time) bool {
+	if len(lt.served) < maxLatencyTracked && len(lt.requests) < maxLatencyTracked {
+		return true
+	}
+	lt.expire(now, true)
+	return len(lt.served) < maxLatencyTracked && len(lt.requests) < maxLatencyTracked
+}
+
+// expire discards requests that are too old, at most once per
+// latencyExpireInterval unless forced, so that the requests that never get
+// a response do not keep the other messages from skipping the tracker.
+// Lock should be held.
+func (lt *latencyTracker) expire(now time.Time, force bool) {
+	if !force && now.Sub(lt.expired) < latencyExpireInterval {
+		return
+	}
+	lt.expired = now
+	for reply, sv := range lt.served {
+		if now.Sub(sv.start) > latencyTrackedMaxAge {
+			delete(lt.served, reply)
+		}
+	}
+	for reply, rq := range lt.requests {
+		if now.Sub(rq.start) > latencyTrackedMaxAge {
+			delete(lt.requests, reply)
+		}
+	}
+}
+
+// updateTracked updates the number of requests and responses tracked.
+// Lock should be held.
+func (lt *latencyTracker) updateTracked() {
+	atomic.StoreInt64(&lt.tracked, int64(len(lt.served)+len(lt.requests)))
+}
+
+func (lt *latencyTracker) clientInfo(c *client) LatencyClient {
+	c.mu.Lock()
+	lc := LatencyClient{Server: lt.id, Cid: c.cid, User: c.opts.Username, RTT: c.rtt}
+	c.mu.Unlock()
+	return lc
+}
+
+// trackLatency is called for each message processed by the server. It
+// starts tracking sampled requests and detects responses to them.
+func (s *Server) trackLatency(c *client) {
+	if c.typ != CLIENT && c.typ != ROUTER {
+		return
+	}
+	lt := s.latency
+	// Most messages are neither sampled requests nor responses to tracked
+	// ones, skip them without locking or allocating.
+	sample := len(c.pa.reply) > 0 && lt.sampled(c.pa.subject, c.pa.reply)
+	if !sample && atomic.LoadInt64(&lt.tracked) == 0 {
+		return
+	}
+	now := time.Now()
+	subject := string(c.pa.subject)
+
+	lt.mu.Lock()
+	// Check if this is the response to a sampled request.
+	sv, isResp := lt.served[subject]
+	if isResp {
+		delete(lt.served, subject)
+		// Only the responder's server measures the service latency.
+		isResp = c.typ == CLIENT
+	}
+	var done *latencyRequest
+	if rq := lt.requests[subject]; rq != nil {
+		if rq.respAt.IsZero() {
+			rq.respAt = now
+		}
+		if rq.resp != nil || isResp {
+			delete(lt.requests, subject)
+			done = rq
+		}
+	}
+	lt.expire(now, false)
+	lt.updateTracked()
+	lt.mu.Unlock()
+
+	if sample {
+		s.trackRequest(c, now)
+	}
+	if !isResp {
+		if done != nil {
+			s.sendLatency(done)
+		}
+		return
+	}
+
+	resp := &latencyResponse{Reply: subject, Responder: lt.clientInfo(c)}
+	resp.Service = now.Sub(sv.start) - resp.Responder.RTT
+	if resp.Service < 0 {
+		resp.Service = 0
+	}
+	if done != nil {
+		// Requester and responder are both connected to this server.
+		done.resp = resp
+		s.sendLatency(done)
+		return
+	}
+	if sv.origin == lt.id {
+		return
+	}
+	b, err := json.Marshal(resp)
+	if err != nil {
+		s.Errorf("Error marshaling latency measurement: %v", err)
+		return
+	}
+	s.sendInternalMsg(latencyRespPrefix+sv.origin, b)
+}
+
+// trackRequest starts tracking a sampled request.
+func (s *Server) trackRequest(c *client, now time.Time) {
+	lt := s.latency
+	reply := string(c.pa.reply)
+	origin := lt.id
+	var rq *latencyRequest
+	if c.typ == ROUTER {
+		c.mu.Lock()
+		if c.route != nil {
+			origin = c.route.remoteID
+		}
+		c.mu.Unlock()
+	} else {
+		rq = &latencyRequest{start: now, subject: string(c.pa.subject), requester: lt.clientInfo(c)}
+	}
+
+	lt.mu.Lock()
+	if lt.prune(now) {
+		lt.served[reply] = &latencyServed{start: now, origin: origin}
+		if rq != nil {
+			lt.requests[reply] = rq
+		}
+	}
+	lt.updateTracked()
+	lt.mu.Unlock()
+}
+
+// processLatencyResponse handles a measurement sent by the responder's server.
+func (s *Server) processLatencyResponse(sub *subscription, subject, reply string, msg []byte) {
+	resp := &latencyResponse{}
+	if err := json.Unmarshal(msg, resp); err != nil {
+		s.Errorf("Error unmarshaling latency measurement: %v", err)
+		return
+	}
+	lt := s.latency
+	lt.mu.Lock()
+	rq := lt.requests[resp.Reply]
+	if rq != nil {
+		rq.resp = resp
+		// The response itself may not have been received yet.
+		if rq.respAt.IsZero() {
+			rq = nil
+		} else {
+			delete(lt.requests, resp.Reply)
+		}
+	}
+	lt.updateTracked()
+	lt.mu.Unlock()
+	if rq != nil {
+		s.sendLatency(rq)
+	}
+}
+
+// sendLatency publishes the metric for a completed request.
+func (s *Server) sendLatency(rq *latencyRequest) {
+	m := &ServiceLatency{
+		Subject:        rq.subject,
+		Requester:      rq.requester,
+		Responder:      rq.resp.Responder,
+		RequestStart:   rq.start.UTC(),
+		ServiceLatency: rq.resp.Service,
+		TotalLatency:   rq.respAt.Sub(rq.start) + rq.requester.RTT,
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		s.Errorf("Error marshaling latency metric: %v", err)
+		return
+	}
+	s.sendInternalMsg(s.latency.subject, b)
+}
+
+// startLatencyTracking subscribes to the measurements sent by other servers.
+func (s *Server) startLatencyTracking() error {
+	_, err := s.sysSubscribe(latencyRespPrefix+s.latency.id, s.processLatencyResponse)
+	return err
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestLatencyConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/latency.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.LatencySubject != "metrics.latency" {
+		t.Fatalf("Unexpected latency subject: %q", opts.LatencySubject)
+	}
+	expected := []*ServiceLatencyConfig{
+		{Subject: "svc.echo", Sampling: 100},
+		{Subject: "svc.>", Sampling: 25},
+	}
+	if !reflect.DeepEqual(opts.ServiceLatency, expected) {
+		t.Fatalf("Unexpected services: %+v", opts.ServiceLatency)
+	}
+
+	for _, sampling := range []interface{}{int64(0), int64(101), "abc"} {
+		lm := map[string]interface{}{
+			"services": []interface{}{
+				map[string]interface{}{"subject": "foo", "sampling": sampling},
+			},
+		}
+		if err := parseLatency(lm, &Options{}); err == nil {
+			t.Fatalf("Expected error for sampling %v", sampling)
+		}
+	}
+}
+
+func TestLatencySampling(t *testing.T) {
+	lt := &latencyTracker{services: []*ServiceLatencyConfig{{Subject: "foo.*", Sampling: 50}}}
+	if lt.sampled([]byte("bar"), []byte("reply")) {
+		t.Fatal("Expected subject not matching a service not to be sampled")
+	}
+	sampled := 0
+	for i := 0; i < 1000; i++ {
+		reply := []byte(fmt.Sprintf("_INBOX.%d", i))
+		if lt.sampled([]byte("foo.bar"), reply) {
+			sampled++
+		}
+		// Decision must be the same on all servers.
+		if lt.sampled([]byte("foo.bar"), reply) != lt.sampled([]byte("foo.bar"), reply) {
+			t.Fatal("Expected sampling decision to be deterministic")
+		}
+	}
+	if sampled < 400 || sampled > 600 {
+		t.Fatalf("Expected about half of the requests to be sampled, got %d", sampled)
+	}
+}
+
+func latencyMetric(t *testing.T, sub *gio.Subscription) *ServiceLatency {
+	t.Helper()
+	m, err := sub.NextMsg(2 * time.Second)
+	if err != nil {
+		t.Fatalf("Expected latency metric: %v", err)
+	}
+	sl := &ServiceLatency{}
+	if err := json.Unmarshal(m.Data, sl); err != nil {
+		t.Fatalf("Error unmarshaling latency metric: %v", err)
+	}
+	return sl
+}
+
+func TestLatencyLocalService(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ServiceLatency = []*ServiceLatencyConfig{{Subject: "svc.>", Sampling: 100}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	responder, err := gio.Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer responder.Close()
+	responder.Subscribe("svc.echo", func(m *gio.Msg) {
+		time.Sleep(20 * time.Millisecond)
+		responder.Publish(m.Reply, m.Data)
+	})
+	responder.Flush()
+
+	requester, err := gio.Connect(url)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer requester.Close()
+	metrics, _ := requester.SubscribeSync(DEFAULT_LATENCY_SUBJECT)
+	requester.Flush()
+
+	// Not a service subject.
+	requester.Request("foo", []byte("hello"), 100*time.Millisecond)
+	if _, err := requester.Request("svc.echo", []byte("hello"), time.Second); err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+
+	sl := latencyMetric(t, metrics)
+	if sl.Subject != "svc.echo" {
+		t.Fatalf("Unexpected subject: %q", sl.Subject)
+	}
+	if sl.Requester.Server != s.ID() || sl.Responder.Server != s.ID() {
+		t.Fatalf("Unexpected servers: %+v", sl)
+	}
+	if sl.Requester.Cid == sl.Responder.Cid {
+		t.Fatalf("Expected different requester and responder: %+v", sl)
+	}
+	if sl.ServiceLatency < 15*time.Millisecond || sl.TotalLatency < sl.ServiceLatency {
+		t.Fatalf("Unexpected latencies: service=%v total=%v", sl.ServiceLatency, sl.TotalLatency)
+	}
+	if _, err := metrics.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("Did not expect another metric")
+	}
+	// Nothing left tracked, other messages skip the tracker.
+	if n := atomic.LoadInt64(&s.latency.tracked); n != 0 {
+		t.Fatalf("Expected nothing tracked, got %d", n)
+	}
+}
+
+func TestLatencyExpired(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ServiceLatency = []*ServiceLatencyConfig{{Subject: "svc.>", Sampling: 100}}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc, err := gio.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// A request that never gets a response.
+	nc.PublishRequest("svc.none", "reply", []byte("hello"))
+	nc.Flush()
+	lt := s.latency
+	if n := atomic.LoadInt64(&lt.tracked); n == 0 {
+		t.Fatal("Expected the request to be tracked")
+	}
+
+	// Once too old, it is discarded on the next message.
+	lt.mu.Lock()
+	past := time.Now().Add(-latencyTrackedMaxAge - time.Second)
+	for _, sv := range lt.served {
+		sv.start = past
+	}
+	for _, rq := range lt.requests {
+		rq.start = past
+	}
+	lt.expired = time.Time{}
+	lt.mu.Unlock()
+	nc.Publish("foo", []byte("hello"))
+	nc.Flush()
+	if n := atomic.LoadInt64(&lt.tracked); n != 0 {
+		t.Fatalf("Expected nothing tracked, got %d", n)
+	}
+}
+
+func TestLatencyAcrossRoutes(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.ServiceLatency = []*ServiceLatencyConfig{{Subject: "svc.echo", Sampling: 100}}
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", srvA.ClusterAddr().Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	responder, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsB.Host, srvB.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer responder.Close()
+	responder.Subscribe("svc.echo", func(m *gio.Msg) {
+		responder.Publish(m.Reply, m.Data)
+	})
+	responder.Flush()
+
+	requester, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsA.Host, srvA.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer requester.Close()
+	metrics, _ := requester.SubscribeSync(DEFAULT_LATENCY_SUBJECT)
+	requester.Flush()
+
+	// Wait for the service interest on A and the internal
+	// subscriptions of both servers to be propagated.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := srvA.NumSubscriptions(); n != 4 {
+			return fmt.Errorf("Expected 4 subscriptions on A, got %d", n)
+		}
+		if n := srvB.NumSubscriptions(); n != 4 {
+			return fmt.Errorf("Expected 4 subscriptions on B, got %d", n)
+		}
+		return nil
+	})
+
+	if _, err := requester.Request("svc.echo", []byte("hello"), time.Second); err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+
+	sl := latencyMetric(t, metrics)
+	if sl.Requester.Server != srvA.ID() {
+		t.Fatalf("Expected requester on %q, got %q", srvA.ID(), sl.Requester.Server)
+	}
+	if sl.Responder.Server != srvB.ID() {
+		t.Fatalf("Expected responder on %q, got %q", srvB.ID(), sl.Responder.Server)
+	}
+	if sl.TotalLatency < sl.ServiceLatency {
+		t.Fatalf("Unexpected latencies: service=%v total=%v", sl.ServiceLatency, sl.TotalLatency)
+	}
+}
@@ -94,6 +94,17 @@ type ConnInfo struct {
 	TLSCipher      string     `json:"tls_cipher_suite,omitempty"`
 	AuthorizedUser string     `json:"authorized_user,omitempty"`
 	Subs           []string   `json:"subscriptions_list,omitempty"`
+
+	// SlowConsumerPolicy is set unless the connection is closed as a
+	// slow consumer, and Dropped is the number of messages it dropped.
+	SlowConsumerPolicy string `json:"slow_consumer_policy,omitempty"`
+	Dropped            int64  `json:"dropped_msgs,omitempty"`
+
+	// MaxSubs is the maximum number of subscriptions of the connection.
+	MaxSubs int `json:"max_subscriptions,omitempty"`
+
+	// PeerCredentials are set for unix domain socket connections.
+	PeerCredentials *PeerCredentials `json:"peer_credentials,omitempty"`
 }
 
 // DefaultConnListSize is the default size of the connection list.
@@ -354,6 +365,12 @@ func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time) {
 	ci.Name = client.opts.Name
 	ci.Lang = client.opts.Lang
 	ci.Version = client.opts.Version
+	if client.out.scp > SlowConsumerClose {
+		ci.SlowConsumerPolicy = client.out.scp.String()
+	}
+	ci.Dropped = client.outDropped
+	ci.MaxSubs = client.msubs
+	ci.PeerCredentials = client.pcred
 	// inMsgs and inBytes are updated outside of the client's lock, so
 	// we need to use atomic here.
 	ci.InMsgs = atomic.LoadInt64(&client.inMsgs)
@@ -370,7 +387,7 @@ func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time) {
 	}
 
 	switch conn := nc.(type) {
-	case *net.TCPConn, *tls.Conn:
+	case *net.TCPConn, *proxyConn, *tls.Conn:
 		addr := conn.RemoteAddr().(*net.TCPAddr)
 		ci.Port = addr.Port
 		ci.IP = addr.IP.String()
@@ -544,6 +561,15 @@ type RouteInfo struct {
 	OutBytes     int64    `json:"out_bytes"`
 	NumSubs      uint32   `json:"subscriptions"`
 	Subs         []string `json:"subscriptions_list,omitempty"`
+
+	PoolIndex        int    `json:"pool_index,omitempty"`
+	DedicatedSubject string `json:"dedicated_subject,omitempty"`
+
+	Compression         string  `json:"compression,omitempty"`
+	OutCompressed       bool    `json:"out_compressed,omitempty"`
+	InCompressed        bool    `json:"in_compressed,omitempty"`
+	OutCompressionRatio float64 `json:"out_compression_ratio,omitempty"`
+	InCompressionRatio  float64 `json:"in_compression_ratio,omitempty"`
 }
 
 // Routez returns a Routez struct containing inormation about routes.
@@ -562,37 +588,64 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 
 	for _, r := range s.routes {
 		r.mu.Lock()
-		ri := &RouteInfo{
-			Rid:          r.cid,
-			RemoteID:     r.route.remoteID,
-			DidSolicit:   r.route.didSolicit,
-			IsConfigured: r.route.routeType == Explicit,
-			InMsgs:       atomic.LoadInt64(&r.inMsgs),
-			OutMsgs:      r.outMsgs,
-			InBytes:      atomic.LoadInt64(&r.inBytes),
-			OutBytes:     r.outBytes,
-			NumSubs:      uint32(len(r.subs)),
+		rs.Routes = append(rs.Routes, newRouteInfo(r, subs))
+		var pooled []*client
+		if r.route.pool != nil {
+			pooled = r.route.pool.members()
 		}
+		r.mu.Unlock()
 
-		if subs && len(r.subs) > 0 {
-			ri.Subs = make([]string, 0, len(r.subs))
-			for _, sub := range r.subs {
-				ri.Subs = append(ri.Subs, string(sub.subject))
+		// The pooled connections of the route are listed after it.
+		for _, pc := range pooled {
+			pc.mu.Lock()
+			if pc.nc != nil {
+				rs.Routes = append(rs.Routes, newRouteInfo(pc, false))
 			}
+			pc.mu.Unlock()
 		}
-		switch conn := r.nc.(type) {
-		case *net.TCPConn, *tls.Conn:
-			addr := conn.RemoteAddr().(*net.TCPAddr)
-			ri.Port = addr.Port
-			ri.IP = addr.IP.String()
-		}
-		r.mu.Unlock()
-		rs.Routes = append(rs.Routes, ri)
 	}
 	s.mu.Unlock()
 	return rs, nil
 }
 
+// newRouteInfo returns the information about a route connection. Lock of
+// the route should be held.
+func newRouteInfo(r *client, subs bool) *RouteInfo {
+	ri := &RouteInfo{
+		Rid:              r.cid,
+		RemoteID:         r.route.remoteID,
+		DidSolicit:       r.route.didSolicit,
+		IsConfigured:     r.route.routeType == Explicit && r.route.primary == nil,
+		InMsgs:           atomic.LoadInt64(&r.inMsgs),
+		OutMsgs:          r.outMsgs,
+		InBytes:          atomic.LoadInt64(&r.inBytes),
+		OutBytes:         r.outBytes,
+		NumSubs:          uint32(len(r.subs)),
+		PoolIndex:        r.route.poolIdx,
+		DedicatedSubject: r.route.poolSubject,
+	}
+	if rc := r.route.comp; rc != nil && rc.mode != CompressionOff && rc.mode != "" {
+		ri.Compression = rc.mode
+		ri.OutCompressed = rc.out != nil
+		ri.InCompressed = rc.in
+		ri.OutCompressionRatio = compressionRatio(atomic.LoadInt64(&rc.rawOut), atomic.LoadInt64(&rc.compOut))
+		ri.InCompressionRatio = compressionRatio(atomic.LoadInt64(&rc.rawIn), atomic.LoadInt64(&rc.compIn))
+	}
+	if subs && len(r.subs) > 0 {
+		ri.Subs = make([]string, 0, len(r.subs))
+		for _, sub := range r.subs {
+			ri.Subs = append(ri.Subs, string(sub.subject))
+		}
+	}
+	switch conn := r.nc.(type) {
+	case *net.TCPConn, *proxyConn, *tls.Conn:
+		addr := conn.RemoteAddr().(*net.TCPAddr)
+		ri.Port = addr.Port
+		ri.IP = addr.IP.String()
+	}
+	return ri
+}
+
 // HandleRoutez process HTTP requests for route information.
 func (s *Server) HandleRoutez(w http.ResponseWriter, r *http.Request) {
 	subs, err := decodeBool(w, r, "subs")
@@ -646,9 +699,13 @@ type SubszOptions struct {
 	Test string `json:"test,omitempty"`
 }
 
+// SubDetail is the detail of a subscription. Msgs is the number of
+// messages delivered to it, which for queue subscriptions shows how
+// messages are spread among the members of the group.
 type SubDetail struct {
 	Subject string `json:"subject"`
 	Queue   string `json:"qgroup,omitempty"`
+	Weight  int    `json:"weight,omitempty"`
 	Sid     string `json:"sid"`
 	Msgs    int64  `json:"msgs"`
 	Max     int64  `json:"max,omitempty"`
@@ -712,6 +769,9 @@ func (s *Server) Subsz(opts *SubszOptions) (*Subsz, error) {
 				Max:     sub.max,
 				Cid:     sub.client.cid,
 			}
+			if sub.queue != nil {
+				details[i].Weight = sub.queueWeight()
+			}
 			sub.client.mu.Unlock()
 			i++
 		}
@@ -803,6 +863,44 @@ func (s *Server) HandleStacksz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, buf[:n])
 }
 
+// HandleReload triggers a config reload, or only reports what it would
+// change with the dry_run parameter. It requires a POST with the configured
+// reload token as a bearer token, and is disabled if there is none.
+func (s *Server) HandleReload(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[ReloadPath]++
+	s.mu.Unlock()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !s.checkReloadToken(token) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	dryRun, err := decodeBool(w, r, "dry_run")
+	if err != nil {
+		return
+	}
+
+	report, err := s.reload(dryRun)
+	if err != nil {
+		s.Errorf("Reload from monitoring failed: %v", err)
+	}
+	b, jerr := json.MarshalIndent(report, "", "  ")
+	if jerr != nil {
+		s.Errorf("Error marshaling response to /reload request: %v", jerr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	w.Write(b)
+}
+
 // Varz will output server information on the monitoring port at /varz.
 type Varz struct {
 	*Info
@@ -824,11 +922,16 @@ type Varz struct {
 	InBytes          int64             `json:"in_bytes"`
 	OutBytes         int64             `json:"out_bytes"`
 	SlowConsumers    int64             `json:"slow_consumers"`
+	RejectedConns    int64             `json:"rejected_connections"`
+	RejectedRoutes   int64             `json:"rejected_routes"`
+	RejectedHTTP     int64             `json:"rejected_monitoring_connections"`
+	Rebalanced       int64             `json:"rebalanced_clients"`
 	MaxPending       int64             `json:"max_pending"`
 	WriteDeadline    time.Duration     `json:"write_deadline"`
 	Subscriptions    uint32            `json:"subscriptions"`
 	HTTPReqStats     map[string]uint64 `json:"http_req_stats"`
 	ConfigLoadTime   time.Time         `json:"config_load_time"`
+	TLSCerts         []*TLSCertInfo    `json:"tls_certs,omitempty"`
 }
 
 // VarzOptions are the options passed to Varz().
@@ -911,10 +1014,15 @@ func (s *Server) Varz(varzOpts *VarzOptions) (*Varz, error) {
 	v.OutMsgs = atomic.LoadInt64(&s.outMsgs)
 	v.OutBytes = atomic.LoadInt64(&s.outBytes)
 	v.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
+	v.RejectedConns = atomic.LoadInt64(&s.rejected.clients)
+	v.RejectedRoutes = atomic.LoadInt64(&s.rejected.routes)
+	v.RejectedHTTP = atomic.LoadInt64(&s.rejected.http)
+	v.Rebalanced = atomic.LoadInt64(&s.rebalanced)
 	v.MaxPending = opts.MaxPending
 	v.WriteDeadline = opts.WriteDeadline
 	v.Subscriptions = s.sl.Count()
 	v.ConfigLoadTime = s.configTime
+	v.TLSCerts = append(tlsCertInfos("client", opts.TLSConfig), tlsCertInfos("cluster", opts.Cluster.TLSConfig)...)
 	// Need a copy here since s.httpReqStats can change while doing
 	// the marshaling down below.
 	v.HTTPReqStats = make(map[string]uint64, len(s.httpReqStats))
@@ -1011,6 +1119,12 @@ func (reason ClosedState) String() string {
 		return "Route Removed"
 	case ServerShutdown:
 		return "Server Shutdown"
+	case MaxSubscriptionsExceeded:
+		return "Maximum Subscriptions Exceeded"
+	case MaxUserConnectionsExceeded:
+		return "Maximum User Connections Exceeded"
+	case MaxIPConnectionsExceeded:
+		return "Maximum IP Connections Exceeded"
 	}
 	return "Unknown State"
 }
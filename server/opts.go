@@ -2,11 +2,9 @@ package server
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"net/url"
 	"os"
@@ -32,6 +30,16 @@ type ClusterOpts struct {
 	Advertise      string            `json:"-"`
 	NoAdvertise    bool              `json:"-"`
 	ConnectRetries int               `json:"-"`
+	AllowedCIDRs   []string          `json:"-"`
+	DeniedCIDRs    []string          `json:"-"`
+	ProxyProtocol  string            `json:"-"`
+	Compression    string            `json:"-"`
+	CompressionRTT time.Duration     `json:"-"`
+
+	PoolSize          int      `json:"-"`
+	DedicatedSubjects []string `json:"-"`
+
+	RebalanceInterval time.Duration `json:"-"`
 }
 
 // Options block for gnatsd server.
@@ -77,11 +85,41 @@ type Options struct {
 	TLSCaCert        string        `json:"-"`
 	TLSConfig        *tls.Config   `json:"-"`
 	WriteDeadline    time.Duration `json:"-"`
+	DrainTimeout     time.Duration `json:"-"`
 	RQSubsSweep      time.Duration `json:"-"`
 	MaxClosedClients int           `json:"-"`
+	MsgTraceSubject  string        `json:"msg_trace_subject,omitempty"`
+	LatencySubject   string        `json:"latency_subject,omitempty"`
+
+	SlowConsumerPolicy SlowConsumerPolicy `json:"-"`
+	ReloadToken        string             `json:"-"`
+	CheckConfig        bool               `json:"-"`
+
+	ServiceLatency    []*ServiceLatencyConfig `json:"-"`
+	PartitionedQueues []*PartitionedQueue     `json:"-"`
+
+	MaxConnPerUser int          `json:"max_connections_per_user,omitempty"`
+	MaxConnPerIP   int          `json:"max_connections_per_ip,omitempty"`
+	ConnLimits     []*ConnLimit `json:"-"`
+
+	AllowedCIDRs     []string `json:"-"`
+	DeniedCIDRs      []string `json:"-"`
+	HTTPAllowedCIDRs []string `json:"-"`
+	HTTPDeniedCIDRs  []string `json:"-"`
+
+	UnixSocket      string      `json:"unix_socket,omitempty"`
+	UnixSocketMode  os.FileMode `json:"-"`
+	UnixSocketOwner string      `json:"-"`
+	UnixSocketGroup string      `json:"-"`
+
+	ProxyProtocol string `json:"-"`
 
 	CustomClientAuthentication Authentication `json:"-"`
 	CustomRouterAuthentication Authentication `json:"-"`
+
+	// MessageHook intercepts the messages and subscriptions of the
+	// clients, see MessageHook. It can not be changed on reload.
+	MessageHook MessageHook `json:"-"`
 }
 
 // Clone performs a deep copy of the Options struct, returning a new clone
@@ -137,6 +175,8 @@ type TLSConfigOpts struct {
 	Timeout          float64
 	Ciphers          []uint16
 	CurvePreferences []tls.CurveID
+	Certs            []TLSCertFiles // Certificates picked by SNI.
+	Watch            time.Duration  // Interval at which files are checked.
 }
 
 var tlsUsage = `
@@ -150,6 +190,14 @@ e.g.
         ca_file:   "./certs/ca.pem"
         verify:    true
 
+        # Certificates picked by the server name sent by clients.
+        certs: [
+            {cert_file: "./certs/other-cert.pem", key_file: "./certs/other-key.pem"}
+        ]
+        # Load the files again when they change, checked every 10s, or
+        # at the given interval like "1m".
+        watch: true
+
         cipher_suites: [
             "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
             "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
@@ -202,12 +250,30 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 	for k, v := range m {
 		switch strings.ToLower(k) {
 		case "listen":
-			hp, err := parseListen(v)
-			if err != nil {
+			if err := parseClientListen(v, o); err != nil {
+				return err
+			}
+		case "unix_socket":
+			o.UnixSocket = v.(string)
+			if path, ok := parseUnixSocket(o.UnixSocket); ok {
+				o.UnixSocket = path
+			}
+		case "proxy_protocol":
+			if o.ProxyProtocol, err = parseProxyProtocol(v); err != nil {
+				return err
+			}
+		case "unix_socket_mode":
+			if o.UnixSocketMode, err = parseFileMode(v); err != nil {
+				return err
+			}
+		case "unix_socket_owner":
+			if o.UnixSocketOwner, err = parseOwner(v); err != nil {
+				return err
+			}
+		case "unix_socket_group":
+			if o.UnixSocketGroup, err = parseOwner(v); err != nil {
 				return err
 			}
-			o.Host = hp.host
-			o.Port = hp.port
 		case "client_advertise":
 			o.ClientAdvertise = v.(string)
 		case "port":
@@ -288,6 +354,52 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 			o.MaxConn = int(v.(int64))
 		case "max_subscriptions", "max_subs":
 			o.MaxSubs = int(v.(int64))
+		case "max_connections_per_user":
+			o.MaxConnPerUser = int(v.(int64))
+		case "max_connections_per_ip":
+			o.MaxConnPerIP = int(v.(int64))
+		case "connection_limits":
+			if err := parseConnLimits(v, o); err != nil {
+				return err
+			}
+		case "allowed_cidrs":
+			if o.AllowedCIDRs, err = parseCIDRs(v); err != nil {
+				return err
+			}
+		case "denied_cidrs":
+			if o.DeniedCIDRs, err = parseCIDRs(v); err != nil {
+				return err
+			}
+		case "http_allowed_cidrs", "monitor_allowed_cidrs":
+			if o.HTTPAllowedCIDRs, err = parseCIDRs(v); err != nil {
+				return err
+			}
+		case "http_denied_cidrs", "monitor_denied_cidrs":
+			if o.HTTPDeniedCIDRs, err = parseCIDRs(v); err != nil {
+				return err
+			}
+		case "reload_token":
+			o.ReloadToken = v.(string)
+		case "msg_trace_subject", "trace_subject":
+			o.MsgTraceSubject = v.(string)
+		case "latency":
+			lm, ok := v.(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("Expected latency to be a map/struct, got %v", v)
+			}
+			if err := parseLatency(lm, o); err != nil {
+				return err
+			}
+		case "slow_consumer_policy":
+			scp, err := parseSlowConsumerPolicy(v)
+			if err != nil {
+				return err
+			}
+			o.SlowConsumerPolicy = scp
+		case "partitioned_queues":
+			if err := parsePartitionedQueues(v, o); err != nil {
+				return err
+			}
 		case "ping_interval":
 			o.PingInterval = time.Duration(int(v.(int64))) * time.Second
 		case "ping_max":
@@ -316,6 +428,12 @@ func (o *Options) ProcessConfigFile(configFile string) error {
 				o.WriteDeadline = time.Duration(v.(int64)) * time.Second
 				fmt.Printf("WARNING: write_deadline should be converted to a duration\n")
 			}
+		case "drain_timeout":
+			dur, err := time.ParseDuration(v.(string))
+			if err != nil {
+				return fmt.Errorf("error parsing drain_timeout: %v", err)
+			}
+			o.DrainTimeout = dur
 		}
 	}
 	return nil
@@ -348,6 +466,34 @@ func parseListen(v interface{}) (*hostPort, error) {
 	return hp, nil
 }
 
+// parseClientListen parses the client listen address, which can be a unix
+// domain socket with the unix:// scheme, or an array with a TCP address and
+// a unix domain socket.
+func parseClientListen(v interface{}, o *Options) error {
+	addrs, ok := v.([]interface{})
+	if !ok {
+		addrs = []interface{}{v}
+	}
+	for _, addr := range addrs {
+		if s, ok := addr.(string); ok {
+			if path, ok := parseUnixSocket(s); ok {
+				if path == "" {
+					return fmt.Errorf("Unix socket listen address %q requires a path", s)
+				}
+				o.UnixSocket = path
+				continue
+			}
+		}
+		hp, err := parseListen(addr)
+		if err != nil {
+			return err
+		}
+		o.Host = hp.host
+		o.Port = hp.port
+	}
+	return nil
+}
+
 // parseCluster will parse the cluster config.
 func parseCluster(cm map[string]interface{}, opts *Options) error {
 	for mk, mv := range cm {
@@ -418,11 +564,119 @@ func parseCluster(cm map[string]interface{}, opts *Options) error {
 			opts.Cluster.NoAdvertise = mv.(bool)
 		case "connect_retries":
 			opts.Cluster.ConnectRetries = int(mv.(int64))
+		case "allowed_cidrs":
+			cidrs, err := parseCIDRs(mv)
+			if err != nil {
+				return err
+			}
+			opts.Cluster.AllowedCIDRs = cidrs
+		case "denied_cidrs":
+			cidrs, err := parseCIDRs(mv)
+			if err != nil {
+				return err
+			}
+			opts.Cluster.DeniedCIDRs = cidrs
+		case "proxy_protocol":
+			mode, err := parseProxyProtocol(mv)
+			if err != nil {
+				return err
+			}
+			opts.Cluster.ProxyProtocol = mode
+		case "compression":
+			mode, err := parseCompression(mv)
+			if err != nil {
+				return err
+			}
+			opts.Cluster.Compression = mode
+		case "compression_rtt_threshold":
+			dur, err := time.ParseDuration(mv.(string))
+			if err != nil {
+				return fmt.Errorf("error parsing compression_rtt_threshold: %v", err)
+			}
+			opts.Cluster.CompressionRTT = dur
+		case "pool_size":
+			opts.Cluster.PoolSize = int(mv.(int64))
+		case "dedicated_subjects":
+			subjects, err := parseSubjects(mv)
+			if err != nil {
+				return err
+			}
+			opts.Cluster.DedicatedSubjects = subjects
+		case "rebalance_interval":
+			dur, err := time.ParseDuration(mv.(string))
+			if err != nil {
+				return fmt.Errorf("error parsing rebalance_interval: %v", err)
+			}
+			opts.Cluster.RebalanceInterval = dur
 		}
 	}
 	return nil
 }
 
+// parseLatency will parse the request/reply latency sampling config.
+func parseLatency(lm map[string]interface{}, opts *Options) error {
+	for mk, mv := range lm {
+		switch strings.ToLower(mk) {
+		case "subject":
+			opts.LatencySubject = mv.(string)
+		case "services":
+			sa, ok := mv.([]interface{})
+			if !ok {
+				return fmt.Errorf("Expected latency services to be an array, got %v", mv)
+			}
+			for _, sv := range sa {
+				sm, ok := sv.(map[string]interface{})
+				if !ok {
+					return fmt.Errorf("Expected latency service entry to be a map/struct, got %v", sv)
+				}
+				sl := &ServiceLatencyConfig{Sampling: 100}
+				for k, v := range sm {
+					switch strings.ToLower(k) {
+					case "subject":
+						sl.Subject = v.(string)
+					case "sampling":
+						sampling, err := parseSampling(v)
+						if err != nil {
+							return err
+						}
+						sl.Sampling = sampling
+					default:
+						return fmt.Errorf("Unknown field %s parsing latency service", k)
+					}
+				}
+				if sl.Subject == "" {
+					return fmt.Errorf("Latency service entry requires a subject")
+				}
+				opts.ServiceLatency = append(opts.ServiceLatency, sl)
+			}
+		default:
+			return fmt.Errorf("Unknown field %s parsing latency", mk)
+		}
+	}
+	return nil
+}
+
+// parseSampling accepts a percentage as an integer or a string like "50%".
+func parseSampling(v interface{}) (int, error) {
+	var sampling int
+	switch v := v.(type) {
+	case int64:
+		sampling = int(v)
+	case string:
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "%"))
+		if err != nil {
+			return 0, fmt.Errorf("Could not parse sampling %q", v)
+		}
+		sampling = n
+	default:
+		return 0, fmt.Errorf("Expected sampling to be an integer or a percentage, got %v", v)
+	}
+	if sampling < 1 || sampling > 100 {
+		return 0, fmt.Errorf("Sampling must be between 1 and 100, got %d", sampling)
+	}
+	return sampling, nil
+}
+
 // Helper function to parse Authorization configs.
 func parseAuthorization(am map[string]interface{}) (*authorization, error) {
 	auth := &authorization{}
@@ -505,6 +759,22 @@ func parseUsers(mv interface{}) ([]*User, error) {
 					return nil, err
 				}
 				user.Permissions = permissions
+			case "slow_consumer_policy":
+				scp, err := parseSlowConsumerPolicy(v)
+				if err != nil {
+					return nil, err
+				}
+				user.SlowConsumerPolicy = scp
+			case "max_connections", "max_conn":
+				user.MaxConnections = int(v.(int64))
+			case "max_subscriptions", "max_subs":
+				user.MaxSubscriptions = int(v.(int64))
+			case "allowed_cidrs":
+				cidrs, err := parseCIDRs(v)
+				if err != nil {
+					return nil, err
+				}
+				user.AllowedCIDRs = cidrs
 			}
 		}
 		// Check to make sure we have at least username and password
@@ -661,6 +931,18 @@ func parseTLS(tlsm map[string]interface{}) (*TLSConfigOpts, error) {
 				}
 				tc.CurvePreferences = append(tc.CurvePreferences, cps)
 			}
+		case "certs":
+			certs, err := parseTLSCerts(mv)
+			if err != nil {
+				return nil, err
+			}
+			tc.Certs = certs
+		case "watch":
+			watch, err := parseTLSWatch(mv)
+			if err != nil {
+				return nil, err
+			}
+			tc.Watch = watch
 		case "timeout":
 			at := float64(0)
 			switch mv.(type) {
@@ -691,42 +973,33 @@ func parseTLS(tlsm map[string]interface{}) (*TLSConfigOpts, error) {
 // GenTLSConfig loads TLS related configuration parameters.
 func GenTLSConfig(tc *TLSConfigOpts) (*tls.Config, error) {
 
-	// Now load in cert and private key
-	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	// Now load in certs, private keys and CAs
+	certs, pool, err := loadTLSCerts(tc)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
-	}
-	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
-	if err != nil {
-		return nil, fmt.Errorf("error parsing certificate: %v", err)
+		return nil, err
 	}
 
 	// Create TLSConfig
 	// We will determine the cipher suites that we prefer.
 	config := tls.Config{
 		CurvePreferences:         tc.CurvePreferences,
-		Certificates:             []tls.Certificate{cert},
+		Certificates:             certs,
 		PreferServerCipherSuites: true,
 		MinVersion:               tls.VersionTLS12,
 		CipherSuites:             tc.Ciphers,
+		ClientCAs:                pool,
 	}
 
 	// Require client certificates as needed
 	if tc.Verify {
 		config.ClientAuth = tls.RequireAndVerifyClientCert
 	}
-	// Add in CAs if applicable.
-	if tc.CaFile != "" {
-		rootPEM, err := ioutil.ReadFile(tc.CaFile)
-		if err != nil || rootPEM == nil {
-			return nil, err
-		}
-		pool := x509.NewCertPool()
-		ok := pool.AppendCertsFromPEM(rootPEM)
-		if !ok {
-			return nil, fmt.Errorf("failed to parse root ca certificate")
-		}
-		config.ClientCAs = pool
+
+	// Load the files again when they change.
+	if tc.Watch > 0 {
+		st := newTLSCertStore(tc, &config)
+		config.GetConfigForClient = st.getConfigForClient
+		config.GetClientCertificate = st.getClientCertificate
 	}
 
 	return &config, nil
@@ -750,6 +1023,9 @@ func MergeOptions(fileOpts, flagOpts *Options) *Options {
 	if flagOpts.Host != "" {
 		opts.Host = flagOpts.Host
 	}
+	if flagOpts.UnixSocket != "" {
+		opts.UnixSocket = flagOpts.UnixSocket
+	}
 	if flagOpts.ClientAdvertise != "" {
 		opts.ClientAdvertise = flagOpts.ClientAdvertise
 	}
@@ -950,6 +1226,9 @@ func processOptions(opts *Options) {
 		if opts.Cluster.AuthTimeout == 0 {
 			opts.Cluster.AuthTimeout = float64(AUTH_TIMEOUT) / float64(time.Second)
 		}
+		if opts.Cluster.CompressionRTT == 0 {
+			opts.Cluster.CompressionRTT = DEFAULT_ROUTE_COMPRESSION_RTT
+		}
 	}
 	if opts.MaxControlLine == 0 {
 		opts.MaxControlLine = MAX_CONTROL_LINE_SIZE
@@ -963,12 +1242,21 @@ func processOptions(opts *Options) {
 	if opts.WriteDeadline == time.Duration(0) {
 		opts.WriteDeadline = DEFAULT_FLUSH_DEADLINE
 	}
+	if opts.DrainTimeout == time.Duration(0) {
+		opts.DrainTimeout = DEFAULT_DRAIN_TIMEOUT
+	}
 	if opts.RQSubsSweep == time.Duration(0) {
 		opts.RQSubsSweep = DEFAULT_REMOTE_QSUBS_SWEEPER
 	}
 	if opts.MaxClosedClients == 0 {
 		opts.MaxClosedClients = DEFAULT_MAX_CLOSED_CLIENTS
 	}
+	if opts.MsgTraceSubject == "" {
+		opts.MsgTraceSubject = DEFAULT_MSG_TRACE_SUBJECT
+	}
+	if opts.LatencySubject == "" {
+		opts.LatencySubject = DEFAULT_LATENCY_SUBJECT
+	}
 }
 
 // Process config options
@@ -992,6 +1280,7 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.StringVar(&opts.Host, "a", "", "Network host to listen on.")
 	fs.StringVar(&opts.Host, "net", "", "Network host to listen on.")
 	fs.StringVar(&opts.ClientAdvertise, "client_advertise", "", "Client URL to advertise to other servers.")
+	fs.StringVar(&opts.UnixSocket, "unix_socket", "", "Unix domain socket for local clients.")
 	fs.BoolVar(&opts.Debug, "D", false, "Enable Debug logging.")
 	fs.BoolVar(&opts.Debug, "debug", false, "Enable Debug logging.")
 	fs.BoolVar(&opts.Trace, "V", false, "Enable Trace logging.")
@@ -1008,8 +1297,10 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.IntVar(&opts.HTTPSPort, "https_port", 0, "HTTPS Port for /varz, /connz endpoints.")
 	fs.StringVar(&configFile, "c", "", "Configuration file.")
 	fs.StringVar(&configFile, "config", "", "Configuration file.")
-	fs.StringVar(&signal, "sl", "", "Send signal to gnatsd process (stop, quit, reopen, reload)")
-	fs.StringVar(&signal, "signal", "", "Send signal to gnatsd process (stop, quit, reopen, reload)")
+	fs.BoolVar(&opts.CheckConfig, "t", false, "Test configuration and exit.")
+	fs.BoolVar(&opts.CheckConfig, "test-config", false, "Test configuration and exit.")
+	fs.StringVar(&signal, "sl", "", "Send signal to gnatsd process (stop, quit, term, upgrade, reopen, reload)")
+	fs.StringVar(&signal, "signal", "", "Send signal to gnatsd process (stop, quit, term, upgrade, reopen, reload)")
 	fs.StringVar(&opts.PidFile, "P", "", "File to store process pid.")
 	fs.StringVar(&opts.PidFile, "pid", "", "File to store process pid.")
 	fs.StringVar(&opts.PortsFileDir, "ports_file_dir", "", "Creates a ports file in the specified directory (<executable_name>_<pid>.ports)")
@@ -1085,6 +1376,15 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 		}
 	}
 
+	// When testing the config, it is checked as a whole by CheckConfigFile.
+	if opts.CheckConfig {
+		if configFile == "" {
+			return nil, fmt.Errorf("a configuration file is required to test the configuration")
+		}
+		opts.ConfigFile = configFile
+		return opts, nil
+	}
+
 	// Parse config if given
 	if configFile != "" {
 		// This will update the options with values from the config file.
@@ -25,8 +25,11 @@ func TestDefaultOptions(t *testing.T) {
 		MaxPayload:       MAX_PAYLOAD_SIZE,
 		MaxPending:       MAX_PENDING_SIZE,
 		WriteDeadline:    DEFAULT_FLUSH_DEADLINE,
+		DrainTimeout:     DEFAULT_DRAIN_TIMEOUT,
 		RQSubsSweep:      DEFAULT_REMOTE_QSUBS_SWEEPER,
 		MaxClosedClients: DEFAULT_MAX_CLOSED_CLIENTS,
+		MsgTraceSubject:  DEFAULT_MSG_TRACE_SUBJECT,
+		LatencySubject:   DEFAULT_LATENCY_SUBJECT,
 	}
 
 	opts := &Options{}
@@ -558,6 +558,11 @@ func (c *client) parse(buf []byte) error {
 					return err
 				}
 				c.drop, c.as, c.state = 0, i+1, OP_START
+				// The rest is compressed, leave it to the read loop.
+				if c.in.zstart {
+					c.in.zrest = buf[i+1:]
+					return nil
+				}
 			default:
 				if c.argBuf != nil {
 					c.argBuf = append(c.argBuf, b)
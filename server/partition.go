@@ -0,0 +1,186 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Partitioned queue groups.
+//
+// Messages published to a partitioned queue group are not delivered to a
+// random member, but to the member selected by rendezvous hashing of a
+// token of their subject, the partition key. All messages with the same
+// key, such as the ID in "orders.<id>.created", are then handled by the
+// same member as long as it is subscribed, which preserves their order.
+// When members join or leave, only the keys of the members concerned move.
+//
+// Members are identified by their server ID and routed sid, so all servers
+// of a cluster select the same member for a given key, whether it is
+// connected to them or to another server. Weights and the preference for
+// local members do not apply to partitioned groups.
+
+// PartitionedQueue configures a queue group as partitioned.
+type PartitionedQueue struct {
+	Queue string `json:"queue"`
+	// Subject, if set, restricts partitioning to the messages published
+	// to matching subjects. The other messages are delivered as usual.
+	Subject string `json:"subject,omitempty"`
+	// Token is the position, starting at 1, of the subject token used as
+	// the partition key. The whole subject is used if 0 or if the subject
+	// does not have that many tokens.
+	Token int `json:"token,omitempty"`
+}
+
+// partitions holds the partitioned queue groups by name.
+type partitions map[string][]*PartitionedQueue
+
+// newPartitions returns the partitioned queue groups of the options, or
+// nil if there are none.
+func newPartitions(opts *Options) partitions {
+	if len(opts.PartitionedQueues) == 0 {
+		return nil
+	}
+	p := make(partitions)
+	for _, pq := range opts.PartitionedQueues {
+		p[pq.Queue] = append(p[pq.Queue], pq)
+	}
+	return p
+}
+
+// key returns the partition key of a message published to subject for the
+// queue group, or nil if the group is not partitioned for that subject.
+func (p partitions) key(queue, subject []byte) []byte {
+	for _, pq := range p[string(queue)] {
+		if pq.Subject != "" && !matchLiteral(string(subject), pq.Subject) {
+			continue
+		}
+		return subjectToken(subject, pq.Token)
+	}
+	return nil
+}
+
+// subjectToken returns the n-th token of subject, starting at 1, or the
+// whole subject if it does not have that many tokens.
+func subjectToken(subject []byte, n int) []byte {
+	if n < 1 {
+		return subject
+	}
+	tok := subject
+	for i := 1; ; i++ {
+		end := bytes.IndexByte(tok, btsep)
+		if i == n {
+			if end < 0 {
+				return tok
+			}
+			return tok[:end]
+		}
+		if end < 0 {
+			return subject
+		}
+		tok = tok[end+1:]
+	}
+}
+
+// partitionMemberHash returns the hash identifying a queue subscription
+// as a member of a partitioned group. It is the same on all servers.
+// Lock should be held.
+func (c *client) partitionMemberHash(sub *subscription) uint64 {
+	h := fnv.New64a()
+	if c.typ == ROUTER {
+		if c.route != nil {
+			h.Write([]byte(c.route.remoteID))
+		}
+		h.Write([]byte{' '})
+		h.Write(sub.sid)
+	} else {
+		if c.srv != nil {
+			h.Write([]byte(c.srv.info.ID))
+		}
+		h.Write([]byte{' '})
+		h.Write([]byte(routeSid(sub)))
+	}
+	return h.Sum64()
+}
+
+// partitionScore returns the rendezvous hashing score of a member for a
+// partition key hash. The member with the highest score owns the key.
+func partitionScore(key, member uint64) uint64 {
+	// Finalizer of splitmix64, so that scores of close hashes are unrelated.
+	x := key ^ member
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// deliverToPartition delivers the message to the member of a queue group
+// that owns the partition key and returns it. If that member can not take
+// the message, the member with the next highest score is tried, and so on.
+// Returns nil if no member could take the message.
+func (c *client) deliverToPartition(qsubs []*subscription, key, msgh, msg []byte) *subscription {
+	h := fnv.New64a()
+	h.Write(key)
+	kh := h.Sum64()
+
+	var last uint64
+	for tried := 0; tried < len(qsubs); tried++ {
+		var best *subscription
+		var bestScore uint64
+		for _, sub := range qsubs {
+			if sub == nil {
+				continue
+			}
+			score := partitionScore(kh, sub.phash)
+			if tried > 0 && score >= last {
+				continue
+			}
+			if best == nil || score > bestScore {
+				best, bestScore = sub, score
+			}
+		}
+		if best == nil {
+			return nil
+		}
+		if c.deliverMsg(best, c.msgHeader(msgh, best), msg) {
+			return best
+		}
+		last = bestScore
+	}
+	return nil
+}
+
+// parsePartitionedQueues will parse the partitioned queue groups config.
+func parsePartitionedQueues(v interface{}, opts *Options) error {
+	pa, ok := v.([]interface{})
+	if !ok {
+		return fmt.Errorf("Expected partitioned queues to be an array, got %v", v)
+	}
+	for _, pv := range pa {
+		pm, ok := pv.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Expected partitioned queue entry to be a map/struct, got %v", pv)
+		}
+		pq := &PartitionedQueue{}
+		for k, v := range pm {
+			switch strings.ToLower(k) {
+			case "queue":
+				pq.Queue = v.(string)
+			case "subject":
+				pq.Subject = v.(string)
+			case "token":
+				pq.Token = int(v.(int64))
+			default:
+				return fmt.Errorf("Unknown field %s parsing partitioned queue", k)
+			}
+		}
+		if pq.Queue == "" {
+			return fmt.Errorf("Partitioned queue entry requires a queue")
+		}
+		if pq.Token < 0 {
+			return fmt.Errorf("Partitioned queue token must not be negative, got %d", pq.Token)
+		}
+		opts.PartitionedQueues = append(opts.PartitionedQueues, pq)
+	}
+	return nil
+}
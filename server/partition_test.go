@@ -0,0 +1,225 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestPartitionedQueuesConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/partitioned_queues.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	expected := []*PartitionedQueue{
+		{Queue: "workers", Subject: "orders.>", Token: 2},
+		{Queue: "audit"},
+	}
+	if !reflect.DeepEqual(opts.PartitionedQueues, expected) {
+		t.Fatalf("Unexpected partitioned queues: %+v", opts.PartitionedQueues)
+	}
+
+	for _, pq := range []map[string]interface{}{
+		{"subject": "foo"},
+		{"queue": "bar", "token": int64(-1)},
+		{"queue": "bar", "size": int64(2)},
+	} {
+		if err := parsePartitionedQueues([]interface{}{pq}, &Options{}); err == nil {
+			t.Fatalf("Expected error for %v", pq)
+		}
+	}
+
+	p := newPartitions(opts)
+	for _, test := range []struct {
+		queue, subject, key string
+	}{
+		{"workers", "orders.42.created", "42"},
+		{"workers", "orders", ""},
+		{"workers", "invoices.42.created", ""},
+		{"audit", "orders.42.created", "orders.42.created"},
+		{"other", "orders.42.created", ""},
+	} {
+		if key := p.key([]byte(test.queue), []byte(test.subject)); string(key) != test.key {
+			t.Fatalf("Expected key %q for %q on %q, got %q", test.key, test.queue, test.subject, key)
+		}
+	}
+}
+
+func TestSubjectToken(t *testing.T) {
+	for _, test := range []struct {
+		n        int
+		expected string
+	}{
+		{0, "a.bb.c"},
+		{1, "a"},
+		{2, "bb"},
+		{3, "c"},
+		{4, "a.bb.c"},
+	} {
+		if tok := subjectToken([]byte("a.bb.c"), test.n); string(tok) != test.expected {
+			t.Fatalf("Expected token %d to be %q, got %q", test.n, test.expected, tok)
+		}
+	}
+}
+
+func TestPartitionMinimalMovement(t *testing.T) {
+	owner := func(key int, members []uint64) uint64 {
+		var best, bestScore uint64
+		for _, m := range members {
+			if score := partitionScore(uint64(key)*0x9e3779b97f4a7c15, m); score >= bestScore {
+				best, bestScore = m, score
+			}
+		}
+		return best
+	}
+
+	var members []uint64
+	for i := 0; i < 10; i++ {
+		members = append(members, uint64(i+1)*0x12345)
+	}
+	const keys = 10000
+	before := make(map[int]uint64, keys)
+	counts := make(map[uint64]int)
+	for k := 0; k < keys; k++ {
+		before[k] = owner(k, members)
+		counts[before[k]]++
+	}
+	for m, n := range counts {
+		if n < keys/20 || n > keys/5 {
+			t.Fatalf("Unbalanced partitions, member %x owns %d keys", m, n)
+		}
+	}
+
+	// Adding a member only moves keys to it, about a share of them.
+	joined := uint64(42) * 0x12345
+	moved := 0
+	for k := 0; k < keys; k++ {
+		if o := owner(k, append(members, joined)); o != before[k] {
+			if o != joined {
+				t.Fatalf("Key %d moved from %x to %x", k, before[k], o)
+			}
+			moved++
+		}
+	}
+	if moved < keys/20 || moved > keys/5 {
+		t.Fatalf("Expected about %d keys to move, got %d", keys/11, moved)
+	}
+
+	// Removing a member only moves its own keys.
+	left := members[3]
+	for k := 0; k < keys; k++ {
+		if o := owner(k, append(members[:3:3], members[4:]...)); o != before[k] && before[k] != left {
+			t.Fatalf("Key %d moved from %x to %x", k, before[k], o)
+		}
+	}
+}
+
+func TestPartitionedQueueAcrossRoutes(t *testing.T) {
+	optsA, _ := ProcessConfigFile("./configs/seed.conf")
+	optsA.NoSigs, optsA.NoLog = true, true
+	optsA.PartitionedQueues = []*PartitionedQueue{{Queue: "workers", Subject: "orders.>", Token: 2}}
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	srvARouteURL := fmt.Sprintf("nats://%s:%d", optsA.Cluster.Host, srvA.ClusterAddr().Port)
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(srvARouteURL)
+
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	ncA, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsA.Host, optsA.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncA.Close()
+
+	ncB, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsB.Host, optsB.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncB.Close()
+
+	// The members that received each order.
+	var mu sync.Mutex
+	received := make(map[string][]int)
+	total := 0
+	var qsubs []*gio.Subscription
+	for i, nc := range []*gio.Conn{ncA, ncA, ncB} {
+		member := i
+		qsub, err := nc.QueueSubscribe("orders.*.*", "workers", func(m *gio.Msg) {
+			mu.Lock()
+			id := strings.Split(m.Subject, ".")[1]
+			received[id] = append(received[id], member)
+			total++
+			mu.Unlock()
+		})
+		if err != nil {
+			t.Fatalf("Error on subscribe: %v", err)
+		}
+		nc.Flush()
+		qsubs = append(qsubs, qsub)
+	}
+	checkExpectedSubs(t, 3, srvA, srvB)
+
+	const orders = 50
+	publish := func() map[string]int {
+		t.Helper()
+		mu.Lock()
+		received = make(map[string][]int)
+		total = 0
+		mu.Unlock()
+		for i := 0; i < orders; i++ {
+			ncA.Publish(fmt.Sprintf("orders.%d.created", i), []byte("hello"))
+			ncB.Publish(fmt.Sprintf("orders.%d.paid", i), []byte("hello"))
+		}
+		ncA.Flush()
+		ncB.Flush()
+		checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
+			mu.Lock()
+			defer mu.Unlock()
+			if total != 2*orders {
+				return fmt.Errorf("Received %d messages, expected %d", total, 2*orders)
+			}
+			return nil
+		})
+		// Both messages of an order, published on different servers,
+		// went to the same member.
+		mu.Lock()
+		defer mu.Unlock()
+		owners := make(map[string]int, orders)
+		for id, members := range received {
+			if len(members) != 2 || members[0] != members[1] {
+				t.Fatalf("Expected order %s to be received twice by the same member, got %v", id, members)
+			}
+			owners[id] = members[0]
+		}
+		return owners
+	}
+
+	before := publish()
+	if again := publish(); !reflect.DeepEqual(before, again) {
+		t.Fatalf("Expected the same members, got %v and %v", before, again)
+	}
+
+	// When a member leaves, only its orders move.
+	qsubs[0].Unsubscribe()
+	ncA.Flush()
+	checkExpectedSubs(t, 2, srvA, srvB)
+	after := publish()
+	for id, member := range after {
+		if member == 0 {
+			t.Fatalf("Order %s received by a member that left", id)
+		}
+		if before[id] != 0 && before[id] != member {
+			t.Fatalf("Order %s moved from member %d to %d", id, before[id], member)
+		}
+	}
+}
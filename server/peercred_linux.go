@@ -0,0 +1,28 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the credentials of the process at the other end
+// of a unix domain socket connection.
+func peerCredentials(nc *net.UnixConn) (*PeerCredentials, error) {
+	rc, err := nc.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ucred *syscall.Ucred
+		uerr  error
+	)
+	if err := rc.Control(func(fd uintptr) {
+		ucred, uerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	if uerr != nil {
+		return nil, uerr
+	}
+	return &PeerCredentials{PID: ucred.Pid, UID: ucred.Uid, GID: ucred.Gid}, nil
+}
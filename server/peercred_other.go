@@ -0,0 +1,13 @@
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerCredentials is only supported on Linux.
+func peerCredentials(nc *net.UnixConn) (*PeerCredentials, error) {
+	return nil, errors.New("peer credentials not supported on this platform")
+}
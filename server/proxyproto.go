@@ -0,0 +1,296 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// PROXY protocol.
+//
+// Behind a TCP load balancer, connections come from the address of the
+// balancer. When the PROXY protocol is required for the client or route
+// listener, connections must start with a PROXY protocol header, version 1
+// (text) or 2 (binary), giving the address of the real source. It is then
+// the remote address of the connection, used in logs, monitoring, IP
+// filters and connection limits. Connections without a valid header are
+// closed, so it must only be required for listeners behind a balancer.
+//
+// When the PROXY protocol is optional, the first bytes of a connection are
+// peeked, and connections that do not start with a header signature keep
+// the address of their peer. Since clients and routes wait for the INFO of
+// the server before sending anything, the server waits for the header at
+// most PROXY_PROTOCOL_PEEK_TIMEOUT, which delays the direct connections.
+// A balancer sends the header as soon as it connects.
+//
+// Headers that do not carry an address, for the health checks of the
+// balancer, are accepted and the address of the balancer is kept.
+
+// PROXY protocol modes.
+const (
+	// ProxyProtocolOff does not expect PROXY protocol headers.
+	ProxyProtocolOff = "off"
+	// ProxyProtocolOptional reads a PROXY protocol header if the connection
+	// starts with one.
+	ProxyProtocolOptional = "optional"
+	// ProxyProtocolRequired closes connections without a PROXY protocol
+	// header.
+	ProxyProtocolRequired = "required"
+)
+
+// parseProxyProtocol parses a PROXY protocol mode. A boolean requires or
+// disables it.
+func parseProxyProtocol(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return ProxyProtocolRequired, nil
+		}
+		return ProxyProtocolOff, nil
+	case string:
+		switch mode := strings.ToLower(strings.TrimSpace(v)); mode {
+		case ProxyProtocolOff, "":
+			return ProxyProtocolOff, nil
+		case ProxyProtocolOptional, ProxyProtocolRequired:
+			return mode, nil
+		}
+	}
+	return "", fmt.Errorf("Unknown PROXY protocol mode %v, expected %q, %q or %q",
+		v, ProxyProtocolOff, ProxyProtocolOptional, ProxyProtocolRequired)
+}
+
+var (
+	// proxyV1Prefix starts a version 1 header.
+	proxyV1Prefix = []byte("PROXY")
+	// proxyV2Sig starts a version 2 header.
+	proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errProxyHeader = errors.New("invalid PROXY protocol header")
+)
+
+const (
+	// Maximum length of a version 1 header, including CRLF.
+	proxyV1MaxLen = 107
+	// Maximum length of the addresses and TLVs of a version 2 header.
+	proxyV2MaxLen = 4096
+)
+
+// proxyConn is a connection with the addresses of a PROXY protocol header.
+type proxyConn struct {
+	net.Conn
+	remote net.Addr
+	local  net.Addr
+}
+
+// RemoteAddr returns the source address of the header.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// LocalAddr returns the destination address of the header.
+func (c *proxyConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+// peekedConn is a connection with bytes already read from it, which are
+// returned first.
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+// Read returns the peeked bytes, then reads from the connection.
+func (c *peekedConn) Read(b []byte) (int, error) {
+	if len(c.peeked) > 0 {
+		n := copy(b, c.peeked)
+		c.peeked = c.peeked[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+// isProxyPrefix returns true if b can start a PROXY protocol header.
+func isProxyPrefix(b []byte) bool {
+	return bytes.HasPrefix(proxyV1Prefix, b) || bytes.HasPrefix(proxyV2Sig, b)
+}
+
+// readProxyHeader reads the PROXY protocol header at the start of conn,
+// without reading past it, and returns the connection with the addresses
+// of the header. If optional, a connection that does not start with a
+// header, or sends nothing within peekTimeout, is returned with the bytes
+// read from it.
+func readProxyHeader(conn net.Conn, timeout time.Duration, optional bool, peekTimeout time.Duration) (net.Conn, error) {
+	start := time.Now()
+	if optional && peekTimeout < timeout {
+		conn.SetReadDeadline(start.Add(peekTimeout))
+	} else {
+		conn.SetReadDeadline(start.Add(timeout))
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	var (
+		prefix [5]byte
+		n      int
+	)
+	for n < len(prefix) {
+		m, err := conn.Read(prefix[n:])
+		n += m
+		if !isProxyPrefix(prefix[:n]) {
+			if optional {
+				return &peekedConn{Conn: conn, peeked: prefix[:n]}, nil
+			}
+			return nil, errProxyHeader
+		}
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && optional && n == 0 {
+				return conn, nil
+			}
+			return nil, err
+		}
+		if m > 0 {
+			// The rest of the header may take up to the full timeout.
+			conn.SetReadDeadline(start.Add(timeout))
+		}
+	}
+	var (
+		remote, local net.Addr
+		err           error
+	)
+	if bytes.Equal(prefix[:], proxyV1Prefix) {
+		remote, local, err = readProxyV1(conn)
+	} else {
+		remote, local, err = readProxyV2(conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, remote: remote, local: local}, nil
+}
+
+// readProxyV1 reads the rest of a version 1 header, after its prefix.
+func readProxyV1(conn net.Conn) (net.Addr, net.Addr, error) {
+	line := make([]byte, 0, proxyV1MaxLen)
+	line = append(line, proxyV1Prefix...)
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte(CR_LF)) {
+		if len(line) == proxyV1MaxLen {
+			return nil, nil, errProxyHeader
+		}
+		if _, err := io.ReadFull(conn, b[:]); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+	fields := strings.Split(string(line[:len(line)-len(CR_LF)]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errProxyHeader
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// parseProxyV1Addr parses an address of a version 1 header.
+func parseProxyV1Addr(host, port string, v4 bool) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return nil, fmt.Errorf("%v: bad address %q", errProxyHeader, host)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%v: bad port %q", errProxyHeader, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readProxyV2 reads the rest of a version 2 header, after the start of its
+// signature.
+func readProxyV2(conn net.Conn) (net.Addr, net.Addr, error) {
+	var hdr [16]byte
+	copy(hdr[:], proxyV2Sig[:5])
+	if _, err := io.ReadFull(conn, hdr[5:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Sig) || hdr[12]>>4 != 2 {
+		return nil, nil, errProxyHeader
+	}
+	n := int(binary.BigEndian.Uint16(hdr[14:]))
+	if n > proxyV2MaxLen {
+		return nil, nil, errProxyHeader
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(conn, data); err != nil {
+		return nil, nil, err
+	}
+	cmd, fam := hdr[12]&0xf, hdr[13]
+	switch {
+	case cmd == 0:
+		// LOCAL, the connection is from the balancer itself.
+		return nil, nil, nil
+	case cmd != 1:
+		return nil, nil, errProxyHeader
+	}
+	var size int
+	switch fam {
+	case 0x11:
+		// TCP over IPv4
+		size = net.IPv4len
+	case 0x21:
+		// TCP over IPv6
+		size = net.IPv6len
+	case 0x00:
+		// UNSPEC
+		return nil, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("%v: unsupported family 0x%02x", errProxyHeader, fam)
+	}
+	if n < 2*size+4 {
+		return nil, nil, errProxyHeader
+	}
+	src := &net.TCPAddr{
+		IP:   net.IP(data[:size]),
+		Port: int(binary.BigEndian.Uint16(data[2*size:])),
+	}
+	dst := &net.TCPAddr{
+		IP:   net.IP(data[size : 2*size]),
+		Port: int(binary.BigEndian.Uint16(data[2*size+2:])),
+	}
+	return src, dst, nil
+}
+
+// acceptProxyHeader reads the PROXY protocol header of an accepted
+// connection if mode is optional or required. The connection is closed and
+// counted in rejected if the header is invalid. Returns nil if closed.
+func (s *Server) acceptProxyHeader(conn net.Conn, mode string, rejected *int64) net.Conn {
+	if mode != ProxyProtocolOptional && mode != ProxyProtocolRequired {
+		return conn
+	}
+	pconn, err := readProxyHeader(conn, PROXY_PROTOCOL_TIMEOUT,
+		mode == ProxyProtocolOptional, PROXY_PROTOCOL_PEEK_TIMEOUT)
+	if err != nil {
+		s.Debugf("PROXY protocol error from %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		atomic.AddInt64(rejected, 1)
+		return nil
+	}
+	return pconn
+}
@@ -0,0 +1,441 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+// proxyV2Header returns a version 2 header for TCP over IPv4 or IPv6.
+func proxyV2Header(cmd byte, src, dst *net.TCPAddr) []byte {
+	hdr := append([]byte{}, proxyV2Sig...)
+	if src == nil {
+		return append(hdr, 0x20|cmd, 0x00, 0, 0)
+	}
+	fam, sip, dip := byte(0x11), src.IP.To4(), dst.IP.To4()
+	if sip == nil {
+		fam, sip, dip = 0x21, src.IP.To16(), dst.IP.To16()
+	}
+	data := append(append([]byte{}, sip...), dip...)
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(data[len(data)-4:], uint16(src.Port))
+	binary.BigEndian.PutUint16(data[len(data)-2:], uint16(dst.Port))
+	hdr = append(hdr, 0x20|cmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(hdr[len(hdr)-2:], uint16(len(data)))
+	return append(hdr, data...)
+}
+
+// readProxyHeaderFrom writes data to a pipe and reads the PROXY protocol
+// header from its other end. It also returns what is left to read.
+func readProxyHeaderFrom(t *testing.T, data []byte) (net.Conn, string, error) {
+	t.Helper()
+	return readProxyHeaderMode(t, data, false)
+}
+
+// readProxyHeaderMode is readProxyHeaderFrom with the header optional or
+// required.
+func readProxyHeaderMode(t *testing.T, data []byte, optional bool) (net.Conn, string, error) {
+	t.Helper()
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	go func() {
+		cli.Write(data)
+		cli.Close()
+	}()
+	conn, err := readProxyHeader(srv, time.Second, optional, time.Second)
+	if err != nil {
+		srv.Close()
+		return nil, "", err
+	}
+	rest, _ := ioutil.ReadAll(conn)
+	conn.Close()
+	return conn, string(rest), nil
+}
+
+func TestProxyProtocolHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4222}
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 56324}
+	dst6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 4222}
+
+	for _, test := range []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.168.1.10 10.0.0.1 56324 4222\r\n"), src.String(), dst.String()},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 4222\r\n"), src6.String(), dst6.String()},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", ""},
+		{"v1 unknown with addresses", []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), "", ""},
+		{"v2 tcp4", proxyV2Header(1, src, dst), src.String(), dst.String()},
+		{"v2 tcp6", proxyV2Header(1, src6, dst6), src6.String(), dst6.String()},
+		{"v2 local", proxyV2Header(0, src, dst), "", ""},
+		{"v2 unspec", proxyV2Header(1, nil, nil), "", ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, rest, err := readProxyHeaderFrom(t, append(test.header, "CONNECT {}\r\n"...))
+			if err != nil {
+				t.Fatalf("Error reading header: %v", err)
+			}
+			// The header should be consumed, and nothing more.
+			if rest != "CONNECT {}\r\n" {
+				t.Fatalf("Expected the rest of the stream to be left, got %q", rest)
+			}
+			pc, ok := conn.(*proxyConn)
+			if test.remote == "" {
+				if ok {
+					t.Fatalf("Expected the original connection, got addresses %v", pc.RemoteAddr())
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Expected a proxied connection, got %T", conn)
+			}
+			if addr := pc.RemoteAddr().String(); addr != test.remote {
+				t.Fatalf("Expected remote address %s, got %s", test.remote, addr)
+			}
+			if addr := pc.LocalAddr().String(); addr != test.local {
+				t.Fatalf("Expected local address %s, got %s", test.local, addr)
+			}
+		})
+	}
+}
+
+func TestProxyProtocolInvalidHeader(t *testing.T) {
+	v2 := proxyV2Header(1, &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2})
+	badVersion := append([]byte{}, v2...)
+	badVersion[12] = 0x11
+	badCommand := append([]byte{}, v2...)
+	badCommand[12] = 0x22
+	badFamily := append([]byte{}, v2...)
+	badFamily[13] = 0x31
+	tooShort := append([]byte{}, v2[:16]...)
+	tooShort[15] = 4
+	tooShort = append(tooShort, 1, 2, 3, 4)
+	tooLong := append([]byte{}, v2[:16]...)
+	binary.BigEndian.PutUint16(tooLong[14:], proxyV2MaxLen+1)
+
+	for _, test := range []struct {
+		name   string
+		header []byte
+	}{
+		{"no header", []byte("CONNECT {}\r\n")},
+		{"v1 bad protocol", []byte("PROXY UDP4 10.0.0.2 10.0.0.1 1 2\r\n")},
+		{"v1 missing port", []byte("PROXY TCP4 10.0.0.2 10.0.0.1 1\r\n")},
+		{"v1 bad address", []byte("PROXY TCP4 10.0.0.x 10.0.0.1 1 2\r\n")},
+		{"v1 ipv6 as tcp4", []byte("PROXY TCP4 ::1 ::1 1 2\r\n")},
+		{"v1 bad port", []byte("PROXY TCP4 10.0.0.2 10.0.0.1 1 65536\r\n")},
+		{"v1 too long", []byte("PROXY TCP6 " + strings.Repeat("f", proxyV1MaxLen) + "\r\n")},
+		{"v1 truncated", []byte("PROXY TCP4 10.0.0.2")},
+		{"v2 bad signature", append([]byte("\r\n\r\n\x00\r\nQUIX\n"), v2[12:]...)},
+		{"v2 bad version", badVersion},
+		{"v2 bad command", badCommand},
+		{"v2 bad family", badFamily},
+		{"v2 addresses too short", tooShort},
+		{"v2 too long", tooLong},
+		{"v2 truncated", v2[:len(v2)-2]},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if _, _, err := readProxyHeaderFrom(t, test.header); err == nil {
+				t.Fatal("Expected error reading header")
+			}
+		})
+	}
+
+	// A connection that sends nothing times out.
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+	if _, err := readProxyHeader(srv, 50*time.Millisecond, false, 0); err == nil {
+		t.Fatal("Expected timeout reading header")
+	}
+}
+
+func TestProxyProtocolOptionalHeader(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 56324}
+	dst := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4222}
+
+	for _, test := range []struct {
+		name   string
+		data   []byte
+		remote string
+		rest   string
+	}{
+		{"v1", []byte("PROXY TCP4 192.168.1.10 10.0.0.1 56324 4222\r\nPING\r\n"), src.String(), "PING\r\n"},
+		{"v2", append(proxyV2Header(1, src, dst), "PING\r\n"...), src.String(), "PING\r\n"},
+		{"no header", []byte("PING\r\n"), "", "PING\r\n"},
+		{"no header with common prefix", []byte("PUB foo 2\r\nok\r\n"), "", "PUB foo 2\r\nok\r\n"},
+		{"no header with v2 common prefix", []byte("\r\nPING\r\n"), "", "\r\nPING\r\n"},
+		{"short", []byte("P"), "", "P"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			conn, rest, err := readProxyHeaderMode(t, test.data, true)
+			if test.name == "short" {
+				// The connection closed in the middle of a signature.
+				if err == nil {
+					t.Fatal("Expected error reading a truncated signature")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Error reading header: %v", err)
+			}
+			if rest != test.rest {
+				t.Fatalf("Expected %q left to read, got %q", test.rest, rest)
+			}
+			pc, ok := conn.(*proxyConn)
+			if test.remote == "" {
+				if ok {
+					t.Fatalf("Expected the original connection, got addresses %v", pc.RemoteAddr())
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("Expected a proxied connection, got %T", conn)
+			}
+			if addr := pc.RemoteAddr().String(); addr != test.remote {
+				t.Fatalf("Expected remote address %s, got %s", test.remote, addr)
+			}
+		})
+	}
+
+	// An invalid header is still an error.
+	if _, _, err := readProxyHeaderMode(t, []byte("PROXY UDP4 10.0.0.2 10.0.0.1 1 2\r\n"), true); err == nil {
+		t.Fatal("Expected error reading an invalid header")
+	}
+
+	// A connection that sends nothing, waiting for the INFO of the server,
+	// is kept once the peek times out.
+	cli, srv := net.Pipe()
+	defer cli.Close()
+	defer srv.Close()
+	conn, err := readProxyHeader(srv, time.Second, true, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error waiting for header: %v", err)
+	}
+	if conn != srv {
+		t.Fatalf("Expected the original connection, got %T", conn)
+	}
+}
+
+func TestProxyProtocolConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/proxy_protocol.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.ProxyProtocol != ProxyProtocolRequired {
+		t.Fatalf("Expected proxy_protocol to be required, got %q", opts.ProxyProtocol)
+	}
+	if opts.Cluster.ProxyProtocol != ProxyProtocolOptional {
+		t.Fatalf("Expected cluster proxy_protocol to be optional, got %q", opts.Cluster.ProxyProtocol)
+	}
+	if cc := CheckConfigFile("./configs/proxy_protocol.conf"); len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+
+	for _, test := range []struct {
+		value interface{}
+		mode  string
+	}{
+		{true, ProxyProtocolRequired},
+		{false, ProxyProtocolOff},
+		{"Optional", ProxyProtocolOptional},
+		{"required", ProxyProtocolRequired},
+		{"off", ProxyProtocolOff},
+	} {
+		mode, err := parseProxyProtocol(test.value)
+		if err != nil || mode != test.mode {
+			t.Fatalf("Expected %v to be %q, got %q, %v", test.value, test.mode, mode, err)
+		}
+	}
+	if _, err := parseProxyProtocol("sometimes"); err == nil {
+		t.Fatal("Expected error for an unknown mode")
+	}
+}
+
+// proxyDialer sends a PROXY protocol header when it connects.
+type proxyDialer struct {
+	header string
+}
+
+func (d *proxyDialer) Dial(network, address string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, address, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte(d.header)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func TestProxyProtocolClients(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ProxyProtocol = ProxyProtocolRequired
+	opts.DeniedCIDRs = []string{"10.1.0.0/16"}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	dialer := &proxyDialer{header: "PROXY TCP4 192.168.1.10 127.0.0.1 56324 4222\r\n"}
+	nc, err := gio.Connect(url, gio.SetCustomDialer(dialer), gio.Name("proxied"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// The client is reported with the address of the header.
+	c, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	if len(c.Conns) != 1 {
+		t.Fatalf("Expected 1 connection, got %d", len(c.Conns))
+	}
+	if ci := c.Conns[0]; ci.IP != "192.168.1.10" || ci.Port != 56324 {
+		t.Fatalf("Expected connection from 192.168.1.10:56324, got %s:%d", ci.IP, ci.Port)
+	}
+	nc.Close()
+	checkClosedConns(t, s, 1, 2*time.Second)
+	c, _ = s.Connz(&ConnzOptions{State: ConnClosed})
+	if ci := c.Conns[0]; ci.IP != "192.168.1.10" || ci.Port != 56324 {
+		t.Fatalf("Expected closed connection from 192.168.1.10:56324, got %s:%d", ci.IP, ci.Port)
+	}
+
+	// Health checks without an address are accepted.
+	dialer.header = "PROXY UNKNOWN\r\n"
+	nc2, err := gio.Connect(url, gio.SetCustomDialer(dialer))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc2.Close()
+
+	// The IP filter applies to the address of the header.
+	dialer.header = "PROXY TCP4 10.1.2.3 127.0.0.1 56324 4222\r\n"
+	if nc, err := gio.Connect(url, gio.SetCustomDialer(dialer), gio.Timeout(time.Second)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection from a denied network to fail")
+	}
+	if n := atomic.LoadInt64(&s.rejected.clients); n != 1 {
+		t.Fatalf("Expected 1 rejected connection, got %d", n)
+	}
+
+	// Connections without a header are closed.
+	if nc, err := gio.Connect(url, gio.Timeout(time.Second)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection without a header to fail")
+	}
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		v, _ := s.Varz(nil)
+		if v.RejectedConns != 2 {
+			return fmt.Errorf("Expected 2 rejected connections, got %d", v.RejectedConns)
+		}
+		return nil
+	})
+}
+
+func TestProxyProtocolOptionalClients(t *testing.T) {
+	opts := DefaultOptions()
+	opts.ProxyProtocol = ProxyProtocolOptional
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+	dialer := &proxyDialer{header: "PROXY TCP4 192.168.1.10 127.0.0.1 56324 4222\r\n"}
+	nc, err := gio.Connect(url, gio.SetCustomDialer(dialer), gio.Name("proxied"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	// Connections without a header keep the address of their peer.
+	nc2, err := gio.Connect(url, gio.Name("direct"))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc2.Close()
+
+	c, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	if len(c.Conns) != 2 {
+		t.Fatalf("Expected 2 connections, got %d", len(c.Conns))
+	}
+	for _, ci := range c.Conns {
+		switch ci.Name {
+		case "proxied":
+			if ci.IP != "192.168.1.10" || ci.Port != 56324 {
+				t.Fatalf("Expected connection from 192.168.1.10:56324, got %s:%d", ci.IP, ci.Port)
+			}
+		case "direct":
+			if ci.IP != "127.0.0.1" {
+				t.Fatalf("Expected connection from 127.0.0.1, got %s", ci.IP)
+			}
+		}
+	}
+
+	// Invalid headers are still rejected.
+	dialer.header = "PROXY UDP4 10.0.0.2 127.0.0.1 1 2\r\n"
+	if nc, err := gio.Connect(url, gio.SetCustomDialer(dialer), gio.Timeout(time.Second)); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection with an invalid header to fail")
+	}
+	if n := atomic.LoadInt64(&s.rejected.clients); n != 1 {
+		t.Fatalf("Expected 1 rejected connection, got %d", n)
+	}
+}
+
+func TestProxyProtocolRoutes(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	optsA.Cluster.ProxyProtocol = ProxyProtocolRequired
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	// A route without a header is rejected.
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sa.ClusterAddr().Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := atomic.LoadInt64(&sa.rejected.routes); n == 0 {
+			return fmt.Errorf("Expected route to be rejected")
+		}
+		return nil
+	})
+	if n := sa.NumRoutes(); n != 0 {
+		t.Fatalf("Expected no route, got %d", n)
+	}
+}
+
+func TestProxyProtocolOptionalRoutes(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	optsA.Cluster.ProxyProtocol = ProxyProtocolOptional
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	// A route without a header is accepted once the peek times out.
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sa.ClusterAddr().Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+	if n := atomic.LoadInt64(&sa.rejected.routes); n != 0 {
+		t.Fatalf("Expected no rejected route, got %d", n)
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Client rebalancing.
+//
+// Clients stay connected to the server they picked, so servers added to a
+// cluster get no clients until others reconnect. Each server sends its
+// number of clients to its routes, shortly after it changes, so that every
+// server knows the load of its peers. A rebalance, triggered from the
+// monitoring port or every rebalance_interval, compares the clients of this
+// server to its share of all the clients of the cluster, and asks the
+// clients above that share to reconnect to another server. The request is
+// an async INFO with rebalance set, which clients supporting it honor by
+// reconnecting to another server of their pool.
+//
+// Only servers that advertise client URLs are counted, since clients can
+// not be sent to the others. After clients were asked to reconnect, the
+// next rebalance waits for every server to send its new number of clients,
+// or for REBALANCE_SETTLE_TIME, so that clients are not moved again based
+// on numbers that do not include them.
+
+// RebalanceReport is the outcome of a rebalance.
+type RebalanceReport struct {
+	Clients int `json:"clients"` // Clients of this server.
+	Servers int `json:"servers"` // Servers the clients are balanced on.
+	Share   int `json:"share"`   // Clients each server should have.
+	Asked   int `json:"asked"`   // Clients asked to reconnect elsewhere.
+}
+
+// Rebalance asks the clients of this server above its share of the clients
+// of the cluster to reconnect to another server.
+func (s *Server) Rebalance() *RebalanceReport {
+	r := &RebalanceReport{Servers: 1}
+
+	s.mu.Lock()
+	r.Clients = len(s.clients)
+	total := r.Clients
+	settling := time.Since(s.rebalanceTime) < REBALANCE_SETTLE_TIME
+	stale := false
+	for _, route := range s.remotes {
+		route.mu.Lock()
+		if !route.route.loadTime.IsZero() && len(route.route.connectURLs) > 0 {
+			total += route.route.numClients
+			r.Servers++
+			if settling && route.route.loadTime.Before(s.rebalanceTime) {
+				stale = true
+			}
+		}
+		route.mu.Unlock()
+	}
+	r.Share = (total + r.Servers - 1) / r.Servers
+	excess := r.Clients - r.Share
+	if r.Servers == 1 || excess <= 0 {
+		s.mu.Unlock()
+		return r
+	}
+	if stale {
+		s.mu.Unlock()
+		s.Debugf("Waiting for the number of clients of the routes to rebalance")
+		return r
+	}
+
+	// Ask the oldest clients, which were there before the cluster grew,
+	// skipping those asked already and those that can not move.
+	var clients []*client
+	for _, c := range s.clients {
+		c.mu.Lock()
+		if c.opts.Protocol >= ClientProtoInfo && c.flags.isSet(firstPongSent) && !c.flags.isSet(rebalanceSent) {
+			if _, local := c.nc.(*net.UnixConn); !local {
+				clients = append(clients, c)
+			}
+		}
+		c.mu.Unlock()
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].cid < clients[j].cid })
+	if len(clients) > excess {
+		clients = clients[:excess]
+	}
+	info := s.copyInfo()
+	info.Rebalance = true
+	for _, c := range clients {
+		c.mu.Lock()
+		c.flags.set(rebalanceSent)
+		c.sendInfo(c.generateClientInfoJSON(info))
+		c.mu.Unlock()
+	}
+	if len(clients) > 0 {
+		s.rebalanceTime = time.Now()
+	}
+	s.mu.Unlock()
+
+	r.Asked = len(clients)
+	if r.Asked > 0 {
+		atomic.AddInt64(&s.rebalanced, int64(r.Asked))
+		s.Noticef("Asked %d of %d clients to reconnect to another server, %d expected per server",
+			r.Asked, r.Clients, r.Share)
+	}
+	return r
+}
+
+// startRebalancing starts the periodic rebalance, if configured and not
+// running already.
+func (s *Server) startRebalancing() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rebalancing || s.getOpts().Cluster.RebalanceInterval <= 0 {
+		return
+	}
+	s.rebalancing = true
+	s.startGoRoutine(s.rebalanceLoop)
+}
+
+// rebalanceLoop rebalances the clients every rebalance_interval, until it
+// is disabled on config reload.
+func (s *Server) rebalanceLoop() {
+	defer s.grWG.Done()
+
+	for {
+		s.mu.Lock()
+		interval := s.getOpts().Cluster.RebalanceInterval
+		if interval <= 0 {
+			s.rebalancing = false
+			s.mu.Unlock()
+			return
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.quitCh:
+			return
+		case <-time.After(interval):
+		}
+		s.Rebalance()
+	}
+}
+
+// clientLoadChanged schedules sending the number of clients to the routes.
+// Updates are delayed so that a burst of connections sends only one.
+// Server lock should be held.
+func (s *Server) clientLoadChanged() {
+	if s.loadTmr != nil || len(s.routes) == 0 || s.shutdown {
+		return
+	}
+	s.loadTmr = time.AfterFunc(ROUTE_LOAD_UPDATE_DELAY, s.sendLoadToRoutes)
+}
+
+// sendLoadToRoutes sends the number of clients to all routes.
+func (s *Server) sendLoadToRoutes() {
+	s.mu.Lock()
+	s.loadTmr = nil
+	proto := s.loadInfoJSON()
+	routes := make([]*client, 0, len(s.routes))
+	for _, r := range s.routes {
+		routes = append(routes, r)
+	}
+	s.mu.Unlock()
+
+	for _, r := range routes {
+		r.mu.Lock()
+		r.sendInfo(proto)
+		r.mu.Unlock()
+	}
+}
+
+// sendLoadToRoute sends the number of clients to a route just registered.
+func (s *Server) sendLoadToRoute(c *client) {
+	s.mu.Lock()
+	proto := s.loadInfoJSON()
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.sendInfo(proto)
+	c.mu.Unlock()
+}
+
+// loadInfoJSON returns the INFO with the number of clients of this server.
+// Server lock should be held.
+func (s *Server) loadInfoJSON() []byte {
+	b, _ := json.Marshal(&Info{ID: s.info.ID, LoadUpdate: true, NumClients: len(s.clients)})
+	return []byte(fmt.Sprintf(InfoProto, b))
+}
+
+// HandleRebalance rebalances the clients on a POST request with the
+// reload token, like /reload.
+func (s *Server) HandleRebalance(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[RebalancePath]++
+	s.mu.Unlock()
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !s.checkReloadToken(token) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	b, err := json.MarshalIndent(s.Rebalance(), "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to /rebalance request: %v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestRebalanceConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/rebalance.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.Cluster.RebalanceInterval != 5*time.Minute {
+		t.Fatalf("Expected rebalance interval of 5m, got %v", opts.Cluster.RebalanceInterval)
+	}
+	if cc := CheckConfigFile("./configs/rebalance.conf"); len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+}
+
+// runRebalanceClients connects n clients to s, and then runs a server
+// routed to s, returning it once the clients and s know about it.
+func runRebalanceClients(t *testing.T, s *Server, n int) (*Server, []*gio.Conn) {
+	t.Helper()
+	url := fmt.Sprintf("nats://127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+	conns := make([]*gio.Conn, 0, n)
+	for i := 0; i < n; i++ {
+		nc, err := gio.Connect(url, gio.ReconnectWait(10*time.Millisecond))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		conns = append(conns, nc)
+	}
+
+	opts := nextServerOpts(s.getOpts())
+	opts.Cluster.RebalanceInterval = 0
+	opts.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", s.ClusterAddr().Port))
+	sb := RunServer(opts)
+	checkClusterFormed(t, s, sb)
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		for _, nc := range conns {
+			if len(nc.DiscoveredServers()) != 1 {
+				return fmt.Errorf("Client did not discover the new server")
+			}
+		}
+		return nil
+	})
+	return sb, conns
+}
+
+// checkNumClientsBalanced checks that the servers have the same number of
+// clients, and know about the number of clients of each other.
+func checkNumClientsBalanced(t *testing.T, expected int, servers ...*Server) {
+	t.Helper()
+	checkFor(t, 3*time.Second, 15*time.Millisecond, func() error {
+		for _, s := range servers {
+			if n := s.NumClients(); n != expected {
+				return fmt.Errorf("Expected %d clients, got %d", expected, n)
+			}
+			s.mu.Lock()
+			for _, r := range s.remotes {
+				r.mu.Lock()
+				n, known := r.route.numClients, r.route.loadTime
+				r.mu.Unlock()
+				if known.IsZero() || n != expected {
+					s.mu.Unlock()
+					return fmt.Errorf("Expected remote to have %d clients, got %d", expected, n)
+				}
+			}
+			s.mu.Unlock()
+		}
+		return nil
+	})
+}
+
+func TestRebalance(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	sb, conns := runRebalanceClients(t, sa, 8)
+	defer sb.Shutdown()
+	for _, nc := range conns {
+		defer nc.Close()
+	}
+
+	// Wait for A to know that B has no clients.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if r := sa.Rebalance(); r.Servers != 2 || r.Asked != 4 {
+			return fmt.Errorf("Expected 4 clients asked to reconnect, got %+v", r)
+		}
+		return nil
+	})
+	checkNumClientsBalanced(t, 4, sa, sb)
+	for _, nc := range conns {
+		if !nc.IsConnected() {
+			t.Fatal("Expected clients to be connected")
+		}
+	}
+
+	// Clients are not asked again once balanced.
+	if r := sa.Rebalance(); r.Asked != 0 || r.Share != 4 {
+		t.Fatalf("Expected no client asked to reconnect, got %+v", r)
+	}
+	if r := sb.Rebalance(); r.Asked != 0 {
+		t.Fatalf("Expected no client asked to reconnect, got %+v", r)
+	}
+	v, _ := sa.Varz(nil)
+	if v.Rebalanced != 4 {
+		t.Fatalf("Expected 4 rebalanced clients, got %d", v.Rebalanced)
+	}
+}
+
+func TestRebalanceInterval(t *testing.T) {
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	optsA.Cluster.RebalanceInterval = 50 * time.Millisecond
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	sb, conns := runRebalanceClients(t, sa, 6)
+	defer sb.Shutdown()
+	for _, nc := range conns {
+		defer nc.Close()
+	}
+	checkNumClientsBalanced(t, 3, sa, sb)
+}
+
+func TestRebalanceMonitoring(t *testing.T) {
+	opts := DefaultOptions()
+	opts.HTTPHost = "127.0.0.1"
+	opts.HTTPPort = -1
+	opts.ReloadToken = "s3cr3t"
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s", s.MonitorAddr().Port, RebalancePath)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error on request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected status %d, got %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+	for _, token := range []string{"", "wrong", "s3cr3t"} {
+		req, _ := http.NewRequest(http.MethodPost, url, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Error on request: %v", err)
+		}
+		defer resp.Body.Close()
+		if token != "s3cr3t" {
+			if resp.StatusCode != http.StatusUnauthorized {
+				t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, resp.StatusCode)
+			}
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, resp.StatusCode)
+		}
+		report := &RebalanceReport{}
+		if err := json.NewDecoder(resp.Body).Decode(report); err != nil {
+			t.Fatalf("Error decoding report: %v", err)
+		}
+		if *report != (RebalanceReport{Servers: 1}) {
+			t.Fatalf("Unexpected report: %+v", report)
+		}
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
@@ -134,6 +135,7 @@ func (t *tlsOption) Apply(server *Server) {
 		message = "enabled"
 	}
 	server.mu.Unlock()
+	server.startTLSCertChecks()
 	server.Noticef("Reloaded: tls = %s", message)
 }
 
@@ -222,7 +224,8 @@ func (u *usersOption) Apply(server *Server) {
 // clusterOption implements the option interface for the `cluster` setting.
 type clusterOption struct {
 	authOption
-	newValue ClusterOpts
+	newValue     ClusterOpts
+	permsChanged bool
 }
 
 // Apply the cluster change.
@@ -233,6 +236,8 @@ func (c *clusterOption) Apply(server *Server) {
 	server.routeInfo.TLSRequired = tlsRequired
 	server.routeInfo.TLSVerify = tlsRequired
 	server.routeInfo.AuthRequired = c.newValue.Username != ""
+	server.routeInfo.Compression = compressionAdvert(c.newValue.Compression)
+	server.routeInfo.RoutePoolSize = routePoolAdvert(&c.newValue)
 	if c.newValue.NoAdvertise {
 		server.routeInfo.ClientConnectURLs = nil
 	} else {
@@ -240,6 +245,14 @@ func (c *clusterOption) Apply(server *Server) {
 	}
 	server.setRouteInfoHostPortAndIP()
 	server.mu.Unlock()
+	if c.permsChanged {
+		server.updateRoutePermissions(c.newValue.Permissions)
+	}
+	if err := server.configureIPFilters(); err != nil {
+		server.Errorf("Error reloading IP filters: %v", err)
+	}
+	server.startRebalancing()
+	server.startTLSCertChecks()
 	server.Noticef("Reloaded: cluster")
 }
 
@@ -420,6 +433,19 @@ func (w *writeDeadlineOption) Apply(server *Server) {
 	server.Noticef("Reloaded: write_deadline = %s", w.newValue)
 }
 
+// drainTimeoutOption implements the option interface for the `drain_timeout`
+// setting.
+type drainTimeoutOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply is a no-op because the drain timeout will be reloaded after options
+// are applied.
+func (d *drainTimeoutOption) Apply(server *Server) {
+	server.Noticef("Reloaded: drain_timeout = %s", d.newValue)
+}
+
 // clientAdvertiseOption implements the option interface for the `client_advertise` setting.
 type clientAdvertiseOption struct {
 	noopOption
@@ -434,20 +460,295 @@ func (c *clientAdvertiseOption) Apply(server *Server) {
 	server.Noticef("Reload: client_advertise = %s", c.newValue)
 }
 
+// maxSubsOption implements the option interface for the `max_subscriptions`
+// setting.
+type maxSubsOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the setting by updating each client, unless its user has its own
+// limit. Clients that have more subscriptions than the new limit are closed.
+func (m *maxSubsOption) Apply(server *Server) {
+	server.mu.Lock()
+	clients := make([]*client, 0, len(server.clients))
+	for _, client := range server.clients {
+		clients = append(clients, client)
+	}
+	server.mu.Unlock()
+
+	closed := 0
+	for _, client := range clients {
+		client.mu.Lock()
+		if client.umsubs == 0 {
+			client.msubs = m.newValue
+		}
+		exceeded := client.msubs > 0 && len(client.subs) > client.msubs
+		client.mu.Unlock()
+		if exceeded {
+			client.maxSubsExceeded()
+			client.closeConnection(MaxSubscriptionsExceeded)
+			closed++
+		}
+	}
+	if closed > 0 {
+		server.Noticef("Closed %d connections to fall within max_subscriptions", closed)
+	}
+	server.Noticef("Reloaded: max_subscriptions = %d", m.newValue)
+}
+
+// connLimitsOption implements the option interface for the
+// `max_connections_per_user`, `max_connections_per_ip` and
+// `connection_limits` settings.
+type connLimitsOption struct {
+	noopOption
+	name     string
+	newValue interface{}
+}
+
+// Apply the limits by counting the clients again, closing the newest ones
+// exceeding them.
+func (c *connLimitsOption) Apply(server *Server) {
+	server.enforceConnLimits()
+	server.Noticef("Reloaded: %s", c.name)
+}
+
+// ipFiltersOption implements the option interface for the `allowed_cidrs`,
+// `denied_cidrs`, `http_allowed_cidrs` and `http_denied_cidrs` settings.
+type ipFiltersOption struct {
+	noopOption
+	name     string
+	newValue []string
+}
+
+// Apply the setting by replacing the IP filters, which are checked for new
+// connections only.
+func (f *ipFiltersOption) Apply(server *Server) {
+	if err := server.configureIPFilters(); err != nil {
+		server.Errorf("Error reloading IP filters: %v", err)
+		return
+	}
+	server.Noticef("Reloaded: %s = %v", f.name, f.newValue)
+}
+
+// proxyProtocolOption implements the option interface for the
+// `proxy_protocol` setting.
+type proxyProtocolOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply is a no-op because the setting is checked for each new connection.
+func (p *proxyProtocolOption) Apply(server *Server) {
+	server.Noticef("Reloaded: proxy_protocol = %v", p.newValue)
+}
+
+// maxPendingOption implements the option interface for the `max_pending`
+// setting.
+type maxPendingOption struct {
+	noopOption
+	newValue int64
+}
+
+// Apply the setting by updating each client. Clients that already have
+// more pending bytes than the new limit allows them are treated as slow
+// consumers.
+func (m *maxPendingOption) Apply(server *Server) {
+	server.mu.Lock()
+	clients := make([]*client, 0, len(server.clients))
+	for _, client := range server.clients {
+		clients = append(clients, client)
+	}
+	server.mu.Unlock()
+
+	for _, client := range clients {
+		client.mu.Lock()
+		client.out.mp = m.newValue
+		if client.overMaxPending() {
+			client.flags.set(slowConsumer)
+			client.clearConnection(SlowConsumerPendingBytes)
+			atomic.AddInt64(&server.slowConsumers, 1)
+			client.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded", client.out.mp)
+		}
+		client.mu.Unlock()
+	}
+	server.Noticef("Reloaded: max_pending = %d", m.newValue)
+}
+
+// slowConsumerPolicyOption implements the option interface for the
+// `slow_consumer_policy` setting.
+type slowConsumerPolicyOption struct {
+	noopOption
+	newValue SlowConsumerPolicy
+}
+
+// Apply the setting by updating the clients that do not have a policy of
+// their own or from their user.
+func (s *slowConsumerPolicyOption) Apply(server *Server) {
+	server.mu.Lock()
+	clients := make([]*client, 0, len(server.clients))
+	for _, client := range server.clients {
+		clients = append(clients, client)
+	}
+	server.mu.Unlock()
+
+	for _, client := range clients {
+		client.mu.Lock()
+		client.applySlowConsumerPolicy(s.newValue)
+		client.mu.Unlock()
+	}
+	server.Noticef("Reloaded: slow_consumer_policy = %s", s.newValue)
+}
+
+// rqSubsSweepOption implements the option interface for the remote queue
+// subscriptions sweeper interval.
+type rqSubsSweepOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply the setting by resetting the sweeper timer if it is running.
+func (r *rqSubsSweepOption) Apply(server *Server) {
+	server.rqsMu.Lock()
+	if server.rqsubsTimer != nil {
+		server.rqsubsTimer.Stop()
+		server.rqsubsTimer = time.AfterFunc(r.newValue, server.purgeRemoteQSubs)
+	}
+	server.rqsMu.Unlock()
+	server.Noticef("Reloaded: remote queue subscriptions sweeper = %s", r.newValue)
+}
+
+// maxClosedClientsOption implements the option interface for the maximum
+// number of closed connections kept for monitoring.
+type maxClosedClientsOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the setting by resizing the closed connections ring buffer.
+func (m *maxClosedClientsOption) Apply(server *Server) {
+	server.mu.Lock()
+	server.closed.resize(m.newValue)
+	server.mu.Unlock()
+	server.Noticef("Reloaded: max_closed_clients = %d", m.newValue)
+}
+
+// monitoringOption implements the option interface for the `http_host`,
+// `http_port` and `https_port` settings.
+type monitoringOption struct {
+	noopOption
+}
+
+// Apply the setting by restarting the monitoring listener.
+func (m *monitoringOption) Apply(server *Server) {
+	if err := server.reloadMonitoring(); err != nil {
+		server.Errorf("Failed to restart monitoring: %v", err)
+		return
+	}
+	server.Noticef("Reloaded: monitoring")
+}
+
+// listenOption implements the option interface for the client `host` and
+// `port` settings.
+type listenOption struct {
+	noopOption
+}
+
+// Apply the setting by replacing the client listener. Existing clients
+// stay connected.
+func (l *listenOption) Apply(server *Server) {
+	if err := server.rebindClientListener(); err != nil {
+		server.Errorf("Failed to listen for client connections: %v", err)
+		return
+	}
+	server.Noticef("Reloaded: listen")
+}
+
+// msgTraceSubjectOption implements the option interface for the
+// `msg_trace_subject` setting.
+type msgTraceSubjectOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply is a no-op because the trace subject will be reloaded after options
+// are applied.
+func (m *msgTraceSubjectOption) Apply(server *Server) {
+	server.Noticef("Reloaded: msg_trace_subject = %s", m.newValue)
+}
+
+// reloadTokenOption implements the option interface for the `reload_token`
+// setting.
+type reloadTokenOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply the setting by enabling or disabling remote reload requests. The
+// token itself is checked against the current options on each request.
+func (r *reloadTokenOption) Apply(server *Server) {
+	if r.newValue != "" {
+		if err := server.startReloadRequests(); err != nil {
+			server.Errorf("Failed to enable remote reload: %v", err)
+			return
+		}
+	} else {
+		server.stopReloadRequests()
+	}
+	server.Noticef("Reloaded: reload_token")
+}
+
+// ReloadReport describes the changes found in the configuration file when
+// reloading it, or when checking what a reload would do.
+type ReloadReport struct {
+	ConfigFile  string   `json:"config_file"`
+	DryRun      bool     `json:"dry_run"`
+	Applied     bool     `json:"applied"`
+	Changed     []string `json:"changed"`
+	Unsupported []string `json:"unsupported,omitempty"`
+	Errors      []string `json:"errors,omitempty"`
+}
+
 // Reload reads the current configuration file and applies any supported
 // changes. This returns an error if the server was not started with a config
 // file or an option which doesn't support hot-swapping was changed.
 func (s *Server) Reload() error {
+	_, err := s.reload(false)
+	return err
+}
+
+// ReloadDryRun reads the current configuration file and reports the options
+// that a Reload would change, without applying anything. The returned error
+// is the one Reload would return.
+func (s *Server) ReloadDryRun() (*ReloadReport, error) {
+	return s.reload(true)
+}
+
+// reload reads the current configuration file and, unless this is a dry
+// run, applies the changes. The report is always returned.
+func (s *Server) reload(dryRun bool) (*ReloadReport, error) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	if !dryRun {
+		sdNotify("RELOADING=1")
+		defer sdNotify("READY=1")
+	}
+
 	s.mu.Lock()
+	report := &ReloadReport{ConfigFile: s.configFile, DryRun: dryRun, Changed: []string{}}
 	if s.configFile == "" {
 		s.mu.Unlock()
-		return errors.New("Can only reload config when a file is provided using -c or --config")
+		err := errors.New("Can only reload config when a file is provided using -c or --config")
+		report.Errors = append(report.Errors, err.Error())
+		return report, err
 	}
 	newOpts, err := ProcessConfigFile(s.configFile)
 	if err != nil {
 		s.mu.Unlock()
 		// TODO: Dump previous good config to a .bak file?
-		return err
+		report.Errors = append(report.Errors, err.Error())
+		return report, err
 	}
 	clientOrgPort := s.clientActualPort
 	clusterOrgPort := s.clusterActualPort
@@ -457,6 +758,9 @@ func (s *Server) Reload() error {
 	newOpts = MergeOptions(newOpts, FlagSnapshot)
 	processOptions(newOpts)
 
+	// The message hook is not part of the config file.
+	newOpts.MessageHook = s.getOpts().MessageHook
+
 	// processOptions sets Port to 0 if set to -1 (RANDOM port)
 	// If that's the case, set it to the saved value when the accept loop was
 	// created.
@@ -468,15 +772,114 @@ func (s *Server) Reload() error {
 		newOpts.Cluster.Port = clusterOrgPort
 	}
 
-	if err := s.reloadOptions(newOpts); err != nil {
-		return err
+	diff := s.compareOptions(newOpts)
+	report.Changed = append(report.Changed, diff.changed...)
+	report.Unsupported = diff.unsupported
+	for _, err := range diff.errs {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	if len(diff.errs) > 0 {
+		return report, diff.errs[0]
+	}
+	if dryRun {
+		return report, nil
 	}
+
+	s.setOpts(newOpts)
+	s.applyOptions(diff.opts)
+	report.Applied = true
+
 	s.mu.Lock()
 	s.configTime = time.Now()
 	s.mu.Unlock()
+	return report, nil
+}
+
+// reloadReqSubj is the subject a server receives remote reload requests on,
+// the %s being the server's ID. Clients need an explicit publish permission
+// for it, see pubAllowed.
+const reloadReqSubj = "_SYS.REQ.SERVER.%s.RELOAD"
+
+// ReloadRequest is the payload of a remote reload request.
+type ReloadRequest struct {
+	Token  string `json:"token"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+// checkReloadToken returns true if token matches the configured reload
+// token. Remote reload is disabled if there is none.
+func (s *Server) checkReloadToken(token string) bool {
+	expected := s.getOpts().ReloadToken
+	return expected != "" && comparePasswords(expected, token)
+}
+
+// startReloadRequests subscribes to remote reload requests.
+func (s *Server) startReloadRequests() error {
+	s.mu.Lock()
+	started := s.reloadSub != nil
+	id := s.info.ID
+	s.mu.Unlock()
+	if started {
+		return nil
+	}
+	sub, err := s.sysSubscribe(fmt.Sprintf(reloadReqSubj, id), s.processReloadRequest)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.reloadSub = sub
+	s.mu.Unlock()
 	return nil
 }
 
+// stopReloadRequests removes the subscription to remote reload requests.
+func (s *Server) stopReloadRequests() {
+	s.mu.Lock()
+	sub := s.reloadSub
+	s.reloadSub = nil
+	s.mu.Unlock()
+	if sub != nil {
+		s.sysUnsubscribe(sub)
+	}
+}
+
+// processReloadRequest handles a remote reload request. The report is
+// sent to the reply subject, if any.
+func (s *Server) processReloadRequest(sub *subscription, subject, reply string, msg []byte) {
+	req := &ReloadRequest{}
+	err := json.Unmarshal(msg, req)
+	// Reloading may close connections, including the requestor's,
+	// so do not hold up the delivery of the request.
+	go func() {
+		var report *ReloadReport
+		switch {
+		case err != nil:
+			report = &ReloadReport{Errors: []string{fmt.Sprintf("Invalid reload request: %v", err)}}
+		case !s.checkReloadToken(req.Token):
+			s.Errorf("Unauthorized remote reload request")
+			report = &ReloadReport{DryRun: req.DryRun, Errors: []string{"Unauthorized"}}
+		default:
+			var rerr error
+			if report, rerr = s.reload(req.DryRun); rerr != nil {
+				s.Errorf("Remote reload failed: %v", rerr)
+			}
+		}
+		s.sendReloadReport(reply, report)
+	}()
+}
+
+func (s *Server) sendReloadReport(reply string, report *ReloadReport) {
+	if reply == "" {
+		return
+	}
+	b, err := json.Marshal(report)
+	if err != nil {
+		s.Errorf("Error marshaling reload report: %v", err)
+		return
+	}
+	s.sendInternalMsg(reply, b)
+}
+
 // reloadOptions reloads the server config with the provided options. If an
 // option that doesn't support hot-swapping is changed, this returns an error.
 func (s *Server) reloadOptions(newOpts *Options) error {
@@ -489,14 +892,40 @@ func (s *Server) reloadOptions(newOpts *Options) error {
 	return nil
 }
 
+// optionsDiff is the result of the comparison of the current options with
+// new ones.
+type optionsDiff struct {
+	opts        []option
+	changed     []string // Changed fields that support hot-swapping.
+	unsupported []string // Changed fields that do not.
+	errs        []error
+}
+
 // diffOptions returns a slice containing options which have been changed. If
 // an option that doesn't support hot-swapping is changed, this returns an
 // error.
 func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
+	diff := s.compareOptions(newOpts)
+	if len(diff.errs) > 0 {
+		return nil, diff.errs[0]
+	}
+	return diff.opts, nil
+}
+
+// compareOptions compares the current options with the new ones. Unlike
+// diffOptions, it does not stop at the first error so that every problem
+// can be reported.
+func (s *Server) compareOptions(newOpts *Options) *optionsDiff {
 	var (
 		oldConfig = reflect.ValueOf(s.getOpts()).Elem()
 		newConfig = reflect.ValueOf(newOpts).Elem()
+		diff      = &optionsDiff{}
 		diffOpts  = []option{}
+
+		// Several fields map to the same option, which
+		// should only be applied once.
+		monitoringChanged bool
+		listenChanged     bool
 	)
 
 	for i := 0; i < oldConfig.NumField(); i++ {
@@ -538,10 +967,16 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &usersOption{newValue: newValue.([]*User)})
 		case "cluster":
 			newClusterOpts := newValue.(ClusterOpts)
-			if err := validateClusterOpts(oldValue.(ClusterOpts), newClusterOpts); err != nil {
-				return nil, err
+			oldClusterOpts := oldValue.(ClusterOpts)
+			if err := validateClusterOpts(oldClusterOpts, newClusterOpts); err != nil {
+				if newClusterOpts.Host != oldClusterOpts.Host || newClusterOpts.Port != oldClusterOpts.Port {
+					diff.unsupported = append(diff.unsupported, field.Name)
+				}
+				diff.errs = append(diff.errs, err)
+				continue
 			}
-			diffOpts = append(diffOpts, &clusterOption{newValue: newClusterOpts})
+			permsChanged := !reflect.DeepEqual(newClusterOpts.Permissions, oldClusterOpts.Permissions)
+			diffOpts = append(diffOpts, &clusterOption{newValue: newClusterOpts, permsChanged: permsChanged})
 		case "routes":
 			add, remove := diffRoutes(oldValue.([]*url.URL), newValue.([]*url.URL))
 			diffOpts = append(diffOpts, &routesOption{add: add, remove: remove})
@@ -561,15 +996,58 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &maxPingsOutOption{newValue: newValue.(int)})
 		case "writedeadline":
 			diffOpts = append(diffOpts, &writeDeadlineOption{newValue: newValue.(time.Duration)})
+		case "draintimeout":
+			diffOpts = append(diffOpts, &drainTimeoutOption{newValue: newValue.(time.Duration)})
 		case "clientadvertise":
 			cliAdv := newValue.(string)
 			if cliAdv != "" {
 				// Validate ClientAdvertise syntax
 				if _, _, err := parseHostPort(cliAdv, 0); err != nil {
-					return nil, fmt.Errorf("invalid ClientAdvertise value of %s, err=%v", cliAdv, err)
+					diff.errs = append(diff.errs, fmt.Errorf("invalid ClientAdvertise value of %s, err=%v", cliAdv, err))
+					continue
 				}
 			}
 			diffOpts = append(diffOpts, &clientAdvertiseOption{newValue: cliAdv})
+		case "maxsubs":
+			diffOpts = append(diffOpts, &maxSubsOption{newValue: newValue.(int)})
+		case "proxyprotocol":
+			diffOpts = append(diffOpts, &proxyProtocolOption{newValue: newValue.(string)})
+		case "allowedcidrs":
+			diffOpts = append(diffOpts, &ipFiltersOption{name: "allowed_cidrs", newValue: newValue.([]string)})
+		case "deniedcidrs":
+			diffOpts = append(diffOpts, &ipFiltersOption{name: "denied_cidrs", newValue: newValue.([]string)})
+		case "httpallowedcidrs":
+			diffOpts = append(diffOpts, &ipFiltersOption{name: "http_allowed_cidrs", newValue: newValue.([]string)})
+		case "httpdeniedcidrs":
+			diffOpts = append(diffOpts, &ipFiltersOption{name: "http_denied_cidrs", newValue: newValue.([]string)})
+		case "maxconnperuser":
+			diffOpts = append(diffOpts, &connLimitsOption{name: "max_connections_per_user", newValue: newValue})
+		case "maxconnperip":
+			diffOpts = append(diffOpts, &connLimitsOption{name: "max_connections_per_ip", newValue: newValue})
+		case "connlimits":
+			diffOpts = append(diffOpts, &connLimitsOption{name: "connection_limits", newValue: newValue})
+		case "maxpending":
+			diffOpts = append(diffOpts, &maxPendingOption{newValue: newValue.(int64)})
+		case "slowconsumerpolicy":
+			diffOpts = append(diffOpts, &slowConsumerPolicyOption{newValue: newValue.(SlowConsumerPolicy)})
+		case "rqsubssweep":
+			diffOpts = append(diffOpts, &rqSubsSweepOption{newValue: newValue.(time.Duration)})
+		case "maxclosedclients":
+			diffOpts = append(diffOpts, &maxClosedClientsOption{newValue: newValue.(int)})
+		case "httphost", "httpport", "httpsport":
+			if !monitoringChanged {
+				monitoringChanged = true
+				diffOpts = append(diffOpts, &monitoringOption{})
+			}
+		case "host":
+			if !listenChanged {
+				listenChanged = true
+				diffOpts = append(diffOpts, &listenOption{})
+			}
+		case "reloadtoken":
+			diffOpts = append(diffOpts, &reloadTokenOption{newValue: newValue.(string)})
+		case "msgtracesubject":
+			diffOpts = append(diffOpts, &msgTraceSubjectOption{newValue: newValue.(string)})
 		case "nolog", "nosigs":
 			// Ignore NoLog and NoSigs options since they are not parsed and only used in
 			// testing.
@@ -580,15 +1058,22 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 				// ignore RANDOM_PORT
 				continue
 			}
-			fallthrough
+			if !listenChanged {
+				listenChanged = true
+				diffOpts = append(diffOpts, &listenOption{})
+			}
 		default:
-			// Bail out if attempting to reload any unsupported options.
-			return nil, fmt.Errorf("Config reload not supported for %s: old=%v, new=%v",
-				field.Name, oldValue, newValue)
+			// Reloading any unsupported options is an error.
+			diff.unsupported = append(diff.unsupported, field.Name)
+			diff.errs = append(diff.errs, fmt.Errorf("Config reload not supported for %s: old=%v, new=%v",
+				field.Name, oldValue, newValue))
+			continue
 		}
+		diff.changed = append(diff.changed, field.Name)
 	}
 
-	return diffOpts, nil
+	diff.opts = diffOpts
+	return diff
 }
 
 func (s *Server) applyOptions(opts []option) {
@@ -641,8 +1126,20 @@ func (s *Server) reloadAuthorization() {
 
 		// Remove any unauthorized subscriptions.
 		s.removeUnauthorizedSubs(client)
+
+		// Close clients over the max subscriptions of their user.
+		client.mu.Lock()
+		exceeded := client.msubs > 0 && len(client.subs) > client.msubs
+		client.mu.Unlock()
+		if exceeded {
+			client.maxSubsExceeded()
+			client.closeConnection(MaxSubscriptionsExceeded)
+		}
 	}
 
+	// The connection limits of the users may have changed.
+	s.enforceConnLimits()
+
 	for _, client := range routes {
 		// Disconnect any unauthorized routes.
 		if !s.isRouterAuthorized(client) {
@@ -10,6 +10,7 @@ type closedClient struct {
 // Fixed sized ringbuffer for closed connections.
 type closedRingBuffer struct {
 	total uint64
+	base  uint64 // Connections dropped from the count used for indexing on resize.
 	conns []*closedClient
 }
 
@@ -28,14 +29,14 @@ func (rb *closedRingBuffer) append(cc *closedClient) {
 }
 
 func (rb *closedRingBuffer) next() int {
-	return int(rb.total % uint64(cap(rb.conns)))
+	return int((rb.total - rb.base) % uint64(cap(rb.conns)))
 }
 
 func (rb *closedRingBuffer) len() int {
-	if rb.total > uint64(cap(rb.conns)) {
+	if rb.total-rb.base > uint64(cap(rb.conns)) {
 		return cap(rb.conns)
 	}
-	return int(rb.total)
+	return int(rb.total - rb.base)
 }
 
 func (rb *closedRingBuffer) totalConns() uint64 {
@@ -50,13 +51,24 @@ func (rb *closedRingBuffer) totalConns() uint64 {
 // access, we do not know when it would be done.
 func (rb *closedRingBuffer) closedClients() []*closedClient {
 	dup := make([]*closedClient, rb.len())
-	if rb.total <= uint64(cap(rb.conns)) {
+	if rb.total-rb.base <= uint64(cap(rb.conns)) {
 		copy(dup, rb.conns[:rb.len()])
 	} else {
 		first := rb.next()
 		next := cap(rb.conns) - first
 		copy(dup, rb.conns[first:])
-		copy(dup[next:], rb.conns[:next])
+		copy(dup[next:], rb.conns[:first])
 	}
 	return dup
 }
+
+// Change the maximum number of items, keeping the most recent ones.
+func (rb *closedRingBuffer) resize(max int) {
+	dup := rb.closedClients()
+	if len(dup) > max {
+		dup = dup[len(dup)-max:]
+	}
+	rb.conns = make([]*closedClient, max)
+	copy(rb.conns, dup)
+	rb.base = rb.total - uint64(len(dup))
+}
@@ -37,6 +37,14 @@ type route struct {
 	tlsRequired  bool
 	closed       bool
 	connectURLs  []string
+	comp         *routeCompression
+	pool         *routePool // The pooled connections of the route.
+	primary      *client    // The route of a pooled connection.
+	poolIdx      int
+	poolSubject  string
+	pooled       bool      // Set once a pooled connection is registered.
+	numClients   int       // Number of clients of the remote.
+	loadTime     time.Time // When the remote last sent its number of clients.
 }
 
 type connectInfo struct {
@@ -128,7 +136,7 @@ func (s *Server) holdRemoteQSub(sub *subscription) {
 // that has gone away. We reroute like a new message but scope to only
 // the queue subscribers that it was originally intended for. We will
 // prefer local clients, but will bounce to another route if needed.
-func (c *client) reRouteQMsg(r *SublistResult, msgh, msg, group []byte) {
+func (c *client) reRouteQMsg(r *SublistResult, msgh, msg, group []byte, mt *msgTrace) {
 	c.Debugf("Attempting redelivery of message for absent queue subscriber on group '%q'", group)
 
 	// We only care about qsubs here. Data structure not setup for optimized
@@ -145,6 +153,9 @@ func (c *client) reRouteQMsg(r *SublistResult, msgh, msg, group []byte) {
 	// If no match return.
 	if qsubs == nil {
 		c.Debugf("Redelivery failed, no queue subscribers for message on group '%q'", group)
+		if mt != nil {
+			mt.drop("no queue member available").Queue = string(group)
+		}
 		return
 	}
 
@@ -156,40 +167,25 @@ func (c *client) reRouteQMsg(r *SublistResult, msgh, msg, group []byte) {
 		c.in.prand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
 
-	// Hold onto a remote if we come across it to utilize in case no locals exist.
-	var rsub *subscription
-
-	startIndex := c.in.prand.Intn(len(qsubs))
-	for i := 0; i < len(qsubs); i++ {
-		index := (startIndex + i) % len(qsubs)
-		sub := qsubs[index]
-		if sub == nil {
-			continue
-		}
-		if rsub == nil && bytes.HasPrefix(sub.sid, []byte(QRSID)) {
-			rsub = sub
-			continue
-		}
-		mh := c.msgHeader(msgh[:], sub)
-		if c.deliverMsg(sub, mh, msg) {
+	if sub := c.deliverToQueueGroup(qsubs, msgh, msg); sub != nil {
+		if sub.isRemote() {
+			c.Debugf("Re-routing message on group '%q' to remote server", group)
+		} else {
 			c.Debugf("Redelivery succeeded for message on group '%q'", group)
-			return
 		}
-	}
-	// If we are here we failed to find a local, see if we snapshotted a
-	// remote sub, and if so deliver to that.
-	if rsub != nil {
-		mh := c.msgHeader(msgh[:], rsub)
-		if c.deliverMsg(rsub, mh, msg) {
-			c.Debugf("Re-routing message on group '%q' to remote server", group)
-			return
+		if mt != nil {
+			mt.delivered(sub, true)
 		}
+		return
 	}
 	c.Debugf("Redelivery failed, no queue subscribers for message on group '%q'", group)
+	if mt != nil {
+		mt.drop("no queue member available").Queue = string(group)
+	}
 }
 
 // processRoutedMsg processes messages inbound from a route.
-func (c *client) processRoutedMsg(r *SublistResult, msg []byte) {
+func (c *client) processRoutedMsg(r *SublistResult, msg []byte, mt *msgTrace) {
 	// Snapshot server.
 	srv := c.srv
 
@@ -212,9 +208,12 @@ func (c *client) processRoutedMsg(r *SublistResult, msg []byte) {
 			mh := c.msgHeader(msgh[:si], sub)
 			didDeliver = c.deliverMsg(sub, mh, msg)
 		}
+		if didDeliver && mt != nil {
+			mt.delivered(sub, true)
+		}
 		if !didDeliver && c.srv != nil {
 			group := c.srv.lookupRemoteQGroup(string(c.pa.sid))
-			c.reRouteQMsg(r, msgh, msg, group)
+			c.reRouteQMsg(r, msgh, msg, group, mt)
 		}
 		return
 	}
@@ -227,7 +226,7 @@ func (c *client) processRoutedMsg(r *SublistResult, msg []byte) {
 			continue
 		}
 		sub.client.mu.Lock()
-		if sub.client.nc == nil {
+		if sub.client.nc == nil && sub.client.typ != SYSTEM {
 			sub.client.mu.Unlock()
 			continue
 		}
@@ -235,7 +234,10 @@ func (c *client) processRoutedMsg(r *SublistResult, msg []byte) {
 
 		// Normal delivery
 		mh := c.msgHeader(msgh[:si], sub)
-		c.deliverMsg(sub, mh, msg)
+		ok := c.deliverMsg(sub, mh, msg)
+		if mt != nil {
+			mt.delivered(sub, ok)
+		}
 	}
 }
 
@@ -288,6 +290,55 @@ func (c *client) processRouteInfo(info *Info) {
 		return
 	}
 
+	// The remote compresses what it sends from now on.
+	if remoteID != "" && info.Compressed {
+		c.route.comp.in = true
+		c.in.zstart = true
+		c.mu.Unlock()
+		c.Debugf("Route remote enabled compression")
+		return
+	}
+
+	// The remote sends its number of clients when it changes.
+	if remoteID != "" && info.LoadUpdate {
+		c.route.numClients = info.NumClients
+		c.route.loadTime = time.Now()
+		c.mu.Unlock()
+		return
+	}
+
+	// The remote is shutting down, stop advertising it to clients and do
+	// not retry an implicit route to it.
+	if remoteID != "" && info.Draining {
+		c.route.retry = false
+		connectURLs := c.route.connectURLs
+		c.route.connectURLs = nil
+		c.mu.Unlock()
+		c.Noticef("Route is draining")
+		if len(connectURLs) > 0 && !s.getOpts().Cluster.NoAdvertise {
+			s.removeClientConnectURLsAndSendINFOToClients(connectURLs)
+		}
+		return
+	}
+
+	// A pooled connection, registered with its route on the first INFO.
+	if c.route.primary != nil || info.RoutePoolIdx > 0 {
+		pooled := c.route.pooled
+		c.mu.Unlock()
+		if !pooled {
+			s.addRoutePoolConn(c, info)
+		}
+		return
+	}
+
+	// The remote asks for our subscriptions again, e.g. because its
+	// export permissions have been changed on config reload.
+	if remoteID != "" && info.ResendSubs {
+		c.mu.Unlock()
+		s.sendLocalSubsToRoute(c)
+		return
+	}
+
 	// Need to set this for the detection of the route to self to work
 	// in closeConnection().
 	c.route.remoteID = info.ID
@@ -324,6 +375,11 @@ func (c *client) processRouteInfo(info *Info) {
 
 	if added, sendInfo := s.addRoute(c, info); added {
 		c.Debugf("Registering remote route %q", info.ID)
+		c.mu.Lock()
+		c.initRouteCompression(info)
+		c.mu.Unlock()
+		s.startRoutePool(c, info)
+		s.sendLoadToRoute(c)
 		// Send our local subscriptions to this route.
 		s.sendLocalSubsToRoute(c)
 		// sendInfo will be false if the route that we just accepted
@@ -336,7 +392,7 @@ func (c *client) processRouteInfo(info *Info) {
 				// Need to get the remote IP address.
 				c.mu.Lock()
 				switch conn := c.nc.(type) {
-				case *net.TCPConn, *tls.Conn:
+				case *net.TCPConn, *proxyConn, *tls.Conn:
 					addr := conn.RemoteAddr().(*net.TCPAddr)
 					info.IP = fmt.Sprintf("nats-route://%s/", net.JoinHostPort(addr.IP.String(),
 						strconv.Itoa(info.Port)))
@@ -458,6 +514,11 @@ func (s *Server) forwardNewRouteInfoToKnownServers(info *Info) {
 // This is for ROUTER connections only.
 // Lock is held on entry.
 func (c *client) canImport(subject []byte) bool {
+	// Messages on reserved subjects are generated by the servers
+	// themselves, e.g. trace events, and always flow between them.
+	if isReservedSubject(subject) {
+		return true
+	}
 	// Use pubAllowed() since this checks Publish permissions which
 	// is what Import maps to.
 	return c.pubAllowed(subject)
@@ -492,6 +553,60 @@ func (c *client) setRoutePermissions(perms *RoutePermissions) {
 	c.setPermissions(p)
 }
 
+// updateRoutePermissions applies new cluster permissions to the existing
+// routes. Interest that is no longer imported is removed from the remote
+// side, newly imported interest is sent, and remote subscriptions that are
+// no longer exported are removed. The remote is then asked to resend its
+// subscriptions so that newly exported interest gets registered.
+func (s *Server) updateRoutePermissions(perms *RoutePermissions) {
+	var raw [4096]*subscription
+	subs := raw[:0]
+	s.sl.localSubs(&subs)
+
+	s.mu.Lock()
+	routes := make([]*client, 0, len(s.routes))
+	for _, route := range s.routes {
+		routes = append(routes, route)
+	}
+	info := s.routeInfo
+	s.mu.Unlock()
+
+	info.ResendSubs = true
+	b, _ := json.Marshal(info)
+	infoProto := []byte(fmt.Sprintf(InfoProto, b))
+
+	imported := make([]bool, len(subs))
+	for _, route := range routes {
+		route.mu.Lock()
+		for i, sub := range subs {
+			imported[i] = route.canImport(sub.subject)
+		}
+		route.setRoutePermissions(perms)
+		for i, sub := range subs {
+			canImport := route.canImport(sub.subject)
+			if canImport == imported[i] {
+				continue
+			}
+			var proto string
+			if canImport {
+				proto = fmt.Sprintf(subProto, sub.subject, sub.queue, routeSid(sub))
+			} else {
+				proto = fmt.Sprintf(unsubProto, routeSid(sub))
+			}
+			route.queueOutbound([]byte(proto))
+		}
+		// Remove the remote interest that is no longer exported.
+		for sid, sub := range route.subs {
+			if !route.canExport(sub.subject) {
+				delete(route.subs, sid)
+				s.sl.Remove(sub)
+			}
+		}
+		route.sendProto(infoProto, true)
+		route.mu.Unlock()
+	}
+}
+
 // This will send local subscription state to a new route connection.
 // FIXME(dlc) - This could be a DOS or perf issue with many clients
 // and large subscription space. Plus buffering in place not a good idea.
@@ -521,10 +636,19 @@ func (s *Server) sendLocalSubsToRoute(route *client) {
 
 // 路由操作：创建一个新路由
 func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
+	return s.createRouteConn(conn, rURL, nil)
+}
+
+// createRouteConn creates a route connection, or a pooled connection of a
+// route if pc is not nil.
+func (s *Server) createRouteConn(conn net.Conn, rURL *url.URL, pc *routePoolConn) *client {
 	opts := s.getOpts()
 
 	didSolicit := rURL != nil
-	r := &route{didSolicit: didSolicit}
+	r := &route{didSolicit: didSolicit, comp: &routeCompression{mode: opts.Cluster.Compression}}
+	if pc != nil {
+		r.primary, r.poolIdx, r.poolSubject = pc.primary, pc.idx, pc.subject
+	}
 	for _, route := range opts.Routes {
 		if rURL != nil && (strings.ToLower(rURL.Host) == strings.ToLower(route.Host)) {
 			r.routeType = Explicit
@@ -536,6 +660,9 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	// 抓取服务变量
 	s.mu.Lock()
 	infoJSON := s.routeInfoJSON
+	if pc != nil {
+		infoJSON = s.routePoolInfoJSON(pc)
+	}
 	authRequired := s.routeInfo.AuthRequired
 	tlsRequired := s.routeInfo.TLSRequired
 	s.mu.Unlock()
@@ -559,7 +686,8 @@ func (s *Server) createRoute(conn net.Conn, rURL *url.URL) *client {
 	// Check for TLS
 	if tlsRequired {
 		// Copy off the config to add in ServerName if we
-		tlsConfig := util.CloneTLSConfig(opts.Cluster.TLSConfig)
+		current, _ := currentTLSConfig(opts.Cluster.TLSConfig)
+		tlsConfig := util.CloneTLSConfig(current)
 
 		// If we solicited, we will act like the client, otherwise the server.
 		if didSolicit {
@@ -709,17 +837,35 @@ func (s *Server) routeSidQueueSubscriber(rsid []byte) (bool, *subscription, erro
 }
 
 // Creates a routable sid that can be used
-// to reach remote subscriptions.
+// to reach remote subscriptions. The weight of a queue subscription,
+// unless the default one, is appended for the other servers.
 func routeSid(sub *subscription) string {
-	var qi string
 	if len(sub.queue) > 0 {
-		qi = "Q"
+		if w := sub.queueWeight(); w != 1 {
+			return fmt.Sprintf("Q%s:%d:%s:%d", RSID, sub.client.cid, sub.sid, w)
+		}
+		return fmt.Sprintf("Q%s:%d:%s", RSID, sub.client.cid, sub.sid)
 	}
-	return fmt.Sprintf("%s%s:%d:%s", qi, RSID, sub.client.cid, sub.sid)
+	return fmt.Sprintf("%s:%d:%s", RSID, sub.client.cid, sub.sid)
+}
+
+// routeSidWeight returns the weight of a remote queue subscription from
+// its sid, or 0 for the default one.
+func routeSidWeight(rsid []byte) int {
+	if !bytes.HasPrefix(rsid, []byte(QRSID)) {
+		return 0
+	}
+	if fields := bytes.Split(rsid, []byte(":")); len(fields) == 4 {
+		if w := parseInt64(fields[3]); w > 0 {
+			return int(w)
+		}
+	}
+	return 0
 }
 
 // Parse the given `rsid` knowing that it starts with `QRSID`.
 // Returns the cid and sid or an error not a valid QRSID.
+// The weight that may follow the sid is ignored.
 func parseRouteQueueSid(rsid []byte) (uint64, []byte, error) {
 	var (
 		cid      uint64
@@ -731,12 +877,13 @@ func parseRouteQueueSid(rsid []byte) (uint64, []byte, error) {
 	// First character here should be `:`
 	if len(rsid) >= QRSID_LEN+4 {
 		if rsid[QRSID_LEN] == ':' {
-			for i, count := QRSID_LEN+1, len(rsid); i < count; i++ {
-				switch rsid[i] {
-				case ':':
-					cid = uint64(parseInt64(rsid[QRSID_LEN+1 : i]))
-					cidFound = true
-					sid = rsid[i+1:]
+			if i := bytes.IndexByte(rsid[QRSID_LEN+1:], ':'); i >= 0 {
+				i += QRSID_LEN + 1
+				cid = uint64(parseInt64(rsid[QRSID_LEN+1 : i]))
+				cidFound = true
+				sid = rsid[i+1:]
+				if j := bytes.IndexByte(sid, ':'); j >= 0 {
+					sid = sid[:j]
 				}
 			}
 			if cidFound {
@@ -800,6 +947,10 @@ func (s *Server) addRoute(c *client, info *Info) (bool, bool) {
 			// If we upgrade to solicited, we still want to keep the remote's
 			// connectURLs. So transfer those.
 			r.connectURLs = remote.route.connectURLs
+			// The compression state and pool are the ones of the remote's
+			// connection.
+			r.comp = remote.route.comp
+			r.pool = remote.route.pool
 			remote.route = r
 		}
 		// This is to mitigate the issue where both sides add the route
@@ -866,7 +1017,7 @@ func (s *Server) broadcastUnSubscribe(sub *subscription) {
 	s.broadcastInterestToRoutes(sub, proto)
 }
 
-//路由接受循环
+// 路由接受循环
 func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	defer func() {
 		if ch != nil {
@@ -885,7 +1036,7 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	}
 
 	hp := net.JoinHostPort(opts.Cluster.Host, strconv.Itoa(port))
-	l, e := net.Listen("tcp", hp)
+	l, e := s.listen(routeListenerName, "tcp", hp)
 	if e != nil {
 		s.Fatalf("错误监听路由端口: %d - %v", opts.Cluster.Port, e)
 		return
@@ -903,6 +1054,9 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 		TLSRequired:  tlsReq,
 		TLSVerify:    tlsReq,
 		MaxPayload:   s.info.MaxPayload,
+		Compression:  compressionAdvert(opts.Cluster.Compression),
+
+		RoutePoolSize: routePoolAdvert(&opts.Cluster),
 	}
 	// 当且仅当告知（advertise）未被激活，才会设置
 	if !opts.Cluster.NoAdvertise {
@@ -940,6 +1094,11 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	for s.isRunning() {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isDraining() {
+				// Closed before a graceful shutdown, wait for it.
+				<-s.quitCh
+				continue
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				s.Debugf("Temporary Route Accept Errorf(%v), sleeping %dms",
 					ne, tmpDelay/time.Millisecond)
@@ -955,7 +1114,7 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 		}
 		tmpDelay = ACCEPT_MIN_SLEEP
 		s.startGoRoutine(func() {
-			s.createRoute(conn, nil)
+			s.acceptRoute(conn)
 			s.grWG.Done()
 		})
 	}
@@ -963,6 +1122,19 @@ func (s *Server) routeAcceptLoop(ch chan struct{}) {
 	s.done <- true
 }
 
+// acceptRoute reads the PROXY protocol header of a route connection if
+// enabled, and creates the route if its address is allowed.
+func (s *Server) acceptRoute(conn net.Conn) {
+	if conn = s.acceptProxyHeader(conn, s.getOpts().Cluster.ProxyProtocol, &s.rejected.routes); conn == nil {
+		return
+	}
+	if !s.isRouteIPAllowed(conn) {
+		conn.Close()
+		return
+	}
+	s.createRoute(conn, nil)
+}
+
 // Similar to setInfoHostPortAndGenerateJSON, but for routeInfo.
 func (s *Server) setRouteInfoHostPortAndIP() error {
 	if s.opts.Cluster.Advertise != "" {
@@ -1033,7 +1205,7 @@ func (s *Server) connectToRoute(rURL *url.URL, tryForEver bool) {
 	defer s.grWG.Done()
 
 	attempts := 0
-	for s.isRunning() && rURL != nil {
+	for s.isRunning() && !s.isDraining() && rURL != nil {
 		if tryForEver && !s.routeStillValid(rURL) {
 			return
 		}
@@ -0,0 +1,373 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Route connection pools.
+//
+// By default two servers have a single route connection, on which all
+// messages between them are sent in order. With pool_size, a server opens
+// more connections to each remote, and messages are sent on the connection
+// picked by hashing their subject, which keeps the order of the messages of
+// a subject. The subjects of dedicated_subjects, which may have wildcards,
+// get a connection of their own each. The first connection is the route
+// itself, on which interest is exchanged, the others only carry messages.
+//
+// The pooled connections are opened by the server with a pool configured,
+// or the one with the lower server ID if both have one. The INFO sent on
+// each of them tells the remote which subjects it is for, so that the
+// remote sends on the same connections. Until a pooled connection is open,
+// its subjects are sent on the first connection. Pooled connections that
+// are lost are opened again, as long as the route is up.
+
+// routePool is the pool of connections of a route. It is held by the first
+// connection of the route and protected by its lock.
+type routePool struct {
+	creator   bool     // Whether this server opens the pooled connections.
+	url       *url.URL // Where the pooled connections are opened.
+	size      int      // Number of connections the subjects are hashed on.
+	conns     []*client
+	dedicated []*dedicatedRouteConn
+}
+
+// dedicatedRouteConn is a pooled connection for the messages of a subject.
+type dedicatedRouteConn struct {
+	subject string
+	idx     int
+	c       *client
+}
+
+// routePoolConn identifies a pooled connection to open.
+type routePoolConn struct {
+	primary *client
+	size    int
+	idx     int
+	subject string
+}
+
+// newRoutePool returns the pool of the route c, with size connections to
+// hash subjects on, c being the first one.
+func newRoutePool(c *client, size int) *routePool {
+	if size < 1 {
+		size = 1
+	}
+	p := &routePool{size: size, conns: make([]*client, size)}
+	p.conns[0] = c
+	return p
+}
+
+// routePoolAdvert returns the pool size advertised in the route INFO, 0 if
+// there is no pool configured.
+func routePoolAdvert(opts *ClusterOpts) int {
+	if opts.PoolSize <= 1 && len(opts.DedicatedSubjects) == 0 {
+		return 0
+	}
+	if opts.PoolSize < 1 {
+		return 1
+	}
+	return opts.PoolSize
+}
+
+// subjectHash returns the 32-bit FNV-1a hash of a subject.
+func subjectHash(subject []byte) uint32 {
+	h := uint32(2166136261)
+	for _, b := range subject {
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return h
+}
+
+// connFor returns the pooled connection to send a message on subject, or
+// nil if it should be sent on the first connection.
+func (p *routePool) connFor(subject []byte) *client {
+	if len(p.dedicated) > 0 {
+		s := string(subject)
+		for _, d := range p.dedicated {
+			if matchLiteral(s, d.subject) {
+				return d.c
+			}
+		}
+	}
+	if p.size > 1 {
+		return p.conns[subjectHash(subject)%uint32(p.size)]
+	}
+	return nil
+}
+
+// resize adopts the pool size of the server opening the connections.
+func (p *routePool) resize(size int) {
+	if size < 1 || size == p.size {
+		return
+	}
+	conns := make([]*client, size)
+	copy(conns, p.conns)
+	p.conns, p.size = conns, size
+}
+
+// add registers a pooled connection, returning false if there is already
+// one for its subjects.
+func (p *routePool) add(c *client, idx int, subject string) bool {
+	if subject != "" {
+		for _, d := range p.dedicated {
+			if d.subject == subject {
+				if d.c != nil {
+					return false
+				}
+				d.c, d.idx = c, idx
+				return true
+			}
+		}
+		p.dedicated = append(p.dedicated, &dedicatedRouteConn{subject: subject, idx: idx, c: c})
+		return true
+	}
+	if idx <= 0 || idx >= p.size || p.conns[idx] != nil {
+		return false
+	}
+	p.conns[idx] = c
+	return true
+}
+
+// remove unregisters a pooled connection.
+func (p *routePool) remove(c *client) {
+	for i := 1; i < len(p.conns); i++ {
+		if p.conns[i] == c {
+			p.conns[i] = nil
+		}
+	}
+	for _, d := range p.dedicated {
+		if d.c == c {
+			d.c = nil
+		}
+	}
+}
+
+// isOpen returns true if there is a pooled connection for idx or subject.
+func (p *routePool) isOpen(idx int, subject string) bool {
+	if subject != "" {
+		for _, d := range p.dedicated {
+			if d.subject == subject {
+				return d.c != nil
+			}
+		}
+		return false
+	}
+	return idx < len(p.conns) && p.conns[idx] != nil
+}
+
+// members returns the pooled connections, without the first one.
+func (p *routePool) members() []*client {
+	var conns []*client
+	for _, c := range p.conns[1:] {
+		if c != nil {
+			conns = append(conns, c)
+		}
+	}
+	for _, d := range p.dedicated {
+		if d.c != nil {
+			conns = append(conns, d.c)
+		}
+	}
+	return conns
+}
+
+// startRoutePool opens the pooled connections of a route that was just
+// registered, if this server is the one to do so.
+func (s *Server) startRoutePool(c *client, info *Info) {
+	opts := s.getOpts()
+	size := routePoolAdvert(&opts.Cluster)
+	if size == 0 || (info.RoutePoolSize > 0 && s.info.ID > info.ID) {
+		return
+	}
+
+	c.mu.Lock()
+	if c.nc == nil || c.route.pool != nil {
+		c.mu.Unlock()
+		return
+	}
+	p := newRoutePool(c, size)
+	p.creator = true
+	p.url = routePoolURL(c, info, opts)
+	for i, subject := range opts.Cluster.DedicatedSubjects {
+		p.dedicated = append(p.dedicated, &dedicatedRouteConn{subject: subject, idx: size + i})
+	}
+	c.route.pool = p
+	c.mu.Unlock()
+
+	c.Debugf("Opening %d pooled route connections", size-1+len(p.dedicated))
+	for i := 1; i < size; i++ {
+		pc := &routePoolConn{primary: c, size: size, idx: i}
+		s.startGoRoutine(func() { s.connectRoutePoolConn(pc, 0) })
+	}
+	for _, d := range p.dedicated {
+		pc := &routePoolConn{primary: c, size: size, idx: d.idx, subject: d.subject}
+		s.startGoRoutine(func() { s.connectRoutePoolConn(pc, 0) })
+	}
+}
+
+// routePoolURL returns where to open the pooled connections of a route.
+// Lock should be held.
+func routePoolURL(c *client, info *Info, opts *Options) *url.URL {
+	rURL := c.route.url
+	if !c.route.didSolicit && info.IP == "" {
+		// The host of an accepted route may be the address it listens on,
+		// so use the address it connected from.
+		if addr, ok := c.nc.RemoteAddr().(*net.TCPAddr); ok {
+			rURL = &url.URL{
+				Scheme: "nats-route",
+				Host:   net.JoinHostPort(addr.IP.String(), strconv.Itoa(info.Port)),
+			}
+		}
+	}
+	if rURL.User == nil && opts.Cluster.Username != "" {
+		u := *rURL
+		u.User = url.UserPassword(opts.Cluster.Username, opts.Cluster.Password)
+		rURL = &u
+	}
+	return rURL
+}
+
+// connectRoutePoolConn opens a pooled connection after delay, trying again
+// until it is open or the route goes away.
+func (s *Server) connectRoutePoolConn(pc *routePoolConn, delay time.Duration) {
+	defer s.grWG.Done()
+
+	for {
+		if delay > 0 {
+			select {
+			case <-s.quitCh:
+				return
+			case <-time.After(delay):
+			}
+		}
+		delay = DEFAULT_ROUTE_CONNECT
+
+		pc.primary.mu.Lock()
+		p := pc.primary.route.pool
+		if pc.primary.nc == nil || p == nil || !p.creator || p.isOpen(pc.idx, pc.subject) {
+			pc.primary.mu.Unlock()
+			return
+		}
+		rURL := p.url
+		pc.primary.mu.Unlock()
+
+		if !s.isRunning() {
+			return
+		}
+		conn, err := net.DialTimeout("tcp", rURL.Host, DEFAULT_ROUTE_DIAL)
+		if err != nil {
+			s.Debugf("Error trying to open pooled route connection to %s: %v", rURL.Host, err)
+			continue
+		}
+		// Connections that fail are opened again when closed.
+		s.createRouteConn(conn, rURL, pc)
+		return
+	}
+}
+
+// routePoolInfoJSON returns the INFO to send on a pooled connection.
+// Server lock should be held.
+func (s *Server) routePoolInfoJSON(pc *routePoolConn) []byte {
+	info := s.routeInfo
+	info.RoutePoolSize = pc.size
+	info.RoutePoolIdx = pc.idx
+	info.RouteSubject = pc.subject
+	b, _ := json.Marshal(info)
+	return []byte(fmt.Sprintf(InfoProto, b))
+}
+
+// addRoutePoolConn registers a pooled connection with its route, once the
+// INFO of the remote was received on it.
+func (s *Server) addRoutePoolConn(c *client, info *Info) {
+	s.mu.Lock()
+	primary := s.remotes[info.ID]
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	if c.nc == nil {
+		c.mu.Unlock()
+		return
+	}
+	expected := c.route.primary
+	if expected == nil {
+		// Opened by the remote, which tells us what it is for.
+		c.route.poolIdx = info.RoutePoolIdx
+		c.route.poolSubject = info.RouteSubject
+		c.route.primary = primary
+	}
+	idx, subject := c.route.poolIdx, c.route.poolSubject
+	c.route.remoteID = info.ID
+	c.mu.Unlock()
+
+	if primary == nil || (expected != nil && expected != primary) {
+		c.Debugf("No route to %q for pooled connection", info.ID)
+		c.closeConnection(RouteRemoved)
+		return
+	}
+
+	primary.mu.Lock()
+	if primary.nc == nil {
+		primary.mu.Unlock()
+		c.closeConnection(RouteRemoved)
+		return
+	}
+	p := primary.route.pool
+	if p == nil {
+		p = newRoutePool(primary, info.RoutePoolSize)
+		primary.route.pool = p
+	} else if !p.creator {
+		p.resize(info.RoutePoolSize)
+	}
+	added := p.add(c, idx, subject)
+	primary.mu.Unlock()
+
+	if !added {
+		c.Debugf("Detected duplicate pooled route connection %d", idx)
+		c.closeConnection(DuplicateRoute)
+		return
+	}
+
+	// Remove from the temporary map, it is closed with the route.
+	s.grMu.Lock()
+	delete(s.grTmpClients, c.cid)
+	s.grMu.Unlock()
+
+	c.mu.Lock()
+	c.route.pooled = true
+	c.initRouteCompression(info)
+	c.mu.Unlock()
+
+	if subject != "" {
+		c.Debugf("Registered pooled route connection %d for %q", idx, subject)
+	} else {
+		c.Debugf("Registered pooled route connection %d", idx)
+	}
+}
+
+// removeRoutePoolConn unregisters a closed pooled connection, and opens it
+// again if this server is the one to do so.
+func (s *Server) removeRoutePoolConn(c *client, primary *client, closed bool) {
+	c.mu.Lock()
+	pc := &routePoolConn{primary: primary, idx: c.route.poolIdx, subject: c.route.poolSubject}
+	c.mu.Unlock()
+
+	primary.mu.Lock()
+	p := primary.route.pool
+	reopen := false
+	if p != nil {
+		p.remove(c)
+		pc.size = p.size
+		reopen = p.creator && primary.nc != nil && !closed && !p.isOpen(pc.idx, pc.subject)
+	}
+	primary.mu.Unlock()
+
+	if reopen {
+		s.startGoRoutine(func() { s.connectRoutePoolConn(pc, DEFAULT_ROUTE_RECONNECT) })
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestRoutePoolConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/route_pool.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.Cluster.PoolSize != 3 {
+		t.Fatalf("Expected pool size of 3, got %d", opts.Cluster.PoolSize)
+	}
+	if expected := []string{"metrics.>", "orders"}; !reflect.DeepEqual(opts.Cluster.DedicatedSubjects, expected) {
+		t.Fatalf("Expected dedicated subjects %v, got %v", expected, opts.Cluster.DedicatedSubjects)
+	}
+	if cc := CheckConfigFile("./configs/route_pool.conf"); len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+	for _, test := range []struct {
+		cluster  ClusterOpts
+		expected int
+	}{
+		{ClusterOpts{}, 0},
+		{ClusterOpts{PoolSize: 1}, 0},
+		{ClusterOpts{PoolSize: 4}, 4},
+		{ClusterOpts{DedicatedSubjects: []string{"foo"}}, 1},
+	} {
+		if size := routePoolAdvert(&test.cluster); size != test.expected {
+			t.Fatalf("Expected advertised pool size %d for %+v, got %d", test.expected, test.cluster, size)
+		}
+	}
+}
+
+func TestRoutePoolConnFor(t *testing.T) {
+	c, c1, c2, d := &client{}, &client{}, &client{}, &client{}
+	p := newRoutePool(c, 3)
+	if !p.add(c1, 1, "") || !p.add(c2, 2, "") || !p.add(d, 3, "metrics.>") {
+		t.Fatal("Expected pooled connections to be added")
+	}
+	if p.add(&client{}, 1, "") || p.add(&client{}, 3, "metrics.>") || p.add(&client{}, 3, "") {
+		t.Fatal("Expected duplicate pooled connections to be rejected")
+	}
+	if pc := p.connFor([]byte("metrics.cpu.host1")); pc != d {
+		t.Fatal("Expected dedicated connection for a matching subject")
+	}
+	// A subject always goes to the same connection, and all are used.
+	used := make(map[*client]int)
+	for i := 0; i < 100; i++ {
+		subject := []byte("foo." + strconv.Itoa(i))
+		pc := p.connFor(subject)
+		if pc != p.connFor(subject) {
+			t.Fatalf("Expected the same connection for %q", subject)
+		}
+		used[pc]++
+	}
+	if len(used) != 3 || used[d] != 0 {
+		t.Fatalf("Expected subjects to be spread on the 3 connections, got %v", used)
+	}
+	// Subjects of a connection that is not open go to the route.
+	p.remove(d)
+	p.remove(c1)
+	if pc := p.connFor([]byte("metrics.cpu.host1")); pc != nil {
+		t.Fatal("Expected no connection for a dedicated subject without one")
+	}
+	for i := 0; i < 100; i++ {
+		if pc := p.connFor([]byte("foo." + strconv.Itoa(i))); pc == c1 {
+			t.Fatal("Expected removed connection not to be used")
+		}
+	}
+	if members := p.members(); len(members) != 1 || members[0] != c2 {
+		t.Fatalf("Expected only one pooled connection, got %v", members)
+	}
+}
+
+// checkRouteConns checks the number of route connections in Routez.
+func checkRouteConns(t *testing.T, s *Server, expected int) []*RouteInfo {
+	t.Helper()
+	var routes []*RouteInfo
+	checkFor(t, 3*time.Second, 15*time.Millisecond, func() error {
+		rz, err := s.Routez(nil)
+		if err != nil {
+			return err
+		}
+		if len(rz.Routes) != expected {
+			return fmt.Errorf("Expected %d route connections, got %d", expected, len(rz.Routes))
+		}
+		routes = rz.Routes
+		return nil
+	})
+	return routes
+}
+
+// runPooledRoutes runs a server with a pool routed to one without.
+func runPooledRoutes(t *testing.T) (*Server, *Server) {
+	t.Helper()
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	optsA.Cluster.PoolSize = 3
+	optsA.Cluster.DedicatedSubjects = []string{"big.>"}
+	sa := RunServer(optsA)
+
+	optsB := nextServerOpts(optsA)
+	optsB.Cluster.PoolSize = 0
+	optsB.Cluster.DedicatedSubjects = nil
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", sa.ClusterAddr().Port))
+	sb := RunServer(optsB)
+
+	checkClusterFormed(t, sa, sb)
+	// The route, 2 connections for hashed subjects and 1 dedicated.
+	checkRouteConns(t, sa, 4)
+	checkRouteConns(t, sb, 4)
+	return sa, sb
+}
+
+func TestRoutePool(t *testing.T) {
+	sa, sb := runPooledRoutes(t)
+	defer sa.Shutdown()
+	defer sb.Shutdown()
+
+	for _, s := range []*Server{sa, sb} {
+		rz, _ := s.Routez(nil)
+		if rz.NumRoutes != 1 {
+			t.Fatalf("Expected 1 route, got %d", rz.NumRoutes)
+		}
+		seen := make(map[int]string)
+		for _, ri := range rz.Routes {
+			seen[ri.PoolIndex] = ri.DedicatedSubject
+		}
+		if expected := map[int]string{0: "", 1: "", 2: "", 3: "big.>"}; !reflect.DeepEqual(seen, expected) {
+			t.Fatalf("Expected pooled connections %v, got %v", expected, seen)
+		}
+	}
+
+	// Send on many subjects both ways, checking the order per subject.
+	for _, servers := range [][2]*Server{{sa, sb}, {sb, sa}} {
+		from, to := servers[0], servers[1]
+		ncTo, err := gio.Connect(fmt.Sprintf("nats://127.0.0.1:%d", to.Addr().(*net.TCPAddr).Port))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer ncTo.Close()
+		msgs := make(chan *gio.Msg, 1000)
+		if _, err := ncTo.ChanSubscribe(">", msgs); err != nil {
+			t.Fatalf("Error on subscribe: %v", err)
+		}
+		ncTo.Flush()
+		checkExpectedSubs(t, 1, from)
+
+		ncFrom, err := gio.Connect(fmt.Sprintf("nats://127.0.0.1:%d", from.Addr().(*net.TCPAddr).Port))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer ncFrom.Close()
+		subjects := []string{"foo", "bar", "baz", "qux", "big.data"}
+		for i := 0; i < 20; i++ {
+			for _, subject := range subjects {
+				ncFrom.Publish(subject, []byte(strconv.Itoa(i)))
+			}
+		}
+		ncFrom.Flush()
+
+		next := make(map[string]int)
+		for i := 0; i < 20*len(subjects); i++ {
+			select {
+			case m := <-msgs:
+				if n, _ := strconv.Atoi(string(m.Data)); n != next[m.Subject] {
+					t.Fatalf("Expected message %d on %q, got %d", next[m.Subject], m.Subject, n)
+				}
+				next[m.Subject]++
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Timeout waiting for messages, got %v", next)
+			}
+		}
+		ncTo.Close()
+		ncFrom.Close()
+		checkExpectedSubs(t, 0, from)
+
+		// The dedicated connection carried big.data only, and the
+		// others were used too.
+		rz, _ := from.Routez(nil)
+		used := 0
+		for _, ri := range rz.Routes {
+			if ri.DedicatedSubject != "" {
+				if ri.OutMsgs != 20 {
+					t.Fatalf("Expected 20 messages on the dedicated connection, got %d", ri.OutMsgs)
+				}
+			} else if ri.OutMsgs > 0 {
+				used++
+			}
+		}
+		if used < 2 {
+			t.Fatalf("Expected messages on several pooled connections, got %d", used)
+		}
+	}
+}
+
+func TestRoutePoolReconnect(t *testing.T) {
+	sa, sb := runPooledRoutes(t)
+	defer sa.Shutdown()
+	defer sb.Shutdown()
+
+	// Close pooled connections on both sides, they are opened again.
+	for _, s := range []*Server{sa, sb} {
+		s.mu.Lock()
+		var primary *client
+		for _, r := range s.routes {
+			primary = r
+		}
+		s.mu.Unlock()
+		primary.mu.Lock()
+		pooled := primary.route.pool.members()
+		primary.mu.Unlock()
+		pooled[0].closeConnection(ClientClosed)
+
+		checkRouteConns(t, sa, 4)
+		checkRouteConns(t, sb, 4)
+	}
+
+	// The pooled connections go away with the route.
+	sb.Shutdown()
+	checkRouteConns(t, sa, 0)
+}
@@ -941,6 +941,156 @@ func TestRoutedQueueAutoUnsubscribe(t *testing.T) {
 	})
 }
 
+func TestRoutedQueuePrefersLocalMembers(t *testing.T) {
+	optsA, _ := ProcessConfigFile("./configs/seed.conf")
+	optsA.NoSigs, optsA.NoLog = true, true
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	srvARouteURL := fmt.Sprintf("nats://%s:%d", optsA.Cluster.Host, srvA.ClusterAddr().Port)
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(srvARouteURL)
+
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	ncA, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsA.Host, optsA.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncA.Close()
+
+	ncB, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsB.Host, optsB.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncB.Close()
+
+	var ra, rb int32
+	if _, err := ncA.QueueSubscribe("foo", "bar", func(*gio.Msg) { atomic.AddInt32(&ra, 1) }); err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	ncA.Flush()
+	qsubB, err := ncB.QueueSubscribe("foo", "bar", func(*gio.Msg) { atomic.AddInt32(&rb, 1) })
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	ncB.Flush()
+	checkExpectedSubs(t, 2, srvA, srvB)
+
+	check := func(expectedA, expectedB int32) {
+		t.Helper()
+		checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
+			if a, b := atomic.LoadInt32(&ra), atomic.LoadInt32(&rb); a != expectedA || b != expectedB {
+				return fmt.Errorf("Expected %d and %d messages, got %d and %d", expectedA, expectedB, a, b)
+			}
+			return nil
+		})
+	}
+
+	// Messages published on each server go to its local member.
+	for i := 0; i < 100; i++ {
+		ncA.Publish("foo", []byte("hello"))
+		ncB.Publish("foo", []byte("hello"))
+	}
+	ncA.Flush()
+	ncB.Flush()
+	check(100, 100)
+
+	// And go to the routed member only when there is no local one.
+	qsubB.Unsubscribe()
+	ncB.Flush()
+	checkExpectedSubs(t, 1, srvA, srvB)
+	for i := 0; i < 100; i++ {
+		ncB.Publish("foo", []byte("hello"))
+	}
+	ncB.Flush()
+	check(200, 100)
+}
+
+func TestRoutedQueueWeightedDelivery(t *testing.T) {
+	optsA, _ := ProcessConfigFile("./configs/seed.conf")
+	optsA.NoSigs, optsA.NoLog = true, true
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	srvARouteURL := fmt.Sprintf("nats://%s:%d", optsA.Cluster.Host, srvA.ClusterAddr().Port)
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(srvARouteURL)
+
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	// The members are on B, with weights that A learns from the route.
+	var counts [2]int32
+	for i, weight := range []int{3, 0} {
+		nc, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsB.Host, optsB.Port), gio.QueueWeight(weight))
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+		count := &counts[i]
+		if _, err := nc.QueueSubscribe("foo", "bar", func(*gio.Msg) {
+			atomic.AddInt32(count, 1)
+		}); err != nil {
+			t.Fatalf("Error on subscribe: %v", err)
+		}
+		nc.Flush()
+	}
+	checkExpectedSubs(t, 2, srvA, srvB)
+
+	ncA, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsA.Host, optsA.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncA.Close()
+	total := int32(4000)
+	for i := int32(0); i < total; i++ {
+		ncA.Publish("foo", []byte("hello"))
+	}
+	ncA.Flush()
+
+	checkFor(t, 5*time.Second, 10*time.Millisecond, func() error {
+		if n := atomic.LoadInt32(&counts[0]) + atomic.LoadInt32(&counts[1]); n != total {
+			return fmt.Errorf("Received %d messages, expected %d", n, total)
+		}
+		return nil
+	})
+	// The heavier member should have received about 3 times as many.
+	if n := atomic.LoadInt32(&counts[0]); n < 2700 || n > 3300 {
+		t.Fatalf("Expected about 3000 messages for the heavier member, got %d", n)
+	}
+}
+
+func TestRouteQueueSid(t *testing.T) {
+	c := &client{cid: 22}
+	for _, tc := range []struct {
+		weight int
+		rsid   string
+	}{
+		{0, "QRSID:22:1"},
+		{1, "QRSID:22:1"},
+		{3, "QRSID:22:1:3"},
+	} {
+		sub := &subscription{client: c, queue: []byte("bar"), sid: []byte("1"), weight: tc.weight}
+		rsid := routeSid(sub)
+		if rsid != tc.rsid {
+			t.Fatalf("Expected %q, got %q", tc.rsid, rsid)
+		}
+		cid, sid, err := parseRouteQueueSid([]byte(rsid))
+		if err != nil || cid != 22 || string(sid) != "1" {
+			t.Fatalf("Unexpected parse of %q: %v, %q, %v", rsid, cid, sid, err)
+		}
+		if w := routeSidWeight([]byte(rsid)); (&subscription{weight: w}).queueWeight() != sub.queueWeight() {
+			t.Fatalf("Expected weight %d for %q, got %d", sub.queueWeight(), rsid, w)
+		}
+	}
+}
+
 func TestRouteFailedConnRemovedFromTmpMap(t *testing.T) {
 	optsA, _ := ProcessConfigFile("./configs/srv_a.conf")
 	optsA.NoSigs, optsA.NoLog = true, true
@@ -41,12 +41,27 @@ type Info struct {
 	IP                string   `json:"ip,omitempty"`
 	CID               uint64   `json:"client_id,omitempty"`
 	ClientConnectURLs []string `json:"connect_urls,omitempty"` // Contains URLs a client can connect to.
+	Rebalance         bool     `json:"rebalance,omitempty"`    // Asks the client to reconnect to another server.
+
+	// Route Only
+	ResendSubs  bool   `json:"resend_subs,omitempty"` // Asks the remote to send its subscriptions again.
+	Compression string `json:"compression,omitempty"` // Compression the server decompresses.
+	Compressed  bool   `json:"compressed,omitempty"`  // What follows is compressed.
+
+	RoutePoolSize int    `json:"route_pool_size,omitempty"` // Connections subjects are hashed on.
+	RoutePoolIdx  int    `json:"route_pool_idx,omitempty"`  // Index of a pooled connection.
+	RouteSubject  string `json:"route_subject,omitempty"`   // Subject of a dedicated connection.
+
+	LoadUpdate bool `json:"load_update,omitempty"` // Carries the number of clients of the remote.
+	NumClients int  `json:"num_clients,omitempty"`
+	Draining   bool `json:"draining,omitempty"` // The remote is shutting down.
 }
 
 // Server is our main struct.
 type Server struct {
 	gcid uint64
 	stats
+	rejected      rejectedStats
 	mu            sync.Mutex
 	info          Info
 	sl            *Sublist
@@ -56,6 +71,7 @@ type Server struct {
 	running       bool
 	shutdown      bool
 	listener      net.Listener
+	unixListener  net.Listener
 	clients       map[uint64]*client
 	routes        map[uint64]*client
 	remotes       map[string]*client
@@ -78,6 +94,60 @@ type Server struct {
 	rqsubs      map[string]rqsub
 	rqsubsTimer *time.Timer
 
+	// Internal client used to publish server generated messages.
+	sysMu  sync.Mutex
+	sys    *client
+	sysSid uint64
+
+	// Request/reply latency sampling, nil if not configured.
+	latency *latencyTracker
+
+	// Partitioned queue groups, nil if not configured.
+	partitions partitions
+
+	// Hook intercepting the messages and subscriptions of the clients,
+	// nil if not set.
+	hook MessageHook
+
+	// IP filters of the client, route and monitoring listeners, nil if
+	// not configured.
+	clientFilter *ipFilter
+	routeFilter  *ipFilter
+	httpFilter   *ipFilter
+
+	// Connections per user, source IP and limited network.
+	userConns map[string]int
+	ipConns   map[string]int
+	netConns  map[string]int
+
+	// Pending update of the number of clients sent to the routes, whether
+	// clients are rebalanced periodically, and when clients were last
+	// asked to reconnect to another server.
+	loadTmr       *time.Timer
+	rebalancing   bool
+	rebalanceTime time.Time
+
+	// Whether the TLS certificates are checked periodically, and what
+	// was last logged about them, per listener.
+	tlsChecking bool
+	tlsCerts    map[string]*tlsCertsState
+
+	// Set once the server stopped accepting connections before a graceful
+	// shutdown, and closed once the server is shut down.
+	draining bool
+	drained  chan struct{}
+
+	// Listeners in use by name, those inherited from a previous process
+	// and not used yet, and whether the process is being upgraded.
+	listeners map[string]net.Listener
+	inherited map[string]net.Listener
+	upgrading bool
+
+	// Serializes config reloads, which can be triggered remotely.
+	reloadMu sync.Mutex
+	// Subscription for remote reload requests, nil if not enabled.
+	reloadSub *subscription
+
 	// Tracking Go routines
 	grMu         sync.Mutex
 	grTmpClients map[uint64]*client
@@ -120,6 +190,7 @@ type stats struct {
 	inBytes       int64
 	outBytes      int64
 	slowConsumers int64
+	rebalanced    int64
 }
 
 // New will setup a new server struct after parsing the options.
@@ -153,6 +224,7 @@ func New(opts *Options) *Server {
 		done:       make(chan bool, 1),
 		start:      now,
 		configTime: now,
+		hook:       opts.MessageHook,
 	}
 
 	s.mu.Lock()
@@ -170,6 +242,11 @@ func New(opts *Options) *Server {
 	// For tracking clients
 	s.clients = make(map[uint64]*client)
 
+	// For the connection limits.
+	s.userConns = make(map[string]int)
+	s.ipConns = make(map[string]int)
+	s.netConns = make(map[string]int)
+
 	// For tracking closed clients.
 	s.closed = newClosedRingBuffer(opts.MaxClosedClients)
 
@@ -188,6 +265,12 @@ func New(opts *Options) *Server {
 	// Used to setup Authorization.
 	s.configureAuthorization()
 
+	// Request/reply latency sampling.
+	s.latency = newLatencyTracker(info.ID, opts)
+
+	// Partitioned queue groups.
+	s.partitions = newPartitions(opts)
+
 	// Start signal handler
 	s.handleSignals()
 
@@ -267,6 +350,18 @@ func (s *Server) Start() {
 	// Snapshot server options.
 	opts := s.getOpts()
 
+	// Take over the listeners passed by systemd or by the process being
+	// upgraded, if any.
+	if err := s.receiveSystemdListeners(); err != nil {
+		s.Fatalf("Can't receive the sockets passed by systemd: %v", err)
+		return
+	}
+	if err := s.receiveUpgrade(); err != nil {
+		s.Fatalf("Can't receive the listeners of the previous process: %v", err)
+		return
+	}
+	s.startSystemdNotify()
+
 	// Log the pid to a file
 	if opts.PidFile != _EMPTY_ {
 		if err := s.logPid(); err != nil {
@@ -275,12 +370,33 @@ func (s *Server) Start() {
 		}
 	}
 
+	if err := s.configureIPFilters(); err != nil {
+		s.Fatalf("Can't configure IP filters: %v", err)
+		return
+	}
+
 	// 核心功能： 1 监控服务
 	if err := s.StartMonitoring(); err != nil {
 		s.Fatalf("Can't start monitoring: %v", err)
 		return
 	}
 
+	if s.latency != nil {
+		if err := s.startLatencyTracking(); err != nil {
+			s.Fatalf("Can't start latency tracking: %v", err)
+			return
+		}
+	}
+
+	s.startTLSCertChecks()
+
+	if opts.ReloadToken != "" {
+		if err := s.startReloadRequests(); err != nil {
+			s.Fatalf("Can't start remote reload: %v", err)
+			return
+		}
+	}
+
 	// The Routing routine needs to wait for the client listen
 	// port to be opened and potential ephemeral port selected.
 	clientListenReady := make(chan struct{})
@@ -291,6 +407,15 @@ func (s *Server) Start() {
 			// core 2
 			s.StartRouting(clientListenReady)
 		})
+		s.startRebalancing()
+	}
+
+	// Unix domain socket for local clients.
+	if opts.UnixSocket != _EMPTY_ {
+		if err := s.startUnixListener(); err != nil {
+			s.Fatalf("Can't listen on unix socket %s: %v", opts.UnixSocket, err)
+			return
+		}
 	}
 
 	// Pprof http 终端调试服务
@@ -353,6 +478,13 @@ func (s *Server) Shutdown() {
 		s.listener = nil
 	}
 
+	// Kick unix socket accept loop, which removes the socket.
+	if s.unixListener != nil {
+		doneExpected++
+		s.unixListener.Close()
+		s.unixListener = nil
+	}
+
 	// Kick route AcceptLoop()
 	if s.routeListener != nil {
 		doneExpected++
@@ -377,6 +509,8 @@ func (s *Server) Shutdown() {
 	s.clearRemoteQSubs()
 	s.mu.Unlock()
 
+	sdNotify("STOPPING=1")
+
 	// Release go routines that wait on that channel
 	close(s.quitCh)
 
@@ -414,7 +548,7 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 
 	hp := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
 	//start TCP listen
-	l, e := net.Listen("tcp", hp)
+	l, e := s.listen(clientListenerName, "tcp", hp)
 	if e != nil {
 		s.Fatalf("Error listening on port: %s, %q", hp, e)
 		return
@@ -461,11 +595,34 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	close(clr)
 	clr = nil
 
+	s.acceptConnections(l)
+
+	// The process may exit once Start returns, so let a graceful shutdown
+	// complete first.
+	s.mu.Lock()
+	drained := s.drained
+	s.mu.Unlock()
+	if drained != nil {
+		<-drained
+	}
+}
+
+// acceptConnections accepts client connections on l until the server is
+// shutdown or l is replaced by a new listener on config reload.
+func (s *Server) acceptConnections(l net.Listener) {
 	tmpDelay := ACCEPT_MIN_SLEEP
 
 	for s.isRunning() {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isListenerReplaced(l) {
+				return
+			}
+			if s.isDraining() {
+				// Closed before a graceful shutdown, wait for it.
+				<-s.quitCh
+				continue
+			}
 			if ne, ok := err.(net.Error); ok && ne.Temporary() {
 				s.Errorf("Temporary Client Accept Error (%v), sleeping %dms",
 					ne, tmpDelay/time.Millisecond)
@@ -482,7 +639,7 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 		tmpDelay = ACCEPT_MIN_SLEEP
 		s.startGoRoutine(func() {
 			//使用go routine 创建一个客户端.
-			s.createClient(conn)
+			s.acceptClient(conn)
 			s.grWG.Done()
 		})
 	}
@@ -490,6 +647,93 @@ func (s *Server) AcceptLoop(clr chan struct{}) {
 	s.done <- true
 }
 
+// acceptClient reads the PROXY protocol header of a client connection if
+// enabled, and creates the client if its address is allowed.
+func (s *Server) acceptClient(conn net.Conn) {
+	if conn = s.acceptProxyHeader(conn, s.getOpts().ProxyProtocol, &s.rejected.clients); conn == nil {
+		return
+	}
+	if !s.isClientIPAllowed(conn) {
+		conn.Close()
+		return
+	}
+	s.createClient(conn)
+}
+
+// isListenerReplaced returns true if l is no longer the client listener
+// because it has been closed or replaced on config reload.
+func (s *Server) isListenerReplaced(l net.Listener) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running && s.listener != l
+}
+
+// rebindClientListener listens for client connections on the host and
+// port from the current options and replaces the existing listener.
+// Clients already connected are not affected.
+func (s *Server) rebindClientListener() error {
+	opts := s.getOpts()
+	s.mu.Lock()
+	old := s.listener
+	oldPort := s.clientActualPort
+	s.mu.Unlock()
+	if old == nil {
+		return nil
+	}
+
+	hp := net.JoinHostPort(opts.Host, strconv.Itoa(opts.Port))
+	l, err := s.listen(clientListenerName, "tcp", hp)
+	if err != nil && opts.Port == oldPort {
+		// Only the host changed, the port may still be in use by the
+		// current listener, so close it first and try again.
+		s.mu.Lock()
+		s.listener = nil
+		s.mu.Unlock()
+		old.Close()
+		if l, err = s.listen(clientListenerName, "tcp", hp); err != nil {
+			// Try to restore the previous listener.
+			if rl, rerr := s.listen(clientListenerName, "tcp", old.Addr().String()); rerr == nil {
+				s.mu.Lock()
+				s.listener = rl
+				s.mu.Unlock()
+				go s.acceptConnections(rl)
+			}
+			return err
+		}
+		old = nil
+	} else if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	// Check for shutdown while the lock was released.
+	if !s.running {
+		s.mu.Unlock()
+		l.Close()
+		return nil
+	}
+	s.listener = l
+	if opts.Port == 0 {
+		opts.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	s.clientActualPort = l.Addr().(*net.TCPAddr).Port
+	if err := s.setInfoHostPort(); err != nil {
+		s.Errorf("Error setting server INFO with ClientAdvertise value of %s, err=%v", opts.ClientAdvertise, err)
+	}
+	s.clientConnectURLs = s.getClientConnectURLs()
+	if !opts.Cluster.NoAdvertise {
+		s.routeInfo.ClientConnectURLs = s.clientConnectURLs
+	}
+	s.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+	s.Noticef("Listening for client connections on %s", l.Addr())
+	go s.acceptConnections(l)
+	return nil
+}
+
 // This function sets the server's info Host/Port based on server Options.
 // Note that this function may be called during config reload, this is why
 // Host/Port may be reset to original Options if the ClientAdvertise option
@@ -595,12 +839,14 @@ func (s *Server) StartMonitoring() error {
 
 // HTTP endpoints
 const (
-	RootPath    = "/"
-	VarzPath    = "/varz"
-	ConnzPath   = "/connz"
-	RoutezPath  = "/routez"
-	SubszPath   = "/subsz"
-	StackszPath = "/stacksz"
+	RootPath      = "/"
+	VarzPath      = "/varz"
+	ConnzPath     = "/connz"
+	RoutezPath    = "/routez"
+	SubszPath     = "/subsz"
+	StackszPath   = "/stacksz"
+	ReloadPath    = "/reload"
+	RebalancePath = "/rebalance"
 )
 
 // Start the monitoring server
@@ -635,7 +881,20 @@ func (s *Server) startMonitoring(secure bool) error {
 		hp = net.JoinHostPort(opts.HTTPHost, strconv.Itoa(port))
 		config := util.CloneTLSConfig(opts.TLSConfig)
 		config.ClientAuth = tls.NoClientCert
-		httpListener, err = tls.Listen("tcp", hp, config)
+		if getConfig := config.GetConfigForClient; getConfig != nil {
+			// Reloaded certificates come with the client settings.
+			config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				current, err := getConfig(hello)
+				if current != nil {
+					current = current.Clone()
+					current.ClientAuth = tls.NoClientCert
+				}
+				return current, err
+			}
+		}
+		if httpListener, err = s.listen(httpsListenerName, "tcp", hp); err == nil {
+			httpListener = tls.NewListener(httpListener, config)
+		}
 
 	} else {
 		port = opts.HTTPPort
@@ -643,7 +902,7 @@ func (s *Server) startMonitoring(secure bool) error {
 			port = 0
 		}
 		hp = net.JoinHostPort(opts.HTTPHost, strconv.Itoa(port))
-		httpListener, err = net.Listen("tcp", hp)
+		httpListener, err = s.listen(httpListenerName, "tcp", hp)
 	}
 
 	if err != nil {
@@ -669,6 +928,10 @@ func (s *Server) startMonitoring(secure bool) error {
 	mux.HandleFunc("/subscriptionsz", s.HandleSubsz)
 	// Stacksz
 	mux.HandleFunc(StackszPath, s.HandleStacksz)
+	// Reload
+	mux.HandleFunc(ReloadPath, s.HandleReload)
+	// Rebalance
+	mux.HandleFunc(RebalancePath, s.HandleRebalance)
 
 	// Do not set a WriteTimeout because it could cause cURL/browser
 	// to return empty response or unable to display page if the
@@ -678,6 +941,9 @@ func (s *Server) startMonitoring(secure bool) error {
 		Handler:        mux,
 		MaxHeaderBytes: 1 << 20,
 	}
+	// Reject the connections from networks not allowed.
+	httpListener = &ipFilterListener{Listener: httpListener, s: s}
+
 	s.mu.Lock()
 	s.http = httpListener
 	s.httpHandler = mux
@@ -688,14 +954,39 @@ func (s *Server) startMonitoring(secure bool) error {
 		srv.Serve(httpListener)
 		srv.Handler = nil
 		s.mu.Lock()
-		s.httpHandler = nil
+		// The listener may have been replaced or removed on config reload,
+		// in which case Shutdown() does not wait for us.
+		reloaded := !s.shutdown && s.http != httpListener
+		if !reloaded {
+			s.httpHandler = nil
+		}
 		s.mu.Unlock()
-		s.done <- true
+		if !reloaded {
+			s.done <- true
+		}
 	}()
 
 	return nil
 }
 
+// reloadMonitoring closes the monitoring listener, if any, and starts
+// monitoring again based on the current options.
+func (s *Server) reloadMonitoring() error {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return nil
+	}
+	old := s.http
+	s.http = nil
+	s.httpHandler = nil
+	s.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return s.StartMonitoring()
+}
+
 // HTTPHandler returns the http.Handler object used to handle monitoring
 // endpoints. It will return nil if the server is not configured for
 // monitoring, or if the server has not been started yet (Server.Start()).
@@ -766,6 +1057,7 @@ func (s *Server) createClient(conn net.Conn) *client {
 		return nil
 	}
 	s.clients[c.cid] = c
+	s.clientLoadChanged()
 	s.mu.Unlock()
 
 	// Re-Grab lock
@@ -979,6 +1271,8 @@ func (s *Server) removeClient(c *client) {
 		if updateProtoInfoCount {
 			s.cproto--
 		}
+		s.unregisterConnLimits(c)
+		s.clientLoadChanged()
 	case ROUTER:
 		delete(s.routes, cid)
 		if r != nil {
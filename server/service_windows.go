@@ -63,7 +63,9 @@ loop:
 		case svc.Interrogate:
 			status <- change.CurrentStatus
 		case svc.Stop, svc.Shutdown:
-			w.server.Shutdown()
+			// The pending data of the connections is sent first.
+			status <- svc.Status{State: svc.StopPending}
+			w.server.shutdownGracefully()
 			break loop
 		case reopenLogCmd:
 			// File log re-open for rotating file logs.
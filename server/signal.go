@@ -22,7 +22,7 @@ func (s *Server) handleSignals() {
 	}
 	c := make(chan os.Signal, 1)
 
-	signal.Notify(c, syscall.SIGINT, syscall.SIGUSR1, syscall.SIGHUP)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
 
 	s.grWG.Add(1)
 	go func() {
@@ -35,6 +35,24 @@ func (s *Server) handleSignals() {
 				case syscall.SIGINT:
 					s.Noticef("Server Exiting..")
 					os.Exit(0)
+				case syscall.SIGTERM:
+					// Not tracked, since the shutdown waits for the
+					// go routines, this one included.
+					go func() {
+						s.shutdownGracefully()
+						os.Exit(0)
+					}()
+				case syscall.SIGUSR2:
+					// Upgrade to a new process of the executable, and
+					// shut down like on SIGTERM once it is ready.
+					go func() {
+						if err := s.upgrade(); err != nil {
+							s.Errorf("Failed to upgrade: %v", err)
+							return
+						}
+						s.shutdownGracefully()
+						os.Exit(0)
+					}()
 				case syscall.SIGUSR1:
 					// File log re-open for rotating file logs.
 					s.ReOpenLogFile()
@@ -88,6 +106,10 @@ func ProcessSignal(command Command, pidStr string) error {
 		err = kill(pid, syscall.SIGKILL)
 	case CommandQuit:
 		err = kill(pid, syscall.SIGINT)
+	case CommandTerm:
+		err = kill(pid, syscall.SIGTERM)
+	case CommandUpgrade:
+		err = kill(pid, syscall.SIGUSR2)
 	case CommandReopen:
 		err = kill(pid, syscall.SIGUSR1)
 	case CommandReload:
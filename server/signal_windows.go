@@ -54,7 +54,7 @@ func ProcessSignal(command Command, service string) error {
 	)
 
 	switch command {
-	case CommandStop, CommandQuit:
+	case CommandStop, CommandQuit, CommandTerm:
 		cmd = svc.Stop
 		to = svc.Stopped
 	case CommandReopen:
@@ -63,6 +63,8 @@ func ProcessSignal(command Command, service string) error {
 	case CommandReload:
 		cmd = svc.ParamChange
 		to = svc.Running
+	case CommandUpgrade:
+		return fmt.Errorf("signal %q is not supported on windows", command)
 	default:
 		return fmt.Errorf("unknown signal %q", command)
 	}
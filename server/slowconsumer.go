@@ -0,0 +1,222 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Slow consumer policies.
+//
+// A client is a slow consumer when the messages it has not read yet would
+// exceed its maximum pending bytes (see Options.MaxPending). By default the
+// connection is closed, but some subscribers would rather miss messages
+// than be disconnected. The policy can be set for the server, per user, and
+// by the client itself in its CONNECT, which takes precedence. Routes are
+// always closed.
+//
+// The number of messages dropped is reported in the ConnInfo of the client.
+// Clients that asked for the policy in their CONNECT are also sent a "Slow
+// Consumer, Messages Dropped" error, once until they catch up. Others may
+// not know that error, and would close the connection on it.
+
+// SlowConsumerPolicy is what the server does with a slow consumer.
+type SlowConsumerPolicy int
+
+const (
+	// SlowConsumerClose closes the connection, the default.
+	SlowConsumerClose SlowConsumerPolicy = iota + 1
+	// SlowConsumerDropNewest drops the messages that do not fit.
+	SlowConsumerDropNewest
+	// SlowConsumerDropOldest drops the oldest messages not being written
+	// to the connection yet to make room for new ones. Since the messages
+	// being written can not be dropped, the newest one is kept past the
+	// maximum pending bytes, up to twice that.
+	SlowConsumerDropOldest
+	// SlowConsumerPause pauses reading from the clients publishing to the
+	// slow consumer, until it catches up or for the write deadline at most.
+	// Messages are then queued up to twice the maximum pending bytes, and
+	// the connection closed past that.
+	SlowConsumerPause
+)
+
+// String returns the name of the policy, as used in configurations.
+func (p SlowConsumerPolicy) String() string {
+	switch p {
+	case 0, SlowConsumerClose:
+		return "close"
+	case SlowConsumerDropNewest:
+		return "drop_newest"
+	case SlowConsumerDropOldest:
+		return "drop_oldest"
+	case SlowConsumerPause:
+		return "pause"
+	}
+	return ""
+}
+
+// MarshalJSON marshals the policy as its name.
+func (p SlowConsumerPolicy) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+// parseSlowConsumerPolicy parses the name of a policy. Dashes can be used
+// instead of underscores.
+func parseSlowConsumerPolicy(v interface{}) (SlowConsumerPolicy, error) {
+	s, ok := v.(string)
+	if !ok {
+		return 0, fmt.Errorf("Expected slow consumer policy to be a string, got %v", v)
+	}
+	name := strings.Replace(strings.ToLower(strings.TrimSpace(s)), "-", "_", -1)
+	for p := SlowConsumerClose; p <= SlowConsumerPause; p++ {
+		if name == p.String() {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown slow consumer policy %q", s)
+}
+
+// applySlowConsumerPolicy sets the policy of the client from the one it
+// asked for, the one of its user or the default one, in that order.
+// Lock should be held.
+func (c *client) applySlowConsumerPolicy(def SlowConsumerPolicy) {
+	scp := SlowConsumerClose
+	if c.typ == CLIENT {
+		switch {
+		case c.cscp != 0:
+			scp = c.cscp
+		case c.uscp != 0:
+			scp = c.uscp
+		case def != 0:
+			scp = def
+		}
+	}
+	if c.out.scp == SlowConsumerDropOldest && scp != SlowConsumerDropOldest {
+		c.releaseDropQueue()
+	}
+	c.out.scp = scp
+}
+
+// overMaxPending tells whether the client has more pending bytes than it
+// is allowed, and should be closed. Clients that do not get closed right
+// away are allowed twice the limit. Lock should be held.
+func (c *client) overMaxPending() bool {
+	return c.out.pb > c.out.mp && (c.out.scp <= SlowConsumerClose || c.out.pb > 2*c.out.mp)
+}
+
+// handleSlowConsumer applies the policy of a client that can not queue a
+// message of n bytes without exceeding its maximum pending bytes. The
+// message is published by producer. Returns true if the message should
+// still be queued. Lock should be held.
+func (c *client) handleSlowConsumer(producer *client, n int64) bool {
+	switch c.out.scp {
+	case SlowConsumerDropOldest:
+		dropped := int64(0)
+		for len(c.out.dq) > 0 && c.out.pb+n > c.out.mp {
+			m := c.out.dq[0]
+			c.out.dq[0] = nil
+			c.out.dq = c.out.dq[1:]
+			c.out.pb -= int64(len(m))
+			c.out.pm--
+			dropped++
+		}
+		// What is left is being written, keep the newest message anyway.
+		fits := c.out.pb+n <= 2*c.out.mp
+		if !fits {
+			dropped++
+		}
+		c.msgsDropped(dropped)
+		return fits
+	case SlowConsumerPause:
+		if !c.flags.isSet(slowConsumer) {
+			c.flags.set(slowConsumer)
+			atomic.AddInt64(&c.srv.slowConsumers, 1)
+			c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded, Pausing Producers", c.out.mp)
+		}
+		// Routes and internal clients are not paused.
+		if producer != nil && producer != c && producer.typ == CLIENT {
+			if c.out.stc == nil {
+				c.out.stc = make(chan struct{})
+			}
+			producer.in.stc = c.out.stc
+		}
+		return true
+	default:
+		c.msgsDropped(1)
+		return false
+	}
+}
+
+// msgsDropped accounts for n messages dropped, and notifies the client if
+// they are the first ones since it last caught up and it asked for the
+// policy. Lock should be held.
+func (c *client) msgsDropped(n int64) {
+	c.outDropped += n
+	if c.flags.isSet(slowConsumer) {
+		return
+	}
+	c.flags.set(slowConsumer)
+	atomic.AddInt64(&c.srv.slowConsumers, 1)
+	c.Noticef("Slow Consumer Detected: MaxPending of %d Exceeded, Dropping Messages", c.out.mp)
+	if c.cscp == 0 {
+		return
+	}
+	c.traceOutOp("-ERR", []byte(ErrSlowConsumerDropped.Error()))
+	c.sendProto([]byte(fmt.Sprintf("-ERR '%s'\r\n", ErrSlowConsumerDropped)), false)
+}
+
+// caughtUp is called after a flush, to resume the producers paused by the
+// client and reset the slow consumer state when it has caught up.
+// Lock should be held.
+func (c *client) caughtUp() {
+	if c.out.pb > c.out.mp/2 || c.out.scp == SlowConsumerClose {
+		return
+	}
+	if c.out.stc != nil {
+		close(c.out.stc)
+		c.out.stc = nil
+	}
+	c.flags.clear(slowConsumer)
+}
+
+// queueDroppable queues a message that can be dropped as long as it is not
+// being written to the connection. Lock should be held.
+func (c *client) queueDroppable(mh, msg []byte) {
+	m := make([]byte, 0, len(mh)+len(msg))
+	m = append(append(m, mh...), msg...)
+	c.out.dq = append(c.out.dq, m)
+	c.out.pb += int64(len(m))
+}
+
+// releaseDropQueue moves the droppable messages to the write buffers, to be
+// written in order with data queued afterwards. Lock should be held.
+func (c *client) releaseDropQueue() {
+	if len(c.out.dq) == 0 {
+		return
+	}
+	c.out.nb = append(c.collapsePtoNB(), c.out.dq...)
+	for i := range c.out.dq {
+		c.out.dq[i] = nil
+	}
+	c.out.dq = c.out.dq[:0]
+}
+
+// waitStalled pauses reading from the client while a slow consumer with
+// the pause policy it published to catches up, for the write deadline at
+// most.
+func (c *client) waitStalled(stc chan struct{}) {
+	c.mu.Lock()
+	wdl := c.out.wdl
+	srv := c.srv
+	c.mu.Unlock()
+
+	t := time.NewTimer(wdl)
+	defer t.Stop()
+	select {
+	case <-stc:
+	case <-t.C:
+	case <-srv.quitCh:
+	}
+}
@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestSlowConsumerPolicyConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/slow_consumer.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.SlowConsumerPolicy != SlowConsumerPause {
+		t.Fatalf("Unexpected policy: %v", opts.SlowConsumerPolicy)
+	}
+	if len(opts.Users) != 2 || opts.Users[0].SlowConsumerPolicy != SlowConsumerDropNewest || opts.Users[1].SlowConsumerPolicy != 0 {
+		t.Fatalf("Unexpected users: %+v", opts.Users)
+	}
+	if p, err := parseSlowConsumerPolicy("Drop-Oldest"); err != nil || p != SlowConsumerDropOldest {
+		t.Fatalf("Expected drop_oldest, got %v, %v", p, err)
+	}
+	if _, err := parseSlowConsumerPolicy("drop_all"); err == nil {
+		t.Fatal("Expected error for an unknown policy")
+	}
+
+	// The policy of a connection is the one it asked for, or the one of
+	// its user, or the one of the server.
+	opts.NoLog, opts.NoSigs = true, true
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	url := fmt.Sprintf("nats://%s:%d", opts.Host, s.Addr().(*net.TCPAddr).Port)
+	for _, o := range [][]gio.Option{
+		{gio.UserInfo("alice", "foo")},
+		{gio.UserInfo("bob", "bar")},
+		{gio.UserInfo("bob", "bar"), gio.SlowConsumerPolicy("drop_oldest")},
+	} {
+		nc, err := gio.Connect(url, o...)
+		if err != nil {
+			t.Fatalf("Error on connect: %v", err)
+		}
+		defer nc.Close()
+	}
+	cz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	expected := []string{"drop_newest", "pause", "drop_oldest"}
+	if len(cz.Conns) != len(expected) {
+		t.Fatalf("Expected %d connections, got %d", len(expected), len(cz.Conns))
+	}
+	for i, ci := range cz.Conns {
+		if ci.SlowConsumerPolicy != expected[i] {
+			t.Fatalf("Expected policy %q for connection %d, got %q", expected[i], i, ci.SlowConsumerPolicy)
+		}
+	}
+
+	// Unknown policies are rejected.
+	if nc, err := gio.Connect(url, gio.UserInfo("bob", "bar"), gio.SlowConsumerPolicy("drop_all")); err == nil {
+		nc.Close()
+		t.Fatal("Expected error for an unknown policy")
+	}
+}
+
+// createSlowConsumer connects a raw client subscribed to foo, with the
+// given policy, or the default one if empty, and a small receive buffer so
+// that messages back up in the server.
+func createSlowConsumer(t *testing.T, opts *Options, policy string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", fmt.Sprintf("%s:%d", opts.Host, opts.Port), 3*time.Second)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	c.(*net.TCPConn).SetReadBuffer(32 * 1024)
+	if _, err := fmt.Fprintf(c, "CONNECT {\"verbose\":false,\"slow_consumer_policy\":%q}\r\nSUB foo 1\r\nPING\r\n", policy); err != nil {
+		t.Fatalf("Error sending protocols to server: %v", err)
+	}
+	br := bufio.NewReaderSize(c, 128*1024)
+	if seqs, errs, err := readSlowConsumer(c, br, -1); err != nil || len(seqs) != 0 || len(errs) != 0 {
+		t.Fatalf("Unexpected protocols: %v, %v, %v", seqs, errs, err)
+	}
+	return c, br
+}
+
+// readSlowConsumer reads the messages of a raw client until it got max of
+// them, or a PONG if max is negative. It returns the sequence numbers of
+// the messages and the errors received.
+func readSlowConsumer(c net.Conn, br *bufio.Reader, max int) (seqs []int, errs []string, err error) {
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	defer c.SetReadDeadline(time.Time{})
+	for max < 0 || len(seqs) < max {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return seqs, errs, err
+		}
+		switch {
+		case strings.HasPrefix(line, "MSG "):
+			args := strings.Fields(line)
+			size, _ := strconv.Atoi(args[len(args)-1])
+			payload := make([]byte, size+LEN_CR_LF)
+			if _, err := io.ReadFull(br, payload); err != nil {
+				return seqs, errs, err
+			}
+			seqs = append(seqs, int(binary.BigEndian.Uint32(payload)))
+		case strings.HasPrefix(line, "-ERR "):
+			errs = append(errs, strings.TrimSpace(line))
+		case strings.HasPrefix(line, "PONG"):
+			if max < 0 {
+				return seqs, errs, nil
+			}
+		}
+	}
+	return seqs, errs, nil
+}
+
+// publishSeqs publishes total messages of 64KB to foo, numbered in their
+// first bytes.
+func publishSeqs(t *testing.T, opts *Options, total int) {
+	t.Helper()
+	sender, err := gio.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer sender.Close()
+	payload := make([]byte, 64*1024)
+	for i := 0; i < total; i++ {
+		binary.BigEndian.PutUint32(payload, uint32(i))
+		if err := sender.Publish("foo", payload); err != nil {
+			t.Fatalf("Error on publish: %v", err)
+		}
+	}
+	if err := sender.FlushTimeout(30 * time.Second); err != nil {
+		t.Fatalf("Error on flush: %v", err)
+	}
+}
+
+func TestSlowConsumerDropPolicies(t *testing.T) {
+	for _, policy := range []SlowConsumerPolicy{SlowConsumerDropNewest, SlowConsumerDropOldest} {
+		t.Run(policy.String(), func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.WriteDeadline = 30 * time.Second
+			opts.MaxPending = 1024 * 1024
+			s := RunServer(opts)
+			defer s.Shutdown()
+
+			c, br := createSlowConsumer(t, opts, policy.String())
+			defer c.Close()
+
+			total := 200
+			publishSeqs(t, opts, total)
+
+			// The consumer is still connected, and dropped messages.
+			cz, err := s.Connz(nil)
+			if err != nil {
+				t.Fatalf("Error getting connz: %v", err)
+			}
+			ci := cz.Conns[0]
+			if ci.SlowConsumerPolicy != policy.String() || ci.Dropped == 0 {
+				t.Fatalf("Expected dropped messages, got %+v", ci)
+			}
+
+			// It receives the rest in order, and is notified of the drops.
+			if _, err := c.Write([]byte("PING\r\n")); err != nil {
+				t.Fatalf("Error on ping: %v", err)
+			}
+			seqs, errs, err := readSlowConsumer(c, br, -1)
+			if err != nil {
+				t.Fatalf("Error reading: %v", err)
+			}
+			if len(seqs)+int(ci.Dropped) != total {
+				t.Fatalf("Expected %d messages, received %d and dropped %d", total, len(seqs), ci.Dropped)
+			}
+			for i := 1; i < len(seqs); i++ {
+				if seqs[i] <= seqs[i-1] {
+					t.Fatalf("Messages out of order: %d after %d", seqs[i], seqs[i-1])
+				}
+			}
+			// Dropping the oldest messages keeps the newest one.
+			if last := seqs[len(seqs)-1]; policy == SlowConsumerDropOldest && last != total-1 {
+				t.Fatalf("Expected the last message to be %d, got %d", total-1, last)
+			}
+			if len(errs) == 0 {
+				t.Fatal("Expected a slow consumer error")
+			}
+			for _, e := range errs {
+				if e != fmt.Sprintf("-ERR '%s'", ErrSlowConsumerDropped) {
+					t.Fatalf("Unexpected error: %q", e)
+				}
+			}
+		})
+	}
+}
+
+func TestSlowConsumerDropPolicyDefault(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WriteDeadline = 30 * time.Second
+	opts.MaxPending = 1024 * 1024
+	opts.SlowConsumerPolicy = SlowConsumerDropNewest
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, br := createSlowConsumer(t, opts, "")
+	defer c.Close()
+	publishSeqs(t, opts, 200)
+
+	cz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	if ci := cz.Conns[0]; ci.SlowConsumerPolicy != "drop_newest" || ci.Dropped == 0 {
+		t.Fatalf("Expected dropped messages, got %+v", ci)
+	}
+
+	// The client did not ask for the policy, so is not sent the error.
+	if _, err := c.Write([]byte("PING\r\n")); err != nil {
+		t.Fatalf("Error on ping: %v", err)
+	}
+	_, errs, err := readSlowConsumer(c, br, -1)
+	if err != nil {
+		t.Fatalf("Error reading: %v", err)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("Expected no error, got %q", errs)
+	}
+}
+
+func TestSlowConsumerPausePolicy(t *testing.T) {
+	opts := DefaultOptions()
+	opts.WriteDeadline = 10 * time.Second
+	opts.MaxPending = 1024 * 1024
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	c, br := createSlowConsumer(t, opts, "pause")
+	defer c.Close()
+
+	// Start reading after the publisher got paused.
+	total := 200
+	type result struct {
+		seqs []int
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		seqs, _, err := readSlowConsumer(c, br, total)
+		ch <- result{seqs, err}
+	}()
+	publishSeqs(t, opts, total)
+
+	r := <-ch
+	if r.err != nil {
+		t.Fatalf("Error reading: %v", r.err)
+	}
+	for i, seq := range r.seqs {
+		if seq != i {
+			t.Fatalf("Expected message %d, got %d", i, seq)
+		}
+	}
+	if n := s.NumSlowConsumers(); n == 0 {
+		t.Fatalf("Expected the consumer to have been slow, got %d slow consumers", n)
+	}
+	cz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	if len(cz.Conns) == 0 || cz.Conns[0].Dropped != 0 {
+		t.Fatalf("Expected the consumer to be connected without drops, got %+v", cz.Conns)
+	}
+}
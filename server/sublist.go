@@ -40,6 +40,13 @@ type SublistResult struct {
 }
 
 // A Sublist stores and efficiently retrieves subscriptions.
+//
+// Results of Match are cached by literal subject. The cache is read
+// without locking, and cached results are never modified: inserts and
+// removes replace the results they affect with updated copies. Cached
+// subjects are also indexed by token, so that the results a subscription
+// affects are found by walking its subject instead of testing every
+// cached subject.
 type Sublist struct {
 	sync.RWMutex
 	genid     uint64
@@ -47,7 +54,10 @@ type Sublist struct {
 	cacheHits uint64
 	inserts   uint64
 	removes   uint64
-	cache     map[string]*SublistResult
+	cache     sync.Map
+	cmu       sync.Mutex // protects ctree and ccount
+	ctree     clevel
+	ccount    int
 	root      *level
 	count     uint32
 }
@@ -67,6 +77,16 @@ type level struct {
 	pwc, fwc *node
 }
 
+// A cache level indexes cached subjects by token.
+type clevel map[string]*cnode
+
+// A cache node is a token of cached subjects, and may end one of them.
+type cnode struct {
+	next    clevel
+	subject string
+	cached  bool
+}
+
 // Create a new default node.
 func newNode() *node {
 	return &node{psubs: make(map[*subscription]*subscription)}
@@ -79,7 +99,7 @@ func newLevel() *level {
 
 // New will create a default sublist
 func NewSublist() *Sublist {
-	return &Sublist{root: newLevel(), cache: make(map[string]*SublistResult)}
+	return &Sublist{root: newLevel(), ctree: make(clevel)}
 }
 
 // Insert adds a subscription into the sublist
@@ -171,7 +191,7 @@ func (s *Sublist) Insert(sub *subscription) error {
 	s.count++
 	s.inserts++
 
-	s.addToCache(subject, sub)
+	s.addToCache(tokens, sub)
 	atomic.AddUint64(&s.genid, 1)
 
 	s.Unlock()
@@ -189,54 +209,198 @@ func copyResult(r *SublistResult) *SublistResult {
 	return nr
 }
 
-// addToCache will add the new entry to existing cache
-// entries if needed. Assumes write lock is held.
-func (s *Sublist) addToCache(subject string, sub *subscription) {
-	for k, r := range s.cache {
-		if matchLiteral(k, subject) {
-			// Copy since others may have a reference.
-			nr := copyResult(r)
-			if sub.queue == nil {
-				nr.psubs = append(nr.psubs, sub)
+// addToCache will add the new subscription to the cached results of
+// the subjects it matches. Assumes write lock is held.
+func (s *Sublist) addToCache(tokens []string, sub *subscription) {
+	s.cmu.Lock()
+	for _, subject := range s.cachedMatches(tokens) {
+		r, _ := s.cache.Load(subject)
+		// Copy since others may have a reference.
+		nr := copyResult(r.(*SublistResult))
+		if sub.queue == nil {
+			nr.psubs = append(nr.psubs, sub)
+		} else {
+			if i := findQSliceForSub(sub, nr.qsubs); i >= 0 {
+				nr.qsubs[i] = append(nr.qsubs[i], sub)
 			} else {
-				if i := findQSliceForSub(sub, nr.qsubs); i >= 0 {
-					nr.qsubs[i] = append(nr.qsubs[i], sub)
-				} else {
-					nr.qsubs = append(nr.qsubs, []*subscription{sub})
-				}
+				nr.qsubs = append(nr.qsubs, []*subscription{sub})
 			}
-			s.cache[k] = nr
 		}
+		s.cache.Store(subject, nr)
 	}
+	s.cmu.Unlock()
 }
 
-// removeFromCache will remove the sub from any active cache entries.
+// removeFromCache will remove the subscription from the cached results
+// of the subjects it matches, dropping the results left empty.
 // Assumes write lock is held.
-func (s *Sublist) removeFromCache(subject string, sub *subscription) {
-	for k := range s.cache {
-		if !matchLiteral(k, subject) {
-			continue
+func (s *Sublist) removeFromCache(tokens []string, sub *subscription) {
+	s.cmu.Lock()
+	for _, subject := range s.cachedMatches(tokens) {
+		r, _ := s.cache.Load(subject)
+		nr := removeSubFromResult(r.(*SublistResult), sub)
+		if len(nr.psubs) == 0 && len(nr.qsubs) == 0 {
+			s.uncache(subject)
+		} else {
+			s.cache.Store(subject, nr)
 		}
-		// Since someone else may be referecing, can't modify the list
-		// safely, just let it re-populate.
-		delete(s.cache, k)
 	}
+	s.cmu.Unlock()
 }
 
-// Match will match all entries to the literal subject.
-// It will return a set of results for both normal and queue subscribers.
-func (s *Sublist) Match(subject string) *SublistResult {
-	s.RLock()
-	atomic.AddUint64(&s.matches, 1)
-	rc, ok := s.cache[subject]
-	s.RUnlock()
-	if ok {
-		atomic.AddUint64(&s.cacheHits, 1)
-		return rc
+// removeSubFromResult returns a copy of the result without the
+// subscription. Lists it is not in are shared with the result.
+func removeSubFromResult(r *SublistResult, sub *subscription) *SublistResult {
+	nr := &SublistResult{psubs: r.psubs}
+	if sub.queue == nil {
+		nr.psubs = make([]*subscription, 0, len(r.psubs))
+		for _, psub := range r.psubs {
+			if psub != sub {
+				nr.psubs = append(nr.psubs, psub)
+			}
+		}
+		nr.qsubs = r.qsubs
+		return nr
+	}
+	for _, qr := range r.qsubs {
+		if len(qr) > 0 && bytes.Equal(sub.queue, qr[0].queue) {
+			nqr := make([]*subscription, 0, len(qr))
+			for _, qsub := range qr {
+				if qsub != sub {
+					nqr = append(nqr, qsub)
+				}
+			}
+			if len(nqr) == 0 {
+				continue
+			}
+			qr = nqr
+		}
+		nr.qsubs = append(nr.qsubs, qr)
+	}
+	return nr
+}
+
+// cachedMatches returns the cached subjects matched by the subject of
+// a subscription. Assumes the cache lock is held.
+func (s *Sublist) cachedMatches(tokens []string) []string {
+	var subjects []string
+	s.ctree.match(tokens, &subjects)
+	return subjects
+}
+
+// match is used to recursively descend into the cache index.
+func (l clevel) match(tokens []string, subjects *[]string) {
+	if len(tokens) == 0 {
+		return
+	}
+	t, rest := tokens[0], tokens[1:]
+	if len(t) == 1 && t[0] == fwc {
+		for _, n := range l {
+			n.all(subjects)
+		}
+		return
+	}
+	add := func(n *cnode) {
+		if len(rest) > 0 {
+			n.next.match(rest, subjects)
+		} else if n.cached {
+			*subjects = append(*subjects, n.subject)
+		}
+	}
+	if len(t) == 1 && t[0] == pwc {
+		for _, n := range l {
+			add(n)
+		}
+	} else if n := l[t]; n != nil {
+		add(n)
 	}
+}
+
+// all collects the cached subjects of the node and below.
+func (n *cnode) all(subjects *[]string) {
+	if n.cached {
+		*subjects = append(*subjects, n.subject)
+	}
+	for _, c := range n.next {
+		c.all(subjects)
+	}
+}
+
+// cacheResult adds a result to the cache, evicting another entry if the
+// cache is full. Assumes the cache lock is held, and at least the read
+// lock so that the result can not be stale.
+func (s *Sublist) cacheResult(subject string, tokens []string, r *SublistResult) {
+	if _, ok := s.cache.Load(subject); ok {
+		return
+	}
+	s.cache.Store(subject, r)
+	l := s.ctree
+	var n *cnode
+	for _, t := range tokens {
+		if l == nil {
+			n.next = make(clevel)
+			l = n.next
+		}
+		if n = l[t]; n == nil {
+			n = &cnode{}
+			l[t] = n
+		}
+		l = n.next
+	}
+	n.subject, n.cached = subject, true
+	s.ccount++
+
+	// Bound the number of entries to slCacheMax
+	if s.ccount > slCacheMax {
+		s.cache.Range(func(k, _ interface{}) bool {
+			if k.(string) != subject {
+				s.uncache(k.(string))
+			}
+			return s.ccount > slCacheMax
+		})
+	}
+}
+
+// uncache removes a subject from the cache and prunes its tokens from
+// the cache index. Assumes the cache lock is held.
+func (s *Sublist) uncache(subject string) {
+	if _, ok := s.cache.Load(subject); !ok {
+		return
+	}
+	s.cache.Delete(subject)
+	s.ccount--
 
 	tsa := [32]string{}
-	tokens := tsa[:0]
+	tokens := tokenizeSubject(tsa[:0], subject)
+
+	// Track levels for pruning
+	type clt struct {
+		l clevel
+		t string
+	}
+	var clts [32]clt
+	levels := clts[:0]
+	l := s.ctree
+	var n *cnode
+	for _, t := range tokens {
+		if n = l[t]; n == nil {
+			return
+		}
+		levels = append(levels, clt{l, t})
+		l = n.next
+	}
+	n.subject, n.cached = "", false
+	for i := len(levels) - 1; i >= 0; i-- {
+		l, t := levels[i].l, levels[i].t
+		if n := l[t]; n.cached || len(n.next) > 0 {
+			break
+		}
+		delete(l, t)
+	}
+}
+
+// tokenizeSubject appends the tokens of the subject to tokens.
+func tokenizeSubject(tokens []string, subject string) []string {
 	start := 0
 	for i := 0; i < len(subject); i++ {
 		if subject[i] == btsep {
@@ -244,24 +408,32 @@ func (s *Sublist) Match(subject string) *SublistResult {
 			start = i + 1
 		}
 	}
-	tokens = append(tokens, subject[start:])
+	return append(tokens, subject[start:])
+}
+
+// Match will match all entries to the literal subject.
+// It will return a set of results for both normal and queue subscribers.
+func (s *Sublist) Match(subject string) *SublistResult {
+	atomic.AddUint64(&s.matches, 1)
+	if rc, ok := s.cache.Load(subject); ok {
+		atomic.AddUint64(&s.cacheHits, 1)
+		return rc.(*SublistResult)
+	}
+
+	tsa := [32]string{}
+	tokens := tokenizeSubject(tsa[:0], subject)
 
 	// FIXME(dlc) - Make shared pool between sublist and client readLoop?
 	result := &SublistResult{}
 
-	s.Lock()
+	s.RLock()
 	matchLevel(s.root, tokens, result)
 
 	// Add to our cache
-	s.cache[subject] = result
-	// Bound the number of entries to sublistMaxCache
-	if len(s.cache) > slCacheMax {
-		for k := range s.cache {
-			delete(s.cache, k)
-			break
-		}
-	}
-	s.Unlock()
+	s.cmu.Lock()
+	s.cacheResult(subject, tokens, result)
+	s.cmu.Unlock()
+	s.RUnlock()
 
 	return result
 }
@@ -416,7 +588,7 @@ func (s *Sublist) remove(sub *subscription, shouldLock bool) error {
 			l.pruneNode(n, t)
 		}
 	}
-	s.removeFromCache(subject, sub)
+	s.removeFromCache(tokens, sub)
 	atomic.AddUint64(&s.genid, 1)
 
 	return nil
@@ -514,9 +686,9 @@ func (s *Sublist) Count() uint32 {
 
 // CacheCount returns the number of result sets in the cache.
 func (s *Sublist) CacheCount() int {
-	s.RLock()
-	defer s.RUnlock()
-	return len(s.cache)
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
+	return s.ccount
 }
 
 // Public stats for the sublist
@@ -533,12 +705,14 @@ type SublistStats struct {
 
 // Stats will return a stats structure for the current state.
 func (s *Sublist) Stats() *SublistStats {
-	s.Lock()
-	defer s.Unlock()
+	s.RLock()
+	defer s.RUnlock()
+	s.cmu.Lock()
+	defer s.cmu.Unlock()
 
 	st := &SublistStats{}
 	st.NumSubs = s.count
-	st.NumCache = uint32(len(s.cache))
+	st.NumCache = uint32(s.ccount)
 	st.NumInserts = s.inserts
 	st.NumRemoves = s.removes
 	st.NumMatches = atomic.LoadUint64(&s.matches)
@@ -547,16 +721,18 @@ func (s *Sublist) Stats() *SublistStats {
 	}
 	// whip through cache for fanout stats
 	tot, max := 0, 0
-	for _, r := range s.cache {
+	s.cache.Range(func(_, v interface{}) bool {
+		r := v.(*SublistResult)
 		l := len(r.psubs) + len(r.qsubs)
 		tot += l
 		if l > max {
 			max = l
 		}
-	}
+		return true
+	})
 	st.MaxFanout = uint32(max)
 	if tot > 0 {
-		st.AvgFanout = float64(tot) / float64(len(s.cache))
+		st.AvgFanout = float64(tot) / float64(s.ccount)
 	}
 	return st
 }
@@ -642,7 +818,7 @@ func IsValidLiteralSubject(subject string) bool {
 }
 
 // matchLiteral is used to test literal subjects, those that do not have any
-// wildcards, with a target subject. This is used in the cache layer.
+// wildcards, with a target subject.
 func matchLiteral(literal, subject string) bool {
 	li := 0
 	ll := len(literal)
@@ -713,7 +889,7 @@ func matchLiteral(literal, subject string) bool {
 }
 
 func addLocalSub(sub *subscription, subs *[]*subscription) {
-	if sub != nil && sub.client != nil && sub.client.typ == CLIENT {
+	if sub != nil && sub.client != nil && sub.client.typ != ROUTER {
 		*subs = append(*subs, sub)
 	}
 }
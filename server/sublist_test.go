@@ -302,6 +302,87 @@ func TestSublistCache(t *testing.T) {
 	}
 }
 
+func TestSublistCacheUpdates(t *testing.T) {
+	s := NewSublist()
+	sub := newSub("foo.bar.baz")
+	psub := newSub("foo.*.baz")
+	fsub := newSub("foo.>")
+	qsub1 := newQSub("foo.bar.baz", "workers")
+	qsub2 := newQSub("foo.*.*", "workers")
+	s.Insert(sub)
+	s.Insert(newSub("bar.baz"))
+
+	r := s.Match("foo.bar.baz")
+	verifyLen(r.psubs, 1, t)
+	s.Match("foo.bar")
+	s.Match("bar.baz")
+	if cc := s.CacheCount(); cc != 3 {
+		t.Fatalf("Cache should have 3 entries, got %d\n", cc)
+	}
+
+	// Inserts update the cached results they match, without dropping them.
+	s.Insert(psub)
+	s.Insert(fsub)
+	s.Insert(qsub1)
+	s.Insert(qsub2)
+	if cc := s.CacheCount(); cc != 3 {
+		t.Fatalf("Cache should have 3 entries, got %d\n", cc)
+	}
+	// Results already returned are not modified.
+	verifyLen(r.psubs, 1, t)
+	verifyQLen(r.qsubs, 0, t)
+
+	r = s.Match("foo.bar.baz")
+	verifyLen(r.psubs, 3, t)
+	verifyQLen(r.qsubs, 1, t)
+	verifyLen(r.qsubs[0], 2, t)
+	r = s.Match("foo.bar")
+	verifyLen(r.psubs, 1, t)
+	verifyMember(r.psubs, fsub, t)
+	r = s.Match("bar.baz")
+	verifyLen(r.psubs, 1, t)
+
+	// So do removes, and results left empty are dropped.
+	s.Remove(sub)
+	s.Remove(qsub1)
+	s.Remove(fsub)
+	if cc := s.CacheCount(); cc != 2 {
+		t.Fatalf("Cache should have 2 entries, got %d\n", cc)
+	}
+	r = s.Match("foo.bar.baz")
+	verifyLen(r.psubs, 1, t)
+	verifyMember(r.psubs, psub, t)
+	verifyQLen(r.qsubs, 1, t)
+	verifyLen(r.qsubs[0], 1, t)
+	verifyQMember(r.qsubs, qsub2, t)
+	s.Remove(qsub2)
+	r = s.Match("foo.bar.baz")
+	verifyQLen(r.qsubs, 0, t)
+
+	// The cached results are the ones computed without the cache.
+	for _, subject := range []string{"foo.bar.baz", "foo.bar", "bar.baz"} {
+		cr := s.Match(subject)
+		s.cmu.Lock()
+		s.uncache(subject)
+		s.cmu.Unlock()
+		r := s.Match(subject)
+		if len(r.psubs) != len(cr.psubs) || len(r.qsubs) != len(cr.qsubs) {
+			t.Fatalf("Unexpected cached results for %q: %+v vs %+v", subject, cr, r)
+		}
+	}
+
+	// Uncached subjects are pruned from the cache index.
+	s.cmu.Lock()
+	for _, subject := range []string{"foo.bar.baz", "foo.bar", "bar.baz"} {
+		s.uncache(subject)
+	}
+	n := len(s.ctree)
+	s.cmu.Unlock()
+	if n != 0 {
+		t.Fatalf("Cache index should be empty, got %d nodes\n", n)
+	}
+}
+
 func TestSublistBasicQueueResults(t *testing.T) {
 	s := NewSublist()
 
@@ -702,9 +783,9 @@ func TestSublistRaceOnMatch(t *testing.T) {
 				}
 			}
 			// Empty cache to maximize chance for race
-			s.Lock()
-			delete(s.cache, "foo.bar")
-			s.Unlock()
+			s.cmu.Lock()
+			s.uncache("foo.bar")
+			s.cmu.Unlock()
 		}
 	}
 	go f()
@@ -888,10 +969,121 @@ func Benchmark_____SublistMatch10kSubsWithNoCache(b *testing.B) {
 		if len(r.psubs) != nsubs {
 			b.Fatalf("Results len is %d, should be %d", len(r.psubs), nsubs)
 		}
-		delete(s.cache, subject)
+		s.cmu.Lock()
+		s.uncache(subject)
+		s.cmu.Unlock()
+	}
+}
+
+// churnSublist returns a sublist with the benchmark subscriptions, many
+// wildcards, and the literal subjects it has cached results for.
+func churnSublist() (*Sublist, []string) {
+	s := NewSublist()
+	for _, sub := range subs {
+		s.Insert(sub)
+	}
+	for _, t := range toks {
+		s.Insert(newSub(t + ".>"))
+		s.Insert(newSub("*." + t + ".>"))
+		s.Insert(newSub("*.*." + t + ".*"))
+		s.Insert(newSub("apcera.*." + t))
+		s.Insert(newQSub(t+".*.*", "workers"))
+	}
+	cached := make([]string, 0, slCacheMax/2)
+	for i := 0; i < cap(cached); i++ {
+		subject := string(subs[i*len(subs)/cap(cached)].subject)
+		s.Match(subject)
+		cached = append(cached, subject)
+	}
+	return s, cached
+}
+
+// replySubs returns subscriptions on unique reply subjects.
+func replySubs(n int) []*subscription {
+	replies := make([]*subscription, n)
+	for i := range replies {
+		replies[i] = newSub(fmt.Sprintf("_INBOX.%d.%d", i%64, i))
+	}
+	return replies
+}
+
+func Benchmark____________SublistReplySubsChurn(b *testing.B) {
+	b.StopTimer()
+	s, cached := churnSublist()
+	replies := replySubs(1024)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		reply := replies[i%len(replies)]
+		s.Insert(reply)
+		if r := s.Match(string(reply.subject)); len(r.psubs) != 1 {
+			b.Fatalf("Results len is %d, should be 1", len(r.psubs))
+		}
+		s.Remove(reply)
+		s.Match(cached[i%len(cached)])
+	}
+	b.StopTimer()
+	if cc := s.CacheCount(); cc < len(cached) {
+		b.Fatalf("Cache should have kept %d entries, got %d", len(cached), cc)
 	}
 }
 
+func Benchmark_______SublistWildcardSubsChurn(b *testing.B) {
+	b.StopTimer()
+	s, cached := churnSublist()
+	wsubs := make([]*subscription, len(toks))
+	for i, t := range toks {
+		wsubs[i] = newSub("*.*." + t + ".>")
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		wsub := wsubs[i%len(wsubs)]
+		s.Insert(wsub)
+		s.Match(cached[i%len(cached)])
+		s.Remove(wsub)
+	}
+}
+
+func matchWithChurn(b *testing.B, churn bool) {
+	b.StopTimer()
+	s, cached := churnSublist()
+	replies := replySubs(1024)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	if churn {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				reply := replies[i%len(replies)]
+				s.Insert(reply)
+				s.Remove(reply)
+			}
+		}()
+	}
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			s.Match(cached[i%len(cached)])
+		}
+	})
+	b.StopTimer()
+	close(done)
+	wg.Wait()
+}
+
+func Benchmark____________SublistParallelMatch(b *testing.B) {
+	matchWithChurn(b, false)
+}
+
+func Benchmark___SublistParallelMatchWithChurn(b *testing.B) {
+	matchWithChurn(b, true)
+}
+
 func removeTest(b *testing.B, singleSubject, doBatch bool, qgroup string) {
 	b.StopTimer()
 	s := NewSublist()
@@ -0,0 +1,193 @@
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// systemd integration.
+//
+// With socket activation, systemd opens the listening sockets and passes
+// them as the file descriptors from 3 on, their number in LISTEN_FDS and
+// their names in LISTEN_FDNAMES. Sockets named after a listener (client,
+// route, http, https or unix) are used for it. Others, like the sockets of
+// a unit listing several ports, are used for the listener of their port.
+//
+// When NOTIFY_SOCKET is set, the server tells systemd that it is ready
+// once it accepts connections, that it is reloading around config reloads
+// and stopping at shutdown, and pings the watchdog if WATCHDOG_USEC is set.
+
+// sdListenFDsStart is the first file descriptor passed by systemd.
+const sdListenFDsStart = 3
+
+// receiveSystemdListeners takes the listeners passed by systemd, if any.
+func (s *Server) receiveSystemdListeners() error {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	// Not for the processes started by this one.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || n <= 0 {
+		return nil
+	}
+
+	inherited, err := s.systemdListeners(sdListenFDsStart, n, names)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.inherited = inherited
+	s.mu.Unlock()
+	s.Noticef("Received %d sockets from systemd", n)
+	return nil
+}
+
+// systemdListeners returns the listeners of the n file descriptors from
+// start by listener name, closing those that are not configured.
+func (s *Server) systemdListeners(start, n int, names []string) (map[string]net.Listener, error) {
+	opts := s.getOpts()
+	inherited := make(map[string]net.Listener, n)
+	for i := 0; i < n; i++ {
+		fd := start + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "systemd")
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range inherited {
+				l.Close()
+			}
+			return nil, fmt.Errorf("invalid socket %d: %v", fd, err)
+		}
+		name := _EMPTY_
+		if i < len(names) {
+			name = names[i]
+		}
+		if !isListenerName(name) {
+			name = listenerNameFor(l, opts)
+		}
+		if name == _EMPTY_ || inherited[name] != nil {
+			s.Noticef("Closing the socket on %s passed by systemd, not configured", l.Addr())
+			l.Close()
+			continue
+		}
+		inherited[name] = l
+	}
+	return inherited, nil
+}
+
+// isListenerName returns true if name is the name of a listener.
+func isListenerName(name string) bool {
+	switch name {
+	case clientListenerName, routeListenerName, httpListenerName, httpsListenerName, unixListenerName:
+		return true
+	}
+	return false
+}
+
+// listenerNameFor returns the name of the listener configured on the
+// address of l, if any.
+func listenerNameFor(l net.Listener, opts *Options) string {
+	if ul, ok := l.Addr().(*net.UnixAddr); ok {
+		path := opts.UnixSocket
+		if p, ok := parseUnixSocket(path); ok {
+			path = p
+		}
+		if path != _EMPTY_ && ul.Name == path {
+			return unixListenerName
+		}
+		return _EMPTY_
+	}
+	tcp, ok := l.Addr().(*net.TCPAddr)
+	if !ok {
+		return _EMPTY_
+	}
+	switch tcp.Port {
+	case opts.Port:
+		return clientListenerName
+	case opts.Cluster.Port:
+		return routeListenerName
+	case opts.HTTPPort:
+		return httpListenerName
+	case opts.HTTPSPort:
+		return httpsListenerName
+	}
+	return _EMPTY_
+}
+
+// startSystemdNotify tells systemd once the server is ready, and starts
+// pinging the watchdog, if enabled.
+func (s *Server) startSystemdNotify() {
+	go func() {
+		if !s.ReadyForConnections(SYSTEMD_READY_TIMEOUT) {
+			return
+		}
+		s.closeInherited()
+		if err := sdNotify("READY=1"); err != nil {
+			s.Errorf("Error notifying systemd: %v", err)
+		}
+	}()
+
+	if interval := sdWatchdogInterval(); interval > 0 {
+		s.startGoRoutine(func() { s.sdWatchdogLoop(interval) })
+	}
+}
+
+// sdWatchdogLoop pings the watchdog of systemd until shutdown.
+func (s *Server) sdWatchdogLoop(interval time.Duration) {
+	defer s.grWG.Done()
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-t.C:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				s.Debugf("Error pinging the systemd watchdog: %v", err)
+			}
+		}
+	}
+}
+
+// sdWatchdogInterval returns how often to ping the watchdog of systemd, half
+// of its timeout, or 0 if it is not enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != _EMPTY_ && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdNotify sends state to systemd, if NOTIFY_SOCKET is set.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == _EMPTY_ {
+		return nil
+	}
+	// Abstract socket.
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
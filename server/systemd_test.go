@@ -0,0 +1,187 @@
+// +build !windows
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// listenNotifySocket listens on a datagram socket and points NOTIFY_SOCKET
+// to it, until the returned function is called.
+func listenNotifySocket(t *testing.T) (*net.UnixConn, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gmessage_systemd")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	path := filepath.Join(dir, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error on listen: %v", err)
+	}
+	os.Setenv("NOTIFY_SOCKET", path)
+	return conn, func() {
+		os.Unsetenv("NOTIFY_SOCKET")
+		conn.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// expectNotify reads the next state sent to the notify socket.
+func expectNotify(t *testing.T, conn *net.UnixConn, expected string) {
+	t.Helper()
+	buf := make([]byte, 256)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("Expected %q, got error %v", expected, err)
+	}
+	if state := string(buf[:n]); state != expected {
+		t.Fatalf("Expected %q, got %q", expected, state)
+	}
+}
+
+func TestSystemdNotify(t *testing.T) {
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+
+	s, _, config := runServerWithSymlinkConfig(t, "tmp_systemd.conf", "./configs/reload/basic.conf")
+	defer os.Remove(config)
+	defer s.Shutdown()
+	expectNotify(t, conn, "READY=1")
+
+	if err := s.Reload(); err != nil {
+		t.Fatalf("Error reloading config: %v", err)
+	}
+	expectNotify(t, conn, "RELOADING=1")
+	expectNotify(t, conn, "READY=1")
+
+	s.Shutdown()
+	expectNotify(t, conn, "STOPPING=1")
+}
+
+func TestSystemdWatchdog(t *testing.T) {
+	conn, cleanup := listenNotifySocket(t)
+	defer cleanup()
+	os.Setenv("WATCHDOG_USEC", "100000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+
+	// The watchdog of another process.
+	os.Setenv("WATCHDOG_PID", "1")
+	if d := sdWatchdogInterval(); d != 0 {
+		t.Fatalf("Expected no watchdog for another process, got %v", d)
+	}
+	os.Setenv("WATCHDOG_PID", fmt.Sprintf("%d", os.Getpid()))
+	defer os.Unsetenv("WATCHDOG_PID")
+	if d := sdWatchdogInterval(); d != 50*time.Millisecond {
+		t.Fatalf("Expected watchdog interval of 50ms, got %v", d)
+	}
+
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+	expectNotify(t, conn, "READY=1")
+	expectNotify(t, conn, "WATCHDOG=1")
+	expectNotify(t, conn, "WATCHDOG=1")
+}
+
+func TestSystemdListeners(t *testing.T) {
+	// sdFD returns a file descriptor listening like l, as passed by systemd.
+	sdFD := func(l net.Listener) int {
+		f, err := l.(interface {
+			File() (*os.File, error)
+		}).File()
+		if err != nil {
+			t.Fatalf("Error getting file: %v", err)
+		}
+		defer f.Close()
+		fd, err := syscall.Dup(int(f.Fd()))
+		if err != nil {
+			t.Fatalf("Error on dup: %v", err)
+		}
+		return fd
+	}
+	listen := func(network, addr string) net.Listener {
+		l, err := net.Listen(network, addr)
+		if err != nil {
+			t.Fatalf("Error on listen: %v", err)
+		}
+		return l
+	}
+
+	dir, err := ioutil.TempDir("", "gmessage_systemd")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gmessage.sock")
+
+	client, monitor, other := listen("tcp", "127.0.0.1:0"), listen("tcp", "127.0.0.1:0"), listen("tcp", "127.0.0.1:0")
+	unix := listen("unix", path)
+	unix.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	opts := DefaultOptions()
+	opts.Port = client.Addr().(*net.TCPAddr).Port
+	opts.UnixSocket = "unix://" + path
+	s := New(opts)
+
+	// Sockets are used by name, or else by address.
+	for _, tc := range []struct {
+		l        net.Listener
+		sdName   string
+		expected string
+	}{
+		{client, "gmessage.socket", clientListenerName},
+		{monitor, httpListenerName, httpListenerName},
+		{unix, "gmessage.socket", unixListenerName},
+		{other, "gmessage.socket", _EMPTY_},
+	} {
+		fd := sdFD(tc.l)
+		tc.l.Close()
+		inherited, err := s.systemdListeners(fd, 1, []string{tc.sdName})
+		if err != nil {
+			t.Fatalf("Error taking socket: %v", err)
+		}
+		if tc.expected == _EMPTY_ {
+			if len(inherited) != 0 {
+				t.Fatalf("Expected socket on %s not to be used, got %v", tc.l.Addr(), inherited)
+			}
+			if c, err := net.Dial("tcp", tc.l.Addr().String()); err == nil {
+				c.Close()
+				t.Fatalf("Expected unused socket on %s to be closed", tc.l.Addr())
+			}
+			continue
+		}
+		l := inherited[tc.expected]
+		if l == nil || l.Addr().String() != tc.l.Addr().String() {
+			t.Fatalf("Expected %s listener on %s, got %v", tc.expected, tc.l.Addr(), inherited)
+		}
+		l.Close()
+	}
+
+	// A datagram socket is not a listener.
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatalf("Error on listen: %v", err)
+	}
+	f, err := pc.File()
+	pc.Close()
+	if err != nil {
+		t.Fatalf("Error getting file: %v", err)
+	}
+	fd, err := syscall.Dup(int(f.Fd()))
+	f.Close()
+	if err != nil {
+		t.Fatalf("Error on dup: %v", err)
+	}
+	if _, err := s.systemdListeners(fd, 1, nil); err == nil {
+		t.Fatal("Expected error for a socket that is not listening")
+	}
+}
@@ -0,0 +1,14 @@
+package server
+
+// receiveSystemdListeners is a no-op, there is no systemd on Windows.
+func (s *Server) receiveSystemdListeners() error {
+	return nil
+}
+
+// startSystemdNotify is a no-op, there is no systemd on Windows.
+func (s *Server) startSystemdNotify() {}
+
+// sdNotify is a no-op, there is no systemd on Windows.
+func sdNotify(state string) error {
+	return nil
+}
@@ -0,0 +1,401 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS certificates reload.
+//
+// With watch set in a tls block, the certificates and CA are loaded again
+// when their files change, without a config reload. The files are checked
+// at most once per watch interval, when a connection is accepted or a
+// route is solicited, and the new certificates are used from then on, for
+// new connections only. If the files can not be loaded, for instance while
+// they are being replaced, the previous certificates are kept.
+//
+// A tls block can list several certificates, the one presented to a client
+// being picked from the server name it sends (SNI). The certificate of
+// cert_file is the default one.
+//
+// The server checks the certificates in use every TLS_CERT_CHECK_INTERVAL,
+// logging the reloads and the certificates about to expire, which are also
+// listed in Varz with their expiry.
+
+// TLSCertFiles is a certificate and its private key.
+type TLSCertFiles struct {
+	CertFile string
+	KeyFile  string
+}
+
+// TLSCertInfo describes a certificate presented by the server.
+type TLSCertInfo struct {
+	Listener string    `json:"listener"`
+	Subject  string    `json:"subject"`
+	DNSNames []string  `json:"dns_names,omitempty"`
+	NotAfter time.Time `json:"expires"`
+}
+
+// parseTLSCerts parses the certificates of the `certs` array of a tls block.
+func parseTLSCerts(v interface{}) ([]TLSCertFiles, error) {
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("error parsing tls config, expected 'certs' to be an array")
+	}
+	certs := make([]TLSCertFiles, 0, len(arr))
+	for _, e := range arr {
+		m, ok := e.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("error parsing tls config, expected 'certs' entries to be maps")
+		}
+		var cf TLSCertFiles
+		for mk, mv := range m {
+			file, ok := mv.(string)
+			switch strings.ToLower(mk) {
+			case "cert_file":
+				cf.CertFile = file
+			case "key_file":
+				cf.KeyFile = file
+			default:
+				return nil, fmt.Errorf("error parsing tls config, unknown field [%q] in 'certs'", mk)
+			}
+			if !ok {
+				return nil, fmt.Errorf("error parsing tls config, expected %q to be filename", mk)
+			}
+		}
+		if cf.CertFile == "" || cf.KeyFile == "" {
+			return nil, fmt.Errorf("error parsing tls config, 'certs' entries need 'cert_file' and 'key_file'")
+		}
+		certs = append(certs, cf)
+	}
+	return certs, nil
+}
+
+// parseTLSWatch parses the watch setting of a tls block, true or the
+// interval at which files are checked.
+func parseTLSWatch(v interface{}) (time.Duration, error) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return DEFAULT_TLS_WATCH_INTERVAL, nil
+		}
+		return 0, nil
+	case string:
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing tls config, invalid 'watch' interval: %v", err)
+		}
+		return d, nil
+	}
+	return 0, fmt.Errorf("error parsing tls config, expected 'watch' to be a boolean or a duration")
+}
+
+// loadTLSCerts loads the certificates and the CA of a tls block.
+func loadTLSCerts(tc *TLSConfigOpts) ([]tls.Certificate, *x509.CertPool, error) {
+	files := append([]TLSCertFiles{{CertFile: tc.CertFile, KeyFile: tc.KeyFile}}, tc.Certs...)
+	certs := make([]tls.Certificate, 0, len(files))
+	for _, f := range files {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+		}
+		cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parsing certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	if tc.CaFile == "" {
+		return certs, nil, nil
+	}
+	rootPEM, err := ioutil.ReadFile(tc.CaFile)
+	if err != nil || rootPEM == nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(rootPEM) {
+		return nil, nil, fmt.Errorf("failed to parse root ca certificate")
+	}
+	return certs, pool, nil
+}
+
+// tlsCertStore reloads the certificates of a tls block when their files
+// change.
+type tlsCertStore struct {
+	sync.Mutex
+	tc       *TLSConfigOpts
+	base     *tls.Config // The config built from the tls block.
+	current  *tls.Config // A copy of base with the reloaded files, if any.
+	checked  time.Time
+	modTimes map[string]time.Time
+	err      error // Why the files could not be reloaded, if so.
+}
+
+// newTLSCertStore returns the store of the config built from tc.
+func newTLSCertStore(tc *TLSConfigOpts, base *tls.Config) *tlsCertStore {
+	st := &tlsCertStore{tc: tc, base: base, checked: time.Now()}
+	st.modTimes, _ = st.fileModTimes()
+	return st
+}
+
+// files returns the files of the tls block.
+func (st *tlsCertStore) files() []string {
+	files := []string{st.tc.CertFile, st.tc.KeyFile}
+	for _, cf := range st.tc.Certs {
+		files = append(files, cf.CertFile, cf.KeyFile)
+	}
+	if st.tc.CaFile != "" {
+		files = append(files, st.tc.CaFile)
+	}
+	return files
+}
+
+// fileModTimes returns the modification times of the files.
+func (st *tlsCertStore) fileModTimes() (map[string]time.Time, error) {
+	times := make(map[string]time.Time)
+	for _, f := range st.files() {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, err
+		}
+		times[f] = fi.ModTime()
+	}
+	return times, nil
+}
+
+// config returns the config with the reloaded files, nil if they did not
+// change, after loading them again if they changed since last checked,
+// along with the error that prevented that, if any.
+func (st *tlsCertStore) config() (*tls.Config, error) {
+	st.Lock()
+	defer st.Unlock()
+
+	if time.Since(st.checked) >= st.tc.Watch {
+		st.checked = time.Now()
+		st.reload()
+	}
+	return st.current, st.err
+}
+
+// reload loads the files again if they changed. Lock should be held.
+func (st *tlsCertStore) reload() {
+	times, err := st.fileModTimes()
+	if err != nil {
+		st.err = err
+		return
+	}
+	changed := false
+	for f, t := range times {
+		if !t.Equal(st.modTimes[f]) {
+			changed = true
+		}
+	}
+	if !changed && st.err == nil {
+		return
+	}
+	certs, pool, err := loadTLSCerts(st.tc)
+	if err != nil {
+		st.err = err
+		return
+	}
+	config := st.base.Clone()
+	config.GetConfigForClient = nil
+	config.GetClientCertificate = nil
+	config.Certificates = certs
+	if pool != nil {
+		// Routes verify both ways with the CA.
+		if st.base.RootCAs == st.base.ClientCAs {
+			config.RootCAs = pool
+		}
+		config.ClientCAs = pool
+	}
+	st.current, st.modTimes, st.err = config, times, nil
+}
+
+// getConfigForClient is the GetConfigForClient of a watched config. Called
+// without hello by currentTLSConfig, it also returns the reload error,
+// which handshakes ignore to go on with the previous certificates.
+func (st *tlsCertStore) getConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	config, err := st.config()
+	if hello != nil {
+		err = nil
+	}
+	return config, err
+}
+
+// getClientCertificate is the GetClientCertificate of a watched config,
+// used when soliciting routes.
+func (st *tlsCertStore) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	config, _ := st.config()
+	if config == nil {
+		config = st.base
+	}
+	return &config.Certificates[0], nil
+}
+
+// currentTLSConfig returns the config to use in place of one from a tls
+// block, which is a copy with the reloaded files if they are watched,
+// along with the error that prevented loading them again, if any.
+func currentTLSConfig(config *tls.Config) (*tls.Config, error) {
+	if config == nil || config.GetConfigForClient == nil {
+		return config, nil
+	}
+	current, err := config.GetConfigForClient(nil)
+	if current == nil {
+		current = config
+	}
+	return current, err
+}
+
+// tlsCertInfos returns the certificates presented with a config.
+func tlsCertInfos(listener string, config *tls.Config) []*TLSCertInfo {
+	config, _ = currentTLSConfig(config)
+	if config == nil {
+		return nil
+	}
+	infos := make([]*TLSCertInfo, 0, len(config.Certificates))
+	for _, cert := range config.Certificates {
+		if cert.Leaf == nil {
+			continue
+		}
+		infos = append(infos, &TLSCertInfo{
+			Listener: listener,
+			Subject:  cert.Leaf.Subject.String(),
+			DNSNames: cert.Leaf.DNSNames,
+			NotAfter: cert.Leaf.NotAfter,
+		})
+	}
+	return infos
+}
+
+// tlsCertsState is what was last logged about the certificates of a
+// listener.
+type tlsCertsState struct {
+	certs  string    // Identifies the certificates.
+	err    string    // The reload error.
+	warned time.Time // When their expiry was last reported.
+}
+
+// startTLSCertChecks starts checking the certificates in use, if TLS is
+// enabled and they are not checked already.
+func (s *Server) startTLSCertChecks() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	opts := s.getOpts()
+	if s.tlsChecking || (opts.TLSConfig == nil && opts.Cluster.TLSConfig == nil) {
+		return
+	}
+	s.tlsChecking = true
+	s.startGoRoutine(s.tlsCertChecksLoop)
+}
+
+// tlsCertChecksLoop checks the certificates in use every
+// TLS_CERT_CHECK_INTERVAL, until TLS is disabled on config reload.
+func (s *Server) tlsCertChecksLoop() {
+	defer s.grWG.Done()
+
+	for {
+		if !s.checkTLSCerts() {
+			// Unless enabled again since checked.
+			s.mu.Lock()
+			if opts := s.getOpts(); opts.TLSConfig == nil && opts.Cluster.TLSConfig == nil {
+				s.tlsChecking = false
+				s.mu.Unlock()
+				return
+			}
+			s.mu.Unlock()
+			continue
+		}
+
+		select {
+		case <-s.quitCh:
+			return
+		case <-time.After(TLS_CERT_CHECK_INTERVAL):
+		}
+	}
+}
+
+// checkTLSCerts logs the certificates in use when they change, and those
+// about to expire once a day. It returns false if TLS is disabled. The
+// files are loaded again if needed without the server lock, which is then
+// held to update what was logged.
+func (s *Server) checkTLSCerts() bool {
+	opts := s.getOpts()
+	configs := map[string]*tls.Config{"client": opts.TLSConfig, "cluster": opts.Cluster.TLSConfig}
+	errs := make(map[string]error, len(configs))
+	for listener, config := range configs {
+		configs[listener], errs[listener] = currentTLSConfig(config)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tlsCerts == nil {
+		s.tlsCerts = make(map[string]*tlsCertsState)
+	}
+	enabled := false
+	for _, listener := range []string{"client", "cluster"} {
+		config, err := configs[listener], errs[listener]
+		if config == nil {
+			delete(s.tlsCerts, listener)
+			continue
+		}
+		enabled = true
+		st := s.tlsCerts[listener]
+		if st == nil {
+			st = &tlsCertsState{}
+			s.tlsCerts[listener] = st
+		}
+
+		errStr := ""
+		if err != nil {
+			errStr = err.Error()
+			if errStr != st.err {
+				s.Errorf("Error reloading TLS certificates of %s connections, keeping the previous ones: %v",
+					listener, err)
+			}
+		}
+		st.err = errStr
+
+		var ids []string
+		for _, cert := range config.Certificates {
+			if cert.Leaf != nil {
+				ids = append(ids, fmt.Sprintf("%s/%v", cert.Leaf.SerialNumber, cert.Leaf.NotAfter.Unix()))
+			}
+		}
+		sort.Strings(ids)
+		certs := strings.Join(ids, ",")
+		changed := certs != st.certs
+		if changed && st.certs != "" {
+			s.Noticef("Reloaded TLS certificates of %s connections", listener)
+		}
+		st.certs = certs
+
+		warn := changed || time.Since(st.warned) >= 24*time.Hour
+		for _, cert := range config.Certificates {
+			if cert.Leaf == nil {
+				continue
+			}
+			subject, notAfter := cert.Leaf.Subject.String(), cert.Leaf.NotAfter
+			left := time.Until(notAfter)
+			switch {
+			case left <= 0 && warn:
+				s.Errorf("TLS certificate %q of %s connections expired on %v", subject, listener, notAfter)
+				st.warned = time.Now()
+			case left < TLS_CERT_EXPIRY_WARNING && warn:
+				s.Errorf("TLS certificate %q of %s connections expires in %v, on %v",
+					subject, listener, left.Round(time.Hour), notAfter)
+				st.warned = time.Now()
+			case changed:
+				s.Noticef("TLS certificate %q of %s connections expires on %v", subject, listener, notAfter)
+			}
+		}
+	}
+	return enabled
+}
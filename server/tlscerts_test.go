@@ -0,0 +1,335 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA signs the certificates created by tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// writeCert writes a certificate for name, valid until notAfter, and its
+// key in dir, returning their files.
+func (ca *testCA) writeCert(t *testing.T, dir, name string, serial int64, notAfter time.Time) TLSCertFiles {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	files := TLSCertFiles{
+		CertFile: filepath.Join(dir, name+"-cert.pem"),
+		KeyFile:  filepath.Join(dir, name+"-key.pem"),
+	}
+	writeTestFile(t, files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeTestFile(t, files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return files
+}
+
+// writeCA writes the certificate of the CA in dir, returning its file.
+func (ca *testCA) writeCA(t *testing.T, dir string) string {
+	t.Helper()
+	file := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	return file
+}
+
+// writeTestFile writes a file, making sure that its modification time
+// changes even if written again right away.
+func writeTestFile(t *testing.T, file string, content []byte) {
+	t.Helper()
+	mod := time.Now()
+	if fi, err := os.Stat(file); err == nil && !mod.After(fi.ModTime()) {
+		mod = fi.ModTime().Add(time.Second)
+	}
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := os.Chtimes(file, mod, mod); err != nil {
+		t.Fatalf("Error setting file times: %v", err)
+	}
+}
+
+// peerCert returns the certificate presented by s for serverName.
+func peerCert(t *testing.T, s *Server, pool *x509.CertPool, serverName string) *x509.Certificate {
+	t.Helper()
+	addr := fmt.Sprintf("127.0.0.1:%d", s.Addr().(*net.TCPAddr).Port)
+	nc, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("Error on dial: %v", err)
+	}
+	defer nc.Close()
+	// Skip the INFO sent before the handshake.
+	nc.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	n, err := nc.Read(buf)
+	if err != nil || !strings.HasPrefix(string(buf[:n]), "INFO") {
+		t.Fatalf("Expected INFO, got %q, %v", buf[:n], err)
+	}
+	nc.SetReadDeadline(time.Time{})
+	conn := tls.Client(nc, &tls.Config{RootCAs: pool, ServerName: serverName})
+	if err := conn.Handshake(); err != nil {
+		t.Fatalf("Error on handshake: %v", err)
+	}
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTLSWatchConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tlswatch")
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	foo := ca.writeCert(t, dir, "foo.example.com", 2, time.Now().Add(time.Hour))
+	bar := ca.writeCert(t, dir, "bar.example.com", 3, time.Now().Add(time.Hour))
+
+	conf := filepath.Join(dir, "tls.conf")
+	writeTestFile(t, conf, []byte(fmt.Sprintf(`
+		listen: "127.0.0.1:-1"
+		tls {
+			cert_file: %q
+			key_file: %q
+			certs: [
+				{cert_file: %q, key_file: %q}
+			]
+			watch: "5s"
+		}
+	`, foo.CertFile, foo.KeyFile, bar.CertFile, bar.KeyFile)))
+	opts, err := ProcessConfigFile(conf)
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if len(opts.TLSConfig.Certificates) != 2 || opts.TLSConfig.GetConfigForClient == nil {
+		t.Fatalf("Expected 2 watched certificates, got %+v", opts.TLSConfig)
+	}
+	if cc := CheckConfigFile(conf); len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+
+	for _, test := range []struct {
+		tls string
+		err string
+	}{
+		{`watch: "5 seconds"`, "invalid 'watch' interval"},
+		{`watch: 5`, "expected 'watch' to be a boolean or a duration"},
+		{`certs: [{cert_file: "cert.pem"}]`, "need 'cert_file' and 'key_file'"},
+		{`certs: [{cert: "cert.pem"}]`, "unknown field"},
+	} {
+		writeTestFile(t, conf, []byte(fmt.Sprintf(`
+			tls {
+				cert_file: %q
+				key_file: %q
+				%s
+			}
+		`, foo.CertFile, foo.KeyFile, test.tls)))
+		if _, err := ProcessConfigFile(conf); err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Fatalf("Expected error %q for %s, got %v", test.err, test.tls, err)
+		}
+		if cc := CheckConfigFile(conf); len(cc.Problems) != 1 || !strings.Contains(cc.Problems[0].Reason, test.err) {
+			t.Fatalf("Expected problem %q for %s, got %v", test.err, test.tls, cc.Problems)
+		}
+	}
+}
+
+func TestTLSCertsBySNI(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tlssni")
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	foo := ca.writeCert(t, dir, "foo.example.com", 2, time.Now().Add(time.Hour))
+	bar := ca.writeCert(t, dir, "bar.example.com", 3, time.Now().Add(2*time.Hour))
+
+	opts := DefaultOptions()
+	config, err := GenTLSConfig(&TLSConfigOpts{CertFile: foo.CertFile, KeyFile: foo.KeyFile, Certs: []TLSCertFiles{bar}})
+	if err != nil {
+		t.Fatalf("Error generating tls config: %v", err)
+	}
+	opts.TLSConfig = config
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	for name, serial := range map[string]int64{"foo.example.com": 2, "bar.example.com": 3} {
+		if cert := peerCert(t, s, ca.pool, name); cert.SerialNumber.Int64() != serial {
+			t.Fatalf("Expected certificate %d for %q, got %d", serial, name, cert.SerialNumber)
+		}
+	}
+
+	v, _ := s.Varz(nil)
+	if len(v.TLSCerts) != 2 {
+		t.Fatalf("Expected 2 certificates in Varz, got %+v", v.TLSCerts)
+	}
+	for i, cf := range []TLSCertFiles{foo, bar} {
+		cert, _ := tls.LoadX509KeyPair(cf.CertFile, cf.KeyFile)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		if ci := v.TLSCerts[i]; ci.Listener != "client" || ci.DNSNames[0] != leaf.DNSNames[0] || !ci.NotAfter.Equal(leaf.NotAfter) {
+			t.Fatalf("Unexpected certificate in Varz: %+v", ci)
+		}
+	}
+}
+
+func TestTLSCertsReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tlsreload")
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	cf := ca.writeCert(t, dir, "localhost", 2, time.Now().Add(time.Hour))
+
+	opts := DefaultOptions()
+	tc := &TLSConfigOpts{CertFile: cf.CertFile, KeyFile: cf.KeyFile, Watch: 10 * time.Millisecond}
+	config, err := GenTLSConfig(tc)
+	if err != nil {
+		t.Fatalf("Error generating tls config: %v", err)
+	}
+	opts.TLSConfig = config
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	if cert := peerCert(t, s, ca.pool, "localhost"); cert.SerialNumber.Int64() != 2 {
+		t.Fatalf("Expected certificate 2, got %d", cert.SerialNumber)
+	}
+
+	// Replace the certificate, which is picked up by new connections.
+	notAfter := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	ca.writeCert(t, dir, "localhost", 3, notAfter)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if cert := peerCert(t, s, ca.pool, "localhost"); cert.SerialNumber.Int64() != 3 {
+			return fmt.Errorf("Expected certificate 3, got %d", cert.SerialNumber)
+		}
+		return nil
+	})
+	v, _ := s.Varz(nil)
+	if len(v.TLSCerts) != 1 || !v.TLSCerts[0].NotAfter.Equal(notAfter) {
+		t.Fatalf("Expected reloaded certificate in Varz, got %+v", v.TLSCerts)
+	}
+
+	// A broken file keeps the previous certificate, and the error is
+	// reported.
+	writeTestFile(t, cf.CertFile, []byte("not a certificate"))
+	time.Sleep(20 * time.Millisecond)
+	if cert := peerCert(t, s, ca.pool, "localhost"); cert.SerialNumber.Int64() != 3 {
+		t.Fatalf("Expected certificate 3, got %d", cert.SerialNumber)
+	}
+	if _, err := currentTLSConfig(opts.TLSConfig); err == nil {
+		t.Fatal("Expected a reload error")
+	}
+	s.checkTLSCerts()
+	s.mu.Lock()
+	st := s.tlsCerts["client"]
+	s.mu.Unlock()
+	if st == nil || st.err == "" {
+		t.Fatalf("Expected reload error to be tracked, got %+v", st)
+	}
+
+	// Fixing it clears the error.
+	ca.writeCert(t, dir, "localhost", 4, notAfter)
+	checkFor(t, time.Second, 15*time.Millisecond, func() error {
+		if cert := peerCert(t, s, ca.pool, "localhost"); cert.SerialNumber.Int64() != 4 {
+			return fmt.Errorf("Expected certificate 4, got %d", cert.SerialNumber)
+		}
+		return nil
+	})
+	if _, err := currentTLSConfig(opts.TLSConfig); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestTLSCertsReloadRoutes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tlsroutes")
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t)
+	caFile := ca.writeCA(t, dir)
+	cf := ca.writeCert(t, dir, "localhost", 2, time.Now().Add(time.Hour))
+
+	clusterTLS := func() *tls.Config {
+		config, err := GenTLSConfig(&TLSConfigOpts{
+			CertFile: cf.CertFile,
+			KeyFile:  cf.KeyFile,
+			CaFile:   caFile,
+			Verify:   true,
+			Watch:    10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatalf("Error generating tls config: %v", err)
+		}
+		config.RootCAs = config.ClientCAs
+		return config
+	}
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.Cluster.Port = -1
+	optsA.Cluster.TLSConfig = clusterTLS()
+	optsA.Cluster.TLSTimeout = 2
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	// Rotate the CA and the certificate before B connects.
+	ca = newTestCA(t)
+	ca.writeCA(t, dir)
+	ca.writeCert(t, dir, "localhost", 3, time.Now().Add(time.Hour))
+	time.Sleep(20 * time.Millisecond)
+
+	optsB := nextServerOpts(optsA)
+	optsB.Cluster.TLSConfig = clusterTLS()
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://localhost:%d", sa.ClusterAddr().Port))
+	sb := RunServer(optsB)
+	defer sb.Shutdown()
+
+	checkClusterFormed(t, sa, sb)
+	v, _ := sa.Varz(nil)
+	if len(v.TLSCerts) != 1 || v.TLSCerts[0].Listener != "cluster" {
+		t.Fatalf("Expected the cluster certificate in Varz, got %+v", v.TLSCerts)
+	}
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+// Message tracing.
+//
+// A publisher opts a single message into tracing by using a reply subject
+// that starts with MsgTracePrefix, the remainder of the reply being the
+// trace id. Every server the message passes through will then publish a
+// MsgTraceEvent for each step of its processing to the trace subject
+// (see Options.MsgTraceSubject). Since events from all servers of the
+// cluster end up on the same subject, a single subscriber is able to
+// reconstruct the full path of the message.
+
+// MsgTracePrefix is the reply subject prefix that marks a message for tracing.
+const MsgTracePrefix = "_TRACE."
+
+// Type of trace events.
+const (
+	MsgTraceIngress    = "ingress"
+	MsgTracePermission = "permission"
+	MsgTraceMatch      = "match"
+	MsgTraceDeliver    = "deliver"
+	MsgTraceRoute      = "route"
+	MsgTraceDrop       = "drop"
+)
+
+// MsgTraceEvent is published to the trace subject for each step
+// of the processing of a traced message.
+type MsgTraceEvent struct {
+	TraceID   string    `json:"trace_id"`
+	Server    string    `json:"server_id"`
+	Time      time.Time `json:"time"`
+	Type      string    `json:"type"`
+	Subject   string    `json:"subject"`
+	Reply     string    `json:"reply,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	Cid       uint64    `json:"cid,omitempty"`
+	User      string    `json:"user,omitempty"`
+	Route     string    `json:"route_id,omitempty"`
+	Sid       string    `json:"sid,omitempty"`
+	Queue     string    `json:"queue,omitempty"`
+	NumSubs   int       `json:"num_subs,omitempty"`
+	NumQueues int       `json:"num_queues,omitempty"`
+	Result    string    `json:"result,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// msgTrace collects the events of a traced message while it is
+// processed. Events are sent once the processing is complete so
+// that no client lock is held when publishing them.
+type msgTrace struct {
+	id      string
+	subject string
+	reply   string
+	events  []*MsgTraceEvent
+}
+
+// newMsgTrace returns a msgTrace if the message currently being
+// processed is marked for tracing, nil otherwise.
+func (c *client) newMsgTrace() *msgTrace {
+	if c.srv == nil || len(c.pa.reply) <= len(MsgTracePrefix) ||
+		!bytes.HasPrefix(c.pa.reply, []byte(MsgTracePrefix)) {
+		return nil
+	}
+	return &msgTrace{
+		id:      string(c.pa.reply[len(MsgTracePrefix):]),
+		subject: string(c.pa.subject),
+		reply:   string(c.pa.reply),
+	}
+}
+
+func (mt *msgTrace) add(typ string) *MsgTraceEvent {
+	e := &MsgTraceEvent{
+		TraceID: mt.id,
+		Time:    time.Now().UTC(),
+		Type:    typ,
+		Subject: mt.subject,
+		Reply:   mt.reply,
+	}
+	mt.events = append(mt.events, e)
+	return e
+}
+
+// ingress records the connection the message was received from.
+func (mt *msgTrace) ingress(c *client) {
+	e := mt.add(MsgTraceIngress)
+	c.mu.Lock()
+	e.Kind = c.typeString()
+	e.Cid = c.cid
+	e.User = c.opts.Username
+	if c.route != nil {
+		e.Route = c.route.remoteID
+	}
+	c.mu.Unlock()
+}
+
+// permission records the result of the publish permission check.
+func (mt *msgTrace) permission(allowed bool) {
+	e := mt.add(MsgTracePermission)
+	if allowed {
+		e.Result = "allowed"
+	} else {
+		e.Result = "denied"
+	}
+}
+
+// match records the result of the subscriptions lookup.
+func (mt *msgTrace) match(r *SublistResult) {
+	e := mt.add(MsgTraceMatch)
+	e.NumSubs = len(r.psubs)
+	e.NumQueues = len(r.qsubs)
+}
+
+// delivered records the outcome of a deliverMsg call for the given
+// subscription, which is either a delivery to a local subscriber, a
+// forward to a route or a drop.
+func (mt *msgTrace) delivered(sub *subscription, ok bool) {
+	var e *MsgTraceEvent
+	client := sub.client
+	client.mu.Lock()
+	switch {
+	case !ok && client.flags.isSet(slowConsumer):
+		e = mt.add(MsgTraceDrop)
+		e.Reason = "slow consumer"
+	case !ok:
+		e = mt.add(MsgTraceDrop)
+		e.Reason = "not delivered"
+	case client.flags.isSet(slowConsumer) && client.out.scp <= SlowConsumerClose:
+		e = mt.add(MsgTraceDrop)
+		e.Reason = "slow consumer"
+	case client.typ == ROUTER:
+		e = mt.add(MsgTraceRoute)
+	default:
+		e = mt.add(MsgTraceDeliver)
+	}
+	e.Kind = client.typeString()
+	e.Cid = client.cid
+	if client.route != nil {
+		e.Route = client.route.remoteID
+	}
+	client.mu.Unlock()
+	e.Sid = string(sub.sid)
+	e.Queue = string(sub.queue)
+}
+
+// drop records that the message was dropped for the given reason.
+func (mt *msgTrace) drop(reason string) *MsgTraceEvent {
+	e := mt.add(MsgTraceDrop)
+	e.Reason = reason
+	return e
+}
+
+// sendMsgTrace publishes the collected events to the trace subject.
+func (s *Server) sendMsgTrace(mt *msgTrace) {
+	dest := s.getOpts().MsgTraceSubject
+	if dest == "" {
+		return
+	}
+	s.mu.Lock()
+	id := s.info.ID
+	s.mu.Unlock()
+	for _, e := range mt.events {
+		e.Server = id
+		b, err := json.Marshal(e)
+		if err != nil {
+			s.Errorf("Error marshaling trace event: %v", err)
+			continue
+		}
+		s.sendInternalMsg(dest, b)
+	}
+}
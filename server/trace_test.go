@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func traceEvents(t *testing.T, sub *gio.Subscription, expected int) []*MsgTraceEvent {
+	t.Helper()
+	events := make([]*MsgTraceEvent, 0, expected)
+	for i := 0; i < expected; i++ {
+		m, err := sub.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("Expected %d trace events, got %d: %v", expected, i, err)
+		}
+		e := &MsgTraceEvent{}
+		if err := json.Unmarshal(m.Data, e); err != nil {
+			t.Fatalf("Error unmarshaling trace event: %v", err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func checkTraceEventTypes(t *testing.T, events []*MsgTraceEvent, types ...string) {
+	t.Helper()
+	if len(events) != len(types) {
+		t.Fatalf("Expected %d events, got %d", len(types), len(events))
+	}
+	for i, e := range events {
+		if e.Type != types[i] {
+			t.Fatalf("Expected event %d to be %q, got %q", i, types[i], e.Type)
+		}
+	}
+}
+
+func TestMsgTraceLocalDelivery(t *testing.T) {
+	opts := DefaultOptions()
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc, err := gio.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	traceSub, _ := nc.SubscribeSync(DEFAULT_MSG_TRACE_SUBJECT)
+	fooSub, _ := nc.SubscribeSync("foo")
+	nc.Flush()
+
+	// A message that is not marked should not produce any event.
+	nc.Publish("foo", []byte("hello"))
+	nc.PublishRequest("foo", MsgTracePrefix+"abc", []byte("hello"))
+	nc.Flush()
+
+	events := traceEvents(t, traceSub, 4)
+	checkTraceEventTypes(t, events, MsgTraceIngress, MsgTracePermission, MsgTraceMatch, MsgTraceDeliver)
+	for _, e := range events {
+		if e.TraceID != "abc" || e.Subject != "foo" || e.Server != s.ID() {
+			t.Fatalf("Unexpected trace event: %+v", e)
+		}
+	}
+	if events[1].Result != "allowed" {
+		t.Fatalf("Expected publish to be allowed, got %q", events[1].Result)
+	}
+	if events[2].NumSubs != 1 {
+		t.Fatalf("Expected 1 matching sub, got %d", events[2].NumSubs)
+	}
+	if events[3].Sid != "2" {
+		t.Fatalf("Expected delivery to sid 2, got %q", events[3].Sid)
+	}
+	if _, err := traceSub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatal("Did not expect more trace events")
+	}
+	// Both messages must have been delivered.
+	for i := 0; i < 2; i++ {
+		if _, err := fooSub.NextMsg(time.Second); err != nil {
+			t.Fatalf("Expected message: %v", err)
+		}
+	}
+}
+
+func TestMsgTraceNoInterest(t *testing.T) {
+	opts := DefaultOptions()
+	opts.MsgTraceSubject = "my.trace"
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc, err := gio.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer nc.Close()
+
+	traceSub, _ := nc.SubscribeSync("my.trace")
+	nc.Flush()
+
+	nc.PublishRequest("bar", MsgTracePrefix+"1", []byte("hello"))
+	nc.Flush()
+
+	events := traceEvents(t, traceSub, 4)
+	checkTraceEventTypes(t, events, MsgTraceIngress, MsgTracePermission, MsgTraceMatch, MsgTraceDrop)
+	if events[3].Reason != "no interest" {
+		t.Fatalf("Unexpected drop reason: %q", events[3].Reason)
+	}
+}
+
+func TestMsgTraceAcrossRoutes(t *testing.T) {
+	optsA := DefaultOptions()
+	srvA := RunServer(optsA)
+	defer srvA.Shutdown()
+
+	optsB := nextServerOpts(optsA)
+	optsB.Routes = RoutesFromStr(fmt.Sprintf("nats://127.0.0.1:%d", srvA.ClusterAddr().Port))
+	srvB := RunServer(optsB)
+	defer srvB.Shutdown()
+
+	checkClusterFormed(t, srvA, srvB)
+
+	ncA, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsA.Host, srvA.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncA.Close()
+	ncB, err := gio.Connect(fmt.Sprintf("nats://%s:%d", optsB.Host, srvB.Addr().(*net.TCPAddr).Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer ncB.Close()
+
+	traceSub, _ := ncA.SubscribeSync(DEFAULT_MSG_TRACE_SUBJECT)
+	ncA.Flush()
+	ncB.SubscribeSync("foo")
+	ncB.Flush()
+
+	// Wait for interest to be propagated.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		if n := srvA.NumSubscriptions(); n != 2 {
+			return fmt.Errorf("Expected 2 subscriptions on A, got %d", n)
+		}
+		if n := srvB.NumSubscriptions(); n != 2 {
+			return fmt.Errorf("Expected 2 subscriptions on B, got %d", n)
+		}
+		return nil
+	})
+
+	ncA.PublishRequest("foo", MsgTracePrefix+"xyz", []byte("hello"))
+	ncA.Flush()
+
+	// Server A reports ingress, permission, match and the forward to the route,
+	// server B reports ingress from the route, match and the local delivery.
+	events := traceEvents(t, traceSub, 7)
+	byServer := make(map[string][]*MsgTraceEvent)
+	for _, e := range events {
+		byServer[e.Server] = append(byServer[e.Server], e)
+	}
+	checkTraceEventTypes(t, byServer[srvA.ID()], MsgTraceIngress, MsgTracePermission, MsgTraceMatch, MsgTraceRoute)
+	checkTraceEventTypes(t, byServer[srvB.ID()], MsgTraceIngress, MsgTraceMatch, MsgTraceDeliver)
+	if r := byServer[srvA.ID()][3].Route; r != srvB.ID() {
+		t.Fatalf("Expected route to %q, got %q", srvB.ID(), r)
+	}
+	if k := byServer[srvB.ID()][0].Kind; k != "Router" {
+		t.Fatalf("Expected ingress from a route, got %q", k)
+	}
+}
@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Unix domain socket listener.
+//
+// Clients running on the same host, like sidecars, can connect through a
+// unix domain socket instead of the TCP loopback. The socket is configured
+// with a unix:// listen address, alongside the TCP listener, and its file
+// mode, owner and group can be set. The credentials of the process at the
+// other end of such connections are available to custom authentication
+// through ClientAuthentication.GetPeerCredentials, where supported.
+
+// unixScheme is the scheme of unix domain socket listen addresses.
+const unixScheme = "unix://"
+
+// PeerCredentials are the credentials of the process connected through a
+// unix domain socket.
+type PeerCredentials struct {
+	PID int32  `json:"pid"`
+	UID uint32 `json:"uid"`
+	GID uint32 `json:"gid"`
+}
+
+// GetPeerCredentials returns the credentials of the process at the other
+// end of a unix domain socket connection, nil otherwise. Implements the
+// ClientAuthentication interface.
+func (c *client) GetPeerCredentials() *PeerCredentials {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.pcred
+}
+
+// parseUnixSocket returns the path of a unix:// listen address.
+func parseUnixSocket(addr string) (string, bool) {
+	if len(addr) < len(unixScheme) || !strings.EqualFold(addr[:len(unixScheme)], unixScheme) {
+		return "", false
+	}
+	return addr[len(unixScheme):], true
+}
+
+// parseFileMode parses a file mode given in octal, as a string or as an
+// integer written with octal digits.
+func parseFileMode(v interface{}) (os.FileMode, error) {
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case int64:
+		s = strconv.FormatInt(v, 10)
+	default:
+		return 0, fmt.Errorf("Expected file mode to be a string or an integer, got %v", v)
+	}
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("Invalid file mode %q", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// parseOwner parses a user or group given by name or as a numeric id.
+func parseOwner(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	}
+	return "", fmt.Errorf("Expected a name or an id, got %v", v)
+}
+
+// lookupID returns the numeric id of a user or group given by name or id,
+// or -1 if none is given.
+func lookupID(name string, group bool) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	var id string
+	if group {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return -1, err
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return -1, err
+		}
+		id = u.Uid
+	}
+	return strconv.Atoi(id)
+}
+
+// startUnixListener listens for client connections on the unix domain
+// socket of the options, and accepts them in a go routine.
+func (s *Server) startUnixListener() error {
+	opts := s.getOpts()
+	path := opts.UnixSocket
+	if p, ok := parseUnixSocket(path); ok {
+		path = p
+	}
+
+	// The socket of a previous process is already set up.
+	l := s.inheritedListener(unixListenerName, "unix", path)
+	if l == nil {
+		var err error
+		if l, err = listenUnix(path, opts); err != nil {
+			return err
+		}
+		s.Noticef("Listening for client connections on %s%s", unixScheme, path)
+	}
+	s.trackListener(unixListenerName, l)
+
+	s.mu.Lock()
+	s.unixListener = l
+	s.mu.Unlock()
+
+	go s.unixAcceptLoop(l)
+	return nil
+}
+
+// listenUnix listens on the unix domain socket path, with the file mode,
+// owner and group of the options.
+func listenUnix(path string, opts *Options) (net.Listener, error) {
+	// Remove a socket left behind by a server that did not shutdown
+	// cleanly, but never anything else.
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%s is in use", path)
+		}
+		os.Remove(path)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.UnixSocketMode != 0 {
+		if err := os.Chmod(path, opts.UnixSocketMode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	uid, err := lookupID(opts.UnixSocketOwner, false)
+	if err == nil {
+		var gid int
+		if gid, err = lookupID(opts.UnixSocketGroup, true); err == nil && (uid >= 0 || gid >= 0) {
+			err = os.Chown(path, uid, gid)
+		}
+	}
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// unixAcceptLoop accepts client connections on the unix domain socket
+// until the server is shutdown.
+func (s *Server) unixAcceptLoop(l net.Listener) {
+	tmpDelay := ACCEPT_MIN_SLEEP
+
+	for s.isRunning() {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isDraining() {
+				// Closed before a graceful shutdown, wait for it.
+				<-s.quitCh
+				continue
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				s.Errorf("Temporary Unix Socket Accept Error (%v), sleeping %dms",
+					ne, tmpDelay/time.Millisecond)
+				time.Sleep(tmpDelay)
+				tmpDelay *= 2
+				if tmpDelay > ACCEPT_MAX_SLEEP {
+					tmpDelay = ACCEPT_MAX_SLEEP
+				}
+			} else if s.isRunning() {
+				s.Errorf("Unix Socket Accept Error: %v", err)
+			}
+			continue
+		}
+		tmpDelay = ACCEPT_MIN_SLEEP
+		s.startGoRoutine(func() {
+			s.createClient(conn)
+			s.grWG.Done()
+		})
+	}
+	s.done <- true
+}
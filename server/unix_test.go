@@ -0,0 +1,188 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/elitecodegroovy/gmessage/gio"
+)
+
+func TestUnixSocketConfig(t *testing.T) {
+	opts, err := ProcessConfigFile("./configs/unix_socket.conf")
+	if err != nil {
+		t.Fatalf("Received an error reading config file: %v", err)
+	}
+	if opts.Host != "127.0.0.1" || opts.Port != -1 || opts.UnixSocket != "/tmp/gmessage_test.sock" {
+		t.Fatalf("Unexpected listeners: %s:%d and %q", opts.Host, opts.Port, opts.UnixSocket)
+	}
+	if opts.UnixSocketMode != 0660 || opts.UnixSocketOwner != "1000" || opts.UnixSocketGroup != "staff" {
+		t.Fatalf("Unexpected socket options: %v, %q, %q", opts.UnixSocketMode, opts.UnixSocketOwner, opts.UnixSocketGroup)
+	}
+	if cc := CheckConfigFile("./configs/unix_socket.conf"); len(cc.Problems) != 0 {
+		t.Fatalf("Expected no problems, got %v", cc.Problems)
+	}
+
+	for _, test := range []struct {
+		v    interface{}
+		mode os.FileMode
+	}{
+		{"0600", 0600},
+		{"755", 0755},
+		{int64(660), 0660},
+	} {
+		if mode, err := parseFileMode(test.v); err != nil || mode != test.mode {
+			t.Fatalf("Expected mode %v for %v, got %v, %v", test.mode, test.v, mode, err)
+		}
+	}
+	for _, v := range []interface{}{"0800", "01777", true} {
+		if _, err := parseFileMode(v); err == nil {
+			t.Fatalf("Expected error for mode %v", v)
+		}
+	}
+	if err := parseClientListen("unix://", &Options{}); err == nil {
+		t.Fatal("Expected error for a unix socket without a path")
+	}
+}
+
+// tempSocket returns the path of a socket in a new temporary directory,
+// removed by the returned function.
+func tempSocket(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "gmessage")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	return filepath.Join(dir, "gm.sock"), func() { os.RemoveAll(dir) }
+}
+
+// peerAuth only allows clients connected through a unix socket by a
+// process of the current user.
+type peerAuth struct{}
+
+func (peerAuth) Check(c ClientAuthentication) bool {
+	pcred := c.GetPeerCredentials()
+	return pcred != nil && int(pcred.UID) == os.Getuid()
+}
+
+func TestUnixSocketListener(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	opts := DefaultOptions()
+	opts.UnixSocket = path
+	opts.UnixSocketMode = 0600
+	s := RunServer(opts)
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected the socket to exist: %v", err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0600 {
+		t.Fatalf("Unexpected socket mode: %v", fi.Mode())
+	}
+
+	// Clients on the socket and on TCP can talk to each other.
+	unc, err := gio.Connect("unix://" + path)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer unc.Close()
+	tnc, err := gio.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port))
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	defer tnc.Close()
+	sub, err := unc.SubscribeSync("foo")
+	if err != nil {
+		t.Fatalf("Error on subscribe: %v", err)
+	}
+	unc.Flush()
+	tnc.Publish("foo", []byte("hello"))
+	if _, err := sub.NextMsg(time.Second); err != nil {
+		t.Fatalf("Error receiving message: %v", err)
+	}
+
+	cz, err := s.Connz(nil)
+	if err != nil {
+		t.Fatalf("Error getting connz: %v", err)
+	}
+	if len(cz.Conns) != 2 || cz.Conns[1].PeerCredentials != nil {
+		t.Fatalf("Unexpected connections: %+v", cz.Conns)
+	}
+	if runtime.GOOS == "linux" {
+		pcred := cz.Conns[0].PeerCredentials
+		if pcred == nil || int(pcred.UID) != os.Getuid() || int(pcred.PID) != os.Getpid() {
+			t.Fatalf("Unexpected peer credentials: %+v", pcred)
+		}
+	}
+
+	// The socket is removed on shutdown.
+	s.Shutdown()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected the socket to be removed, got %v", err)
+	}
+}
+
+func TestUnixSocketPeerCredentialsAuth(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Peer credentials not supported on this platform")
+	}
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	opts := DefaultOptions()
+	opts.UnixSocket = path
+	opts.CustomClientAuthentication = peerAuth{}
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc, err := gio.Connect("unix://" + path)
+	if err != nil {
+		t.Fatalf("Error on connect: %v", err)
+	}
+	nc.Close()
+	if nc, err := gio.Connect(fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)); err == nil {
+		nc.Close()
+		t.Fatal("Expected TCP connection to fail authorization")
+	}
+}
+
+func TestUnixSocketExistingFile(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	opts := DefaultOptions()
+	opts.UnixSocket = path
+	s := New(opts)
+	s.running = true
+
+	// A socket left behind is replaced.
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+	l.Close()
+	if err := s.startUnixListener(); err != nil {
+		t.Fatalf("Expected stale socket to be replaced, got %v", err)
+	}
+	s.mu.Lock()
+	s.running = false
+	s.unixListener.Close()
+	s.mu.Unlock()
+	<-s.done
+
+	// But not another file.
+	if err := ioutil.WriteFile(path, []byte("data"), 0600); err != nil {
+		t.Fatalf("Error writing file: %v", err)
+	}
+	if err := s.startUnixListener(); err == nil {
+		t.Fatal("Expected error for a file that is not a socket")
+	}
+}
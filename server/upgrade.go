@@ -0,0 +1,281 @@
+// +build linux
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Zero-downtime upgrade.
+//
+// On SIGUSR2, the server starts its executable again with the same
+// arguments, and hands off its client, route, monitoring and unix socket
+// listeners to the new process over a unix socket pair, whose end in the
+// new process is the file descriptor named by GMESSAGE_UPGRADE_FD. The new
+// process uses them instead of listening itself, writes its own PID and
+// ports files, and reports on the same socket once it is ready. The old
+// process then shuts down gracefully, sending the pending data of its
+// connections, while the new one accepts the new connections. If the new
+// process is not ready within UPGRADE_TIMEOUT, it is killed and the old one
+// keeps running.
+
+// upgradeFDEnv names the file descriptor of the upgrade socket in the new
+// process.
+const upgradeFDEnv = "GMESSAGE_UPGRADE_FD"
+
+// upgradeReadyMsg is sent by the new process once ready.
+const upgradeReadyMsg = "ready"
+
+// maxUpgradeListeners is the number of listeners that can be handed off.
+const maxUpgradeListeners = 16
+
+// upgrade starts a new process of the executable, hands off the listeners
+// to it and waits for it to be ready. The server should then be shut down.
+func (s *Server) upgrade() (err error) {
+	s.mu.Lock()
+	if !s.running || s.draining || s.upgrading {
+		s.mu.Unlock()
+		return fmt.Errorf("server is shutting down or already upgrading")
+	}
+	s.upgrading = true
+	names := make([]string, 0, len(s.listeners))
+	files := make([]*os.File, 0, len(s.listeners))
+	for name, l := range s.listeners {
+		// Listeners replaced or closed on config reload fail here.
+		f, err := listenerFile(l)
+		if err != nil {
+			s.Debugf("Not handing off the %s listener: %v", name, err)
+			continue
+		}
+		names = append(names, name)
+		files = append(files, f)
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+		if err != nil {
+			s.mu.Lock()
+			s.upgrading = false
+			s.mu.Unlock()
+		}
+	}()
+
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("error creating upgrade socket: %v", err)
+	}
+	local := os.NewFile(uintptr(pair[0]), "upgrade")
+	remote := os.NewFile(uintptr(pair[1]), "upgrade")
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		remote.Close()
+		return fmt.Errorf("error creating upgrade socket: %v", err)
+	}
+	defer conn.Close()
+
+	exe, err := os.Executable()
+	if err != nil {
+		remote.Close()
+		return fmt.Errorf("error finding executable: %v", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	// The first extra file is the file descriptor 3. The systemd watchdog
+	// is for the main process, which the new one becomes.
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeFDEnv+"=3")
+	cmd.ExtraFiles = []*os.File{remote}
+	err = cmd.Start()
+	remote.Close()
+	if err != nil {
+		return fmt.Errorf("error starting new process: %v", err)
+	}
+	// Reap the new process if it exits before this one.
+	go cmd.Wait()
+
+	uc := conn.(*net.UnixConn)
+	if err = sendListeners(uc, names, files); err == nil {
+		err = waitUpgradeReady(uc)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		// The new process may have written its PID already.
+		if s.getOpts().PidFile != _EMPTY_ {
+			s.logPid()
+		}
+		return fmt.Errorf("new process %d is not ready: %v", cmd.Process.Pid, err)
+	}
+
+	// Tell systemd about its new main process.
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", cmd.Process.Pid)); err != nil {
+		s.Errorf("Error notifying systemd: %v", err)
+	}
+
+	s.mu.Lock()
+	// The socket file is now the one of the new process.
+	if ul, ok := s.unixListener.(*net.UnixListener); ok {
+		ul.SetUnlinkOnClose(false)
+	}
+	s.mu.Unlock()
+	s.Noticef("Upgraded to process %d, handing off the %v listeners", cmd.Process.Pid, names)
+	return nil
+}
+
+// receiveUpgrade receives the listeners of the previous process if this
+// one was started by an upgrade, and reports to it once ready.
+func (s *Server) receiveUpgrade() error {
+	v := os.Getenv(upgradeFDEnv)
+	if v == _EMPTY_ {
+		return nil
+	}
+	// Not for the processes started by this one.
+	os.Unsetenv(upgradeFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", upgradeFDEnv, v)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return fmt.Errorf("%s is not a unix socket", upgradeFDEnv)
+	}
+	inherited, err := receiveListeners(uc)
+	if err != nil {
+		uc.Close()
+		return err
+	}
+	s.mu.Lock()
+	s.inherited = inherited
+	s.mu.Unlock()
+	s.Noticef("Received %d listeners from the previous process", len(inherited))
+
+	go func() {
+		defer uc.Close()
+		if !s.ReadyForConnections(UPGRADE_TIMEOUT) {
+			return
+		}
+		s.closeInherited()
+		uc.Write([]byte(upgradeReadyMsg))
+	}()
+	return nil
+}
+
+// listenerFile returns a duplicate of the file descriptor of l.
+func listenerFile(l net.Listener) (*os.File, error) {
+	fl, ok := l.(interface {
+		File() (*os.File, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("%T has no file descriptor", l)
+	}
+	return fl.File()
+}
+
+// sendListeners sends the names of the listeners followed by their file
+// descriptors.
+func sendListeners(uc *net.UnixConn, names []string, files []*os.File) error {
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		// Fd would put the shared file description in blocking mode.
+		rc, err := f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if err := rc.Control(func(fd uintptr) { fds = append(fds, int(fd)) }); err != nil {
+			return err
+		}
+	}
+	b, _ := json.Marshal(names)
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	uc.SetWriteDeadline(time.Now().Add(UPGRADE_TIMEOUT))
+	_, _, err := uc.WriteMsgUnix(b, oob, nil)
+	return err
+}
+
+// receiveListeners receives the listeners sent by sendListeners.
+func receiveListeners(uc *net.UnixConn) (map[string]net.Listener, error) {
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(maxUpgradeListeners*4))
+	uc.SetReadDeadline(time.Now().Add(UPGRADE_TIMEOUT))
+	n, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, err
+	}
+	uc.SetReadDeadline(time.Time{})
+
+	var fds []int
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	for i := 0; err == nil && i < len(msgs); i++ {
+		var rights []int
+		if rights, err = syscall.ParseUnixRights(&msgs[i]); err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	var names []string
+	if err == nil {
+		err = json.Unmarshal(buf[:n], &names)
+	}
+	if err == nil && len(names) != len(fds) {
+		err = fmt.Errorf("received %d listeners for %d names", len(fds), len(names))
+	}
+
+	listeners := make(map[string]net.Listener, len(fds))
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "listener")
+		if err == nil {
+			var l net.Listener
+			if l, err = net.FileListener(f); err == nil {
+				listeners[names[i]] = l
+			} else {
+				err = fmt.Errorf("invalid %s listener: %v", names[i], err)
+			}
+		}
+		f.Close()
+	}
+	if err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+		return nil, err
+	}
+	return listeners, nil
+}
+
+// waitUpgradeReady waits for the new process to report that it is ready.
+func waitUpgradeReady(uc *net.UnixConn) error {
+	uc.SetReadDeadline(time.Now().Add(UPGRADE_TIMEOUT))
+	buf := make([]byte, len(upgradeReadyMsg))
+	if _, err := io.ReadFull(uc, buf); err != nil {
+		return err
+	}
+	if string(buf) != upgradeReadyMsg {
+		return fmt.Errorf("unexpected %q", buf)
+	}
+	return nil
+}
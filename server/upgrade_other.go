@@ -0,0 +1,15 @@
+// +build !linux
+
+package server
+
+import "errors"
+
+// upgrade is only supported on Linux.
+func (s *Server) upgrade() error {
+	return errors.New("upgrade is only supported on Linux")
+}
+
+// receiveUpgrade is a no-op, since upgrades are only supported on Linux.
+func (s *Server) receiveUpgrade() error {
+	return nil
+}
@@ -0,0 +1,132 @@
+// +build linux
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// upgradeSocketPair returns the two ends of an upgrade socket.
+func upgradeSocketPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	pair, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatalf("Error creating socket pair: %v", err)
+	}
+	conns := make([]*net.UnixConn, 2)
+	for i, fd := range pair {
+		f := os.NewFile(uintptr(fd), "upgrade")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("Error creating conn: %v", err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func TestUpgradeHandOff(t *testing.T) {
+	path, cleanup := tempSocket(t)
+	defer cleanup()
+
+	optsA := DefaultOptions()
+	optsA.Cluster.Host = "127.0.0.1"
+	optsA.UnixSocket = path
+	sa := RunServer(optsA)
+	defer sa.Shutdown()
+
+	// What the old process sends on upgrade.
+	sa.mu.Lock()
+	var names []string
+	var files []*os.File
+	for name, l := range sa.listeners {
+		f, err := listenerFile(l)
+		if err != nil {
+			t.Fatalf("Error getting file of the %s listener: %v", name, err)
+		}
+		defer f.Close()
+		names = append(names, name)
+		files = append(files, f)
+	}
+	sa.mu.Unlock()
+	if len(names) != 4 {
+		t.Fatalf("Expected client, route, http and unix listeners, got %v", names)
+	}
+	local, remote := upgradeSocketPair(t)
+	defer local.Close()
+	defer remote.Close()
+	go sendListeners(local, names, files)
+
+	inherited, err := receiveListeners(remote)
+	if err != nil {
+		t.Fatalf("Error receiving listeners: %v", err)
+	}
+	if len(inherited) != 4 {
+		t.Fatalf("Expected 4 listeners, got %v", inherited)
+	}
+
+	// The new process has the same options, with random ports.
+	optsB := DefaultOptions()
+	optsB.Cluster.Host = "127.0.0.1"
+	optsB.UnixSocket = path
+	sb := New(optsB)
+	sb.inherited = inherited
+	go sb.Start()
+	defer sb.Shutdown()
+	if !sb.ReadyForConnections(2 * time.Second) {
+		t.Fatal("Unable to start server")
+	}
+	if sb.Addr().(*net.TCPAddr).Port != sa.Addr().(*net.TCPAddr).Port ||
+		sb.ClusterAddr().Port != sa.ClusterAddr().Port ||
+		sb.MonitorAddr().Port != sa.MonitorAddr().Port {
+		t.Fatal("Expected the ports of the previous server")
+	}
+
+	// Once the old server is gone, the new one gets all connections.
+	sa.mu.Lock()
+	sa.unixListener.(*net.UnixListener).SetUnlinkOnClose(false)
+	sa.mu.Unlock()
+	sa.Shutdown()
+
+	clientAddr := fmt.Sprintf("127.0.0.1:%d", sb.Addr().(*net.TCPAddr).Port)
+	if id := readServerID(t, "tcp", clientAddr); id != sb.ID() {
+		t.Fatalf("Expected INFO of %q, got %q", sb.ID(), id)
+	}
+	if id := readServerID(t, "unix", path); id != sb.ID() {
+		t.Fatalf("Expected INFO of %q, got %q", sb.ID(), id)
+	}
+	if id := readServerID(t, "tcp", sb.ClusterAddr().String()); id != sb.ID() {
+		t.Fatalf("Expected route INFO of %q, got %q", sb.ID(), id)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/varz", sb.MonitorAddr().Port))
+	if err != nil {
+		t.Fatalf("Error getting varz: %v", err)
+	}
+	defer resp.Body.Close()
+	var v Varz
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		t.Fatalf("Error decoding varz: %v", err)
+	}
+	if v.ID != sb.ID() {
+		t.Fatalf("Expected varz of %q, got %q", sb.ID(), v.ID)
+	}
+}
+
+func TestUpgradeNotReady(t *testing.T) {
+	local, remote := upgradeSocketPair(t)
+	defer local.Close()
+
+	// The new process exits before it is ready.
+	remote.Close()
+	if err := waitUpgradeReady(local); err == nil {
+		t.Fatal("Expected an error")
+	}
+}
@@ -11,6 +11,10 @@ import (
 // errors that occur in the course of a single decode.
 type Error struct {
 	Errors []string
+
+	// Fields holds the errors that are about a single field, along
+	// with the field they are about.
+	Fields []*FieldError
 }
 
 func (e *Error) Error() string {
@@ -40,11 +44,27 @@ func (e *Error) WrappedErrors() []error {
 	return result
 }
 
-func appendErrors(errors []string, err error) []string {
-	switch e := err.(type) {
+func (e *Error) append(err error) {
+	switch err := err.(type) {
 	case *Error:
-		return append(errors, e.Errors...)
+		e.Errors = append(e.Errors, err.Errors...)
+		e.Fields = append(e.Fields, err.Fields...)
+	case *FieldError:
+		e.Errors = append(e.Errors, err.Error())
+		e.Fields = append(e.Fields, err)
 	default:
-		return append(errors, e.Error())
+		e.Errors = append(e.Errors, err.Error())
 	}
 }
+
+// FieldError is an error decoding the value of a single field. Name is
+// the path of the field in the decoded data, with nested keys joined by
+// dots and slice elements indexed, e.g. "users[0].name".
+type FieldError struct {
+	Name string
+	Err  error
+}
+
+func (e *FieldError) Error() string {
+	return e.Err.Error()
+}
@@ -208,7 +208,10 @@ func (d *Decoder) decode(name string, data interface{}, val reflect.Value) error
 			d.config.DecodeHook,
 			dataVal.Type(), val.Type(), data)
 		if err != nil {
-			return fmt.Errorf("error decoding '%s': %s", name, err)
+			return &FieldError{
+				Name: name,
+				Err:  fmt.Errorf("error decoding '%s': %s", name, err),
+			}
 		}
 	}
 
@@ -248,6 +251,13 @@ func (d *Decoder) decode(name string, data interface{}, val reflect.Value) error
 		d.config.Metadata.Keys = append(d.config.Metadata.Keys, name)
 	}
 
+	// Errors from nested values already carry the field they are about.
+	switch err.(type) {
+	case nil, *Error, *FieldError:
+	default:
+		err = &FieldError{Name: name, Err: err}
+	}
+
 	return err
 }
 
@@ -515,7 +525,7 @@ func (d *Decoder) decodeMap(name string, data interface{}, val reflect.Value) er
 	}
 
 	// Accumulate errors
-	errors := make([]string, 0)
+	errors := &Error{}
 
 	for _, k := range dataVal.MapKeys() {
 		fieldName := fmt.Sprintf("%s[%s]", name, k)
@@ -523,7 +533,7 @@ func (d *Decoder) decodeMap(name string, data interface{}, val reflect.Value) er
 		// First decode the key into the proper type
 		currentKey := reflect.Indirect(reflect.New(valKeyType))
 		if err := d.decode(fieldName, k.Interface(), currentKey); err != nil {
-			errors = appendErrors(errors, err)
+			errors.append(err)
 			continue
 		}
 
@@ -531,7 +541,7 @@ func (d *Decoder) decodeMap(name string, data interface{}, val reflect.Value) er
 		v := dataVal.MapIndex(k).Interface()
 		currentVal := reflect.Indirect(reflect.New(valElemType))
 		if err := d.decode(fieldName, v, currentVal); err != nil {
-			errors = appendErrors(errors, err)
+			errors.append(err)
 			continue
 		}
 
@@ -542,8 +552,8 @@ func (d *Decoder) decodeMap(name string, data interface{}, val reflect.Value) er
 	val.Set(valMap)
 
 	// If we had errors, return those
-	if len(errors) > 0 {
-		return &Error{errors}
+	if len(errors.Errors) > 0 {
+		return errors
 	}
 
 	return nil
@@ -619,7 +629,7 @@ func (d *Decoder) decodeSlice(name string, data interface{}, val reflect.Value)
 	}
 
 	// Accumulate any errors
-	errors := make([]string, 0)
+	errors := &Error{}
 
 	for i := 0; i < dataVal.Len(); i++ {
 		currentData := dataVal.Index(i).Interface()
@@ -630,7 +640,7 @@ func (d *Decoder) decodeSlice(name string, data interface{}, val reflect.Value)
 
 		fieldName := fmt.Sprintf("%s[%d]", name, i)
 		if err := d.decode(fieldName, currentData, currentField); err != nil {
-			errors = appendErrors(errors, err)
+			errors.append(err)
 		}
 	}
 
@@ -638,8 +648,8 @@ func (d *Decoder) decodeSlice(name string, data interface{}, val reflect.Value)
 	val.Set(valSlice)
 
 	// If there were errors, we return those
-	if len(errors) > 0 {
-		return &Error{errors}
+	if len(errors.Errors) > 0 {
+		return errors
 	}
 
 	return nil
@@ -674,7 +684,7 @@ func (d *Decoder) decodeStruct(name string, data interface{}, val reflect.Value)
 		dataValKeysUnused[dataValKey.Interface()] = struct{}{}
 	}
 
-	errors := make([]string, 0)
+	errors := &Error{}
 
 	// This slice will keep track of all the structs we'll be decoding.
 	// There can be more than one struct if there are embedded structs
@@ -711,7 +721,7 @@ func (d *Decoder) decodeStruct(name string, data interface{}, val reflect.Value)
 
 			if squash {
 				if fieldKind != reflect.Struct {
-					errors = appendErrors(errors,
+					errors.append(
 						fmt.Errorf("%s: unsupported type for squash: %s", fieldType.Name, fieldKind))
 				} else {
 					structs = append(structs, val.FieldByName(fieldType.Name))
@@ -729,15 +739,27 @@ func (d *Decoder) decodeStruct(name string, data interface{}, val reflect.Value)
 		field, fieldValue := f.field, f.val
 		fieldName := field.Name
 
-		tagValue := field.Tag.Get(d.config.TagName)
-		tagValue = strings.SplitN(tagValue, ",", 2)[0]
-		if tagValue != "" {
-			fieldName = tagValue
+		tagParts := strings.Split(field.Tag.Get(d.config.TagName), ",")
+		if tagParts[0] != "" {
+			fieldName = tagParts[0]
 		}
 
-		rawMapKey := reflect.ValueOf(fieldName)
-		rawMapVal := dataVal.MapIndex(rawMapKey)
-		if !rawMapVal.IsValid() {
+		// Aliases are other keys accepted for the field, given
+		// as "alias=name" options in the tag.
+		fieldNames := []string{fieldName}
+		for _, tag := range tagParts[1:] {
+			if strings.HasPrefix(tag, "alias=") {
+				fieldNames = append(fieldNames, strings.TrimPrefix(tag, "alias="))
+			}
+		}
+
+		var rawMapKey, rawMapVal reflect.Value
+		for _, fn := range fieldNames {
+			rawMapKey = reflect.ValueOf(fn)
+			rawMapVal = dataVal.MapIndex(rawMapKey)
+			if rawMapVal.IsValid() {
+				break
+			}
 			// Do a slower search by iterating over each key and
 			// doing case-insensitive search.
 			for dataValKey := range dataValKeys {
@@ -747,20 +769,29 @@ func (d *Decoder) decodeStruct(name string, data interface{}, val reflect.Value)
 					continue
 				}
 
-				if strings.EqualFold(mK, fieldName) {
+				if strings.EqualFold(mK, fn) {
 					rawMapKey = dataValKey
 					rawMapVal = dataVal.MapIndex(dataValKey)
 					break
 				}
 			}
-
-			if !rawMapVal.IsValid() {
-				// There was no matching key in the map for the value in
-				// the struct. Just ignore.
-				continue
+			if rawMapVal.IsValid() {
+				break
 			}
 		}
 
+		if !rawMapVal.IsValid() {
+			// There was no matching key in the map for the value in
+			// the struct. Just ignore.
+			continue
+		}
+
+		// Name the field after the key found, so that errors refer
+		// to what is in the data.
+		if mK, ok := rawMapKey.Interface().(string); ok {
+			fieldName = mK
+		}
+
 		// Delete the key we're using from the unused map so we stop tracking
 		delete(dataValKeysUnused, rawMapKey.Interface())
 
@@ -782,7 +813,7 @@ func (d *Decoder) decodeStruct(name string, data interface{}, val reflect.Value)
 		}
 
 		if err := d.decode(fieldName, rawMapVal.Interface(), fieldValue); err != nil {
-			errors = appendErrors(errors, err)
+			errors.append(err)
 		}
 	}
 
@@ -794,14 +825,11 @@ func (d *Decoder) decodeStruct(name string, data interface{}, val reflect.Value)
 		sort.Strings(keys)
 
 		err := fmt.Errorf("'%s' has invalid keys: %s", name, strings.Join(keys, ", "))
-		errors = appendErrors(errors, err)
-	}
-
-	if len(errors) > 0 {
-		return &Error{errors}
+		errors.append(err)
 	}
 
-	// Add the unused keys to the list of unused keys if we're tracking metadata
+	// Add the unused keys to the list of unused keys if we're tracking
+	// metadata, even when other keys failed to decode.
 	if d.config.Metadata != nil {
 		for rawKey := range dataValKeysUnused {
 			key := rawKey.(string)
@@ -813,6 +841,10 @@ func (d *Decoder) decodeStruct(name string, data interface{}, val reflect.Value)
 		}
 	}
 
+	if len(errors.Errors) > 0 {
+		return errors
+	}
+
 	return nil
 }
 